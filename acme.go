@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Certificates are requested with ACME from Let's Encrypt by default, or
+// from the CA at -acme-directory, such as a local Pebble instance.
+
+const (
+	keyTypeECDSA = "ecdsa"
+	keyTypeRSA   = "rsa"
+)
+
+// newACMEManager returns the manager requesting certificates as configured
+// by the -acme flags, and the function that serves them.
+func newACMEManager() (*autocert.Manager, func(*tls.ClientHelloInfo) (*tls.Certificate, error), error) {
+	policy, err := hostPolicy(*acmeHostsFlag)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid -acme-hosts: %v", err)
+	}
+	if *acmeKeyTypeFlag != keyTypeECDSA && *acmeKeyTypeFlag != keyTypeRSA {
+		return nil, nil, fmt.Errorf("-acme-key-type must be %q or %q", keyTypeECDSA, keyTypeRSA)
+	}
+	client := &acme.Client{DirectoryURL: *acmeDirectoryFlag}
+	if *acmeCAFlag != "" {
+		data, err := ioutil.ReadFile(*acmeCAFlag)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot read -acme-ca: %v", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(data) {
+			return nil, nil, fmt.Errorf("no certificates found in %s", *acmeCAFlag)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+		client.HTTPClient = &http.Client{Transport: transport}
+	}
+	m := &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		Cache:       autocert.DirCache(*acmeFlag),
+		RenewBefore: *acmeRenewBeforeFlag,
+		HostPolicy:  policy,
+		Email:       *acmeEmailFlag,
+		Client:      client,
+	}
+	if *acmeKeyTypeFlag == keyTypeRSA {
+		return m, forceRSA(m.GetCertificate), nil
+	}
+	return m, m.GetCertificate, nil
+}
+
+// hostPolicy returns a policy allowing the hosts in the comma-separated
+// list, where "*" matches any letters, digits and dashes within a label,
+// so that "p*.gopkg.in" allows "p1.gopkg.in" but not "p1.evil.gopkg.in".
+func hostPolicy(list string) (autocert.HostPolicy, error) {
+	var patterns []string
+	for _, host := range strings.Split(list, ",") {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if host == "" {
+			continue
+		}
+		if strings.Trim(host, "*.") == "" || strings.ContainsAny(host, "/:") {
+			return nil, fmt.Errorf("invalid host %q", host)
+		}
+		patterns = append(patterns, strings.Replace(regexp.QuoteMeta(host), `\*`, `[a-z0-9-]+`, -1))
+	}
+	if len(patterns) == 0 {
+		return nil, fmt.Errorf("no hosts provided")
+	}
+	re := regexp.MustCompile("^(?:" + strings.Join(patterns, "|") + ")$")
+	return func(_ context.Context, host string) error {
+		if !re.MatchString(strings.ToLower(host)) {
+			return fmt.Errorf("acme/autocert: host %q not allowed by -acme-hosts", host)
+		}
+		return nil
+	}, nil
+}
+
+// forceRSA wraps getCert so that it's asked for RSA certificates only, by
+// hiding the client support for ECDSA signatures.
+func forceRSA(getCert func(*tls.ClientHelloInfo) (*tls.Certificate, error)) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		rsaHello := *hello
+		rsaHello.SignatureSchemes = []tls.SignatureScheme{}
+		for _, scheme := range hello.SignatureSchemes {
+			switch scheme {
+			case tls.ECDSAWithSHA1, tls.ECDSAWithP256AndSHA256, tls.ECDSAWithP384AndSHA384, tls.ECDSAWithP521AndSHA512:
+			default:
+				rsaHello.SignatureSchemes = append(rsaHello.SignatureSchemes, scheme)
+			}
+		}
+		return getCert(&rsaHello)
+	}
+}
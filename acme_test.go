@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&ACMESuite{})
+
+type ACMESuite struct{}
+
+var hostPolicyTests = []struct {
+	list  string
+	host  string
+	allow bool
+}{
+	{"gopkg.in", "gopkg.in", true},
+	{"gopkg.in", "GOPKG.IN", true},
+	{"gopkg.in", "p1.gopkg.in", false},
+	{"gopkg.in", "gopkgxin", false},
+	{"gopkg.in, p*.gopkg.in", "p1.gopkg.in", true},
+	{"gopkg.in, p*.gopkg.in", "p42.gopkg.in", true},
+	{"gopkg.in, p*.gopkg.in", "p.gopkg.in", false},
+	{"gopkg.in, p*.gopkg.in", "p1.evil.gopkg.in", false},
+	{"gopkg.in, p*.gopkg.in", "evil.p1.gopkg.in", false},
+	{"*.example.com", "a-b.example.com", true},
+	{"*.example.com", "example.com", false},
+}
+
+func (s *ACMESuite) TestHostPolicy(c *C) {
+	for _, test := range hostPolicyTests {
+		policy, err := hostPolicy(test.list)
+		c.Assert(err, IsNil)
+		err = policy(context.Background(), test.host)
+		c.Assert(err == nil, Equals, test.allow, Commentf("%s %s", test.list, test.host))
+	}
+}
+
+func (s *ACMESuite) TestHostPolicyErrors(c *C) {
+	for _, list := range []string{"", " , ", "*", "*.*", "gopkg.in:443", "gopkg.in/foo"} {
+		_, err := hostPolicy(list)
+		c.Assert(err, NotNil, Commentf("%q", list))
+	}
+}
+
+func (s *ACMESuite) TestForceRSA(c *C) {
+	var got *tls.ClientHelloInfo
+	getCert := forceRSA(func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		got = hello
+		return nil, nil
+	})
+
+	hello := &tls.ClientHelloInfo{
+		ServerName:       "gopkg.in",
+		SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256, tls.PSSWithSHA256, tls.PKCS1WithSHA256},
+	}
+	getCert(hello)
+	c.Assert(got.ServerName, Equals, "gopkg.in")
+	c.Assert(got.SignatureSchemes, DeepEquals, []tls.SignatureScheme{tls.PSSWithSHA256, tls.PKCS1WithSHA256})
+	c.Assert(hello.SignatureSchemes, HasLen, 3)
+
+	getCert(&tls.ClientHelloInfo{})
+	c.Assert(got.SignatureSchemes, NotNil)
+	c.Assert(got.SignatureSchemes, HasLen, 0)
+}
+
+func (s *ACMESuite) TestNewACMEManager(c *C) {
+	defer func(dir, email, keyType string, renew time.Duration) {
+		*acmeDirectoryFlag, *acmeEmailFlag, *acmeKeyTypeFlag, *acmeRenewBeforeFlag = dir, email, keyType, renew
+	}(*acmeDirectoryFlag, *acmeEmailFlag, *acmeKeyTypeFlag, *acmeRenewBeforeFlag)
+
+	m, _, err := newACMEManager()
+	c.Assert(err, IsNil)
+	c.Assert(m.Client.DirectoryURL, Equals, acme.LetsEncryptURL)
+	c.Assert(m.RenewBefore, Equals, 30*24*time.Hour)
+	c.Assert(m.HostPolicy(context.Background(), "p3.gopkg.in"), IsNil)
+	c.Assert(m.HostPolicy(context.Background(), "p4.gopkg.in"), NotNil)
+
+	*acmeDirectoryFlag = "https://localhost:14000/dir"
+	*acmeEmailFlag = "admin@example.com"
+	*acmeRenewBeforeFlag = time.Hour
+	*acmeKeyTypeFlag = keyTypeRSA
+	m, _, err = newACMEManager()
+	c.Assert(err, IsNil)
+	c.Assert(m.Client.DirectoryURL, Equals, "https://localhost:14000/dir")
+	c.Assert(m.Email, Equals, "admin@example.com")
+	c.Assert(m.RenewBefore, Equals, time.Hour)
+
+	*acmeKeyTypeFlag = "dsa"
+	_, _, err = newACMEManager()
+	c.Assert(err, ErrorMatches, `-acme-key-type must be "ecdsa" or "rsa"`)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/niemeyer/gopkg/resolver"
+)
+
+// adminHandler serves the administration API under /admin/. When an admin
+// token is set, all requests must provide it as a bearer token.
+//
+// The API offers the following resources:
+//
+//	GET    /admin/cache                 List refs cache entries.
+//	DELETE /admin/cache                 Purge all refs cache entries.
+//	GET    /admin/cache/<root>          Inspect the refs cached for a GitHub root.
+//	DELETE /admin/cache/<root>          Purge the refs cached for a GitHub root.
+//	GET    /admin/redirects             List repository redirects.
+//	POST   /admin/redirects             Add a redirect (path, target).
+//	DELETE /admin/redirects             Remove a redirect (path).
+//	POST   /admin/redirects/approve     Approve a discovered redirect (path).
+//	POST   /admin/redirects/reject      Reject a discovered redirect (path).
+//	GET    /admin/blocklist             List blocked repositories and versions.
+//	POST   /admin/blocklist             Block (path, major or version, reason, message).
+//	DELETE /admin/blocklist             Unblock (path, major or version).
+//	GET    /admin/proxies               List in-flight upload-pack proxies.
+//	GET    /admin/moved-tags            List version tags moved since first seen.
+//	GET    /admin/metrics               Report metrics in the Prometheus text format.
+//
+// Parameters in parenthesis are provided as form values.
+func adminHandler(resp http.ResponseWriter, req *http.Request) {
+	if !adminAuthorized(req) {
+		resp.Header().Set("WWW-Authenticate", `Bearer realm="gopkg.in admin"`)
+		sendAdminError(resp, http.StatusUnauthorized, "invalid or missing admin token")
+		return
+	}
+
+	log.Printf("%s admin request %s %s", clientIP(req), req.Method, req.URL)
+
+	path := strings.TrimPrefix(req.URL.Path, "/admin")
+	switch {
+	case path == "/cache":
+		adminCache(resp, req)
+	case strings.HasPrefix(path, "/cache/"):
+		adminCacheEntry(resp, req, strings.TrimPrefix(path, "/cache/"))
+	case path == "/redirects":
+		adminRedirects(resp, req)
+	case path == "/redirects/approve":
+		adminReviewRedirect(resp, req, redirectApproved)
+	case path == "/redirects/reject":
+		adminReviewRedirect(resp, req, redirectRejected)
+	case path == "/blocklist":
+		adminBlocklist(resp, req)
+	case path == "/proxies":
+		if adminMethod(resp, req, "GET") {
+			sendJSON(resp, http.StatusOK, proxyList())
+		}
+	case path == "/moved-tags":
+		if adminMethod(resp, req, "GET") {
+			sendJSON(resp, http.StatusOK, movedTagList())
+		}
+	case path == "/metrics":
+		if adminMethod(resp, req, "GET") {
+			resp.Header().Set("Content-Type", "text/plain; version=0.0.4")
+			writeMetrics(resp)
+		}
+	default:
+		sendAdminError(resp, http.StatusNotFound, "unknown admin resource")
+	}
+}
+
+// checkAdminAddr ensures the admin API isn't served without a token at
+// addr unless it's only reachable from the local machine.
+func checkAdminAddr(addr string) error {
+	if *adminTokenFlag != "" {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid -admin address: %v", err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("cannot use -admin on a non-loopback address without -admin-token")
+	}
+	return nil
+}
+
+func adminAuthorized(req *http.Request) bool {
+	if *adminTokenFlag == "" {
+		// Only reachable via the dedicated -admin listener on loopback.
+		return true
+	}
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(*adminTokenFlag)) == 1
+}
+
+func adminMethod(resp http.ResponseWriter, req *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if req.Method == method {
+			return true
+		}
+	}
+	resp.Header().Set("Allow", strings.Join(methods, ", "))
+	sendAdminError(resp, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+	return false
+}
+
+func adminCache(resp http.ResponseWriter, req *http.Request) {
+	if !adminMethod(resp, req, "GET", "DELETE") {
+		return
+	}
+	if req.Method == "DELETE" {
+		refsCache.Purge("")
+	}
+	sendJSON(resp, http.StatusOK, refsCache.List())
+}
+
+func adminCacheEntry(resp http.ResponseWriter, req *http.Request, root string) {
+	if !adminMethod(resp, req, "GET", "DELETE") {
+		return
+	}
+	if req.Method == "DELETE" {
+		if !refsCache.Purge(root) {
+			sendAdminError(resp, http.StatusNotFound, "no refs cached for %s", root)
+			return
+		}
+		sendJSON(resp, http.StatusOK, refsCache.List())
+		return
+	}
+	info, refs, ok := refsCache.Lookup(root)
+	if !ok {
+		sendAdminError(resp, http.StatusNotFound, "no refs cached for %s", root)
+		return
+	}
+	sendJSON(resp, http.StatusOK, struct {
+		resolver.CacheInfo
+		Refs string `json:"refs"`
+	}{info, string(refs)})
+}
+
+func adminRedirects(resp http.ResponseWriter, req *http.Request) {
+	if !adminMethod(resp, req, "GET", "POST", "DELETE") {
+		return
+	}
+	if req.Method != "GET" {
+		base, ok := parseRepoBase(req.FormValue("path"))
+		if !ok {
+			sendAdminError(resp, http.StatusBadRequest, "invalid repository path %q", req.FormValue("path"))
+			return
+		}
+		var err error
+		if req.Method == "POST" {
+			err = addRedirect(base, req.FormValue("target"))
+		} else {
+			err = removeRedirect(base)
+		}
+		if err != nil {
+			sendAdminError(resp, http.StatusBadRequest, "%v", err)
+			return
+		}
+	}
+	sendJSON(resp, http.StatusOK, redirectList())
+}
+
+// adminReviewRedirect approves or rejects the discovered redirect for the
+// repository provided in the "path" form value, as in "user/name".
+func adminReviewRedirect(resp http.ResponseWriter, req *http.Request, status string) {
+	if !adminMethod(resp, req, "POST") {
+		return
+	}
+	base, ok := parseRepoBase(req.FormValue("path"))
+	if !ok {
+		sendAdminError(resp, http.StatusBadRequest, "invalid repository path %q", req.FormValue("path"))
+		return
+	}
+	if err := reviewRedirect(base, status); err != nil {
+		sendAdminError(resp, http.StatusNotFound, "%v", err)
+		return
+	}
+	sendJSON(resp, http.StatusOK, redirectList())
+}
+
+func adminBlocklist(resp http.ResponseWriter, req *http.Request) {
+	if !adminMethod(resp, req, "GET", "POST", "DELETE") {
+		return
+	}
+	if req.Method != "GET" {
+		e := blockEntry{
+			Path:    req.FormValue("path"),
+			Major:   req.FormValue("major"),
+			Version: req.FormValue("version"),
+			Reason:  req.FormValue("reason"),
+			Message: req.FormValue("message"),
+		}
+		var err error
+		if req.Method == "POST" {
+			err = addBlock(e)
+		} else {
+			err = removeBlock(e)
+		}
+		if err != nil {
+			sendAdminError(resp, http.StatusBadRequest, "%v", err)
+			return
+		}
+	}
+	sendJSON(resp, http.StatusOK, blockList())
+}
+
+func sendJSON(resp http.ResponseWriter, status int, value interface{}) {
+	data, err := json.MarshalIndent(value, "", "\t")
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		resp.Write([]byte(fmt.Sprintf("Cannot encode JSON response: %v", err)))
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(status)
+	resp.Write(append(data, '\n'))
+}
+
+func sendAdminError(resp http.ResponseWriter, status int, msg string, args ...interface{}) {
+	if len(args) > 0 {
+		msg = fmt.Sprintf(msg, args...)
+	}
+	sendJSON(resp, status, map[string]string{"error": msg})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&AdminSuite{})
+
+type AdminSuite struct{}
+
+func (s *AdminSuite) SetUpTest(c *C) {
+	*adminTokenFlag = "secret"
+}
+
+func (s *AdminSuite) TearDownTest(c *C) {
+	*adminTokenFlag = ""
+	blocklistLock.Lock()
+	blocklist = make(map[string]*blockEntry)
+	blocklistLock.Unlock()
+}
+
+func adminRequest(method, path, token string, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp := httptest.NewRecorder()
+	adminHandler(resp, req)
+	return resp
+}
+
+func (s *AdminSuite) TestUnauthorized(c *C) {
+	resp := adminRequest("GET", "/admin/cache", "", nil)
+	c.Assert(resp.Code, Equals, http.StatusUnauthorized)
+	resp = adminRequest("GET", "/admin/cache", "wrong", nil)
+	c.Assert(resp.Code, Equals, http.StatusUnauthorized)
+	resp = adminRequest("GET", "/admin/cache", "secret", nil)
+	c.Assert(resp.Code, Equals, http.StatusOK)
+
+	// The token must be provided with the bearer scheme.
+	req := httptest.NewRequest("GET", "/admin/cache", nil)
+	req.Header.Set("Authorization", "secret")
+	rec := httptest.NewRecorder()
+	adminHandler(rec, req)
+	c.Assert(rec.Code, Equals, http.StatusUnauthorized)
+}
+
+func (s *AdminSuite) TestAdminAddr(c *C) {
+	c.Assert(checkAdminAddr(":8080"), IsNil)
+	*adminTokenFlag = ""
+	for _, addr := range []string{"localhost:8080", "127.0.0.1:8080", "[::1]:8080"} {
+		c.Assert(checkAdminAddr(addr), IsNil)
+	}
+	for _, addr := range []string{":8080", "0.0.0.0:8080", "192.0.2.1:8080", "example.com:8080"} {
+		c.Assert(checkAdminAddr(addr), ErrorMatches, "cannot use -admin on a non-loopback address without -admin-token")
+	}
+	c.Assert(checkAdminAddr("8080"), ErrorMatches, "invalid -admin address: .*")
+}
+
+func (s *AdminSuite) TestBlocklist(c *C) {
+	resp := adminRequest("POST", "/admin/blocklist", "secret", url.Values{"path": {"foo/bar"}, "version": {"v1.2.3"}, "reason": {"legal"}})
+	c.Assert(resp.Code, Equals, http.StatusOK)
+	list := blockList()
+	c.Assert(list, HasLen, 1)
+	c.Assert(list[0].key(), Equals, "foo/bar@v1.2.3")
+	c.Assert(list[0].Reason, Equals, blockLegal)
+
+	resp = adminRequest("POST", "/admin/blocklist", "secret", url.Values{"path": {"foo/bar"}, "major": {"v1.2"}})
+	c.Assert(resp.Code, Equals, http.StatusBadRequest)
+	c.Assert(resp.Body.String(), Matches, `(?s).*invalid major version.*`)
+
+	resp = adminRequest("DELETE", "/admin/blocklist?path=foo/bar&version=v1.2.3", "secret", nil)
+	c.Assert(resp.Code, Equals, http.StatusOK)
+	c.Assert(blockList(), HasLen, 0)
+}
+
+func (s *AdminSuite) TestMethodNotAllowed(c *C) {
+	resp := adminRequest("PUT", "/admin/proxies", "secret", nil)
+	c.Assert(resp.Code, Equals, http.StatusMethodNotAllowed)
+	c.Assert(resp.Header().Get("Allow"), Equals, "GET")
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/niemeyer/gopkg/resolver"
+)
+
+const (
+	blockLegal = "legal" // Served as 451 Unavailable For Legal Reasons.
+	blockGone  = "gone"  // Served as 410 Gone.
+)
+
+// blockEntry prevents a repository, one of its major versions, or a
+// specific full version from being served.
+type blockEntry struct {
+	Path    string    `json:"path"`              // As in gopkg.in, "name" or "user/name".
+	Major   string    `json:"major,omitempty"`   // Major version such as "v2", if limited to it.
+	Version string    `json:"version,omitempty"` // Full version such as "v2.1.3", if limited to it.
+	Reason  string    `json:"reason"`
+	Message string    `json:"message,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// key returns the string identifying the entry in the blocklist.
+func (e *blockEntry) key() string {
+	switch {
+	case e.Version != "":
+		return e.Path + "@" + e.Version
+	case e.Major != "":
+		return e.Path + "@" + e.Major
+	}
+	return e.Path
+}
+
+// check verifies that the entry is well formed and normalizes its fields.
+func (e *blockEntry) check() error {
+	base, ok := parseRepoBase(e.Path)
+	if !ok {
+		return fmt.Errorf("invalid repository path %q", e.Path)
+	}
+	e.Path = base.String()
+	if e.Major != "" && e.Version != "" {
+		return fmt.Errorf("cannot block both a major version and a full version")
+	}
+	if e.Major != "" {
+		v, ok := resolver.ParseVersion(e.Major)
+		if !ok || v.Minor != -1 {
+			return fmt.Errorf("invalid major version %q", e.Major)
+		}
+	}
+	if e.Version != "" {
+		if _, ok := resolver.ParseVersion(e.Version); !ok {
+			return fmt.Errorf("invalid version %q", e.Version)
+		}
+	}
+	switch e.Reason {
+	case "":
+		e.Reason = blockGone
+	case blockGone, blockLegal:
+	default:
+		return fmt.Errorf("invalid block reason %q; must be %q or %q", e.Reason, blockGone, blockLegal)
+	}
+	return nil
+}
+
+const blocklistFile = "blocklist.json"
+
+var blocklist = make(map[string]*blockEntry)
+var blocklistLock sync.RWMutex
+
+func loadBlocklist() error {
+	var list []*blockEntry
+	if err := loadState(blocklistFile, &list); err != nil {
+		return err
+	}
+	blocklistLock.Lock()
+	defer blocklistLock.Unlock()
+	for _, e := range list {
+		if err := e.check(); err != nil {
+			return fmt.Errorf("invalid entry in %s: %v", blocklistFile, err)
+		}
+		blocklist[e.key()] = e
+	}
+	return nil
+}
+
+// saveBlocklist must be called with blocklistLock held.
+func saveBlocklist() {
+	if err := saveState(blocklistFile, blocklistEntries()); err != nil {
+		log.Printf("Error saving blocklist: %v", err)
+	}
+}
+
+// blocklistEntries must be called with blocklistLock held.
+func blocklistEntries() []blockEntry {
+	list := make([]blockEntry, 0, len(blocklist))
+	for _, e := range blocklist {
+		list = append(list, *e)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].key() < list[j].key() })
+	return list
+}
+
+// blockList returns a copy of all blocklist entries.
+func blockList() []blockEntry {
+	blocklistLock.RLock()
+	defer blocklistLock.RUnlock()
+	return blocklistEntries()
+}
+
+// addBlock adds e to the blocklist, replacing any entry with the same scope.
+func addBlock(e blockEntry) error {
+	if err := e.check(); err != nil {
+		return err
+	}
+	if e.Created.IsZero() {
+		e.Created = time.Now()
+	}
+	blocklistLock.Lock()
+	defer blocklistLock.Unlock()
+	blocklist[e.key()] = &e
+	saveBlocklist()
+	return nil
+}
+
+// removeBlock removes the blocklist entry with the same scope as e.
+func removeBlock(e blockEntry) error {
+	if err := e.check(); err != nil {
+		return err
+	}
+	blocklistLock.Lock()
+	defer blocklistLock.Unlock()
+	if _, ok := blocklist[e.key()]; !ok {
+		return fmt.Errorf("%s is not blocked", e.key())
+	}
+	delete(blocklist, e.key())
+	saveBlocklist()
+	return nil
+}
+
+// blockFor returns the blocklist entry preventing version v of the repository
+// at base from being served, or nil if it isn't blocked. Entries for a full
+// version block all versions it contains, so "v1.2" blocks "v1.2.3" as well.
+func blockFor(base repoBase, v resolver.Version) *blockEntry {
+	path := base.String()
+	major := resolver.Version{Major: v.Major, Minor: -1, Patch: -1, Unstable: v.Unstable}
+	blocklistLock.RLock()
+	defer blocklistLock.RUnlock()
+	for _, e := range blocklist {
+		if e.Path != path {
+			continue
+		}
+		if e.Major == "" && e.Version == "" {
+			return e
+		}
+		if e.Major != "" && e.Major == major.String() {
+			return e
+		}
+		if ev, ok := resolver.ParseVersion(e.Version); ok && ev.Contains(v) {
+			return e
+		}
+	}
+	return nil
+}
+
+// blockWithin returns an entry blocking some version contained in the
+// provided major version, or nil if there are none.
+func blockWithin(base repoBase, major resolver.Version) *blockEntry {
+	path := base.String()
+	blocklistLock.RLock()
+	defer blocklistLock.RUnlock()
+	for _, e := range blocklist {
+		if ev, ok := resolver.ParseVersion(e.Version); ok && e.Path == path && major.Contains(ev) {
+			return e
+		}
+	}
+	return nil
+}
+
+const blockedTemplateString = `<!DOCTYPE html>
+<html>
+	<head>
+		<meta charset="utf-8">
+		<title>{{.Path}} - {{.StatusText}}</title>
+	</head>
+	<body>
+		<h1>{{.StatusText}}</h1>
+		<p>{{if .Entry.Version}}Version {{.Entry.Version}} of {{else if .Entry.Major}}Version {{.Entry.Major}} of {{end}}{{.Entry.Path}} is no longer served by gopkg.in.</p>
+		{{if .Entry.Message}}<p>{{.Entry.Message}}</p>{{end}}
+	</body>
+</html>`
+
+var blockedTemplate = template.Must(template.New("blocked").Parse(blockedTemplateString))
+
+type blockedData struct {
+	Path       string
+	Status     int
+	StatusText string
+	Entry      *blockEntry
+}
+
+// loadBlockedTemplate replaces the built-in explanation page for blocked
+// packages with the template at path.
+func loadBlockedTemplate(path string) error {
+	t, err := template.ParseFiles(path)
+	if err != nil {
+		return fmt.Errorf("cannot load blocked page template: %v", err)
+	}
+	blockedTemplate = t
+	return nil
+}
+
+func sendBlocked(resp http.ResponseWriter, repo *resolver.Repo, e *blockEntry) {
+	status := http.StatusGone
+	if e.Reason == blockLegal {
+		status = http.StatusUnavailableForLegalReasons
+	}
+	resp.Header().Set("Content-Type", "text/html")
+	resp.WriteHeader(status)
+	err := blockedTemplate.Execute(resp, &blockedData{
+		Path:       repo.Original().GopkgPath(),
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Entry:      e,
+	})
+	if err != nil {
+		log.Printf("error executing blocked page template: %v", err)
+	}
+}
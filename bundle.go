@@ -0,0 +1,320 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/niemeyer/gopkg/pktline"
+	"github.com/niemeyer/gopkg/resolver"
+)
+
+// Bundles are prebuilt git bundles holding the selected version of the
+// packages cloned most often. They're advertised to protocol v2 clients via
+// the bundle-uri command, so that modern git clients download a static file
+// and only negotiate the remainder through proxyUploadPack, and are also
+// available for plain download at <package>.git/info/bundle.
+
+const bundlesFile = "bundles.json"
+const bundleDemandsFile = "bundle-demands.json"
+const bundlePath = "/info/bundle"
+
+// bundleInfo describes the bundle built for a package root.
+type bundleInfo struct {
+	Root    string    `json:"root"`
+	Hash    string    `json:"hash"`
+	Size    int64     `json:"size"`
+	Created time.Time `json:"created"`
+}
+
+// bundleDemand tracks how often a package root is cloned, and what its
+// latest resolution is.
+type bundleDemand struct {
+	GitHubRoot string  `json:"github-root"`
+	Hash       string  `json:"hash"`
+	Clones     float64 `json:"clones"`
+}
+
+var (
+	bundles       = make(map[string]*bundleInfo) // gopkg root => bundle
+	bundleDemands = make(map[string]*bundleDemand)
+	bundlesLock   sync.Mutex
+)
+
+var (
+	bundleCount     = newGauge("gopkg_bundles", "Number of prebuilt git bundles available.")
+	bundleBuilds    = newCounter("gopkg_bundle_builds_total", "Number of git bundle builds attempted.", "result")
+	bundleDownloads = newCounter("gopkg_bundle_downloads_total", "Number of git bundle downloads served.")
+)
+
+// loadBundles loads the index of bundles built previously and removes any
+// bundle files in the -bundles directory that it doesn't refer to.
+func loadBundles() error {
+	if *bundlesFlag == "" {
+		return nil
+	}
+	if err := os.MkdirAll(*bundlesFlag, 0700); err != nil {
+		return err
+	}
+	bundlesLock.Lock()
+	defer bundlesLock.Unlock()
+	if err := loadState(bundlesFile, &bundles); err != nil {
+		return err
+	}
+	if err := loadState(bundleDemandsFile, &bundleDemands); err != nil {
+		return err
+	}
+	for root, b := range bundles {
+		if _, err := os.Stat(bundleFile(b.Hash)); err != nil {
+			delete(bundles, root)
+		}
+	}
+	cleanBundles()
+	return nil
+}
+
+func bundleFile(hash string) string {
+	return filepath.Join(*bundlesFlag, hash+".bundle")
+}
+
+// cleanBundles removes all files in the -bundles directory not referred to
+// by the bundles index. It must be called with bundlesLock held.
+func cleanBundles() {
+	used := make(map[string]bool)
+	for _, b := range bundles {
+		used[filepath.Base(bundleFile(b.Hash))] = true
+	}
+	infos, err := ioutil.ReadDir(*bundlesFlag)
+	if err != nil {
+		log.Printf("Error reading bundles directory: %v", err)
+		return
+	}
+	for _, info := range infos {
+		if !used[info.Name()] {
+			os.Remove(filepath.Join(*bundlesFlag, info.Name()))
+		}
+	}
+	bundleCount.set(float64(len(bundles)))
+}
+
+// noteClone records that a fresh clone of repo was requested, when it
+// resolved to the provided commit hash.
+func noteClone(repo *resolver.Repo, hash string) {
+	if *bundlesFlag == "" || hash == "" {
+		return
+	}
+	root := repo.Original().GopkgRoot()
+	bundlesLock.Lock()
+	defer bundlesLock.Unlock()
+	d, ok := bundleDemands[root]
+	if !ok {
+		d = &bundleDemand{}
+		bundleDemands[root] = d
+	}
+	d.GitHubRoot = repo.GitHubRoot()
+	d.Hash = hash
+	d.Clones++
+}
+
+// currentBundle returns the bundle for repo if it holds the provided commit
+// hash, or nil otherwise.
+func currentBundle(repo *resolver.Repo, hash string) *bundleInfo {
+	if *bundlesFlag == "" {
+		return nil
+	}
+	bundlesLock.Lock()
+	defer bundlesLock.Unlock()
+	if b := bundles[repo.Original().GopkgRoot()]; b != nil && b.Hash == hash {
+		copy := *b
+		return &copy
+	}
+	return nil
+}
+
+// saveBundleDemands persists how often each package was cloned, so that
+// the selection of bundles isn't reset by restarts.
+func saveBundleDemands() {
+	if *bundlesFlag == "" {
+		return
+	}
+	bundlesLock.Lock()
+	defer bundlesLock.Unlock()
+	if err := saveState(bundleDemandsFile, bundleDemands); err != nil {
+		log.Printf("Error saving bundle demands: %v", err)
+	}
+}
+
+// bundleLoop rebuilds the bundles for the most popular packages on every
+// -bundle-interval.
+func bundleLoop() {
+	for range time.Tick(*bundleIntervalFlag) {
+		updateBundles()
+	}
+}
+
+// updateBundles builds bundles for the -bundle-count packages cloned most
+// often, for the version they currently resolve to, and drops the bundles
+// of all other packages. Clone counts decay by half on every update, so
+// the selection follows recent demand.
+func updateBundles() {
+	type target struct {
+		root string
+		bundleDemand
+	}
+	bundlesLock.Lock()
+	var targets []target
+	for root, d := range bundleDemands {
+		targets = append(targets, target{root, *d})
+		d.Clones /= 2
+		if d.Clones < 1 {
+			delete(bundleDemands, root)
+		}
+	}
+	bundlesLock.Unlock()
+
+	sort.Slice(targets, func(i, j int) bool {
+		if targets[i].Clones != targets[j].Clones {
+			return targets[i].Clones > targets[j].Clones
+		}
+		return targets[i].root < targets[j].root
+	})
+	if len(targets) > *bundleCountFlag {
+		targets = targets[:*bundleCountFlag]
+	}
+
+	updated := make(map[string]*bundleInfo)
+	for _, t := range targets {
+		bundlesLock.Lock()
+		b := bundles[t.root]
+		bundlesLock.Unlock()
+		if b == nil || b.Hash != t.Hash {
+			size, err := buildBundle(t.GitHubRoot, t.Hash)
+			if err != nil {
+				log.Printf("Error building bundle for %s: %v", t.root, err)
+				bundleBuilds.inc("error")
+				continue
+			}
+			bundleBuilds.inc("ok")
+			b = &bundleInfo{Root: t.root, Hash: t.Hash, Size: size, Created: time.Now()}
+		}
+		updated[t.root] = b
+	}
+
+	bundlesLock.Lock()
+	defer bundlesLock.Unlock()
+	bundles = updated
+	cleanBundles()
+	if err := saveState(bundlesFile, bundles); err != nil {
+		log.Printf("Error saving bundles: %v", err)
+	}
+}
+
+// buildBundle stores as a git bundle the pack with all objects reachable
+// from the commit hash in the repository at githubRoot, with that commit as
+// its master branch, which is where the refs advertisement puts the
+// selected version.
+func buildBundle(githubRoot, hash string) (size int64, err error) {
+	pack, err := fetchPack(githubRoot, hash)
+	if err != nil {
+		return 0, err
+	}
+	defer pack.Close()
+
+	tmp, err := ioutil.TempFile(*bundlesFlag, hash+".bundle.tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	header := fmt.Sprintf("# v2 git bundle\n%s refs/heads/master\n\n", hash)
+	if _, err = io.WriteString(tmp, header); err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(tmp, pack)
+	if err != nil {
+		return 0, fmt.Errorf("cannot obtain data pack from GitHub: %v", err)
+	}
+	if err = tmp.Close(); err != nil {
+		return 0, err
+	}
+	if err = os.Rename(tmp.Name(), bundleFile(hash)); err != nil {
+		return 0, err
+	}
+	return int64(len(header)) + n, nil
+}
+
+// sendBundle serves the bundle of repo for download, if it holds the
+// provided commit hash.
+func sendBundle(resp http.ResponseWriter, req *http.Request, repo *resolver.Repo, hash string) {
+	b := currentBundle(repo, hash)
+	if b == nil {
+		sendNotFound(resp, "No bundle available for %s", repo.Original().GopkgRoot())
+		return
+	}
+	f, err := os.Open(bundleFile(b.Hash))
+	if err != nil {
+		sendNotFound(resp, "No bundle available for %s", repo.Original().GopkgRoot())
+		return
+	}
+	defer f.Close()
+	bundleDownloads.inc()
+	resp.Header().Set("Content-Type", "application/octet-stream")
+	resp.Header().Set("ETag", strconv.Quote(b.Hash))
+	http.ServeContent(resp, req, "", b.Created, f)
+}
+
+// bundleURIWanted returns whether the info/refs request should be answered
+// with a protocol v2 capability advertisement including bundle-uri.
+func bundleURIWanted(req *http.Request) bool {
+	if *bundlesFlag == "" {
+		return false
+	}
+	for _, param := range strings.Split(req.Header.Get("Git-Protocol"), ":") {
+		if param == "version=2" {
+			return true
+		}
+	}
+	return false
+}
+
+// writeCapabilities writes the protocol v2 capability advertisement. The
+// ls-refs and bundle-uri commands are served locally, while fetch is
+// forwarded to GitHub.
+func writeCapabilities(w io.Writer) error {
+	pw := pktline.NewWriter(w)
+	for _, line := range []string{"version 2", "agent=" + *hostFlag, "ls-refs", "fetch=shallow filter", "object-format=sha1", "bundle-uri"} {
+		if err := pw.WriteString(line + "\n"); err != nil {
+			return err
+		}
+	}
+	return pw.WriteFlush()
+}
+
+// writeBundleURI writes the response to a protocol v2 bundle-uri command,
+// listing the bundle for repo if it holds the provided commit hash. The
+// bundle URI is always at -host over https, whatever host the client asked.
+func writeBundleURI(w io.Writer, req *http.Request, repo *resolver.Repo, hash string) error {
+	pw := pktline.NewWriter(w)
+	if b := currentBundle(repo, hash); b != nil {
+		uri := "https://" + *hostFlag + strings.TrimSuffix(req.URL.Path, "/git-upload-pack") + bundlePath
+		for _, line := range []string{"bundle.version=1", "bundle.mode=all", "bundle.gopkg.uri=" + uri} {
+			if err := pw.WriteString(line + "\n"); err != nil {
+				return err
+			}
+		}
+	}
+	return pw.WriteFlush()
+}
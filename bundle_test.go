@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/niemeyer/gopkg/resolver"
+)
+
+var _ = Suite(&BundleSuite{})
+
+type BundleSuite struct {
+	transport http.RoundTripper
+	body      string
+	header    http.Header
+}
+
+func (s *BundleSuite) SetUpTest(c *C) {
+	*bundlesFlag = c.MkDir()
+	s.transport = bulkClient.Transport
+	bulkClient.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		data, _ := ioutil.ReadAll(req.Body)
+		s.body = string(data)
+		s.header = req.Header
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(strings.NewReader("0008NAK\nPACK data")),
+			Request:    req,
+		}, nil
+	})
+}
+
+func (s *BundleSuite) TearDownTest(c *C) {
+	bulkClient.Transport = s.transport
+	*bundlesFlag = ""
+	bundlesLock.Lock()
+	bundles = make(map[string]*bundleInfo)
+	bundleDemands = make(map[string]*bundleDemand)
+	bundlesLock.Unlock()
+}
+
+func (s *BundleSuite) TestUpdateBundles(c *C) {
+	defer func(count int) { *bundleCountFlag = count }(*bundleCountFlag)
+	*bundleCountFlag = 1
+
+	popular := &resolver.Repo{User: "user", Name: "popular", MajorVersion: resolver.Version{Major: 1, Minor: -1, Patch: -1}}
+	other := &resolver.Repo{User: "user", Name: "other", MajorVersion: resolver.Version{Major: 1, Minor: -1, Patch: -1}}
+	noteClone(popular, wantHash1)
+	noteClone(popular, wantHash1)
+	noteClone(other, wantHash2)
+	updateBundles()
+
+	c.Assert(s.body, Equals, pktlines("want "+wantHash1+" ofs-delta agent=gopkg.in\n", "0000", "done\n"))
+	c.Assert(currentBundle(other, wantHash2), IsNil)
+	c.Assert(currentBundle(popular, wantHash2), IsNil)
+	b := currentBundle(popular, wantHash1)
+	c.Assert(b, NotNil)
+	c.Assert(b.Root, Equals, "gopkg.in/user/popular.v1")
+
+	req := httptest.NewRequest("GET", "/user/popular.v1.git/info/bundle", nil)
+	resp := httptest.NewRecorder()
+	sendBundle(resp, req, popular, wantHash1)
+	c.Assert(resp.Code, Equals, http.StatusOK)
+	c.Assert(resp.Body.String(), Equals, "# v2 git bundle\n"+wantHash1+" refs/heads/master\n\nPACK data")
+
+	resp = httptest.NewRecorder()
+	sendBundle(resp, req, popular, wantHash2)
+	c.Assert(resp.Code, Equals, http.StatusNotFound)
+}
+
+func (s *BundleSuite) TestTooLarge(c *C) {
+	defer func(max int64) { *maxResponseFlag = max }(*maxResponseFlag)
+	*maxResponseFlag = int64(len("PACK data")) - 1
+
+	_, err := buildBundle("github.com/user/repo", wantHash1)
+	c.Assert(err, ErrorMatches, "cannot obtain data pack from GitHub: upload-pack response too large")
+
+	// The partial bundle is removed.
+	infos, err := ioutil.ReadDir(*bundlesFlag)
+	c.Assert(err, IsNil)
+	c.Assert(infos, HasLen, 0)
+
+	*maxResponseFlag = int64(len("PACK data"))
+	_, err = buildBundle("github.com/user/repo", wantHash1)
+	c.Assert(err, IsNil)
+}
+
+func (s *BundleSuite) TestHostAgent(c *C) {
+	*hostFlag = "example.com"
+	defer func() { *hostFlag = gopkgIn }()
+
+	pack, err := fetchPack("github.com/user/repo", wantHash1)
+	c.Assert(err, IsNil)
+	pack.Close()
+	c.Assert(s.body, Equals, pktlines("want "+wantHash1+" ofs-delta agent=example.com\n", "0000", "done\n"))
+	c.Assert(s.header.Get("User-Agent"), Equals, "example.com (+https://example.com)")
+	c.Assert(s.header.Get("Via"), Equals, "1.1 example.com")
+
+	var buf bytes.Buffer
+	c.Assert(writeCapabilities(&buf), IsNil)
+	c.Assert(buf.String(), Equals, pktlines(
+		"version 2\n",
+		"agent=example.com\n",
+		"ls-refs\n",
+		"fetch=shallow filter\n",
+		"object-format=sha1\n",
+		"bundle-uri\n",
+		"0000",
+	))
+}
+
+func (s *BundleSuite) TestBundleURI(c *C) {
+	repo := &resolver.Repo{User: "user", Name: "repo", MajorVersion: resolver.Version{Major: 1, Minor: -1, Patch: -1}}
+	req := httptest.NewRequest("POST", "http://example.com/user/repo.v1.git/git-upload-pack", nil)
+
+	var buf bytes.Buffer
+	c.Assert(writeBundleURI(&buf, req, repo, wantHash1), IsNil)
+	c.Assert(buf.String(), Equals, "0000")
+
+	noteClone(repo, wantHash1)
+	updateBundles()
+	buf.Reset()
+	c.Assert(writeBundleURI(&buf, req, repo, wantHash1), IsNil)
+	c.Assert(buf.String(), Equals, pktlines(
+		"bundle.version=1\n",
+		"bundle.mode=all\n",
+		"bundle.gopkg.uri=https://gopkg.in/user/repo.v1.git/info/bundle\n",
+		"0000",
+	))
+}
+
+func (s *BundleSuite) TestBundleURIWanted(c *C) {
+	req := httptest.NewRequest("GET", "/user/repo.v1.git/info/refs?service=git-upload-pack", nil)
+	c.Assert(bundleURIWanted(req), Equals, false)
+	req.Header.Set("Git-Protocol", "version=2")
+	c.Assert(bundleURIWanted(req), Equals, true)
+
+	*bundlesFlag = ""
+	c.Assert(bundleURIWanted(req), Equals, false)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Static certificates provided with -cert and -key are reloaded whenever
+// their files change, and picked for each connection by the server name
+// the client asks for, falling back to the first one.
+
+var (
+	certExpiry       = newGauge("gopkg_tls_cert_expiry_timestamp_seconds", "Expiry time of the static TLS certificates as a Unix timestamp.", "cert")
+	certReloadErrors = newCounter("gopkg_tls_cert_reload_errors_total", "Number of failed attempts to reload a static TLS certificate.", "cert")
+)
+
+// certs holds the static certificates, and is nil if there are none.
+var certs *certManager
+
+type certManager struct {
+	mu    sync.RWMutex
+	pairs []*certPair
+}
+
+type certPair struct {
+	certFile string
+	keyFile  string
+	stamp    string // Sizes and modification times of the files loaded.
+	cert     *tls.Certificate
+}
+
+// newCertManager loads the certificates in the comma-separated list of
+// files, each with the key in the respective file in the keys list.
+func newCertManager(certList, keyList string) (*certManager, error) {
+	certFiles := strings.Split(certList, ",")
+	keyFiles := strings.Split(keyList, ",")
+	if len(certFiles) != len(keyFiles) {
+		return nil, fmt.Errorf("-cert and -key must list the same number of files")
+	}
+	m := &certManager{}
+	for i := range certFiles {
+		m.pairs = append(m.pairs, &certPair{
+			certFile: strings.TrimSpace(certFiles[i]),
+			keyFile:  strings.TrimSpace(keyFiles[i]),
+		})
+	}
+	if err := m.reload(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// reload loads the certificates whose files changed since last loaded.
+// Certificates that fail to load are kept as they were, and the first
+// error is returned.
+func (m *certManager) reload() error {
+	var first error
+	for _, pair := range m.pairs {
+		stamp := fileStamp(pair.certFile) + " " + fileStamp(pair.keyFile)
+		if stamp == pair.stamp {
+			continue
+		}
+		cert, err := loadCert(pair.certFile, pair.keyFile)
+		if err != nil {
+			certReloadErrors.inc(pair.certFile)
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		if pair.cert != nil {
+			log.Printf("Reloaded TLS certificate %s", pair.certFile)
+		}
+		m.mu.Lock()
+		pair.cert = cert
+		pair.stamp = stamp
+		m.mu.Unlock()
+		certExpiry.set(float64(cert.Leaf.NotAfter.Unix()), pair.certFile)
+	}
+	return first
+}
+
+func fileStamp(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "-"
+	}
+	return fmt.Sprintf("%d@%d", info.Size(), info.ModTime().UnixNano())
+}
+
+func loadCert(certFile, keyFile string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load TLS certificate %s: %v", certFile, err)
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse TLS certificate %s: %v", certFile, err)
+	}
+	return &cert, nil
+}
+
+// watch reloads the certificates every interval.
+func (m *certManager) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := m.reload(); err != nil {
+			log.Printf("Error reloading TLS certificates: %v", err)
+		}
+	}
+}
+
+// getCertificate returns the first certificate the client supports for
+// the requested server name, or the first certificate if none matches.
+func (m *certManager) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, pair := range m.pairs {
+		if hello.SupportsCertificate(pair.cert) == nil {
+			return pair.cert, nil
+		}
+	}
+	return m.pairs[0].cert, nil
+}
+
+// check returns an error if any of the certificates is expired at now.
+// It's fine to call it on a nil certManager.
+func (m *certManager) check(now time.Time) error {
+	if m == nil {
+		return nil
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, pair := range m.pairs {
+		if notAfter := pair.cert.Leaf.NotAfter; now.After(notAfter) {
+			return fmt.Errorf("TLS certificate %s expired at %s", pair.certFile, notAfter.UTC().Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// expiry returns when the first of the certificates expires.
+func (m *certManager) expiry() time.Time {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var first time.Time
+	for _, pair := range m.pairs {
+		if notAfter := pair.cert.Leaf.NotAfter; first.IsZero() || notAfter.Before(first) {
+			first = notAfter
+		}
+	}
+	return first
+}
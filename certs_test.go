@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&CertsSuite{})
+
+type CertsSuite struct {
+	dir string
+}
+
+func (s *CertsSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+}
+
+// writeCert writes a self-signed certificate for host expiring at
+// notAfter, and its key, to files named after name.
+func (s *CertsSuite) writeCert(c *C, name, host string, notAfter time.Time) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    notAfter.Add(-365 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	c.Assert(err, IsNil)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, IsNil)
+
+	certFile = filepath.Join(s.dir, name+".crt")
+	keyFile = filepath.Join(s.dir, name+".key")
+	c.Assert(ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600), IsNil)
+	c.Assert(ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600), IsNil)
+	return certFile, keyFile
+}
+
+func (s *CertsSuite) serverName(c *C, m *certManager, name string) string {
+	cert, err := m.getCertificate(&tls.ClientHelloInfo{
+		ServerName:        name,
+		SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		SupportedCurves:   []tls.CurveID{tls.CurveP256},
+		SupportedVersions: []uint16{tls.VersionTLS13},
+	})
+	c.Assert(err, IsNil)
+	return cert.Leaf.Subject.CommonName
+}
+
+func (s *CertsSuite) TestSNI(c *C) {
+	expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+	cert1, key1 := s.writeCert(c, "one", "gopkg.in", expiry)
+	cert2, key2 := s.writeCert(c, "two", "example.com", expiry)
+
+	m, err := newCertManager(cert1+","+cert2, key1+","+key2)
+	c.Assert(err, IsNil)
+	c.Assert(s.serverName(c, m, "gopkg.in"), Equals, "gopkg.in")
+	c.Assert(s.serverName(c, m, "example.com"), Equals, "example.com")
+	c.Assert(s.serverName(c, m, "other.com"), Equals, "gopkg.in")
+	c.Assert(s.serverName(c, m, ""), Equals, "gopkg.in")
+
+	c.Assert(certExpiry.values[`{cert="`+cert2+`"}`], Equals, float64(expiry.Unix()))
+}
+
+func (s *CertsSuite) TestReload(c *C) {
+	certFile, keyFile := s.writeCert(c, "one", "gopkg.in", time.Now().Add(time.Hour))
+	m, err := newCertManager(certFile, keyFile)
+	c.Assert(err, IsNil)
+	c.Assert(m.check(time.Now()), IsNil)
+
+	// Unchanged files aren't reloaded.
+	old := m.pairs[0].cert
+	c.Assert(m.reload(), IsNil)
+	c.Assert(m.pairs[0].cert, Equals, old)
+
+	// A broken certificate keeps the old one in use.
+	c.Assert(ioutil.WriteFile(certFile, []byte("broken"), 0600), IsNil)
+	c.Assert(m.reload(), ErrorMatches, "cannot load TLS certificate .*")
+	c.Assert(m.pairs[0].cert, Equals, old)
+	c.Assert(certReloadErrors.values[`{cert="`+certFile+`"}`] > 0, Equals, true)
+
+	// The rotated certificate is picked up.
+	s.writeCert(c, "one", "example.com", time.Now().Add(-time.Minute))
+	future := time.Now().Add(time.Hour)
+	c.Assert(os.Chtimes(certFile, future, future), IsNil)
+	c.Assert(m.reload(), IsNil)
+	c.Assert(s.serverName(c, m, "gopkg.in"), Equals, "example.com")
+	c.Assert(m.check(time.Now()), ErrorMatches, "TLS certificate .*/one.crt expired at .*")
+}
+
+func (s *CertsSuite) TestErrors(c *C) {
+	certFile, keyFile := s.writeCert(c, "one", "gopkg.in", time.Now().Add(time.Hour))
+	_, err := newCertManager(certFile+","+certFile, keyFile)
+	c.Assert(err, ErrorMatches, "-cert and -key must list the same number of files")
+	_, err = newCertManager(certFile, filepath.Join(s.dir, "missing.key"))
+	c.Assert(err, ErrorMatches, "cannot load TLS certificate .*")
+
+	var m *certManager
+	c.Assert(m.check(time.Now()), IsNil)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/niemeyer/gopkg/resolver"
+)
+
+// The version feed lists every version tag in the order the ledger first
+// saw it, so mirrors and scanners can follow new releases:
+//
+//	/index?since=<RFC 3339 time>&limit=<n>  Versions first seen at or after since, as JSON lines.
+//	/_feed/<package path>                     Atom feed of the latest versions of a package.
+//
+// The index lines have the same fields as the ones in index.golang.org,
+// plus the commit the version tag pointed to when first seen. The
+// Timestamp is when the version was first seen.
+
+// feedPath is where the package feeds are served. Like sitePath, it can't
+// clash with package paths.
+const feedPath = "/_feed/"
+
+const (
+	feedIndexLimit  = 2000
+	feedMaxEntries  = 50
+	feedContentType = "application/atom+xml; charset=utf-8"
+)
+
+// feedVersion is a version tag in the feed.
+type feedVersion struct {
+	root    string // GitHub root.
+	tag     string // Tag name, such as refs/tags/v1.2.3.
+	version resolver.Version
+	commit  string
+	seen    time.Time
+}
+
+var (
+	feed       []*feedVersion
+	feedByRoot = make(map[string][]*feedVersion)
+)
+
+// noteVersion adds the tag first seen in the ledger to the feed, if it's
+// for a version. Peeled tags update the commit of their annotated tag.
+// Versions are kept in the order they were first seen, even if ledger
+// lines, appended by more than one process during a restart, aren't.
+// It must be called with ledgerLock held.
+func noteVersion(root, tag, hash string, seen time.Time) {
+	if strings.HasSuffix(tag, "^{}") {
+		versions := feedByRoot[root]
+		for i := len(versions) - 1; i >= 0; i-- {
+			if versions[i].tag+"^{}" == tag {
+				versions[i].commit = hash
+				break
+			}
+		}
+		return
+	}
+	v, ok := resolver.ParseVersion(strings.TrimPrefix(tag, "refs/tags/"))
+	if !ok {
+		return
+	}
+	fv := &feedVersion{root, tag, v, hash, seen}
+	feed = insertVersion(feed, fv)
+	feedByRoot[root] = insertVersion(feedByRoot[root], fv)
+}
+
+// insertVersion inserts fv into versions after every version seen before
+// or at the same time.
+func insertVersion(versions []*feedVersion, fv *feedVersion) []*feedVersion {
+	i := sort.Search(len(versions), func(i int) bool { return versions[i].seen.After(fv.seen) })
+	versions = append(versions, nil)
+	copy(versions[i+1:], versions[i:])
+	versions[i] = fv
+	return versions
+}
+
+// path returns the package path for the version in the canonical form,
+// which is the short one for repositories named go-<name>/<name>.
+func (fv *feedVersion) path() string {
+	repo := &resolver.Repo{Host: *hostFlag, Name: fv.root[strings.LastIndexByte(fv.root, '/')+1:]}
+	if user := strings.TrimPrefix(fv.root[:len(fv.root)-len(repo.Name)-1], githubCom+"/"); user != "go-"+repo.Name {
+		repo.User = user
+	}
+	return repo.GopkgVersionRoot(fv.version)
+}
+
+// feedIndexLine is a line in the /index response.
+type feedIndexLine struct {
+	Path      string
+	Version   string
+	Commit    string
+	Timestamp time.Time
+}
+
+// feedIndexHandler serves up to ?limit versions first seen at or after ?since.
+func feedIndexHandler(resp http.ResponseWriter, req *http.Request) {
+	var since time.Time
+	var err error
+	if s := req.FormValue("since"); s != "" {
+		since, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			sendJSON(resp, http.StatusBadRequest, map[string]string{"error": "since must be a RFC 3339 time"})
+			return
+		}
+	}
+	limit := feedIndexLimit
+	if s := req.FormValue("limit"); s != "" {
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > feedIndexLimit {
+			sendJSON(resp, http.StatusBadRequest, map[string]string{"error": "limit must be between 1 and " + strconv.Itoa(feedIndexLimit)})
+			return
+		}
+	}
+
+	ledgerLock.RLock()
+	i := sort.Search(len(feed), func(i int) bool { return !feed[i].seen.Before(since) })
+	lines := make([]feedIndexLine, 0, limit)
+	for ; i < len(feed) && len(lines) < limit; i++ {
+		fv := feed[i]
+		lines = append(lines, feedIndexLine{fv.path(), fv.version.String(), fv.commit, fv.seen.UTC()})
+	}
+	ledgerLock.RUnlock()
+
+	resp.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(resp)
+	for i := range lines {
+		if err := enc.Encode(&lines[i]); err != nil {
+			return
+		}
+	}
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  atomAuthor  `xml:"author"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	ID      string   `xml:"id"`
+	Title   string   `xml:"title"`
+	Updated string   `xml:"updated"`
+	Link    atomLink `xml:"link"`
+	Summary string   `xml:"summary"`
+}
+
+// feedHandler serves the Atom feed with the latest versions first seen
+// for the package at the path after feedPath.
+func feedHandler(resp http.ResponseWriter, req *http.Request) {
+	repo, err := resolver.ParsePath("/" + strings.TrimPrefix(req.URL.Path, feedPath))
+	if err != nil || repo.SubPath != "" {
+		sendNotFound(resp, "Unknown package feed.")
+		return
+	}
+	repo.Host = *hostFlag
+	if user, name, ok := renameRepo(repo.User, repo.Name); ok {
+		repo.RedirUser, repo.RedirName = repo.User, repo.Name
+		repo.User, repo.Name = user, name
+	}
+	root := repo.Original().GopkgRoot()
+
+	f := &atomFeed{
+		ID:     "https://" + root,
+		Title:  root + " versions",
+		Author: atomAuthor{*hostFlag},
+		Links: []atomLink{
+			{Rel: "self", Href: "https://" + *hostFlag + req.URL.Path},
+			{Rel: "alternate", Href: "https://" + root},
+		},
+	}
+	ledgerLock.RLock()
+	versions := feedByRoot[repo.GitHubRoot()]
+	for i := len(versions) - 1; i >= 0 && len(f.Entries) < feedMaxEntries; i-- {
+		fv := versions[i]
+		if !repo.MajorVersion.Contains(fv.version) {
+			continue
+		}
+		v := fv.version.String()
+		updated := fv.seen.UTC().Format(time.RFC3339)
+		if f.Updated == "" {
+			f.Updated = updated
+		}
+		f.Entries = append(f.Entries, atomEntry{
+			ID:      "https://" + root + "@" + v,
+			Title:   root + " " + v,
+			Updated: updated,
+			Link:    atomLink{Href: "https://" + repo.GitHubRoot() + "/tree/" + v},
+			Summary: "Version " + v + " of " + root + " at commit " + fv.commit + ".",
+		})
+	}
+	ledgerLock.RUnlock()
+	if f.Updated == "" {
+		f.Updated = time.Unix(0, 0).UTC().Format(time.RFC3339)
+	}
+
+	data, err := xml.MarshalIndent(f, "", "\t")
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		resp.Write([]byte("Cannot encode feed."))
+		return
+	}
+	resp.Header().Set("Content-Type", feedContentType)
+	resp.Write([]byte(xml.Header))
+	resp.Write(append(data, '\n'))
+}
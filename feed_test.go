@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&FeedSuite{})
+
+type FeedSuite struct{}
+
+func (s *FeedSuite) TearDownTest(c *C) {
+	(&LedgerSuite{}).TearDownTest(c)
+}
+
+func feedGet(h http.HandlerFunc, path string) *httptest.ResponseRecorder {
+	resp := httptest.NewRecorder()
+	h(resp, httptest.NewRequest("GET", path, nil))
+	return resp
+}
+
+func indexLines(c *C, resp *httptest.ResponseRecorder) []feedIndexLine {
+	c.Assert(resp.Code, Equals, http.StatusOK)
+	c.Assert(resp.Header().Get("Content-Type"), Equals, "application/x-ndjson")
+	var lines []feedIndexLine
+	dec := json.NewDecoder(resp.Body)
+	for dec.More() {
+		var line feedIndexLine
+		c.Assert(dec.Decode(&line), IsNil)
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func (s *FeedSuite) TestIndex(c *C) {
+	_, err := trackTags("github.com/go-yaml/yaml", []byte(reflines(
+		"00000000000000000000000000000000000hash1 HEAD",
+		"00000000000000000000000000000000000hash2 refs/heads/v2",
+		"00000000000000000000000000000000000hash3 refs/tags/v2.0.0",
+		"00000000000000000000000000000000000hash4 refs/tags/v2.1.0",
+		"00000000000000000000000000000000000hash5 refs/tags/v2.1.0^{}",
+		"00000000000000000000000000000000000hash6 refs/tags/very-old",
+	)))
+	c.Assert(err, IsNil)
+	time.Sleep(10 * time.Millisecond)
+	since := time.Now()
+	_, err = trackTags(ledgerRoot, []byte(ledgerOriginal))
+	c.Assert(err, IsNil)
+	_, err = trackTags(ledgerRoot, []byte(ledgerMoved))
+	c.Assert(err, IsNil)
+
+	lines := indexLines(c, feedGet(feedIndexHandler, "/index"))
+	c.Assert(lines, HasLen, 3)
+	c.Assert(lines[0].Path, Equals, "gopkg.in/yaml.v2")
+	c.Assert(lines[0].Version, Equals, "v2.0.0")
+	c.Assert(lines[0].Commit, Equals, "00000000000000000000000000000000000hash3")
+	c.Assert(lines[1].Version, Equals, "v2.1.0")
+	c.Assert(lines[1].Commit, Equals, "00000000000000000000000000000000000hash5")
+	c.Assert(lines[2], DeepEquals, feedIndexLine{"gopkg.in/user/repo.v1", "v1.0.0", "00000000000000000000000000000000000hash3", lines[2].Timestamp})
+	c.Assert(lines[2].Timestamp.Before(since), Equals, false)
+	c.Assert(lines[0].Timestamp.Before(since), Equals, true)
+
+	lines = indexLines(c, feedGet(feedIndexHandler, "/index?since="+since.Format(time.RFC3339Nano)))
+	c.Assert(lines, HasLen, 1)
+	c.Assert(lines[0].Path, Equals, "gopkg.in/user/repo.v1")
+
+	lines = indexLines(c, feedGet(feedIndexHandler, "/index?limit=2"))
+	c.Assert(lines, HasLen, 2)
+	c.Assert(lines[1].Version, Equals, "v2.1.0")
+
+	lines = indexLines(c, feedGet(feedIndexHandler, "/index?since="+time.Now().Add(time.Hour).Format(time.RFC3339)))
+	c.Assert(lines, HasLen, 0)
+
+	resp := feedGet(feedIndexHandler, "/index?since=yesterday")
+	c.Assert(resp.Code, Equals, http.StatusBadRequest)
+	resp = feedGet(feedIndexHandler, "/index?limit=5000")
+	c.Assert(resp.Code, Equals, http.StatusBadRequest)
+}
+
+func (s *FeedSuite) TestIndexReloaded(c *C) {
+	*dataFlag = c.MkDir()
+	defer func() { *dataFlag = "" }()
+	_, err := trackTags(ledgerRoot, []byte(reflines(
+		"00000000000000000000000000000000000hash3 refs/tags/v1.0.0",
+		"00000000000000000000000000000000000hash4 refs/tags/v1.0.0^{}",
+	)))
+	c.Assert(err, IsNil)
+	before := indexLines(c, feedGet(feedIndexHandler, "/index"))
+
+	s.TearDownTest(c)
+	c.Assert(loadLedger(), IsNil)
+	after := indexLines(c, feedGet(feedIndexHandler, "/index"))
+	c.Assert(after, DeepEquals, before)
+	c.Assert(after, HasLen, 1)
+	c.Assert(after[0].Commit, Equals, "00000000000000000000000000000000000hash4")
+}
+
+func (s *FeedSuite) TestIndexInterleaved(c *C) {
+	*dataFlag = c.MkDir()
+	defer func() { *dataFlag = "" }()
+
+	// Two processes may append to the ledger at once during a restart.
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	yaml := "github.com/go-yaml/yaml"
+	c.Assert(appendState(ledgerFile,
+		ledgerEvent{"seen", yaml, "refs/tags/v2.1.0", "00000000000000000000000000000000000hash4", t0.Add(2 * time.Second)},
+		ledgerEvent{"seen", ledgerRoot, "refs/tags/v1.0.0", "00000000000000000000000000000000000hash1", t0.Add(time.Second)},
+		ledgerEvent{"seen", yaml, "refs/tags/v2.1.0^{}", "00000000000000000000000000000000000hash5", t0.Add(2 * time.Second)},
+		ledgerEvent{"seen", yaml, "refs/tags/v2.0.0", "00000000000000000000000000000000000hash3", t0},
+	), IsNil)
+	c.Assert(loadLedger(), IsNil)
+
+	lines := indexLines(c, feedGet(feedIndexHandler, "/index"))
+	c.Assert(lines, DeepEquals, []feedIndexLine{
+		{"gopkg.in/yaml.v2", "v2.0.0", "00000000000000000000000000000000000hash3", t0},
+		{"gopkg.in/user/repo.v1", "v1.0.0", "00000000000000000000000000000000000hash1", t0.Add(time.Second)},
+		{"gopkg.in/yaml.v2", "v2.1.0", "00000000000000000000000000000000000hash5", t0.Add(2 * time.Second)},
+	})
+	lines = indexLines(c, feedGet(feedIndexHandler, "/index?since="+t0.Add(time.Second).Format(time.RFC3339)))
+	c.Assert(lines, HasLen, 2)
+	c.Assert(lines[0].Version, Equals, "v1.0.0")
+
+	var f atomFeed
+	c.Assert(xml.Unmarshal(feedGet(feedHandler, "/_feed/yaml.v2").Body.Bytes(), &f), IsNil)
+	c.Assert(f.Entries, HasLen, 2)
+	c.Assert(f.Entries[0].Title, Equals, "gopkg.in/yaml.v2 v2.1.0")
+}
+
+func (s *FeedSuite) TestAtom(c *C) {
+	_, err := trackTags("github.com/go-yaml/yaml", []byte(reflines(
+		"00000000000000000000000000000000000hash1 refs/tags/v1.0.0",
+		"00000000000000000000000000000000000hash2 refs/tags/v2.0.0",
+		"00000000000000000000000000000000000hash3 refs/tags/v2.1.0",
+		"00000000000000000000000000000000000hash4 refs/tags/v2.1.0^{}",
+	)))
+	c.Assert(err, IsNil)
+
+	for _, path := range []string{"/_feed/yaml.v2", "/_feed/v2/yaml", "/_feed/go-yaml/yaml.v2"} {
+		resp := feedGet(feedHandler, path)
+		c.Assert(resp.Code, Equals, http.StatusOK)
+		c.Assert(resp.Header().Get("Content-Type"), Equals, "application/atom+xml; charset=utf-8")
+		c.Assert(strings.HasPrefix(resp.Body.String(), xml.Header), Equals, true)
+
+		var f atomFeed
+		c.Assert(xml.Unmarshal(resp.Body.Bytes(), &f), IsNil)
+		c.Assert(f.Entries, HasLen, 2, Commentf("%s", path))
+		c.Assert(f.Entries[0].Title, Matches, `gopkg\.in/.*yaml.* v2\.1\.0`)
+		c.Assert(f.Entries[0].Link.Href, Equals, "https://github.com/go-yaml/yaml/tree/v2.1.0")
+		c.Assert(f.Entries[0].Summary, Matches, ".*hash4.*")
+		c.Assert(f.Entries[1].Title, Matches, `.* v2\.0\.0`)
+		c.Assert(f.Updated, Equals, f.Entries[0].Updated)
+	}
+
+	resp := feedGet(feedHandler, "/_feed/yaml.v3")
+	c.Assert(resp.Code, Equals, http.StatusOK)
+	var f atomFeed
+	c.Assert(xml.Unmarshal(resp.Body.Bytes(), &f), IsNil)
+	c.Assert(f.Entries, HasLen, 0)
+	c.Assert(f.ID, Equals, "https://gopkg.in/yaml.v3")
+
+	resp = feedGet(feedHandler, "/_feed/yaml.v2/subpkg")
+	c.Assert(resp.Code, Equals, http.StatusNotFound)
+	resp = feedGet(feedHandler, "/_feed/nothing")
+	c.Assert(resp.Code, Equals, http.StatusNotFound)
+}
@@ -4,6 +4,7 @@ go 1.21.2
 
 require (
 	golang.org/x/crypto v0.14.0
+	golang.org/x/mod v0.14.0
 	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c
 )
 
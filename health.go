@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/niemeyer/gopkg/resolver"
+)
+
+// The service reports its health in JSON for orchestrators at /healthz,
+// which only tells the process is alive, and at /readyz, which checks that
+// it can actually serve packages:
+//
+//	upstream      GitHub responds for the -ready-probe package.
+//	store         The state and cache directories are writable.
+//	certificates  The static TLS certificates aren't expired.
+//	load          The upload-pack queue isn't full.
+//
+// Responses have status 200 when everything is fine and 503 otherwise.
+
+// readyProbeTTL is how long the upstream and store check results are reused
+// for, so that frequent readiness checks don't reach GitHub or touch the
+// disks every time.
+const readyProbeTTL = 30 * time.Second
+
+type healthReport struct {
+	Status string                  `json:"status"`
+	Checks map[string]*healthCheck `json:"checks,omitempty"`
+}
+
+type healthCheck struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+const (
+	healthOK   = "ok"
+	healthFail = "fail"
+)
+
+func sendHealth(resp http.ResponseWriter, report *healthReport) {
+	status := http.StatusOK
+	report.Status = healthOK
+	for _, check := range report.Checks {
+		if !check.OK {
+			status = http.StatusServiceUnavailable
+			report.Status = healthFail
+		}
+	}
+	resp.Header().Set("Cache-Control", "no-store")
+	sendJSON(resp, status, report)
+}
+
+func healthzHandler(resp http.ResponseWriter, req *http.Request) {
+	sendHealth(resp, &healthReport{})
+}
+
+// readiness checks whether the service is ready to serve packages.
+type readiness struct {
+	resolver *resolver.Handler
+
+	mu       sync.Mutex
+	probing  bool
+	probed   time.Time
+	upstream healthCheck
+	stored   time.Time
+	store    healthCheck
+}
+
+func (r *readiness) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	now := time.Now()
+	report := &healthReport{Checks: map[string]*healthCheck{
+		"upstream": r.checkUpstream(req.Context(), now),
+		"store":    r.checkStore(now),
+		"load":     checkLoad(),
+	}}
+	if certs != nil {
+		report.Checks["certificates"] = checkCerts(now)
+	}
+	sendHealth(resp, report)
+}
+
+// checkUpstream resolves the -ready-probe package, reusing the result for
+// readyProbeTTL. The refs obtained are also cached as usual. Only one probe
+// runs at a time, and checks meanwhile report the previous result.
+func (r *readiness) checkUpstream(ctx context.Context, now time.Time) *healthCheck {
+	if *readyProbeFlag == "" {
+		return &healthCheck{OK: true, Detail: "no probe"}
+	}
+	r.mu.Lock()
+	if r.probing || now.Sub(r.probed) < readyProbeTTL {
+		check := r.upstream
+		if r.probed.IsZero() {
+			check = healthCheck{false, "first probe in progress"}
+		}
+		r.mu.Unlock()
+		return &check
+	}
+	r.probing = true
+	r.mu.Unlock()
+
+	// The probe result is shared, so it must not depend on this client.
+	repo, err := resolver.ParsePath("/" + *readyProbeFlag)
+	if err == nil {
+		_, err = r.resolver.FetchRefs(context.WithoutCancel(ctx), repo)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		r.upstream = healthCheck{false, fmt.Sprintf("cannot resolve %s: %v", *readyProbeFlag, err)}
+	} else {
+		r.upstream = healthCheck{true, "resolved " + repo.GopkgRoot()}
+	}
+	r.probing = false
+	r.probed = now
+	check := r.upstream
+	return &check
+}
+
+// checkStore verifies that the directories holding state and caches are
+// writable, reusing the result for readyProbeTTL.
+func (r *readiness) checkStore(now time.Time) *healthCheck {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if now.Sub(r.stored) >= readyProbeTTL {
+		r.store = *storeCheck()
+		r.stored = now
+	}
+	check := r.store
+	return &check
+}
+
+func storeCheck() *healthCheck {
+	dirs := []string{*dataFlag, *packCacheFlag, *bundlesFlag, *mirrorFlag}
+	checked := 0
+	for _, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+		f, err := ioutil.TempFile(dir, ".readyz")
+		if err == nil {
+			err = f.Close()
+			os.Remove(f.Name())
+		}
+		if err != nil {
+			return &healthCheck{false, err.Error()}
+		}
+		checked++
+	}
+	if checked == 0 {
+		return &healthCheck{OK: true, Detail: "nothing stored"}
+	}
+	return &healthCheck{OK: true}
+}
+
+// checkCerts verifies that the static certificates aren't expired, and
+// reports when the first one expires.
+func checkCerts(now time.Time) *healthCheck {
+	if err := certs.check(now); err != nil {
+		return &healthCheck{false, err.Error()}
+	}
+	return &healthCheck{true, "expires " + certs.expiry().UTC().Format(time.RFC3339)}
+}
+
+// checkLoad verifies that upload-pack requests aren't being turned away
+// for a full queue.
+func checkLoad() *healthCheck {
+	uploadPackLock.Lock()
+	queued := uploadPackQueued
+	uploadPackLock.Unlock()
+	if uploadPackSlots == nil {
+		return &healthCheck{OK: true, Detail: "no limit"}
+	}
+	detail := fmt.Sprintf("%d/%d upload-packs running, %d/%d queued", len(uploadPackSlots), cap(uploadPackSlots), queued, *uploadPackQueueFlag)
+	full := queued >= *uploadPackQueueFlag && len(uploadPackSlots) == cap(uploadPackSlots)
+	return &healthCheck{!full, detail}
+}
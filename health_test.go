@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/niemeyer/gopkg/resolver"
+)
+
+var _ = Suite(&HealthSuite{})
+
+type HealthSuite struct {
+	fetched  []string
+	failing  bool
+	cache    *resolver.MemoryCache
+	resolver *resolver.Handler
+}
+
+func (s *HealthSuite) SetUpTest(c *C) {
+	s.fetched = nil
+	s.failing = false
+	s.cache = resolver.NewMemoryCache(time.Minute)
+	s.resolver = resolver.New(resolver.Options{
+		Cache: s.cache,
+		Client: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			s.fetched = append(s.fetched, req.URL.String())
+			status := 200
+			if s.failing {
+				status = 500
+			}
+			return &http.Response{StatusCode: status, Status: http.StatusText(status), Body: ioutil.NopCloser(strings.NewReader("")), Request: req}, nil
+		})},
+	})
+}
+
+func (s *HealthSuite) TearDownTest(c *C) {
+	*dataFlag = ""
+	certs = nil
+}
+
+func getHealth(c *C, h http.Handler) (int, *healthReport) {
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, httptest.NewRequest("GET", "/readyz", nil))
+	c.Assert(resp.Header().Get("Content-Type"), Equals, "application/json")
+	var report healthReport
+	c.Assert(json.Unmarshal(resp.Body.Bytes(), &report), IsNil)
+	return resp.Code, &report
+}
+
+func (s *HealthSuite) TestHealthz(c *C) {
+	code, report := getHealth(c, http.HandlerFunc(healthzHandler))
+	c.Assert(code, Equals, 200)
+	c.Assert(report, DeepEquals, &healthReport{Status: healthOK})
+}
+
+func (s *HealthSuite) TestReadyz(c *C) {
+	*dataFlag = c.MkDir()
+	ready := &readiness{resolver: s.resolver}
+
+	code, report := getHealth(c, ready)
+	c.Assert(code, Equals, 200)
+	c.Assert(report.Status, Equals, healthOK)
+	c.Assert(report.Checks["upstream"], DeepEquals, &healthCheck{true, "resolved gopkg.in/yaml.v3"})
+	c.Assert(report.Checks["store"], DeepEquals, &healthCheck{OK: true})
+	c.Assert(report.Checks["load"].OK, Equals, true)
+	c.Assert(report.Checks["certificates"], IsNil)
+	c.Assert(s.fetched, DeepEquals, []string{"https://github.com/go-yaml/yaml.git/info/refs?service=git-upload-pack"})
+
+	// The probe result is reused for a while, and so are cached refs.
+	s.failing = true
+	ready.probed = time.Now().Add(-readyProbeTTL)
+	code, _ = getHealth(c, ready)
+	c.Assert(code, Equals, 200)
+	c.Assert(s.fetched, HasLen, 1)
+
+	s.cache.Purge("")
+	code, _ = getHealth(c, ready)
+	c.Assert(code, Equals, 200)
+	c.Assert(s.fetched, HasLen, 1)
+
+	ready.probed = time.Now().Add(-readyProbeTTL)
+	code, report = getHealth(c, ready)
+	c.Assert(code, Equals, 503)
+	c.Assert(report.Status, Equals, healthFail)
+	c.Assert(report.Checks["upstream"].OK, Equals, false)
+	c.Assert(report.Checks["upstream"].Detail, Matches, "cannot resolve yaml.v3: error from GitHub: .*")
+}
+
+func (s *HealthSuite) TestReadyzProbeInProgress(c *C) {
+	started := make(chan bool)
+	release := make(chan bool)
+	ready := &readiness{resolver: resolver.New(resolver.Options{
+		Cache: s.cache,
+		Client: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			started <- true
+			<-release
+			return &http.Response{StatusCode: 200, Status: "200 OK", Body: ioutil.NopCloser(strings.NewReader("")), Request: req}, nil
+		})},
+	})}
+
+	done := make(chan *healthCheck)
+	go func() { done <- ready.checkUpstream(context.Background(), time.Now()) }()
+	<-started
+
+	// Checks don't wait for the probe in progress, nor start another one.
+	c.Assert(ready.checkUpstream(context.Background(), time.Now()), DeepEquals, &healthCheck{false, "first probe in progress"})
+	close(release)
+	c.Assert(<-done, DeepEquals, &healthCheck{true, "resolved gopkg.in/yaml.v3"})
+
+	// Once stale, the previous result is reported during the refresh.
+	s.cache.Purge("")
+	release = make(chan bool)
+	probed := time.Now().Add(readyProbeTTL)
+	go func() { done <- ready.checkUpstream(context.Background(), probed) }()
+	<-started
+	c.Assert(ready.checkUpstream(context.Background(), probed), DeepEquals, &healthCheck{true, "resolved gopkg.in/yaml.v3"})
+	close(release)
+	c.Assert(<-done, DeepEquals, &healthCheck{true, "resolved gopkg.in/yaml.v3"})
+}
+
+func (s *HealthSuite) TestReadyzStore(c *C) {
+	*dataFlag = filepath.Join(c.MkDir(), "missing")
+	code, report := getHealth(c, &readiness{resolver: s.resolver})
+	c.Assert(code, Equals, 503)
+	c.Assert(report.Checks["store"].OK, Equals, false)
+	c.Assert(report.Checks["store"].Detail, Matches, ".*no such file or directory")
+	c.Assert(report.Checks["upstream"].OK, Equals, true)
+
+	// The result is reused for a while.
+	ready := &readiness{resolver: s.resolver}
+	now := time.Now()
+	c.Assert(ready.checkStore(now).OK, Equals, false)
+	*dataFlag = c.MkDir()
+	c.Assert(ready.checkStore(now.Add(readyProbeTTL-time.Second)).OK, Equals, false)
+	c.Assert(ready.checkStore(now.Add(readyProbeTTL)).OK, Equals, true)
+}
+
+func (s *HealthSuite) TestReadyzCerts(c *C) {
+	cs := &CertsSuite{dir: c.MkDir()}
+	expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+	certFile, keyFile := cs.writeCert(c, "one", "gopkg.in", expiry)
+	var err error
+	certs, err = newCertManager(certFile, keyFile)
+	c.Assert(err, IsNil)
+
+	code, report := getHealth(c, &readiness{resolver: s.resolver})
+	c.Assert(code, Equals, 200)
+	c.Assert(report.Checks["certificates"], DeepEquals, &healthCheck{true, "expires " + expiry.UTC().Format(time.RFC3339)})
+
+	c.Assert(os.Remove(certFile), IsNil)
+	cs.writeCert(c, "one", "gopkg.in", time.Now().Add(-time.Minute))
+	c.Assert(certs.reload(), IsNil)
+	code, report = getHealth(c, &readiness{resolver: s.resolver})
+	c.Assert(code, Equals, 503)
+	c.Assert(report.Checks["certificates"].Detail, Matches, "TLS certificate .* expired at .*")
+}
+
+func (s *HealthSuite) TestReadyzLoad(c *C) {
+	defer func(slots chan struct{}, queued, queue int) {
+		uploadPackSlots, uploadPackQueued, *uploadPackQueueFlag = slots, queued, queue
+	}(uploadPackSlots, uploadPackQueued, *uploadPackQueueFlag)
+
+	uploadPackSlots = make(chan struct{}, 1)
+	*uploadPackQueueFlag = 1
+	c.Assert(checkLoad(), DeepEquals, &healthCheck{true, "0/1 upload-packs running, 0/1 queued"})
+
+	uploadPackSlots <- struct{}{}
+	uploadPackQueued = 1
+	c.Assert(checkLoad(), DeepEquals, &healthCheck{false, "1/1 upload-packs running, 1/1 queued"})
+}
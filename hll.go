@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+// hyperLogLog estimates the number of distinct values added to it, without
+// holding the values themselves. Registers are kept sparse until enough of
+// them are set, since most sketches only ever see a few values.
+type hyperLogLog struct {
+	sparse map[uint16]uint8
+	dense  []uint8
+}
+
+const (
+	hllPrecision = 10
+	hllRegisters = 1 << hllPrecision
+
+	// hllSparseMax is the number of registers set before switching to
+	// the dense representation.
+	hllSparseMax = hllRegisters / 8
+)
+
+// add adds the value to the sketch. Values are hashed with the secret key,
+// so only their hashes may be recovered from the registers, only partially,
+// and only tested against candidate values by those holding the key. Values
+// added with different keys are counted as distinct.
+func (h *hyperLogLog) add(key []byte, value string) {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	x := binary.BigEndian.Uint64(mac.Sum(nil))
+	index := uint16(x >> (64 - hllPrecision))
+	rank := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1))) + 1
+	h.set(index, rank)
+}
+
+func (h *hyperLogLog) set(index uint16, rank uint8) {
+	if h.dense != nil {
+		if rank > h.dense[index] {
+			h.dense[index] = rank
+		}
+		return
+	}
+	if h.sparse == nil {
+		h.sparse = make(map[uint16]uint8)
+	}
+	if rank > h.sparse[index] {
+		h.sparse[index] = rank
+	}
+	if len(h.sparse) > hllSparseMax {
+		h.dense = make([]uint8, hllRegisters)
+		for i, r := range h.sparse {
+			h.dense[i] = r
+		}
+		h.sparse = nil
+	}
+}
+
+// merge adds to h all the values added to other.
+func (h *hyperLogLog) merge(other *hyperLogLog) {
+	for i, r := range other.dense {
+		if r > 0 {
+			h.set(uint16(i), r)
+		}
+	}
+	for i, r := range other.sparse {
+		h.set(i, r)
+	}
+}
+
+// count returns the estimated number of distinct values added.
+func (h *hyperLogLog) count() int64 {
+	if h.dense == nil && len(h.sparse) == 0 {
+		return 0
+	}
+	const m = float64(hllRegisters)
+	sum := 0.0
+	zeros := 0
+	for i := 0; i < hllRegisters; i++ {
+		var r uint8
+		if h.dense != nil {
+			r = h.dense[i]
+		} else {
+			r = h.sparse[uint16(i)]
+		}
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	alpha := 0.7213 / (1 + 1.079/m)
+	estimate := alpha * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		// Linear counting is more accurate for small cardinalities.
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return int64(estimate + 0.5)
+}
+
+// MarshalJSON encodes the registers in base64, either as the dense list of
+// all registers or as (index, rank) triples of bytes for the ones set.
+func (h *hyperLogLog) MarshalJSON() ([]byte, error) {
+	var data []byte
+	if h.dense != nil {
+		data = h.dense
+	} else {
+		for i, r := range h.sparse {
+			data = append(data, byte(i>>8), byte(i), r)
+		}
+	}
+	return json.Marshal(base64.StdEncoding.EncodeToString(data))
+}
+
+func (h *hyperLogLog) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	*h = hyperLogLog{}
+	if len(data) == hllRegisters {
+		h.dense = data
+		return nil
+	}
+	if len(data)%3 != 0 {
+		return fmt.Errorf("invalid sketch length %d", len(data))
+	}
+	for i := 0; i < len(data); i += 3 {
+		index := uint16(data[i])<<8 | uint16(data[i+1])
+		if index >= hllRegisters {
+			return fmt.Errorf("invalid sketch register %d", index)
+		}
+		h.set(index, data[i+2])
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// The home page documents the service, and offers a search over the
+// package index, in HTML or in JSON with /search?q=<words>&format=json.
+// Its templates and assets are embedded from the site directory, and may
+// be overridden file by file with -site for deployments under other host
+// names.
+
+//go:embed site
+var embeddedSite embed.FS
+
+// sitePath is where the static assets are served. It can't clash with
+// package paths, which never start with an underscore.
+const sitePath = "/_site/"
+
+const maxSearchResults = 100
+
+var (
+	siteFiles      fs.FS
+	homeTemplate   *template.Template
+	searchTemplate *template.Template
+)
+
+// searchResults is the JSON response of /search?format=json.
+type searchResults struct {
+	Query   string       `json:"query"`
+	Results []indexEntry `json:"results"`
+}
+
+// siteData is provided to the home page templates.
+type siteData struct {
+	Host     string
+	Upstream string
+	Query    string
+	Results  []indexEntry
+}
+
+func loadSite() error {
+	embedded, err := fs.Sub(embeddedSite, "site")
+	if err != nil {
+		return err
+	}
+	siteFiles = embedded
+	if *siteFlag != "" {
+		siteFiles = overlayFS{os.DirFS(*siteFlag), embedded}
+	}
+	if homeTemplate, err = template.ParseFS(siteFiles, "layout.html", "home.html"); err != nil {
+		return fmt.Errorf("cannot parse home page template: %v", err)
+	}
+	if searchTemplate, err = template.ParseFS(siteFiles, "layout.html", "search.html"); err != nil {
+		return fmt.Errorf("cannot parse search page template: %v", err)
+	}
+	return nil
+}
+
+// overlayFS opens files from top, or from bottom if they're not in top.
+type overlayFS struct {
+	top    fs.FS
+	bottom fs.FS
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	f, err := o.top.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return o.bottom.Open(name)
+	}
+	return f, err
+}
+
+// serveSite serves the home page, the search page, and their assets, and
+// reports whether the request was for one of them.
+func serveSite(resp http.ResponseWriter, req *http.Request) bool {
+	data := &siteData{Host: *hostFlag, Upstream: githubCom}
+	switch {
+	case req.URL.Path == "/":
+		if *homeFlag != "" {
+			resp.Header().Set("Location", *homeFlag)
+			resp.WriteHeader(http.StatusTemporaryRedirect)
+			return true
+		}
+		renderSite(resp, homeTemplate, data)
+	case req.URL.Path == "/search":
+		data.Query = strings.TrimSpace(req.FormValue("q"))
+		data.Results = searchIndex(data.Query, maxSearchResults)
+		if req.FormValue("format") == "json" {
+			sendJSON(resp, http.StatusOK, &searchResults{data.Query, data.Results})
+			return true
+		}
+		renderSite(resp, searchTemplate, data)
+	case strings.HasPrefix(req.URL.Path, sitePath):
+		static, err := fs.Sub(siteFiles, "static")
+		if err != nil {
+			http.NotFound(resp, req)
+			return true
+		}
+		resp.Header().Set("Cache-Control", "public, max-age=3600")
+		http.StripPrefix(sitePath, http.FileServer(http.FS(static))).ServeHTTP(resp, req)
+	default:
+		return false
+	}
+	return true
+}
+
+func renderSite(resp http.ResponseWriter, t *template.Template, data *siteData) {
+	var buf bytes.Buffer
+	if err := t.ExecuteTemplate(&buf, "layout", data); err != nil {
+		log.Printf("Error executing site template: %v", err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		resp.Write([]byte("Cannot render page."))
+		return
+	}
+	resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+	resp.Write(buf.Bytes())
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&HomeSuite{})
+
+type HomeSuite struct{}
+
+func (s *HomeSuite) SetUpTest(c *C) {
+	c.Assert(loadSite(), IsNil)
+}
+
+func (s *HomeSuite) TearDownTest(c *C) {
+	*hostFlag = gopkgIn
+	*homeFlag = ""
+	*siteFlag = ""
+	resetIndex()
+}
+
+func siteGet(path string) (*httptest.ResponseRecorder, bool) {
+	resp := httptest.NewRecorder()
+	ok := serveSite(resp, httptest.NewRequest("GET", path, nil))
+	return resp, ok
+}
+
+func (s *HomeSuite) TestHome(c *C) {
+	*hostFlag = "go.example.com"
+	resp, ok := siteGet("/")
+	c.Assert(ok, Equals, true)
+	c.Assert(resp.Code, Equals, http.StatusOK)
+	c.Assert(resp.Header().Get("Content-Type"), Equals, "text/html; charset=utf-8")
+	c.Assert(resp.Body.String(), Matches, `(?s).*go\.example\.com/pkg\.v3.*`)
+	c.Assert(resp.Body.String(), Not(Matches), `(?s).*gopkg\.in.*`)
+}
+
+func (s *HomeSuite) TestHomeRedirect(c *C) {
+	*homeFlag = "https://example.com/docs"
+	resp, ok := siteGet("/")
+	c.Assert(ok, Equals, true)
+	c.Assert(resp.Code, Equals, http.StatusTemporaryRedirect)
+	c.Assert(resp.Header().Get("Location"), Equals, "https://example.com/docs")
+}
+
+func (s *HomeSuite) TestSearch(c *C) {
+	observe(c, "/yaml.v2", 2)
+	observe(c, "/check.v1", 1)
+
+	resp, ok := siteGet("/search?q=check")
+	c.Assert(ok, Equals, true)
+	c.Assert(resp.Code, Equals, http.StatusOK)
+	c.Assert(resp.Body.String(), Matches, `(?s).*href="https://gopkg\.in/check\.v1".*`)
+	c.Assert(resp.Body.String(), Not(Matches), `(?s).*yaml.*`)
+
+	resp, _ = siteGet("/search?q=gopkg&format=json")
+	c.Assert(resp.Code, Equals, http.StatusOK)
+	c.Assert(resp.Header().Get("Content-Type"), Equals, "application/json")
+	var result searchResults
+	c.Assert(json.Unmarshal(resp.Body.Bytes(), &result), IsNil)
+	c.Assert(result.Query, Equals, "gopkg")
+	c.Assert(result.Results, HasLen, 2)
+	c.Assert(result.Results[0].Majors, DeepEquals, []indexMajor{{"v2", "gopkg.in/yaml.v2"}})
+	c.Assert(result.Results[0].Requests, Equals, int64(2))
+}
+
+func (s *HomeSuite) TestAssets(c *C) {
+	resp, ok := siteGet("/_site/style.css")
+	c.Assert(ok, Equals, true)
+	c.Assert(resp.Code, Equals, http.StatusOK)
+	c.Assert(resp.Header().Get("Content-Type"), Matches, "text/css.*")
+	c.Assert(resp.Header().Get("Cache-Control"), Equals, "public, max-age=3600")
+
+	resp, ok = siteGet("/_site/missing.css")
+	c.Assert(ok, Equals, true)
+	c.Assert(resp.Code, Equals, http.StatusNotFound)
+}
+
+func (s *HomeSuite) TestOverride(c *C) {
+	dir := c.MkDir()
+	content := `{{define "content"}}<p>Welcome to {{.Host}}.</p>{{end}}`
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "home.html"), []byte(content), 0644), IsNil)
+	*siteFlag = dir
+	c.Assert(loadSite(), IsNil)
+
+	resp, _ := siteGet("/")
+	c.Assert(resp.Code, Equals, http.StatusOK)
+	c.Assert(resp.Body.String(), Matches, `(?s).*/_site/style\.css.*<p>Welcome to gopkg\.in\.</p>.*`)
+
+	// Files not overridden still come from the built-in site.
+	resp, _ = siteGet("/_site/style.css")
+	c.Assert(resp.Code, Equals, http.StatusOK)
+
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "home.html"), []byte(`{{define "content"}`), 0644), IsNil)
+	c.Assert(loadSite(), ErrorMatches, "cannot parse home page template: .*")
+}
+
+func (s *HomeSuite) TestOtherPaths(c *C) {
+	for _, path := range []string{"/yaml.v2", "/foo/bar.v1/info/refs", "/searching"} {
+		_, ok := siteGet(path)
+		c.Assert(ok, Equals, false, Commentf("%s", path))
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"go/doc"
+	"go/parser"
+	"go/token"
+	"io"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/niemeyer/gopkg/resolver"
+)
+
+// The package index records every package resolved successfully, with the
+// major versions requested, the synopsis of its package documentation, and
+// how often and how recently it was requested. It backs the search on
+// the home page, where results are ranked by request volume.
+
+const indexFile = "index.json"
+
+const (
+	// indexSaveInterval is how often the index is persisted, on top of
+	// when the server shuts down.
+	indexSaveInterval = 10 * time.Minute
+
+	// synopsisTTL is how long a synopsis is used for before being
+	// obtained again.
+	synopsisTTL = 7 * 24 * time.Hour
+
+	// synopsisInterval is the pace at which synopses are obtained in
+	// the background, so that anonymous GitHub API limits aren't exceeded.
+	synopsisInterval = time.Minute
+
+	// synopsisFiles is how many Go files are looked at for the package
+	// documentation before falling back to the repository description.
+	synopsisFiles = 10
+
+	// synopsisFileSize is how much of each Go file is read for it.
+	synopsisFileSize = 1 << 20
+)
+
+// githubAPI is where repository contents and descriptions are obtained from.
+var githubAPI = "https://api.github.com"
+
+type indexEntry struct {
+	Repo     string       `json:"repo"` // GitHub root the package is served from.
+	Majors   []indexMajor `json:"majors"`
+	Synopsis string       `json:"synopsis,omitempty"`
+	Requests int64        `json:"requests"`
+	LastSeen time.Time    `json:"last_seen"`
+
+	SynopsisTime time.Time `json:"synopsis_time"` // When Synopsis was last obtained or attempted.
+
+	queued bool // Waiting in indexSynopses.
+}
+
+// indexMajor is a major version of an indexed package, and its root path.
+type indexMajor struct {
+	Version string `json:"version"`
+	Path    string `json:"path"`
+}
+
+var (
+	index     = make(map[string]*indexEntry) // Original GitHub root => entry
+	indexLock sync.RWMutex
+
+	// indexSynopses holds the keys of entries to obtain synopses for.
+	indexSynopses = make(chan string, 1000)
+)
+
+var indexSize = newGauge("gopkg_index_packages", "Number of packages in the search index.")
+
+func loadIndex() error {
+	indexLock.Lock()
+	defer indexLock.Unlock()
+	if err := loadState(indexFile, &index); err != nil {
+		return err
+	}
+	indexSize.set(float64(len(index)))
+	return nil
+}
+
+func saveIndex() {
+	indexLock.RLock()
+	defer indexLock.RUnlock()
+	if err := saveState(indexFile, index); err != nil {
+		log.Printf("Error saving package index: %v", err)
+	}
+}
+
+// indexLoop saves the index every indexSaveInterval, and obtains the
+// missing or outdated synopses at the pace of synopsisInterval.
+func indexLoop() {
+	save := time.Tick(indexSaveInterval)
+	fetch := time.Tick(synopsisInterval)
+	for {
+		select {
+		case <-save:
+			saveIndex()
+		case <-fetch:
+			select {
+			case key := <-indexSynopses:
+				refreshSynopsis(context.Background(), key)
+			default:
+			}
+		}
+	}
+}
+
+// indexObserve records that repo was requested at now.
+func indexObserve(repo *resolver.Repo, now time.Time) {
+	key := repo.Original().GitHubRoot()
+	major := repo.MajorVersion
+	major.Minor = -1
+	major.Patch = -1
+
+	indexLock.Lock()
+	defer indexLock.Unlock()
+	e, ok := index[key]
+	if !ok {
+		e = &indexEntry{}
+		index[key] = e
+		indexSize.set(float64(len(index)))
+	}
+	e.Repo = repo.GitHubRoot()
+	e.Requests++
+	e.LastSeen = now
+	e.addMajor(major.String(), repo.Original().GopkgRoot())
+	e.queueSynopsis(key, now)
+}
+
+// queueSynopsis queues the entry at key for its synopsis to be obtained in
+// the background, if it's missing or outdated. indexLock must be held.
+func (e *indexEntry) queueSynopsis(key string, now time.Time) {
+	if !e.queued && now.Sub(e.SynopsisTime) > synopsisTTL {
+		select {
+		case indexSynopses <- key:
+			e.queued = true
+		default:
+		}
+	}
+}
+
+// addMajor adds the major version unless known, keeping the latest first.
+func (e *indexEntry) addMajor(version, path string) {
+	for _, m := range e.Majors {
+		if m.Version == version {
+			return
+		}
+	}
+	e.Majors = append(e.Majors, indexMajor{version, path})
+	sort.Slice(e.Majors, func(i, j int) bool {
+		vi, _ := resolver.ParseVersion(e.Majors[i].Version)
+		vj, _ := resolver.ParseVersion(e.Majors[j].Version)
+		return vj.Less(vi)
+	})
+}
+
+// packageSynopsis returns the synopsis of repo known to the index, queueing
+// it to be obtained again in the background if it's outdated.
+func packageSynopsis(repo *resolver.Repo) string {
+	key := repo.Original().GitHubRoot()
+	indexLock.Lock()
+	defer indexLock.Unlock()
+	e, ok := index[key]
+	if !ok {
+		return ""
+	}
+	e.queueSynopsis(key, time.Now())
+	return e.Synopsis
+}
+
+// refreshSynopsis obtains again the synopsis for the entry at key.
+func refreshSynopsis(ctx context.Context, key string) (string, error) {
+	indexLock.RLock()
+	e, ok := index[key]
+	var root string
+	if ok {
+		root = e.Repo
+	}
+	indexLock.RUnlock()
+	if !ok {
+		return "", nil
+	}
+	synopsis, err := fetchSynopsis(ctx, root)
+	indexLock.Lock()
+	e.queued = false
+	e.SynopsisTime = time.Now()
+	if err == nil {
+		e.Synopsis = synopsis
+	} else {
+		synopsis = e.Synopsis
+	}
+	indexLock.Unlock()
+	if err != nil {
+		log.Printf("Cannot obtain synopsis of %s: %v", root, err)
+	}
+	return synopsis, err
+}
+
+// fetchSynopsis obtains the synopsis of the package at the GitHub root
+// provided, from the documentation in its Go files at the default branch,
+// or from the repository description if there's no documentation.
+func fetchSynopsis(ctx context.Context, root string) (string, error) {
+	name := strings.TrimPrefix(root, githubCom+"/")
+	var files []struct {
+		Name        string `json:"name"`
+		Type        string `json:"type"`
+		DownloadURL string `json:"download_url"`
+	}
+	if err := getGitHubAPI(ctx, "/repos/"+name+"/contents/", &files); err != nil {
+		return "", err
+	}
+	// The documentation is conventionally in doc.go, when there's one.
+	sort.SliceStable(files, func(i, j int) bool { return files[i].Name == "doc.go" && files[j].Name != "doc.go" })
+	n := 0
+	for _, f := range files {
+		if f.Type != "file" || !strings.HasSuffix(f.Name, ".go") || strings.HasSuffix(f.Name, "_test.go") {
+			continue
+		}
+		if n++; n > synopsisFiles {
+			break
+		}
+		synopsis, err := fetchPackageDoc(ctx, f.DownloadURL)
+		if err != nil {
+			return "", err
+		}
+		if synopsis != "" {
+			return synopsis, nil
+		}
+	}
+
+	var info struct {
+		Description string `json:"description"`
+	}
+	if err := getGitHubAPI(ctx, "/repos/"+name, &info); err != nil {
+		return "", err
+	}
+	return info.Description, nil
+}
+
+// fetchPackageDoc returns the synopsis of the package documentation in the
+// Go file at url, if any.
+func fetchPackageDoc(ctx context.Context, url string) (string, error) {
+	resp, err := getContext(ctx, url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("cannot obtain %s: %s", url, resp.Status)
+	}
+	src, err := ioutil.ReadAll(io.LimitReader(resp.Body, synopsisFileSize))
+	if err != nil {
+		return "", err
+	}
+	f, err := parser.ParseFile(token.NewFileSet(), "", src, parser.PackageClauseOnly|parser.ParseComments)
+	if err != nil || f.Doc == nil || strings.HasSuffix(f.Name.Name, "_test") {
+		// Broken files are for the go tool to report, not the index.
+		return "", nil
+	}
+	return new(doc.Package).Synopsis(f.Doc.Text()), nil
+}
+
+// getGitHubAPI obtains path from the GitHub API and decodes the result
+// into v.
+func getGitHubAPI(ctx context.Context, path string, v interface{}) error {
+	resp, err := getContext(ctx, githubAPI+path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("GitHub API returned %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("cannot decode GitHub API response: %v", err)
+	}
+	return nil
+}
+
+// searchIndex returns up to max entries holding every word in q in their
+// paths, repository, or synopsis, the most requested first.
+func searchIndex(q string, max int) []indexEntry {
+	words := strings.Fields(strings.ToLower(q))
+	if len(words) == 0 {
+		return nil
+	}
+	var results []indexEntry
+	indexLock.RLock()
+	for _, e := range index {
+		if e.matches(words) {
+			result := *e
+			result.Majors = append([]indexMajor(nil), e.Majors...)
+			results = append(results, result)
+		}
+	}
+	indexLock.RUnlock()
+	sort.Slice(results, func(i, j int) bool {
+		ri, rj := &results[i], &results[j]
+		if ri.Requests != rj.Requests {
+			return ri.Requests > rj.Requests
+		}
+		return ri.Repo < rj.Repo
+	})
+	if len(results) > max {
+		results = results[:max]
+	}
+	return results
+}
+
+func (e *indexEntry) matches(words []string) bool {
+	text := []string{e.Repo, e.Synopsis}
+	for _, m := range e.Majors {
+		text = append(text, m.Path)
+	}
+	all := strings.ToLower(strings.Join(text, " "))
+	for _, word := range words {
+		if !strings.Contains(all, word) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/niemeyer/gopkg/resolver"
+)
+
+var _ = Suite(&IndexSuite{})
+
+type IndexSuite struct {
+	transport http.RoundTripper
+	requested []string
+	status    int
+	files     map[string]string // Name => content of files in every repository.
+}
+
+func (s *IndexSuite) SetUpTest(c *C) {
+	s.requested = nil
+	s.status = http.StatusOK
+	s.files = nil
+	s.transport = httpClient.Transport
+	httpClient.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		s.requested = append(s.requested, req.URL.String())
+		var body []byte
+		switch {
+		case req.URL.Host == "raw.githubusercontent.com":
+			body = []byte(s.files[path.Base(req.URL.Path)])
+		case strings.HasSuffix(req.URL.Path, "/contents/"):
+			type file struct {
+				Name        string `json:"name"`
+				Type        string `json:"type"`
+				DownloadURL string `json:"download_url"`
+			}
+			repo := strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, "/repos/"), "/contents/")
+			files := []file{{Name: "subpkg", Type: "dir"}}
+			for name := range s.files {
+				files = append(files, file{name, "file", "https://raw.githubusercontent.com/" + repo + "/HEAD/" + name})
+			}
+			sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+			body, _ = json.Marshal(files)
+		default:
+			body = []byte(`{"description": "The ` + path.Base(req.URL.Path) + ` repository."}`)
+		}
+		return &http.Response{
+			StatusCode: s.status,
+			Status:     fmt.Sprintf("%d %s", s.status, http.StatusText(s.status)),
+			Body:       ioutil.NopCloser(bytes.NewReader(body)),
+			Request:    req,
+		}, nil
+	})
+}
+
+func (s *IndexSuite) TearDownTest(c *C) {
+	httpClient.Transport = s.transport
+	*dataFlag = ""
+	resetIndex()
+}
+
+func resetIndex() {
+	indexLock.Lock()
+	index = make(map[string]*indexEntry)
+	indexLock.Unlock()
+	for len(indexSynopses) > 0 {
+		<-indexSynopses
+	}
+}
+
+// observe records n requests for the package at path.
+func observe(c *C, path string, n int) *resolver.Repo {
+	repo, err := resolver.ParsePath(path)
+	c.Assert(err, IsNil)
+	for i := 0; i < n; i++ {
+		indexObserve(repo, time.Now())
+	}
+	return repo
+}
+
+func (s *IndexSuite) TestObserve(c *C) {
+	observe(c, "/yaml.v2", 1)
+	observe(c, "/yaml.v3/subpkg", 2)
+	observe(c, "/yaml.v1-unstable", 1)
+	observe(c, "/user/v1/pkg", 1)
+
+	indexLock.RLock()
+	defer indexLock.RUnlock()
+	c.Assert(index, HasLen, 2)
+	e := index["github.com/go-yaml/yaml"]
+	c.Assert(e.Repo, Equals, "github.com/go-yaml/yaml")
+	c.Assert(e.Requests, Equals, int64(4))
+	c.Assert(time.Since(e.LastSeen) < time.Minute, Equals, true)
+	c.Assert(e.Majors, DeepEquals, []indexMajor{
+		{"v3", "gopkg.in/yaml.v3"},
+		{"v2", "gopkg.in/yaml.v2"},
+		{"v1-unstable", "gopkg.in/yaml.v1-unstable"},
+	})
+	c.Assert(index["github.com/user/pkg"].Majors, DeepEquals, []indexMajor{{"v1", "gopkg.in/user/v1/pkg"}})
+
+	// Each new entry is queued once for its synopsis.
+	c.Assert(len(indexSynopses), Equals, 2)
+}
+
+func (s *IndexSuite) TestRedirected(c *C) {
+	repo, err := resolver.ParsePath("/old/pkg.v1")
+	c.Assert(err, IsNil)
+	repo.RedirUser, repo.RedirName = repo.User, repo.Name
+	repo.User, repo.Name = "new", "pkg"
+	indexObserve(repo, time.Now())
+
+	results := searchIndex("old", 10)
+	c.Assert(results, HasLen, 1)
+	c.Assert(results[0].Repo, Equals, "github.com/new/pkg")
+	c.Assert(results[0].Majors, DeepEquals, []indexMajor{{"v1", "gopkg.in/old/pkg.v1"}})
+}
+
+func (s *IndexSuite) TestSearch(c *C) {
+	observe(c, "/yaml.v2", 1)
+	observe(c, "/niemeyer/yaml.v3", 3)
+	observe(c, "/check.v1", 2)
+	_, err := refreshSynopsis(context.Background(), "github.com/go-check/check")
+	c.Assert(err, IsNil)
+
+	paths := func(results []indexEntry) []string {
+		var paths []string
+		for _, e := range results {
+			paths = append(paths, e.Majors[0].Path)
+		}
+		return paths
+	}
+	c.Assert(paths(searchIndex("YAML", 10)), DeepEquals, []string{"gopkg.in/niemeyer/yaml.v3", "gopkg.in/yaml.v2"})
+	c.Assert(paths(searchIndex("yaml", 1)), DeepEquals, []string{"gopkg.in/niemeyer/yaml.v3"})
+	c.Assert(paths(searchIndex("gopkg", 10)), DeepEquals, []string{"gopkg.in/niemeyer/yaml.v3", "gopkg.in/check.v1", "gopkg.in/yaml.v2"})
+	c.Assert(paths(searchIndex("the check repository", 10)), DeepEquals, []string{"gopkg.in/check.v1"})
+	c.Assert(paths(searchIndex("check yaml", 10)), HasLen, 0)
+	c.Assert(paths(searchIndex(" ", 10)), HasLen, 0)
+}
+
+func (s *IndexSuite) TestSynopsis(c *C) {
+	repo := observe(c, "/yaml.v2", 1)
+
+	// Synopses are obtained in the background only.
+	c.Assert(packageSynopsis(repo), Equals, "")
+	c.Assert(s.requested, HasLen, 0)
+	c.Assert(<-indexSynopses, Equals, "github.com/go-yaml/yaml")
+	synopsis, err := refreshSynopsis(context.Background(), "github.com/go-yaml/yaml")
+	c.Assert(err, IsNil)
+	c.Assert(synopsis, Equals, "The yaml repository.")
+	c.Assert(s.requested, DeepEquals, []string{
+		"https://api.github.com/repos/go-yaml/yaml/contents/",
+		"https://api.github.com/repos/go-yaml/yaml",
+	})
+
+	// They're reused until outdated, and then served while obtained again.
+	c.Assert(packageSynopsis(repo), Equals, "The yaml repository.")
+	c.Assert(len(indexSynopses), Equals, 0)
+	indexLock.Lock()
+	index["github.com/go-yaml/yaml"].SynopsisTime = time.Now().Add(-synopsisTTL)
+	indexLock.Unlock()
+	c.Assert(packageSynopsis(repo), Equals, "The yaml repository.")
+	c.Assert(packageSynopsis(repo), Equals, "The yaml repository.")
+	c.Assert(len(indexSynopses), Equals, 1)
+	c.Assert(s.requested, HasLen, 2)
+
+	s.status = http.StatusForbidden
+	synopsis, err = refreshSynopsis(context.Background(), <-indexSynopses)
+	c.Assert(err, ErrorMatches, "GitHub API returned 403 Forbidden")
+	c.Assert(synopsis, Equals, "The yaml repository.")
+
+	// Failures aren't retried until outdated either.
+	c.Assert(packageSynopsis(repo), Equals, "The yaml repository.")
+	c.Assert(len(indexSynopses), Equals, 0)
+}
+
+func (s *IndexSuite) TestSynopsisDoc(c *C) {
+	observe(c, "/yaml.v2", 1)
+	s.files = map[string]string{
+		"README.md":    "# Package yaml is not Go.\n",
+		"decode.go":    "// Copyright notice.\n\npackage yaml\n",
+		"doc.go":       "// Package yaml implements YAML support for the Go language.\n//\n// More details.\npackage yaml\n",
+		"yaml_test.go": "// Package yaml_test tests it.\npackage yaml_test\n",
+	}
+
+	// The package documentation is preferred, looking at doc.go first.
+	synopsis, err := refreshSynopsis(context.Background(), "github.com/go-yaml/yaml")
+	c.Assert(err, IsNil)
+	c.Assert(synopsis, Equals, "Package yaml implements YAML support for the Go language.")
+	c.Assert(s.requested, DeepEquals, []string{
+		"https://api.github.com/repos/go-yaml/yaml/contents/",
+		"https://raw.githubusercontent.com/go-yaml/yaml/HEAD/doc.go",
+	})
+
+	// Go files without it are skipped, up to the repository description.
+	delete(s.files, "doc.go")
+	s.requested = nil
+	synopsis, err = refreshSynopsis(context.Background(), "github.com/go-yaml/yaml")
+	c.Assert(err, IsNil)
+	c.Assert(synopsis, Equals, "The yaml repository.")
+	c.Assert(s.requested, DeepEquals, []string{
+		"https://api.github.com/repos/go-yaml/yaml/contents/",
+		"https://raw.githubusercontent.com/go-yaml/yaml/HEAD/decode.go",
+		"https://api.github.com/repos/go-yaml/yaml",
+	})
+}
+
+func (s *IndexSuite) TestPersist(c *C) {
+	*dataFlag = c.MkDir()
+	observe(c, "/yaml.v2", 3)
+	saveIndex()
+	resetIndex()
+
+	c.Assert(loadIndex(), IsNil)
+	results := searchIndex("yaml", 10)
+	c.Assert(results, HasLen, 1)
+	c.Assert(results[0].Requests, Equals, int64(3))
+	c.Assert(results[0].Majors, DeepEquals, []indexMajor{{"v2", "gopkg.in/yaml.v2"}})
+	c.Assert(indexSize.values[""], Equals, float64(1))
+}
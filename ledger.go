@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/niemeyer/gopkg/resolver"
+)
+
+const (
+	movedTagsWarn = "warn" // Serve moved tags as they are now, but report them.
+	movedTagsPin  = "pin"  // Keep serving the hash first seen for moved tags.
+)
+
+// tagRecord holds the hash first seen for a version tag in a repository,
+// and the hash it was last seen moved to, if any.
+type tagRecord struct {
+	Root      string    `json:"root"`
+	Ref       string    `json:"ref"`
+	Hash      string    `json:"hash"`
+	FirstSeen time.Time `json:"first-seen"`
+	MovedHash string    `json:"moved-hash,omitempty"`
+	MovedSeen time.Time `json:"moved-seen"`
+}
+
+// ledgerEvent is a line in the append-only ledger file.
+type ledgerEvent struct {
+	Event string    `json:"event"` // "seen", "moved" or "restored"
+	Root  string    `json:"root"`
+	Ref   string    `json:"ref"`
+	Hash  string    `json:"hash"`
+	Time  time.Time `json:"time"`
+}
+
+const ledgerFile = "ledger.jsonl"
+
+var ledger = make(map[string]map[string]*tagRecord)
+var ledgerLock sync.RWMutex
+
+var (
+	ledgerTags      = newGauge("gopkg_ledger_tags", "Number of version tags recorded in the ledger.")
+	ledgerMovedTags = newCounter("gopkg_ledger_moved_tags_total", "Number of version tag moves observed.")
+)
+
+func loadLedger() error {
+	ledgerLock.Lock()
+	defer ledgerLock.Unlock()
+	err := loadStateLines(ledgerFile, func(line []byte) error {
+		var e ledgerEvent
+		if err := json.Unmarshal(line, &e); err != nil {
+			return err
+		}
+		switch e.Event {
+		case "seen":
+			recordTag(e.Root, e.Ref, e.Hash, e.Time)
+		case "moved":
+			if r := ledger[e.Root][e.Ref]; r != nil {
+				r.MovedHash = e.Hash
+				r.MovedSeen = e.Time
+			}
+		case "restored":
+			if r := ledger[e.Root][e.Ref]; r != nil {
+				r.MovedHash = ""
+				r.MovedSeen = time.Time{}
+			}
+		default:
+			return fmt.Errorf("unknown ledger event %q", e.Event)
+		}
+		return nil
+	})
+	return err
+}
+
+// recordTag must be called with ledgerLock held.
+func recordTag(root, ref, hash string, seen time.Time) {
+	refs, ok := ledger[root]
+	if !ok {
+		refs = make(map[string]*tagRecord)
+		ledger[root] = refs
+	}
+	refs[ref] = &tagRecord{
+		Root:      root,
+		Ref:       ref,
+		Hash:      hash,
+		FirstSeen: seen,
+	}
+	ledgerTags.add(1)
+	noteVersion(root, ref, hash, seen)
+}
+
+// trackTags records in the ledger the hashes of all version tags advertised
+// in the refs data obtained for root, and reports tags that moved since they
+// were first seen, until they are moved back. Under the pin policy the returned data has moved tags
+// pointing back to the hashes first seen for them.
+func trackTags(root string, data []byte) ([]byte, error) {
+	var events []interface{}
+	var pinned []byte
+
+	ledgerLock.Lock()
+	// Taken with the lock held so that tags are noted in the order seen.
+	now := time.Now()
+	err := resolver.ScanRefs(bytes.NewReader(data), func(line resolver.RefLine) {
+		if !strings.HasPrefix(line.Name, "refs/tags/v") {
+			return
+		}
+		r := ledger[root][line.Name]
+		if r == nil {
+			recordTag(root, line.Name, line.Hash, now)
+			events = append(events, &ledgerEvent{"seen", root, line.Name, line.Hash, now})
+			return
+		}
+		if r.Hash == line.Hash {
+			if r.MovedHash != "" {
+				log.Printf("Version tag %s at %s restored to %s", line.Name, root, r.Hash)
+				r.MovedHash = ""
+				r.MovedSeen = time.Time{}
+				events = append(events, &ledgerEvent{"restored", root, line.Name, line.Hash, now})
+			}
+			return
+		}
+		if r.MovedHash != line.Hash {
+			log.Printf("Version tag %s at %s moved from %s to %s", line.Name, root, r.Hash, line.Hash)
+			r.MovedHash = line.Hash
+			r.MovedSeen = now
+			ledgerMovedTags.inc()
+			events = append(events, &ledgerEvent{"moved", root, line.Name, line.Hash, now})
+		}
+		if *movedTagsFlag == movedTagsPin {
+			if pinned == nil {
+				pinned = append([]byte(nil), data...)
+			}
+			copy(pinned[line.HashOffset:], r.Hash)
+		}
+	})
+	ledgerLock.Unlock()
+
+	if err := appendState(ledgerFile, events...); err != nil {
+		log.Printf("Error saving ledger: %v", err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if pinned != nil {
+		return pinned, nil
+	}
+	return data, nil
+}
+
+// movedTag returns the ledger record for the tag of version v at root if
+// that tag moved since it was first seen, or nil otherwise.
+func movedTag(root string, v resolver.Version) *tagRecord {
+	if !v.IsValid() {
+		return nil
+	}
+	ledgerLock.RLock()
+	defer ledgerLock.RUnlock()
+	ref := "refs/tags/" + v.String()
+	for _, name := range []string{ref, ref + "^{}"} {
+		if r := ledger[root][name]; r != nil && r.MovedHash != "" {
+			moved := *r
+			return &moved
+		}
+	}
+	return nil
+}
+
+// movedTagList returns all tags that moved since first seen, sorted by root and ref.
+func movedTagList() []tagRecord {
+	ledgerLock.RLock()
+	defer ledgerLock.RUnlock()
+	var list []tagRecord
+	for _, refs := range ledger {
+		for _, r := range refs {
+			if r.MovedHash != "" {
+				list = append(list, *r)
+			}
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Root != list[j].Root {
+			return list[i].Root < list[j].Root
+		}
+		return list[i].Ref < list[j].Ref
+	})
+	return list
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/niemeyer/gopkg/resolver"
+)
+
+var _ = Suite(&LedgerSuite{})
+
+type LedgerSuite struct{}
+
+func (s *LedgerSuite) TearDownTest(c *C) {
+	*movedTagsFlag = movedTagsWarn
+	ledgerLock.Lock()
+	ledger = make(map[string]map[string]*tagRecord)
+	feed = nil
+	feedByRoot = make(map[string][]*feedVersion)
+	ledgerLock.Unlock()
+}
+
+// reflines returns a refs advertisement with the provided reference lines.
+func reflines(lines ...string) string {
+	var buf bytes.Buffer
+	buf.WriteString("001e# service=git-upload-pack\n0000")
+	for _, l := range lines {
+		buf.WriteString(fmt.Sprintf("%04x%s\n", len(l)+5, l))
+	}
+	buf.WriteString("0000")
+	return buf.String()
+}
+
+const ledgerRoot = "github.com/user/repo"
+
+var ledgerOriginal = reflines(
+	"00000000000000000000000000000000000hash1 HEAD",
+	"00000000000000000000000000000000000hash2 refs/heads/v1",
+	"00000000000000000000000000000000000hash3 refs/tags/v1.0.0",
+)
+
+var ledgerMoved = reflines(
+	"00000000000000000000000000000000000hash1 HEAD",
+	"00000000000000000000000000000000000hash4 refs/heads/v1",
+	"00000000000000000000000000000000000hash5 refs/tags/v1.0.0",
+)
+
+func (s *LedgerSuite) TestWarn(c *C) {
+	data, err := trackTags(ledgerRoot, []byte(ledgerOriginal))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, ledgerOriginal)
+	c.Assert(movedTag(ledgerRoot, resolver.Version{Major: 1, Minor: 0, Patch: 0}), IsNil)
+
+	data, err = trackTags(ledgerRoot, []byte(ledgerMoved))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, ledgerMoved)
+
+	r := movedTag(ledgerRoot, resolver.Version{Major: 1, Minor: 0, Patch: 0})
+	c.Assert(r, NotNil)
+	c.Assert(r.Hash, Equals, "00000000000000000000000000000000000hash3")
+	c.Assert(r.MovedHash, Equals, "00000000000000000000000000000000000hash5")
+	c.Assert(r.MovedSeen.IsZero(), Equals, false)
+
+	list := movedTagList()
+	c.Assert(list, HasLen, 1)
+	c.Assert(list[0].Ref, Equals, "refs/tags/v1.0.0")
+}
+
+func (s *LedgerSuite) TestRestored(c *C) {
+	*dataFlag = c.MkDir()
+	defer func() { *dataFlag = "" }()
+
+	for _, data := range []string{ledgerOriginal, ledgerMoved, ledgerOriginal} {
+		_, err := trackTags(ledgerRoot, []byte(data))
+		c.Assert(err, IsNil)
+	}
+	c.Assert(movedTag(ledgerRoot, resolver.Version{Major: 1, Minor: 0, Patch: 0}), IsNil)
+	c.Assert(movedTagList(), HasLen, 0)
+
+	// The restore is persisted as well.
+	s.TearDownTest(c)
+	c.Assert(loadLedger(), IsNil)
+	c.Assert(ledger[ledgerRoot]["refs/tags/v1.0.0"], NotNil)
+	c.Assert(movedTagList(), HasLen, 0)
+}
+
+func (s *LedgerSuite) TestPin(c *C) {
+	*movedTagsFlag = movedTagsPin
+
+	_, err := trackTags(ledgerRoot, []byte(ledgerOriginal))
+	c.Assert(err, IsNil)
+	data, err := trackTags(ledgerRoot, []byte(ledgerMoved))
+	c.Assert(err, IsNil)
+
+	// Branches move freely, but the tag is pinned.
+	c.Assert(string(data), Equals, reflines(
+		"00000000000000000000000000000000000hash1 HEAD",
+		"00000000000000000000000000000000000hash4 refs/heads/v1",
+		"00000000000000000000000000000000000hash3 refs/tags/v1.0.0",
+	))
+
+	changed, _, err := resolver.ChangeRefs(data, resolver.Version{Major: 1, Minor: 0, Patch: -1}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(string(changed), Equals, reflines(
+		"00000000000000000000000000000000000hash3 HEAD",
+		"00000000000000000000000000000000000hash3 refs/heads/master",
+		"00000000000000000000000000000000000hash4 refs/heads/v1",
+		"00000000000000000000000000000000000hash3 refs/tags/v1.0.0",
+	))
+}
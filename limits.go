@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Upload-pack requests proxied to GitHub may hold a connection for minutes,
+// so they may be limited in number with -max-upload-packs globally and
+// -max-upload-packs-per-ip per client IP. Requests over the global limit
+// wait in a bounded queue for a while before being turned away. Everything
+// else, such as go-get and info/refs requests, is cheap and never waits
+// behind them.
+
+var (
+	uploadPackSlots   chan struct{}          // Nil when there's no global limit.
+	uploadPackClients = make(map[string]int) // client IP => requests running or queued
+	uploadPackQueued  int
+	uploadPackLock    sync.Mutex
+)
+
+var (
+	uploadPackRunning  = newGauge("gopkg_upload_pack_running", "Number of upload-pack requests being proxied.")
+	uploadPackWaiting  = newGauge("gopkg_upload_pack_queued", "Number of upload-pack requests waiting for a free slot.")
+	uploadPackRejected = newCounter("gopkg_upload_pack_rejected_total", "Number of upload-pack requests turned away.", "reason")
+)
+
+// Reasons for turning an upload-pack request away.
+const (
+	rejectPerIP     = "per-ip"
+	rejectQueueFull = "queue-full"
+	rejectTimeout   = "queue-timeout"
+	rejectCanceled  = "canceled"
+)
+
+func setupUploadPackLimits() {
+	if *maxUploadPacksFlag > 0 {
+		uploadPackSlots = make(chan struct{}, *maxUploadPacksFlag)
+	}
+}
+
+// acquireUploadPack waits for the upload-pack request to be allowed to
+// proceed, and returns a function that must be called once it's done.
+// If the request is turned away, the returned function is nil and the
+// reason is reported.
+func acquireUploadPack(req *http.Request) (release func(), reason string) {
+	ip := clientIP(req)
+	uploadPackLock.Lock()
+	if max := *maxUploadPacksPerIPFlag; max > 0 && uploadPackClients[ip] >= max {
+		uploadPackLock.Unlock()
+		uploadPackRejected.inc(rejectPerIP)
+		return nil, rejectPerIP
+	}
+	uploadPackClients[ip]++
+	uploadPackLock.Unlock()
+
+	releaseClient := func() {
+		uploadPackLock.Lock()
+		if uploadPackClients[ip]--; uploadPackClients[ip] == 0 {
+			delete(uploadPackClients, ip)
+		}
+		uploadPackLock.Unlock()
+	}
+	if uploadPackSlots == nil {
+		return releaseClient, ""
+	}
+	release = func() {
+		<-uploadPackSlots
+		uploadPackRunning.set(float64(len(uploadPackSlots)))
+		releaseClient()
+	}
+
+	select {
+	case uploadPackSlots <- struct{}{}:
+		uploadPackRunning.set(float64(len(uploadPackSlots)))
+		return release, ""
+	default:
+	}
+
+	uploadPackLock.Lock()
+	if uploadPackQueued >= *uploadPackQueueFlag {
+		uploadPackLock.Unlock()
+		releaseClient()
+		uploadPackRejected.inc(rejectQueueFull)
+		return nil, rejectQueueFull
+	}
+	uploadPackQueued++
+	uploadPackWaiting.set(float64(uploadPackQueued))
+	uploadPackLock.Unlock()
+	defer func() {
+		uploadPackLock.Lock()
+		uploadPackQueued--
+		uploadPackWaiting.set(float64(uploadPackQueued))
+		uploadPackLock.Unlock()
+	}()
+
+	timer := time.NewTimer(*uploadPackQueueTimeoutFlag)
+	defer timer.Stop()
+	select {
+	case uploadPackSlots <- struct{}{}:
+		uploadPackRunning.set(float64(len(uploadPackSlots)))
+		return release, ""
+	case <-timer.C:
+		reason = rejectTimeout
+	case <-req.Context().Done():
+		reason = rejectCanceled
+	}
+	releaseClient()
+	uploadPackRejected.inc(reason)
+	return nil, reason
+}
+
+// sendOverloaded tells the client to retry the upload-pack request later.
+func sendOverloaded(resp http.ResponseWriter, reason string) {
+	retry := *uploadPackQueueTimeoutFlag
+	if retry < time.Second {
+		retry = time.Second
+	}
+	resp.Header().Set("Retry-After", strconv.Itoa(int(retry/time.Second)))
+	resp.WriteHeader(http.StatusServiceUnavailable)
+	if reason == rejectPerIP {
+		resp.Write([]byte(fmt.Sprintf("Too many concurrent fetches from your address (limit is %d); please retry later.", *maxUploadPacksPerIPFlag)))
+	} else {
+		resp.Write([]byte("Too many concurrent fetches; please retry later."))
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&LimitsSuite{})
+
+type LimitsSuite struct {
+	restore []func()
+}
+
+func (s *LimitsSuite) SetUpTest(c *C) {
+	s.restore = []func(){
+		func(v int) func() { return func() { *maxUploadPacksFlag = v } }(*maxUploadPacksFlag),
+		func(v int) func() { return func() { *maxUploadPacksPerIPFlag = v } }(*maxUploadPacksPerIPFlag),
+		func(v int) func() { return func() { *uploadPackQueueFlag = v } }(*uploadPackQueueFlag),
+		func(v time.Duration) func() { return func() { *uploadPackQueueTimeoutFlag = v } }(*uploadPackQueueTimeoutFlag),
+	}
+	*maxUploadPacksFlag = 2
+	*maxUploadPacksPerIPFlag = 1
+	*uploadPackQueueFlag = 1
+	*uploadPackQueueTimeoutFlag = 50 * time.Millisecond
+	setupUploadPackLimits()
+}
+
+func (s *LimitsSuite) TearDownTest(c *C) {
+	for _, restore := range s.restore {
+		restore()
+	}
+	uploadPackSlots = nil
+	uploadPackClients = make(map[string]int)
+}
+
+func uploadPackFrom(ip string) *http.Request {
+	req := httptest.NewRequest("POST", "/user/repo.v1/git-upload-pack", nil)
+	req.RemoteAddr = ip + ":1234"
+	return req
+}
+
+func (s *LimitsSuite) TestLimits(c *C) {
+	release1, reason := acquireUploadPack(uploadPackFrom("10.0.0.1"))
+	c.Assert(release1, NotNil)
+	c.Assert(reason, Equals, "")
+
+	// Per client IP.
+	release, reason := acquireUploadPack(uploadPackFrom("10.0.0.1"))
+	c.Assert(release, IsNil)
+	c.Assert(reason, Equals, rejectPerIP)
+
+	release2, _ := acquireUploadPack(uploadPackFrom("10.0.0.2"))
+	c.Assert(release2, NotNil)
+
+	// Queue times out.
+	release, reason = acquireUploadPack(uploadPackFrom("10.0.0.3"))
+	c.Assert(release, IsNil)
+	c.Assert(reason, Equals, rejectTimeout)
+
+	// Queued requests proceed once a slot is free, and the queue is bounded.
+	*uploadPackQueueTimeoutFlag = 5 * time.Second
+	done := make(chan func())
+	go func() {
+		release, _ := acquireUploadPack(uploadPackFrom("10.0.0.3"))
+		done <- release
+	}()
+	for {
+		uploadPackLock.Lock()
+		queued := uploadPackQueued
+		uploadPackLock.Unlock()
+		if queued == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	release, reason = acquireUploadPack(uploadPackFrom("10.0.0.4"))
+	c.Assert(release, IsNil)
+	c.Assert(reason, Equals, rejectQueueFull)
+
+	release1()
+	release3 := <-done
+	c.Assert(release3, NotNil)
+	release2()
+	release3()
+
+	c.Assert(uploadPackClients, HasLen, 0)
+	c.Assert(uploadPackSlots, HasLen, 0)
+}
+
+func (s *LimitsSuite) TestOverloaded(c *C) {
+	resp := httptest.NewRecorder()
+	sendOverloaded(resp, rejectQueueFull)
+	c.Assert(resp.Code, Equals, http.StatusServiceUnavailable)
+	c.Assert(resp.Header().Get("Retry-After"), Equals, "1")
+}
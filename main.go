@@ -3,38 +3,92 @@ package main
 import (
 	"bytes"
 	"crypto/tls"
-	"errors"
 	"flag"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
-	"regexp"
-	"strconv"
+	"os/signal"
 	"strings"
-	"sync"
-	"text/template"
+	"syscall"
 	"time"
 
-	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/crypto/acme"
+
+	"github.com/niemeyer/gopkg/resolver"
 )
 
 var (
 	httpFlag  = flag.String("http", ":8080", "Serve HTTP at given address")
 	httpsFlag = flag.String("https", "", "Serve HTTPS at given address")
-	certFlag  = flag.String("cert", "", "Use the provided TLS certificate")
-	keyFlag   = flag.String("key", "", "Use the provided TLS key")
+	certFlag  = flag.String("cert", "", "Use the provided TLS certificates, comma-separated and picked by server name")
+	keyFlag   = flag.String("key", "", "Use the provided TLS keys, comma-separated in the order of -cert")
 	acmeFlag  = flag.String("acme", "", "Auto-request TLS certs and store in given directory")
+	dataFlag  = flag.String("data", "", "Persist service state in given directory")
+	hostFlag  = flag.String("host", gopkgIn, "Serve packages under given host name")
+	homeFlag  = flag.String("home", "", "Redirect requests for / to given URL instead of serving the built-in home page")
+	siteFlag  = flag.String("site", "", "Override the built-in home page templates and assets with the files in given directory")
+
+	certReloadFlag = flag.Duration("cert-reload", time.Minute, "Interval between checks for changes to the -cert and -key files")
+
+	acmeHTTPFlag        = flag.String("acme-http", ":80", "Answer ACME HTTP challenges at given address")
+	acmeEmailFlag       = flag.String("acme-email", "gustavo@niemeyer.net", "Contact email for the ACME account")
+	acmeHostsFlag       = flag.String("acme-hosts", "localhost,gopkg.in,p1.gopkg.in,p2.gopkg.in,p3.gopkg.in", `Comma-separated hosts to request certificates for, where "*" matches letters, digits and dashes within a label`)
+	acmeKeyTypeFlag     = flag.String("acme-key-type", keyTypeECDSA, `Certificate key type: "ecdsa", with an RSA fallback for older clients, or "rsa"`)
+	acmeRenewBeforeFlag = flag.Duration("acme-renew-before", 30*24*time.Hour, "Renew certificates this long before they expire")
+	acmeDirectoryFlag   = flag.String("acme-directory", acme.LetsEncryptURL, "URL of the ACME directory to request certificates from")
+	acmeCAFlag          = flag.String("acme-ca", "", "Trust the PEM certificates in given file when talking to the ACME directory")
+
+	filterRefsFlag    = flag.Bool("filter-refs", false, "Advertise only the refs matching the requested major version")
+	restrictWantsFlag = flag.Bool("restrict-wants", false, "Only serve packs for refs matching the requested major version")
+	tlogKeyFlag       = flag.String("tlog-key", "", "Sign transparency log tree heads with the note signer key in given file")
+	movedTagsFlag     = flag.String("moved-tags", movedTagsWarn, `Policy for version tags moved since first seen: "warn" or "pin"`)
+	blockedPageFlag   = flag.String("blocked-page", "", "Use the template file at given path to explain blocked packages")
+	statsDaysFlag     = flag.Int("stats-days", 90, "Number of days download statistics are kept for")
+
+	maxRequestFlag             = flag.Int64("max-upload-pack-request", 10<<20, "Maximum size in bytes of upload-pack request bodies")
+	maxResponseFlag            = flag.Int64("max-upload-pack-response", 4<<30, "Maximum size in bytes of upload-pack responses from GitHub, or 0 for no limit")
+	maxUploadPacksFlag         = flag.Int("max-upload-packs", 0, "Maximum number of upload-pack requests proxied at once, or 0 for no limit")
+	maxUploadPacksPerIPFlag    = flag.Int("max-upload-packs-per-ip", 0, "Maximum number of upload-pack requests proxied at once per client IP, or 0 for no limit")
+	uploadPackQueueFlag        = flag.Int("upload-pack-queue", 200, "Maximum number of upload-pack requests waiting for a free slot")
+	uploadPackQueueTimeoutFlag = flag.Duration("upload-pack-queue-timeout", 15*time.Second, "Maximum time upload-pack requests wait for a free slot")
+
+	packCacheFlag      = flag.String("pack-cache", "", "Cache packs of fresh clones in given directory")
+	packCacheSizeFlag  = flag.Int64("pack-cache-size", 10<<30, "Maximum size in bytes of the pack cache")
+	bundlesFlag        = flag.String("bundles", "", "Build git bundles for popular packages in given directory")
+	bundleCountFlag    = flag.Int("bundle-count", 100, "Number of popular packages to build git bundles for")
+	bundleIntervalFlag = flag.Duration("bundle-interval", time.Hour, "Interval between git bundle updates")
+	mirrorFlag         = flag.String("mirror", "", "Serve the dumb HTTP protocol from a local mirror in given directory")
+	mirrorSizeFlag     = flag.Int64("mirror-size", 10<<30, "Maximum size in bytes of the local mirror")
+
+	trustedProxiesFlag = flag.String("trusted-proxies", "", "Trust client addresses reported by proxies in given comma-separated CIDRs")
+	proxyProtocolFlag  = flag.Bool("proxy-protocol", false, "Expect a PROXY protocol header on every connection to the public listeners")
+	allowFlag          = flag.String("allow", "", "Only serve clients in given comma-separated CIDRs")
+	denyFlag           = flag.String("deny", "", "Refuse clients in given comma-separated CIDRs")
+	rateMetaFlag       = flag.Float64("rate-meta", 0, "Requests per second allowed per client IP for pages and refs, or 0 for no limit")
+	rateMetaBurstFlag  = flag.Int("rate-meta-burst", 50, "Number of requests per client IP for pages and refs allowed in a burst")
+	ratePacksFlag      = flag.Float64("rate-packs", 0, "Requests per second allowed per client IP for packs, or 0 for no limit")
+	ratePacksBurstFlag = flag.Int("rate-packs-burst", 10, "Number of requests per client IP for packs allowed in a burst")
+
+	adminFlag      = flag.String("admin", "", "Serve the /admin/ API at given address instead of the public listeners (loopback only without -admin-token)")
+	adminTokenFlag = flag.String("admin-token", "", "Require given bearer token for the /admin/ API")
+
+	otlpEndpointFlag    = flag.String("otlp-endpoint", "", "Export traces with OTLP over HTTP to given URL, such as http://localhost:4318")
+	traceSampleFlag     = flag.Float64("trace-sample", 1, "Fraction of requests traced, whatever the caller asks for")
+	tracePropagateFlag  = flag.String("trace-propagate", "", "Pass the trace context on to given comma-separated hosts when requesting them")
+	readyProbeFlag      = flag.String("ready-probe", "yaml.v3", "Resolve the package at given gopkg.in path to check readiness at /readyz, or nothing if empty")
+	shutdownTimeoutFlag = flag.Duration("shutdown-timeout", 5*time.Minute, "Maximum time to drain requests in flight when shutting down")
 )
 
 var httpClient = &http.Client{
-	Timeout: 10 * time.Second,
+	Timeout:   10 * time.Second,
+	Transport: tracingTransport{},
 }
 
 var bulkClient = &http.Client{
-	Timeout: 5 * time.Minute,
+	Timeout:   5 * time.Minute,
+	Transport: tracingTransport{},
 }
 
 func newServer() *http.Server {
@@ -54,11 +108,26 @@ func main() {
 func run() error {
 	flag.Parse()
 
-	http.HandleFunc("/", handler)
+	if err := loadSite(); err != nil {
+		return err
+	}
+
+	http.Handle("/", newHandler())
+	for _, path := range []string{"/tlog/key", "/tlog/latest", "/tlog/lookup/", "/tlog/tile/"} {
+		http.HandleFunc(path, tlogHandler)
+	}
+	if *adminFlag == "" && *adminTokenFlag != "" {
+		http.HandleFunc("/admin/", adminHandler)
+	}
 
 	if *httpFlag == "" && *httpsFlag == "" {
 		return fmt.Errorf("must provide -http and/or -https")
 	}
+	if *adminFlag != "" {
+		if err := checkAdminAddr(*adminFlag); err != nil {
+			return err
+		}
+	}
 	if *acmeFlag != "" && *httpsFlag == "" {
 		return fmt.Errorf("cannot use -acme without -https")
 	}
@@ -69,7 +138,7 @@ func run() error {
 		return fmt.Errorf("-https -cert and -key must be used together")
 	}
 
-	ch := make(chan error, 2)
+	ch := make(chan error, 4)
 
 	if *acmeFlag != "" {
 		// So a potential error is seen upfront.
@@ -77,512 +146,396 @@ func run() error {
 			return err
 		}
 	}
+	if *dataFlag != "" {
+		if err := os.MkdirAll(*dataFlag, 0700); err != nil {
+			return err
+		}
+	}
+	if err := loadRedirects(); err != nil {
+		return err
+	}
+	if err := loadBlocklist(); err != nil {
+		return err
+	}
+	if *movedTagsFlag != movedTagsWarn && *movedTagsFlag != movedTagsPin {
+		return fmt.Errorf("-moved-tags must be %q or %q", movedTagsWarn, movedTagsPin)
+	}
+	if err := loadLedger(); err != nil {
+		return err
+	}
+	if err := loadTlog(); err != nil {
+		return err
+	}
+	if err := loadIndex(); err != nil {
+		return err
+	}
+	go indexLoop()
+	if err := loadStats(); err != nil {
+		return err
+	}
+	go statsLoop()
+	if err := loadPackCache(); err != nil {
+		return err
+	}
+	if err := loadBundles(); err != nil {
+		return err
+	}
+	if err := loadMirror(); err != nil {
+		return err
+	}
+	setupUploadPackLimits()
+	if err := setupRateLimits(); err != nil {
+		return err
+	}
+	if err := setupTracing(); err != nil {
+		return err
+	}
+	if *bundlesFlag != "" {
+		go bundleLoop()
+	}
+	if *blockedPageFlag != "" {
+		if err := loadBlockedTemplate(*blockedPageFlag); err != nil {
+			return err
+		}
+	}
 
-	if *httpFlag != "" && (*httpsFlag == "" || *acmeFlag == "") {
-		server := newServer()
-		server.Addr = *httpFlag
+	if err := loadCaches(); err != nil {
+		return err
+	}
+	if err := inheritListeners(); err != nil {
+		return err
+	}
+
+	var servers []*http.Server
+	serve := func(server *http.Server, l net.Listener, tls bool) {
+		servers = append(servers, server)
 		go func() {
-			ch <- server.ListenAndServe()
+			var err error
+			if tls {
+				err = server.ServeTLS(l, "", "")
+			} else {
+				err = server.Serve(l)
+			}
+			if err != http.ErrServerClosed {
+				ch <- err
+			}
 		}()
 	}
+
+	if *adminFlag != "" {
+		l, err := listen("admin", *adminFlag)
+		if err != nil {
+			return err
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/admin/", adminHandler)
+		server := newServer()
+		server.Handler = mux
+		serve(server, l, false)
+	}
+
+	if *httpFlag != "" && (*httpsFlag == "" || *acmeFlag == "") {
+		l, err := listenPublic("http", *httpFlag)
+		if err != nil {
+			return err
+		}
+		server := newServer()
+		server.Handler = limitHandler(http.DefaultServeMux)
+		serve(server, l, false)
+	}
 	if *httpsFlag != "" {
+		l, err := listenPublic("https", *httpsFlag)
+		if err != nil {
+			return err
+		}
 		server := newServer()
-		server.Addr = *httpsFlag
-		if *acmeFlag != "" {
-			m := autocert.Manager{
-				ForceRSA:    true,
-				Prompt:      autocert.AcceptTOS,
-				Cache:       autocert.DirCache(*acmeFlag),
-				RenewBefore: 24 * 30 * time.Hour,
-				HostPolicy: autocert.HostWhitelist(
-					"localhost",
-					"gopkg.in",
-					"p1.gopkg.in",
-					"p2.gopkg.in",
-					"p3.gopkg.in",
-				),
-				Email: "gustavo@niemeyer.net",
+		server.Handler = limitHandler(http.DefaultServeMux)
+		if *acmeFlag == "" {
+			certs, err = newCertManager(*certFlag, *keyFlag)
+			if err != nil {
+				return err
 			}
+			go certs.watch(*certReloadFlag)
 			server.TLSConfig = &tls.Config{
-				GetCertificate: m.GetCertificate,
+				GetCertificate: certs.getCertificate,
+			}
+		} else {
+			m, getCertificate, err := newACMEManager()
+			if err != nil {
+				return err
+			}
+			server.TLSConfig = &tls.Config{
+				GetCertificate: getCertificate,
+			}
+			l80, err := listenPublic("acme", *acmeHTTPFlag)
+			if err != nil {
+				return err
 			}
-			go func() {
-				ch <- http.ListenAndServe(":80", m.HTTPHandler(nil))
-			}()
+			server80 := newServer()
+			server80.Handler = m.HTTPHandler(nil)
+			serve(server80, l80, false)
 		}
-		go func() {
-			ch <- server.ListenAndServeTLS(*certFlag, *keyFlag)
-		}()
-
+		serve(server, l, true)
 	}
-	return <-ch
-}
-
-var gogetTemplate = template.Must(template.New("").Parse(`
-<html>
-<head>
-<meta name="go-import" content="{{.Original.GopkgRoot}} git https://{{.Original.GopkgRoot}}">
-{{$root := .GitHubRoot}}{{$tree := .GitHubTree}}<meta name="go-source" content="{{.Original.GopkgRoot}} _ https://{{$root}}/tree/{{$tree}}{/dir} https://{{$root}}/blob/{{$tree}}{/dir}/{file}#L{line}">
-</head>
-<body>
-go get {{.GopkgPath}}
-</body>
-</html>
-`))
-
-// Repo represents a source code repository on GitHub.
-type Repo struct {
-	User         string
-	Name         string
-	SubPath      string
-	OldFormat    bool // The old /v2/pkg format.
-	MajorVersion Version
-
-	// FullVersion is the best version in AllVersions that matches MajorVersion.
-	// It defaults to InvalidVersion if there are no matches.
-	FullVersion Version
-
-	// AllVersions holds all versions currently available in the repository,
-	// either coming from branch names or from tag names. Version zero (v0)
-	// is only present in the list if it really exists in the repository.
-	AllVersions VersionList
-
-	// When there is a redirect in place, these are from the original request.
-	RedirUser string
-	RedirName string
-}
+	closeInherited()
+	notifyReady()
 
-// SetVersions records in the relevant fields the details about which
-// package versions are available in the repository.
-func (repo *Repo) SetVersions(all []Version) {
-	repo.AllVersions = all
-	for _, v := range repo.AllVersions {
-		if v.Major == repo.MajorVersion.Major && v.Unstable == repo.MajorVersion.Unstable && repo.FullVersion.Less(v) {
-			repo.FullVersion = v
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	for {
+		select {
+		case err := <-ch:
+			return err
+		case sig := <-sigs:
+			handedOff := false
+			if sig == syscall.SIGHUP {
+				// The new process must see the latest state, and
+				// is the only one writing it once serving.
+				saveCaches()
+				if err := handOffState(handOff); err != nil {
+					log.Printf("Cannot restart: %v", err)
+					continue
+				}
+				handedOff = true
+			}
+			log.Printf("Shutting down on %v; draining requests for up to %v", sig, *shutdownTimeoutFlag)
+			shutdown(servers, *shutdownTimeoutFlag)
+			if !handedOff {
+				saveCaches()
+			}
+			flushTraces(10 * time.Second)
+			return nil
 		}
 	}
 }
 
-// When there is a redirect in place, this will return the original repository
-// but preserving the data for the new repository.
-func (repo *Repo) Original() *Repo {
-	if repo.RedirName == "" {
-		return repo
-	}
-	orig := *repo
-	orig.User = repo.RedirUser
-	orig.Name = repo.RedirName
-	return &orig
-}
-
-type repoBase struct {
-	user string
-	name string
-}
-
-var redirect = map[repoBase]repoBase{
-	// https://github.com/go-fsnotify/fsnotify/issues/1
-	{"", "fsnotify"}: {"fsnotify", "fsnotify"},
-}
-
 const (
 	githubCom = "github.com"
 	gopkgIn   = "gopkg.in"
+	refsPath  = "/info/refs"
 )
 
-// GitHubRoot returns the repository root at GitHub, without a schema.
-func (repo *Repo) GitHubRoot() string {
-	if repo.User == "" {
-		return githubCom + "/go-" + repo.Name + "/" + repo.Name
-	} else {
-		return githubCom + "/" + repo.User + "/" + repo.Name
+// refsCache holds the refs advertisements obtained from GitHub.
+var refsCache = resolver.NewMemoryCache(time.Minute)
+
+// resolverOptions returns the options for resolving packages and forwarding
+// fetches for them, as configured by the flags.
+func resolverOptions() resolver.Options {
+	return resolver.Options{
+		Host:        *hostFlag,
+		Upstream:    githubCom,
+		Client:      httpClient,
+		PackClient:  bulkClient,
+		Cache:       refsCache,
+		MaxRequest:  *maxRequestFlag,
+		MaxResponse: *maxResponseFlag,
+		FilterRefs:  *filterRefsFlag,
+		Rename:      renameRepo,
+		Blocked:     blockedVersion,
+		Moved:       movedRepo,
+		CheckRefs:   checkRefs,
+		Serve:       serveResolved,
+		Error:       sendResolveError,
+		Trace:       traceStep,
 	}
 }
 
-// GitHubTree returns the repository tree name at GitHub for the selected version.
-func (repo *Repo) GitHubTree() string {
-	if repo.FullVersion == InvalidVersion {
-		return "master"
-	}
-	return repo.FullVersion.String()
-}
-
-// GopkgRoot returns the package root at gopkg.in, without a schema.
-func (repo *Repo) GopkgRoot() string {
-	return repo.GopkgVersionRoot(repo.MajorVersion)
-}
-
-// GopkgPath returns the package path at gopkg.in, without a schema.
-func (repo *Repo) GopkgPath() string {
-	return repo.GopkgVersionRoot(repo.MajorVersion) + repo.SubPath
-}
-
-// GopkgVersionRoot returns the package root in gopkg.in for the
-// provided version, without a schema.
-func (repo *Repo) GopkgVersionRoot(version Version) string {
-	version.Minor = -1
-	version.Patch = -1
-	v := version.String()
-	if repo.OldFormat {
-		if repo.User == "" {
-			return gopkgIn + "/" + v + "/" + repo.Name
-		} else {
-			return gopkgIn + "/" + repo.User + "/" + v + "/" + repo.Name
-		}
-	} else {
-		if repo.User == "" {
-			return gopkgIn + "/" + repo.Name + "." + v
+// newHandler returns the handler for the public listeners, which resolves
+// packages with the features of the gopkg.in service on top.
+func newHandler() http.Handler {
+	r := resolver.New(resolverOptions())
+	ready := &readiness{resolver: r}
+	traced := traceHandler(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if id := traceID(req.Context()); id != "" {
+			log.Printf("%s requested %s (trace %s)", clientIP(req), req.URL, id)
 		} else {
-			return gopkgIn + "/" + repo.User + "/" + repo.Name + "." + v
+			log.Printf("%s requested %s", clientIP(req), req.URL)
 		}
-	}
-}
 
-var patternOld = regexp.MustCompile(`^/(?:([a-z0-9][-a-z0-9]+)/)?((?:v0|v[1-9][0-9]*)(?:\.0|\.[1-9][0-9]*){0,2}(?:-unstable)?)/([a-zA-Z][-a-zA-Z0-9]*)(?:\.git)?((?:/[a-zA-Z][-a-zA-Z0-9]*)*)$`)
-var patternNew = regexp.MustCompile(`^/(?:([a-zA-Z0-9][-a-zA-Z0-9]+)/)?([a-zA-Z][-.a-zA-Z0-9]*)\.((?:v0|v[1-9][0-9]*)(?:\.0|\.[1-9][0-9]*){0,2}(?:-unstable)?)(?:\.git)?((?:/[a-zA-Z0-9][-.a-zA-Z0-9]*)*)$`)
-
-func handler(resp http.ResponseWriter, req *http.Request) {
-	if req.URL.Path == "/health-check" {
-		resp.Write([]byte("ok"))
-		return
-	}
-
-	log.Printf("%s requested %s", req.RemoteAddr, req.URL)
-
-	if req.URL.Path == "/" {
-		resp.Header().Set("Location", "https://labix.org/gopkg.in")
-		resp.WriteHeader(http.StatusTemporaryRedirect)
-		return
-	}
-
-	m := patternNew.FindStringSubmatch(req.URL.Path)
-	oldFormat := false
-	if m == nil {
-		m = patternOld.FindStringSubmatch(req.URL.Path)
-		if m == nil {
-			sendNotFound(resp, "Unsupported URL pattern; see the documentation at gopkg.in for details.")
+		switch {
+		case strings.HasPrefix(req.URL.Path, statsPath):
+			statsHandler(resp, req)
+			return
+		case strings.HasPrefix(req.URL.Path, feedPath):
+			feedHandler(resp, req)
+			return
+		case req.URL.Path == "/index":
+			feedIndexHandler(resp, req)
 			return
 		}
-		// "/v2/name" <= "/name.v2"
-		m[2], m[3] = m[3], m[2]
-		oldFormat = true
-	}
-
-	if strings.Contains(m[3], ".") {
-		sendNotFound(resp, "Import paths take the major version only (.%s instead of .%s); see docs at gopkg.in for the reasoning.",
-			m[3][:strings.Index(m[3], ".")], m[3])
-		return
-	}
-
-	repo := &Repo{
-		User:        m[1],
-		Name:        m[2],
-		SubPath:     m[4],
-		OldFormat:   oldFormat,
-		FullVersion: InvalidVersion,
-	}
-
-	if r, ok := redirect[repoBase{repo.User, repo.Name}]; ok {
-		repo.RedirUser, repo.RedirName = repo.User, repo.Name
-		repo.User, repo.Name = r.user, r.name
-	}
-
-	var ok bool
-	repo.MajorVersion, ok = parseVersion(m[3])
-	if !ok {
-		sendNotFound(resp, "Version %q improperly considered invalid; please warn the service maintainers.", m[3])
-		return
-	}
-
-	var changed []byte
-	var versions VersionList
-	original, err := fetchRefs(repo)
-	if err == ErrTimeout {
-		// Retry once.
-		httpClient.CloseIdleConnections()
-		original, err = fetchRefs(repo)
-	}
-	if err == nil {
-		changed, versions, err = changeRefs(original, repo.MajorVersion)
-		repo.SetVersions(versions)
-	}
-
-	switch err {
-	case nil:
-		// all ok
-	case ErrNoRepo:
-		sendNotFound(resp, "GitHub repository not found at https://%s", repo.GitHubRoot())
-		return
-	case ErrNoVersion:
-		major := repo.MajorVersion
-		suffix := ""
-		if major.Unstable {
-			major.Unstable = false
-			suffix = unstableSuffix
+		if serveSite(resp, req) {
+			return
 		}
-		v := major.String()
-		sendNotFound(resp, `GitHub repository at https://%s has no branch or tag "%s%s", "%s.N%s" or "%s.N.M%s"`, repo.GitHubRoot(), v, suffix, v, suffix, v, suffix)
-		return
-	default:
-		resp.WriteHeader(http.StatusBadGateway)
-		resp.Write([]byte(fmt.Sprintf("Cannot obtain refs from GitHub: %v", err)))
-		return
-	}
-
-	if repo.SubPath == "/git-upload-pack" {
-		proxyUploadPack(resp, req, repo)
-		return
-	}
-
-	if repo.SubPath == "/info/refs" {
-		resp.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
-		resp.Write(changed)
-		return
-	}
-
-	resp.Header().Set("Content-Type", "text/html")
-	if req.FormValue("go-get") == "1" {
-		// execute simple template when this is a go-get request
-		err = gogetTemplate.Execute(resp, repo)
-		if err != nil {
-			log.Printf("error executing go get template: %s\n", err)
+		r.ServeHTTP(resp, req)
+	}))
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/healthz":
+			healthzHandler(resp, req)
+			return
+		case "/readyz":
+			ready.ServeHTTP(resp, req)
+			return
 		}
-		return
-	}
-
-	renderPackagePage(resp, req, repo)
+		if req.URL.Path == "/health-check" {
+			if err := certs.check(time.Now()); err != nil {
+				resp.WriteHeader(http.StatusServiceUnavailable)
+				resp.Write([]byte(err.Error()))
+				return
+			}
+			resp.Write([]byte("ok"))
+			return
+		}
+		traced.ServeHTTP(resp, req)
+	})
 }
 
-func sendNotFound(resp http.ResponseWriter, msg string, args ...interface{}) {
-	if len(args) > 0 {
-		msg = fmt.Sprintf(msg, args...)
-	}
-	resp.WriteHeader(http.StatusNotFound)
-	resp.Write([]byte(msg))
+// repoBases returns the bases of the repository as originally requested and
+// as served, which are the same unless there's a redirect in place.
+func repoBases(repo *resolver.Repo) []repoBase {
+	orig := repo.Original()
+	return []repoBase{{orig.User, orig.Name}, {repo.User, repo.Name}}
 }
 
-const refsSuffix = ".git/info/refs?service=git-upload-pack"
-
-func proxyUploadPack(resp http.ResponseWriter, req *http.Request, repo *Repo) {
-	preq, err := http.NewRequest(req.Method, "https://"+repo.GitHubRoot()+"/git-upload-pack", req.Body)
-	if err != nil {
-		resp.WriteHeader(http.StatusInternalServerError)
-		resp.Write([]byte(fmt.Sprintf("Cannot create GitHub request: %v", err)))
-		return
-	}
-	preq.Header = req.Header
-	presp, err := bulkClient.Do(preq)
-	if err != nil {
-		resp.WriteHeader(http.StatusBadGateway)
-		resp.Write([]byte(fmt.Sprintf("Cannot obtain data pack from GitHub: %v", err)))
-		return
-	}
-	defer presp.Body.Close()
-
-	header := resp.Header()
-	for key, values := range presp.Header {
-		header[key] = values
-	}
-	resp.WriteHeader(presp.StatusCode)
+func renameRepo(user, name string) (newUser, newName string, ok bool) {
+	r, ok := lookupRedirect(repoBase{user, name})
+	return r.user, r.name, ok
+}
 
-	// Ignore errors. Dropped connections are usual and will make this fail.
-	_, err = io.Copy(resp, presp.Body)
-	if err != nil {
-		log.Printf("Error copying data from GitHub: %v", err)
+func blockedVersion(repo *resolver.Repo, v resolver.Version) bool {
+	for _, base := range repoBases(repo) {
+		if blockFor(base, v) != nil {
+			return true
+		}
 	}
+	return false
 }
 
-var (
-	ErrNoRepo    = errors.New("repository not found in GitHub")
-	ErrNoVersion = errors.New("version reference not found in GitHub")
-	ErrTimeout   = errors.New("timeout")
-)
-
-type refsCacheEntry struct {
-	refs      []byte
-	timestamp time.Time
+func movedRepo(repo *resolver.Repo, root string) {
+	discoverRedirect(repoBases(repo)[0], root)
 }
 
-var refsCache map[string]*refsCacheEntry = make(map[string]*refsCacheEntry)
-var refsCacheLock sync.RWMutex
-
-const refsCacheTTL = 1 * time.Minute
-
-func getRefs(root string) []byte {
-	refsCacheLock.RLock()
-	defer refsCacheLock.RUnlock()
-	if entry, ok := refsCache[root]; ok {
-		if time.Since(entry.timestamp) < refsCacheTTL {
-			return entry.refs
-		}
-	}
-	return nil
+func checkRefs(repo *resolver.Repo, refs []byte) ([]byte, error) {
+	return trackTags(repo.GitHubRoot(), refs)
 }
 
-func setRefs(root string, refs []byte) {
-	refsCacheLock.Lock()
-	defer refsCacheLock.Unlock()
-	if entry, ok := refsCache[root]; ok {
-		if time.Since(entry.timestamp) < refsCacheTTL {
-			return
+// sendResolveError explains that repo is blocked, if that's the reason it
+// can't be served.
+func sendResolveError(resp http.ResponseWriter, req *http.Request, repo *resolver.Repo, err error) bool {
+	if err != resolver.ErrBlocked {
+		return false
+	}
+	bases := repoBases(repo)
+	for _, base := range bases {
+		if e := blockFor(base, repo.MajorVersion); e != nil {
+			sendBlocked(resp, repo, e)
+			return true
 		}
 	}
-	refsCache[root] = &refsCacheEntry{
-		refs:      refs,
-		timestamp: time.Now(),
+	for _, base := range bases {
+		if e := blockWithin(base, repo.MajorVersion); e != nil {
+			sendBlocked(resp, repo, e)
+			return true
+		}
 	}
+	return false
 }
 
-func fetchRefs(repo *Repo) (data []byte, err error) {
-	if refs := getRefs(repo.GitHubRoot()); refs != nil {
-		return refs, nil
-	}
-
-	resp, err := httpClient.Get("https://" + repo.GitHubRoot() + refsSuffix)
-	if err != nil {
-		if os.IsTimeout(err) {
-			return nil, ErrTimeout
-		}
-		return nil, fmt.Errorf("cannot talk to GitHub: %w", err)
-	}
-	defer resp.Body.Close()
+// serveResolved serves the requests for a resolved package that go beyond
+// what the resolver package does by itself.
+func serveResolved(resp http.ResponseWriter, req *http.Request, res *resolver.Resolution) bool {
+	repo, sel, original := res.Repo, res.Selection, res.Refs
 
-	switch resp.StatusCode {
-	case 200:
-		// ok
-	case 401, 404:
-		return nil, ErrNoRepo
-	default:
-		return nil, fmt.Errorf("error from GitHub: %v", resp.Status)
+	now := time.Now()
+	indexObserve(repo, now)
+	switch {
+	case repo.SubPath == refsPath:
+		countDownload(req, repo, statsRefs, now)
+	case req.FormValue("go-get") == "1":
+		countDownload(req, repo, statsMeta, now)
 	}
 
-	data, err = ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("error reading from GitHub: %v", err)
+	if strings.HasPrefix(sel.Name, "refs/tags/") {
+		// Branches move by design, so only resolutions of tags are logged.
+		tlogObserve(repo.Original().GopkgRoot(), repo.FullVersion, sel.Hash)
 	}
-	setRefs(repo.GitHubRoot(), data)
-	return data, err
-}
-
-func changeRefs(data []byte, major Version) (changed []byte, versions VersionList, err error) {
-	var hlinei, hlinej int // HEAD reference line start/end
-	var mlinei, mlinej int // master reference line start/end
-	var vrefhash string
-	var vrefname string
-	var vrefv = InvalidVersion
-
-	// Record all available versions, the locations of the master and HEAD lines,
-	// and details of the best reference satisfying the requested major version.
-	versions = make([]Version, 0)
-	sdata := string(data)
-	for i, j := 0, 0; i < len(data); i = j {
-		size, err := strconv.ParseInt(sdata[i:i+4], 16, 32)
-		if err != nil {
-			return nil, nil, fmt.Errorf("cannot parse refs line size: %s", string(data[i:i+4]))
-		}
-		if size == 0 {
-			size = 4
-		}
-		j = i + int(size)
-		if j > len(sdata) {
-			return nil, nil, fmt.Errorf("incomplete refs data received from GitHub")
-		}
-		if sdata[0] == '#' {
-			continue
-		}
-
-		hashi := i + 4
-		hashj := strings.IndexByte(sdata[hashi:j], ' ')
-		if hashj < 0 || hashj != 40 {
-			continue
-		}
-		hashj += hashi
-
-		namei := hashj + 1
-		namej := strings.IndexAny(sdata[namei:j], "\n\x00")
-		if namej < 0 {
-			namej = j
-		} else {
-			namej += namei
-		}
 
-		name := sdata[namei:namej]
-
-		if name == "HEAD" {
-			hlinei = i
-			hlinej = j
-		}
-		if name == "refs/heads/master" {
-			mlinei = i
-			mlinej = j
+	var err error
+	if repo.SubPath == "/git-upload-pack" {
+		body, upr, ok := readUploadPack(resp, req)
+		if !ok {
+			return true
 		}
-
-		if strings.HasPrefix(name, "refs/heads/v") || strings.HasPrefix(name, "refs/tags/v") {
-			// Annotated tag is peeled off and overrides the same version just parsed.
-			name = strings.TrimSuffix(name, "^{}")
-
-			v, ok := parseVersion(name[strings.IndexByte(name, 'v'):])
-			if ok && major.Contains(v) && (v == vrefv || !vrefv.IsValid() || vrefv.Less(v)) {
-				vrefv = v
-				vrefhash = sdata[hashi:hashj]
-				vrefname = name
+		switch upr.Command {
+		case "ls-refs":
+			resp.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+			err = sel.WriteLsRefs(resp, bytes.NewReader(original), upr.Options)
+		case "bundle-uri":
+			resp.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+			err = writeBundleURI(resp, req, repo, sel.Hash)
+		default:
+			release, reason := acquireUploadPack(req)
+			if release == nil {
+				sendOverloaded(resp, reason)
+				return true
 			}
-			if ok {
-				versions = append(versions, v)
+			defer release()
+			countDownload(req, repo, statsPacks, now)
+			if upr.Haves == 0 {
+				noteClone(repo, sel.Hash)
 			}
+			proxyUploadPack(resp, req, res, body, upr)
 		}
+		if err != nil {
+			log.Printf("Error writing upload-pack response: %v", err)
+		}
+		return true
 	}
 
-	// If there were absolutely no versions, and v0 was requested, accept the master as-is.
-	if len(versions) == 0 && major == (Version{0, -1, -1, false}) {
-		return data, nil, nil
+	if *mirrorFlag != "" && isDumbPath(repo.SubPath) && req.FormValue("service") == "" && req.FormValue("go-get") != "1" {
+		hash := sel.Hash
+		if sel.Keep {
+			err = resolver.ScanRefs(bytes.NewReader(original), func(line resolver.RefLine) {
+				if line.Name == "HEAD" {
+					hash = line.Hash
+				}
+			})
+		}
+		if err != nil || hash == "" {
+			resp.WriteHeader(http.StatusBadGateway)
+			resp.Write([]byte(fmt.Sprintf("Cannot obtain refs from GitHub: %v", err)))
+			return true
+		}
+		sendDumb(resp, req, repo, sel.Name, hash)
+		return true
 	}
 
-	// If the file has no HEAD line or the version was not found, report as unavailable.
-	if hlinei == 0 || vrefhash == "" {
-		return nil, nil, ErrNoVersion
+	if repo.SubPath == refsPath && bundleURIWanted(req) {
+		resp.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
+		if err := writeCapabilities(resp); err != nil {
+			log.Printf("Error writing refs: %v", err)
+		}
+		return true
 	}
 
-	var buf bytes.Buffer
-	buf.Grow(len(data) + 256)
-
-	// Copy the header as-is.
-	buf.Write(data[:hlinei])
-
-	// Extract the original capabilities.
-	caps := ""
-	if i := strings.Index(sdata[hlinei:hlinej], "\x00"); i > 0 {
-		caps = strings.Replace(sdata[hlinei+i+1:hlinej-1], "symref=", "oldref=", -1)
+	if repo.SubPath == bundlePath && req.FormValue("go-get") != "1" {
+		sendBundle(resp, req, repo, sel.Hash)
+		return true
 	}
 
-	// Insert the HEAD reference line with the right hash and a proper symref capability.
-	var line string
-	if strings.HasPrefix(vrefname, "refs/heads/") {
-		if caps == "" {
-			line = fmt.Sprintf("%s HEAD\x00symref=HEAD:%s\n", vrefhash, vrefname)
-		} else {
-			line = fmt.Sprintf("%s HEAD\x00symref=HEAD:%s %s\n", vrefhash, vrefname, caps)
-		}
-	} else {
-		if caps == "" {
-			line = fmt.Sprintf("%s HEAD\n", vrefhash)
-		} else {
-			line = fmt.Sprintf("%s HEAD\x00%s\n", vrefhash, caps)
-		}
+	if repo.SubPath == refsPath || req.FormValue("go-get") == "1" {
+		return false
 	}
-	fmt.Fprintf(&buf, "%04x%s", 4+len(line), line)
 
-	// Insert the master reference line.
-	line = fmt.Sprintf("%s refs/heads/master\n", vrefhash)
-	fmt.Fprintf(&buf, "%04x%s", 4+len(line), line)
+	resp.Header().Set("Content-Type", "text/html")
+	renderPackagePage(resp, req, repo)
+	return true
+}
 
-	// Append the rest, dropping the original master line if necessary.
-	if mlinei > 0 {
-		buf.Write(data[hlinej:mlinei])
-		buf.Write(data[mlinej:])
-	} else {
-		buf.Write(data[hlinej:])
+func sendNotFound(resp http.ResponseWriter, msg string, args ...interface{}) {
+	if len(args) > 0 {
+		msg = fmt.Sprintf(msg, args...)
 	}
-
-	return buf.Bytes(), versions, nil
+	resp.WriteHeader(http.StatusNotFound)
+	resp.Write([]byte(msg))
 }
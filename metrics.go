@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// metric holds the values of a counter or gauge for every combination of
+// label values, and is exposed in the Prometheus text format.
+type metric struct {
+	kind   string
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+var metrics []*metric
+
+func newMetric(kind, name, help string, labels ...string) *metric {
+	m := &metric{
+		kind:   kind,
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]float64),
+	}
+	metrics = append(metrics, m)
+	return m
+}
+
+func newCounter(name, help string, labels ...string) *metric {
+	return newMetric("counter", name, help, labels...)
+}
+
+func newGauge(name, help string, labels ...string) *metric {
+	return newMetric("gauge", name, help, labels...)
+}
+
+func (m *metric) key(values []string) string {
+	if len(values) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s takes %d label values, got %d", m.name, len(m.labels), len(values)))
+	}
+	if len(values) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(values))
+	for i, value := range values {
+		pairs[i] = fmt.Sprintf("%s=%q", m.labels[i], value)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// add adds delta to the metric value with the provided label values.
+func (m *metric) add(delta float64, values ...string) {
+	key := m.key(values)
+	m.mu.Lock()
+	m.values[key] += delta
+	m.mu.Unlock()
+}
+
+// inc adds one to the metric value with the provided label values.
+func (m *metric) inc(values ...string) {
+	m.add(1, values...)
+}
+
+// set sets the metric value with the provided label values.
+func (m *metric) set(value float64, values ...string) {
+	key := m.key(values)
+	m.mu.Lock()
+	m.values[key] = value
+	m.mu.Unlock()
+}
+
+// writeMetrics writes all metrics to w in the Prometheus text format.
+func writeMetrics(w io.Writer) error {
+	for _, m := range metrics {
+		m.mu.Lock()
+		keys := make([]string, 0, len(m.values))
+		for key := range m.values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+		for _, key := range keys {
+			if err == nil {
+				_, err = fmt.Fprintf(w, "%s%s %g\n", m.name, key, m.values[key])
+			}
+		}
+		m.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
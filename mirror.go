@@ -0,0 +1,311 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/niemeyer/gopkg/packfile"
+	"github.com/niemeyer/gopkg/resolver"
+)
+
+// The mirror holds locally, for every commit served via the dumb HTTP
+// protocol, a pack with all objects reachable from it and the index of
+// that pack, as <mirror>/<commit>/pack-<checksum>.{pack,idx}. Dumb clients
+// see a repository with a single master branch pointing to that commit,
+// and the least recently used mirrored commits are removed when the mirror
+// grows beyond its size limit.
+
+type mirrorEntry struct {
+	name     string // Pack name, in the form pack-<checksum>.
+	size     int64
+	lastUsed time.Time
+}
+
+// mirrorBuild tracks a mirror entry being built.
+type mirrorBuild struct {
+	done  chan struct{}
+	entry *mirrorEntry
+	err   error
+}
+
+var (
+	mirror       = make(map[string]*mirrorEntry) // commit => entry
+	mirrorBuilds = make(map[string]*mirrorBuild)
+	mirrorSize   int64
+	mirrorLock   sync.Mutex
+)
+
+var (
+	mirrorPacks       = newGauge("gopkg_mirror_packs", "Number of commits held in the local mirror.")
+	mirrorBytes       = newGauge("gopkg_mirror_bytes", "Size in bytes of all packs and indexes in the local mirror.")
+	mirrorBuildsTotal = newCounter("gopkg_mirror_builds_total", "Number of commits mirrored from GitHub.", "result")
+)
+
+// loadMirror indexes the commits in the -mirror directory, considering
+// their modification time as the last time they were used.
+func loadMirror() error {
+	if *mirrorFlag == "" {
+		return nil
+	}
+	if err := os.MkdirAll(*mirrorFlag, 0700); err != nil {
+		return err
+	}
+	infos, err := ioutil.ReadDir(*mirrorFlag)
+	if err != nil {
+		return fmt.Errorf("cannot read mirror: %v", err)
+	}
+	mirrorLock.Lock()
+	defer mirrorLock.Unlock()
+	for _, info := range infos {
+		path := filepath.Join(*mirrorFlag, info.Name())
+		entry := loadMirrorEntry(path)
+		if entry == nil || !info.IsDir() || !isHash(info.Name()) {
+			// Left behind by an interrupted build.
+			os.RemoveAll(path)
+			continue
+		}
+		entry.lastUsed = info.ModTime()
+		mirror[info.Name()] = entry
+		mirrorSize += entry.size
+	}
+	evictMirror()
+	return nil
+}
+
+func loadMirrorEntry(dir string) *mirrorEntry {
+	packs, _ := filepath.Glob(filepath.Join(dir, "pack-*.pack"))
+	if len(packs) != 1 {
+		return nil
+	}
+	name := strings.TrimSuffix(filepath.Base(packs[0]), ".pack")
+	var size int64
+	for _, ext := range []string{".pack", ".idx"} {
+		info, err := os.Stat(filepath.Join(dir, name+ext))
+		if err != nil {
+			return nil
+		}
+		size += info.Size()
+	}
+	return &mirrorEntry{name: name, size: size}
+}
+
+func isHash(s string) bool {
+	if len(s) != 40 {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// mirrorCommit returns the mirror entry for the commit hash in the
+// repository at githubRoot, obtaining it from GitHub if necessary.
+func mirrorCommit(githubRoot, hash string) (mirrorEntry, error) {
+	mirrorLock.Lock()
+	if entry, ok := mirror[hash]; ok {
+		entry.lastUsed = time.Now()
+		mirrorLock.Unlock()
+		now := time.Now()
+		os.Chtimes(filepath.Join(*mirrorFlag, hash), now, now)
+		return *entry, nil
+	}
+	build, ok := mirrorBuilds[hash]
+	if ok {
+		mirrorLock.Unlock()
+		<-build.done
+		if build.err != nil {
+			return mirrorEntry{}, build.err
+		}
+		return *build.entry, nil
+	}
+	build = &mirrorBuild{done: make(chan struct{})}
+	mirrorBuilds[hash] = build
+	mirrorLock.Unlock()
+
+	build.entry, build.err = buildMirror(githubRoot, hash)
+
+	mirrorLock.Lock()
+	delete(mirrorBuilds, hash)
+	if build.err == nil {
+		mirror[hash] = build.entry
+		mirrorSize += build.entry.size
+		evictMirror()
+		mirrorBuildsTotal.inc("ok")
+	} else {
+		log.Printf("Error mirroring %s at %s: %v", githubRoot, hash, build.err)
+		mirrorBuildsTotal.inc("error")
+	}
+	mirrorLock.Unlock()
+	close(build.done)
+
+	if build.err != nil {
+		return mirrorEntry{}, build.err
+	}
+	return *build.entry, nil
+}
+
+// buildMirror obtains the pack for the commit hash in the repository at
+// githubRoot, and stores it in the mirror together with its index.
+func buildMirror(githubRoot, hash string) (*mirrorEntry, error) {
+	tmp, err := ioutil.TempDir(*mirrorFlag, hash+".tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	pack, err := fetchPack(githubRoot, hash)
+	if err != nil {
+		return nil, err
+	}
+	defer pack.Close()
+	f, err := os.Create(filepath.Join(tmp, "pack"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	size, err := io.Copy(f, pack)
+	if err != nil {
+		return nil, fmt.Errorf("cannot obtain data pack from GitHub: %v", err)
+	}
+
+	idx, err := os.Create(filepath.Join(tmp, "idx"))
+	if err != nil {
+		return nil, err
+	}
+	checksum, err := packfile.WriteIndex(idx, f, size)
+	if cerr := idx.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot index pack from GitHub: %v", err)
+	}
+	info, err := os.Stat(idx.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &mirrorEntry{
+		name:     fmt.Sprintf("pack-%x", checksum),
+		size:     size + info.Size(),
+		lastUsed: time.Now(),
+	}
+	for _, ext := range []string{"pack", "idx"} {
+		if err := os.Rename(filepath.Join(tmp, ext), filepath.Join(tmp, entry.name+"."+ext)); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.Rename(tmp, filepath.Join(*mirrorFlag, hash)); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// evictMirror removes the least recently used commits until the mirror
+// fits its size limit. It must be called with mirrorLock held.
+func evictMirror() {
+	if mirrorSize > *mirrorSizeFlag {
+		hashes := make([]string, 0, len(mirror))
+		for hash := range mirror {
+			hashes = append(hashes, hash)
+		}
+		sort.Slice(hashes, func(i, j int) bool {
+			return mirror[hashes[i]].lastUsed.Before(mirror[hashes[j]].lastUsed)
+		})
+		// The most recently used commit is kept even if it alone
+		// exceeds the limit, as it's likely being served right now.
+		for _, hash := range hashes[:len(hashes)-1] {
+			if mirrorSize <= *mirrorSizeFlag {
+				break
+			}
+			if err := os.RemoveAll(filepath.Join(*mirrorFlag, hash)); err != nil {
+				log.Printf("Error evicting mirrored commit: %v", err)
+				continue
+			}
+			mirrorSize -= mirror[hash].size
+			delete(mirror, hash)
+		}
+	}
+	mirrorPacks.set(float64(len(mirror)))
+	mirrorBytes.set(float64(mirrorSize))
+}
+
+// isDumbPath returns whether the repository sub-path is a dumb HTTP
+// protocol resource.
+func isDumbPath(subPath string) bool {
+	return subPath == refsPath || subPath == "/HEAD" || strings.HasPrefix(subPath, "/objects/")
+}
+
+// sendDumb serves the dumb HTTP protocol resource at repo.SubPath from the
+// mirror, with HEAD and master pointing to the commit hash, which is also
+// advertised under the selected reference name, if any.
+func sendDumb(resp http.ResponseWriter, req *http.Request, repo *resolver.Repo, name, hash string) {
+	switch subPath := repo.SubPath; {
+	case subPath == refsPath:
+		resp.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		resp.Header().Set("Cache-Control", "no-cache")
+		refs := []string{"refs/heads/master"}
+		if name != "" && name != refs[0] {
+			refs = append(refs, name)
+		}
+		sort.Strings(refs)
+		for _, ref := range refs {
+			fmt.Fprintf(resp, "%s\t%s\n", hash, ref)
+		}
+
+	case subPath == "/HEAD":
+		resp.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		resp.Header().Set("Cache-Control", "no-cache")
+		resp.Write([]byte("ref: refs/heads/master\n"))
+
+	case subPath == "/objects/info/packs":
+		entry, err := mirrorCommit(repo.GitHubRoot(), hash)
+		if err != nil {
+			resp.WriteHeader(http.StatusBadGateway)
+			resp.Write([]byte(fmt.Sprintf("Cannot mirror %s: %v", repo.GitHubRoot(), err)))
+			return
+		}
+		resp.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		resp.Header().Set("Cache-Control", "no-cache")
+		fmt.Fprintf(resp, "P %s.pack\n\n", entry.name)
+
+	case strings.HasPrefix(subPath, "/objects/pack/pack-"):
+		file := strings.TrimPrefix(subPath, "/objects/pack/")
+		ext := filepath.Ext(file)
+		contentType := map[string]string{
+			".pack": "application/x-git-packed-objects",
+			".idx":  "application/x-git-packed-objects-toc",
+		}[ext]
+		mirrorLock.Lock()
+		entry, ok := mirror[hash]
+		mirrorLock.Unlock()
+		if !ok || contentType == "" || entry.name+ext != file {
+			sendNotFound(resp, "Pack %s not available for %s", file, repo.Original().GopkgRoot())
+			return
+		}
+		f, err := os.Open(filepath.Join(*mirrorFlag, hash, file))
+		if err != nil {
+			sendNotFound(resp, "Pack %s not available for %s", file, repo.Original().GopkgRoot())
+			return
+		}
+		defer f.Close()
+		resp.Header().Set("Content-Type", contentType)
+		resp.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		http.ServeContent(resp, req, "", time.Time{}, f)
+
+	default:
+		// Loose objects and alternates. Everything is in the mirrored pack.
+		sendNotFound(resp, "Not found")
+	}
+}
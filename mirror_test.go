@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/niemeyer/gopkg/resolver"
+)
+
+var _ = Suite(&MirrorSuite{})
+
+type MirrorSuite struct {
+	transport http.RoundTripper
+	fetches   int
+}
+
+// blobPack returns a pack holding a single blob with the provided data.
+func blobPack(data string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("PACK\x00\x00\x00\x02\x00\x00\x00\x01")
+	buf.WriteByte(0x30 | byte(len(data)))
+	w := zlib.NewWriter(&buf)
+	w.Write([]byte(data))
+	w.Close()
+	sum := sha1.Sum(buf.Bytes())
+	return append(buf.Bytes(), sum[:]...)
+}
+
+var mirrorPack = blobPack("hello\n")
+
+const (
+	mirrorHash1 = "ce013625030ba8dba906f756967f9e9ca394464a"
+	mirrorHash2 = "3b18e512dba79e4c8300dd08aeb37f8e728b8dad"
+)
+
+func (s *MirrorSuite) SetUpTest(c *C) {
+	*mirrorFlag = c.MkDir()
+	s.fetches = 0
+	s.transport = bulkClient.Transport
+	bulkClient.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		s.fetches++
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(bytes.NewReader(append([]byte("0008NAK\n"), mirrorPack...))),
+			Request:    req,
+		}, nil
+	})
+}
+
+func (s *MirrorSuite) TearDownTest(c *C) {
+	bulkClient.Transport = s.transport
+	*mirrorFlag = ""
+	mirrorLock.Lock()
+	mirror = make(map[string]*mirrorEntry)
+	mirrorSize = 0
+	mirrorLock.Unlock()
+}
+
+func (s *MirrorSuite) dumb(path string) *httptest.ResponseRecorder {
+	repo := &resolver.Repo{User: "user", Name: "repo", MajorVersion: resolver.Version{Major: 1, Minor: -1, Patch: -1}, SubPath: path}
+	req := httptest.NewRequest("GET", "/user/repo.v1"+path, nil)
+	resp := httptest.NewRecorder()
+	sendDumb(resp, req, repo, "refs/tags/v1.0.0", mirrorHash1)
+	return resp
+}
+
+func (s *MirrorSuite) TestDumb(c *C) {
+	resp := s.dumb("/info/refs")
+	c.Assert(resp.Body.String(), Equals, mirrorHash1+"\trefs/heads/master\n"+mirrorHash1+"\trefs/tags/v1.0.0\n")
+	resp = s.dumb("/HEAD")
+	c.Assert(resp.Body.String(), Equals, "ref: refs/heads/master\n")
+	c.Assert(s.fetches, Equals, 0)
+
+	name := fmt.Sprintf("pack-%x", mirrorPack[len(mirrorPack)-20:])
+	resp = s.dumb("/objects/info/packs")
+	c.Assert(resp.Code, Equals, http.StatusOK)
+	c.Assert(resp.Body.String(), Equals, "P "+name+".pack\n\n")
+	c.Assert(s.fetches, Equals, 1)
+
+	resp = s.dumb("/objects/pack/" + name + ".pack")
+	c.Assert(resp.Code, Equals, http.StatusOK)
+	c.Assert(resp.Header().Get("Content-Type"), Equals, "application/x-git-packed-objects")
+	c.Assert(resp.Body.Bytes(), DeepEquals, mirrorPack)
+
+	resp = s.dumb("/objects/pack/" + name + ".idx")
+	c.Assert(resp.Code, Equals, http.StatusOK)
+	c.Assert(resp.Header().Get("Content-Type"), Equals, "application/x-git-packed-objects-toc")
+	c.Assert(resp.Body.String()[:8], Equals, "\xfftOc\x00\x00\x00\x02")
+
+	resp = s.dumb("/objects/pack/pack-0000000000000000000000000000000000000000.pack")
+	c.Assert(resp.Code, Equals, http.StatusNotFound)
+	resp = s.dumb("/objects/ce/013625030ba8dba906f756967f9e9ca394464a")
+	c.Assert(resp.Code, Equals, http.StatusNotFound)
+
+	// The mirror is reused, also after a restart.
+	s.dumb("/objects/info/packs")
+	c.Assert(s.fetches, Equals, 1)
+	mirror = make(map[string]*mirrorEntry)
+	mirrorSize = 0
+	c.Assert(loadMirror(), IsNil)
+	s.dumb("/objects/info/packs")
+	c.Assert(s.fetches, Equals, 1)
+}
+
+func (s *MirrorSuite) TestLoadAndEvict(c *C) {
+	defer func(size int64) { *mirrorSizeFlag = size }(*mirrorSizeFlag)
+
+	_, err := mirrorCommit("github.com/user/repo", mirrorHash1)
+	c.Assert(err, IsNil)
+	c.Assert(os.Mkdir(filepath.Join(*mirrorFlag, mirrorHash2+".tmp123"), 0700), IsNil)
+	*mirrorSizeFlag = 1
+	_, err = mirrorCommit("github.com/user/repo", mirrorHash2)
+	c.Assert(err, IsNil)
+
+	infos, err := ioutil.ReadDir(*mirrorFlag)
+	c.Assert(err, IsNil)
+	c.Assert(infos, HasLen, 2)
+
+	// Stale build directories are removed on load, and the most
+	// recently used commit is kept even if over the limit.
+	mirror = make(map[string]*mirrorEntry)
+	mirrorSize = 0
+	c.Assert(loadMirror(), IsNil)
+	infos, err = ioutil.ReadDir(*mirrorFlag)
+	c.Assert(err, IsNil)
+	c.Assert(infos, HasLen, 1)
+	c.Assert(infos[0].Name(), Equals, mirrorHash2)
+}
+
+func (s *MirrorSuite) TestTooLarge(c *C) {
+	defer func(max int64) { *maxResponseFlag = max }(*maxResponseFlag)
+	*maxResponseFlag = int64(len(mirrorPack)) - 1
+
+	_, err := mirrorCommit("github.com/user/repo", mirrorHash1)
+	c.Assert(err, ErrorMatches, "cannot obtain data pack from GitHub: upload-pack response too large")
+
+	// Nothing is left behind.
+	infos, err := ioutil.ReadDir(*mirrorFlag)
+	c.Assert(err, IsNil)
+	c.Assert(infos, HasLen, 0)
+
+	*maxResponseFlag = int64(len(mirrorPack))
+	_, err = mirrorCommit("github.com/user/repo", mirrorHash1)
+	c.Assert(err, IsNil)
+}
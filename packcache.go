@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The pack cache holds on disk the upload-pack responses obtained from GitHub
+// for fresh clones, which have no "have" lines, so that identical requests
+// for the same repository are served locally. Entries are named after the
+// hash of everything that may affect the response, and the least recently
+// used ones are evicted when the cache grows beyond its size limit.
+
+const packCacheSuffix = ".pack"
+
+type packCacheEntry struct {
+	size     int64
+	lastUsed time.Time
+}
+
+var packCache = make(map[string]*packCacheEntry)
+var packCacheSize int64
+var packCacheLock sync.Mutex
+
+var (
+	packCacheHits      = newCounter("gopkg_pack_cache_hits_total", "Number of upload-pack requests served from the pack cache.")
+	packCacheMisses    = newCounter("gopkg_pack_cache_misses_total", "Number of cacheable upload-pack requests proxied to GitHub.")
+	packCacheBytes     = newGauge("gopkg_pack_cache_bytes", "Size in bytes of all packs in the pack cache.")
+	packCacheEvictions = newCounter("gopkg_pack_cache_evictions_total", "Number of packs evicted from the pack cache.")
+)
+
+// loadPackCache indexes the packs in the -pack-cache directory, considering
+// their modification time as the last time they were used.
+func loadPackCache() error {
+	if *packCacheFlag == "" {
+		return nil
+	}
+	if err := os.MkdirAll(*packCacheFlag, 0700); err != nil {
+		return err
+	}
+	infos, err := ioutil.ReadDir(*packCacheFlag)
+	if err != nil {
+		return fmt.Errorf("cannot read pack cache: %v", err)
+	}
+	packCacheLock.Lock()
+	defer packCacheLock.Unlock()
+	for _, info := range infos {
+		name := info.Name()
+		if strings.HasSuffix(name, packCacheSuffix) && info.Mode().IsRegular() {
+			key := strings.TrimSuffix(name, packCacheSuffix)
+			packCache[key] = &packCacheEntry{size: info.Size(), lastUsed: info.ModTime()}
+			packCacheSize += info.Size()
+		} else if strings.Contains(name, packCacheSuffix+".tmp") {
+			// Left behind by an interrupted download.
+			os.Remove(filepath.Join(*packCacheFlag, name))
+		}
+	}
+	evictPacks()
+	return nil
+}
+
+// packCacheKey returns the cache key for the upload-pack request upr made
+// for the repository at root with the provided Git-Protocol header, or the
+// empty string if the request cannot be served from the cache.
+func packCacheKey(root string, protocol string, upr *uploadPackRequest) string {
+	if *packCacheFlag == "" || upr.Haves > 0 || len(upr.Wants) == 0 || upr.Command != "" && upr.Command != "fetch" {
+		return ""
+	}
+	wants := append([]string(nil), upr.Wants...)
+	options := append([]string(nil), upr.Options...)
+	sort.Strings(wants)
+	sort.Strings(options)
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n%s\n%t\n", root, protocol, strings.Join(wants, " "), strings.Join(options, " "), upr.Done)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func packCachePath(key string) string {
+	return filepath.Join(*packCacheFlag, key+packCacheSuffix)
+}
+
+// openCachedPack opens the cached pack for key, if there's one.
+func openCachedPack(key string) (*os.File, bool) {
+	packCacheLock.Lock()
+	entry, ok := packCache[key]
+	if ok {
+		entry.lastUsed = time.Now()
+	}
+	packCacheLock.Unlock()
+	if !ok {
+		return nil, false
+	}
+	f, err := os.Open(packCachePath(key))
+	if err != nil {
+		log.Printf("Error opening cached pack: %v", err)
+		return nil, false
+	}
+	now := time.Now()
+	os.Chtimes(f.Name(), now, now)
+	return f, true
+}
+
+// packCacheWriter writes a pack into a temporary file that only becomes
+// visible in the cache when committed.
+type packCacheWriter struct {
+	key  string
+	file *os.File
+	size int64
+	err  error
+}
+
+func createCachedPack(key string) *packCacheWriter {
+	f, err := ioutil.TempFile(*packCacheFlag, key+packCacheSuffix+".tmp")
+	if err != nil {
+		log.Printf("Error creating cached pack: %v", err)
+		return nil
+	}
+	return &packCacheWriter{key: key, file: f}
+}
+
+// Write never fails, so that errors writing to the cache don't interrupt
+// the transfer to the client. They are reported on commit instead.
+func (w *packCacheWriter) Write(data []byte) (int, error) {
+	if w.err == nil {
+		n, err := w.file.Write(data)
+		w.size += int64(n)
+		w.err = err
+	}
+	return len(data), nil
+}
+
+// abort drops the partially written pack.
+func (w *packCacheWriter) abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
+
+// commit makes the written pack available in the cache.
+func (w *packCacheWriter) commit() {
+	err := w.err
+	if cerr := w.file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(w.file.Name(), packCachePath(w.key))
+	}
+	if err != nil {
+		log.Printf("Error writing cached pack: %v", err)
+		os.Remove(w.file.Name())
+		return
+	}
+
+	packCacheLock.Lock()
+	defer packCacheLock.Unlock()
+	if old, ok := packCache[w.key]; ok {
+		packCacheSize -= old.size
+	}
+	packCache[w.key] = &packCacheEntry{size: w.size, lastUsed: time.Now()}
+	packCacheSize += w.size
+	evictPacks()
+}
+
+// evictPacks removes the least recently used packs until the cache fits its
+// size limit. It must be called with packCacheLock held.
+func evictPacks() {
+	if packCacheSize > *packCacheSizeFlag {
+		keys := make([]string, 0, len(packCache))
+		for key := range packCache {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return packCache[keys[i]].lastUsed.Before(packCache[keys[j]].lastUsed)
+		})
+		for _, key := range keys {
+			if packCacheSize <= *packCacheSizeFlag {
+				break
+			}
+			if err := os.Remove(packCachePath(key)); err != nil && !os.IsNotExist(err) {
+				log.Printf("Error evicting cached pack: %v", err)
+				continue
+			}
+			packCacheSize -= packCache[key].size
+			delete(packCache, key)
+			packCacheEvictions.inc()
+		}
+	}
+	packCacheBytes.set(float64(packCacheSize))
+}
+
+// serveCachedPack serves the upload-pack response cached for key, if there's one.
+func serveCachedPack(resp http.ResponseWriter, key string, info *proxyInfo) bool {
+	f, ok := openCachedPack(key)
+	if !ok {
+		return false
+	}
+	defer f.Close()
+	packCacheHits.inc()
+	resp.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+	resp.Header().Set("Cache-Control", "no-cache")
+	if _, err := io.Copy(io.MultiWriter(resp, info), f); err != nil {
+		log.Printf("Error copying cached pack: %v", err)
+	}
+	return true
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/niemeyer/gopkg/resolver"
+)
+
+var _ = Suite(&PackCacheSuite{})
+
+type PackCacheSuite struct {
+	transport http.RoundTripper
+	requests  int
+}
+
+func (s *PackCacheSuite) SetUpTest(c *C) {
+	*packCacheFlag = c.MkDir()
+	s.requests = 0
+	s.transport = bulkClient.Transport
+	bulkClient.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		s.requests++
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {"application/x-git-upload-pack-result"}},
+			Body:       ioutil.NopCloser(strings.NewReader("0008NAK\nPACK data")),
+			Request:    req,
+		}, nil
+	})
+}
+
+func (s *PackCacheSuite) TearDownTest(c *C) {
+	bulkClient.Transport = s.transport
+	*packCacheFlag = ""
+	packCacheLock.Lock()
+	packCache = make(map[string]*packCacheEntry)
+	packCacheSize = 0
+	packCacheLock.Unlock()
+}
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+var freshClone = pktlines(
+	"want "+wantHash1+" multi_ack_detailed side-band-64k thin-pack ofs-delta agent=git/2.40\n",
+	"want "+wantHash2+"\n",
+	"0000",
+	"done\n",
+)
+
+func (s *PackCacheSuite) fetch(c *C, body string) string {
+	repo := &resolver.Repo{User: "user", Name: "repo", MajorVersion: resolver.Version{Major: 1, Minor: -1, Patch: -1}}
+	req := httptest.NewRequest("POST", "/user/repo.v1/git-upload-pack", strings.NewReader(body))
+	resp := httptest.NewRecorder()
+	data, upr, ok := readUploadPack(resp, req)
+	c.Assert(ok, Equals, true)
+	proxyUploadPack(resp, req, resolution(repo, nil), data, upr)
+	c.Assert(resp.Code, Equals, http.StatusOK)
+	return resp.Body.String()
+}
+
+func (s *PackCacheSuite) TestCacheHit(c *C) {
+	c.Assert(s.fetch(c, freshClone), Equals, "0008NAK\nPACK data")
+	c.Assert(s.requests, Equals, 1)
+
+	// Same request with wants in a different order and another agent.
+	reordered := pktlines(
+		"want "+wantHash2+" multi_ack_detailed side-band-64k thin-pack ofs-delta agent=git/2.41\n",
+		"want "+wantHash1+"\n",
+		"0000",
+		"done\n",
+	)
+	c.Assert(s.fetch(c, reordered), Equals, "0008NAK\nPACK data")
+	c.Assert(s.requests, Equals, 1)
+
+	// Shallow clones get a different pack.
+	shallow := pktlines(
+		"want "+wantHash1+" multi_ack_detailed side-band-64k thin-pack ofs-delta\n",
+		"want "+wantHash2+"\n",
+		"deepen 1\n",
+		"0000",
+		"done\n",
+	)
+	c.Assert(s.fetch(c, shallow), Equals, "0008NAK\nPACK data")
+	c.Assert(s.requests, Equals, 2)
+
+	// Fetches with haves are never cached.
+	s.fetch(c, uploadPackV0)
+	s.fetch(c, uploadPackV0)
+	c.Assert(s.requests, Equals, 4)
+}
+
+func (s *PackCacheSuite) TestLoadAndEvict(c *C) {
+	defer func(size int64) { *packCacheSizeFlag = size }(*packCacheSizeFlag)
+	*packCacheSizeFlag = 25
+
+	now := time.Now()
+	for i, key := range []string{"old", "mid", "new"} {
+		path := filepath.Join(*packCacheFlag, key+packCacheSuffix)
+		err := ioutil.WriteFile(path, []byte("0123456789"), 0644)
+		c.Assert(err, IsNil)
+		mtime := now.Add(time.Duration(i-3) * time.Hour)
+		c.Assert(os.Chtimes(path, mtime, mtime), IsNil)
+	}
+	err := ioutil.WriteFile(filepath.Join(*packCacheFlag, "new"+packCacheSuffix+".tmp123"), nil, 0644)
+	c.Assert(err, IsNil)
+
+	c.Assert(loadPackCache(), IsNil)
+
+	infos, err := ioutil.ReadDir(*packCacheFlag)
+	c.Assert(err, IsNil)
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	c.Assert(names, DeepEquals, []string{"mid.pack", "new.pack"})
+	c.Assert(packCacheSize, Equals, int64(20))
+
+	// Using a pack makes it the most recently used.
+	f, ok := openCachedPack("mid")
+	c.Assert(ok, Equals, true)
+	f.Close()
+	w := createCachedPack("newer")
+	w.Write([]byte("0123456789"))
+	w.commit()
+
+	_, ok = openCachedPack("new")
+	c.Assert(ok, Equals, false)
+	_, err = os.Stat(filepath.Join(*packCacheFlag, "new"+packCacheSuffix))
+	c.Assert(os.IsNotExist(err), Equals, true)
+	c.Assert(packCacheSize, Equals, int64(20))
+}
+
+func (s *PackCacheSuite) TestTruncatedNotCached(c *C) {
+	bulkClient.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		s.requests++
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(truncatedReader{strings.NewReader("0008NAK\nPACK")}),
+			Request:    req,
+		}, nil
+	})
+	c.Assert(func() { s.fetch(c, freshClone) }, PanicMatches, "net/http: abort Handler")
+	c.Assert(func() { s.fetch(c, freshClone) }, PanicMatches, "net/http: abort Handler")
+	c.Assert(s.requests, Equals, 2)
+	infos, err := ioutil.ReadDir(*packCacheFlag)
+	c.Assert(err, IsNil)
+	c.Assert(infos, HasLen, 0)
+}
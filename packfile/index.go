@@ -0,0 +1,456 @@
+// Package packfile implements indexing of git packfiles, so that packs
+// obtained over the wire may be served by the dumb HTTP protocol, which
+// requires a pack index next to every pack.
+//
+// A pack starts with the "PACK" signature, a version and the number of
+// objects, followed by the objects themselves and a trailing SHA-1 checksum
+// of everything before it. Objects are zlib-compressed, and may be deltas
+// against a base object found at an earlier offset or by object name.
+package packfile
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"sort"
+)
+
+// Object types as encoded in packs.
+const (
+	typeCommit   = 1
+	typeTree     = 2
+	typeBlob     = 3
+	typeTag      = 4
+	typeOfsDelta = 6
+	typeRefDelta = 7
+)
+
+var typeNames = map[byte]string{
+	typeCommit: "commit",
+	typeTree:   "tree",
+	typeBlob:   "blob",
+	typeTag:    "tag",
+}
+
+// ErrThinPack is returned when a delta refers to a base object that is not
+// part of the pack.
+var ErrThinPack = errors.New("invalid pack: delta base object missing")
+
+type entry struct {
+	offset     int64 // Offset of the entry header.
+	dataOffset int64 // Offset of the compressed data.
+	size       int64 // Uncompressed size of the data.
+	typ        byte  // Type of the object, once resolved for deltas.
+	crc        uint32
+	baseOffset int64    // Offset of the base of an offset delta.
+	baseID     [20]byte // Name of the base of a reference delta.
+	delta      bool
+	resolved   bool
+	id         [20]byte
+}
+
+// countingReader tracks the offset, CRC-32 and SHA-1 of the data read.
+type countingReader struct {
+	r   *bufio.Reader
+	n   int64
+	crc uint32
+	sum hash.Hash
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.update(p[:n])
+	return n, err
+}
+
+func (cr *countingReader) ReadByte() (byte, error) {
+	b, err := cr.r.ReadByte()
+	if err == nil {
+		cr.update([]byte{b})
+	}
+	return b, err
+}
+
+func (cr *countingReader) update(p []byte) {
+	cr.n += int64(len(p))
+	cr.crc = crc32.Update(cr.crc, crc32.IEEETable, p)
+	cr.sum.Write(p)
+}
+
+// WriteIndex reads the pack of the given size from r and writes to w its
+// version 2 index. The pack checksum is returned, which is the hash used
+// to name the pack and its index.
+func WriteIndex(w io.Writer, r io.ReaderAt, size int64) (checksum [20]byte, err error) {
+	if size < 32 {
+		return checksum, fmt.Errorf("invalid pack: too short")
+	}
+	cr := &countingReader{r: bufio.NewReader(io.NewSectionReader(r, 0, size-20)), sum: sha1.New()}
+	var header [12]byte
+	if _, err := io.ReadFull(cr, header[:]); err != nil {
+		return checksum, fmt.Errorf("invalid pack: %v", err)
+	}
+	version := binary.BigEndian.Uint32(header[4:])
+	if string(header[:4]) != "PACK" || version != 2 && version != 3 {
+		return checksum, fmt.Errorf("invalid pack: unsupported signature or version")
+	}
+	count := binary.BigEndian.Uint32(header[8:])
+	if int64(count) > size/2 {
+		return checksum, fmt.Errorf("invalid pack: too many objects")
+	}
+
+	entries := make([]*entry, count)
+	byOffset := make(map[int64]*entry, count)
+	for i := range entries {
+		e, err := readEntry(cr)
+		if err != nil {
+			return checksum, fmt.Errorf("invalid pack: object at offset %d: %v", cr.n, err)
+		}
+		entries[i] = e
+		byOffset[e.offset] = e
+	}
+	if cr.n != size-20 {
+		return checksum, fmt.Errorf("invalid pack: %d unexpected bytes after objects", size-20-cr.n)
+	}
+	if _, err := r.ReadAt(checksum[:], size-20); err != nil {
+		return checksum, fmt.Errorf("invalid pack: %v", err)
+	}
+	if !bytes.Equal(cr.sum.Sum(nil), checksum[:]) {
+		return checksum, fmt.Errorf("invalid pack: checksum mismatch")
+	}
+
+	if err := resolveDeltas(r, size, entries, byOffset); err != nil {
+		return checksum, err
+	}
+	return checksum, writeIndex(w, entries, checksum)
+}
+
+// readEntry reads the object entry at the current position of cr, hashing
+// it if it isn't a delta.
+func readEntry(cr *countingReader) (*entry, error) {
+	e := &entry{offset: cr.n}
+	cr.crc = 0
+	c, err := cr.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	e.typ = c >> 4 & 7
+	e.size = int64(c & 15)
+	for shift := uint(4); c&0x80 != 0; shift += 7 {
+		if shift > 56 {
+			return nil, fmt.Errorf("object size overflow")
+		}
+		if c, err = cr.ReadByte(); err != nil {
+			return nil, err
+		}
+		e.size |= int64(c&0x7f) << shift
+	}
+
+	switch e.typ {
+	case typeCommit, typeTree, typeBlob, typeTag:
+	case typeOfsDelta:
+		e.delta = true
+		c, err := cr.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		rel := int64(c & 0x7f)
+		for c&0x80 != 0 {
+			if rel >= 1<<55 {
+				return nil, fmt.Errorf("delta base offset overflow")
+			}
+			if c, err = cr.ReadByte(); err != nil {
+				return nil, err
+			}
+			rel = (rel+1)<<7 | int64(c&0x7f)
+		}
+		e.baseOffset = e.offset - rel
+		if rel == 0 || e.baseOffset < 12 {
+			return nil, fmt.Errorf("invalid delta base offset")
+		}
+	case typeRefDelta:
+		e.delta = true
+		if _, err := io.ReadFull(cr, e.baseID[:]); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown object type %d", e.typ)
+	}
+
+	e.dataOffset = cr.n
+	zr, err := zlib.NewReader(cr)
+	if err != nil {
+		return nil, err
+	}
+	var dst io.Writer = ioutil.Discard
+	var h hash.Hash
+	if !e.delta {
+		h = sha1.New()
+		fmt.Fprintf(h, "%s %d\x00", typeNames[e.typ], e.size)
+		dst = h
+	}
+	n, err := io.Copy(dst, zr)
+	if err != nil {
+		return nil, err
+	}
+	if n != e.size {
+		return nil, fmt.Errorf("object size mismatch")
+	}
+	if h != nil {
+		copy(e.id[:], h.Sum(nil))
+		e.resolved = true
+	}
+	e.crc = cr.crc
+	return e, nil
+}
+
+// maxCached is the total size of object data kept around while resolving
+// deltas, so that chains of deltas don't inflate their bases repeatedly.
+const maxCached = 64 << 20
+
+type resolver struct {
+	r        io.ReaderAt
+	size     int64
+	byOffset map[int64]*entry
+	byID     map[[20]byte]*entry
+	cache    map[int64][]byte
+	cached   int
+}
+
+// resolveDeltas computes the type and name of all delta entries.
+func resolveDeltas(r io.ReaderAt, size int64, entries []*entry, byOffset map[int64]*entry) error {
+	res := &resolver{
+		r:        r,
+		size:     size,
+		byOffset: byOffset,
+		byID:     make(map[[20]byte]*entry),
+		cache:    make(map[int64][]byte),
+	}
+	var pending []*entry
+	for _, e := range entries {
+		if e.resolved {
+			res.byID[e.id] = e
+		} else {
+			pending = append(pending, e)
+		}
+	}
+	// Offset deltas always follow their bases, but reference deltas
+	// may refer to any other object, so iterate until done.
+	for len(pending) > 0 {
+		var left []*entry
+		for _, e := range pending {
+			base := res.base(e)
+			if base == nil || !base.resolved {
+				left = append(left, e)
+				continue
+			}
+			data, err := res.data(e)
+			if err != nil {
+				return err
+			}
+			h := sha1.New()
+			fmt.Fprintf(h, "%s %d\x00", typeNames[e.typ], len(data))
+			h.Write(data)
+			copy(e.id[:], h.Sum(nil))
+			e.resolved = true
+			res.byID[e.id] = e
+		}
+		if len(left) == len(pending) {
+			return ErrThinPack
+		}
+		pending = left
+	}
+	return nil
+}
+
+func (res *resolver) base(e *entry) *entry {
+	if e.baseOffset != 0 {
+		return res.byOffset[e.baseOffset]
+	}
+	return res.byID[e.baseID]
+}
+
+// data returns the uncompressed object data of e, applying deltas as
+// necessary, and sets the type of delta entries to that of their base.
+func (res *resolver) data(e *entry) ([]byte, error) {
+	if data, ok := res.cache[e.offset]; ok {
+		return data, nil
+	}
+	data, err := res.inflate(e)
+	if err != nil {
+		return nil, err
+	}
+	if e.delta {
+		base := res.base(e)
+		if base == nil {
+			return nil, ErrThinPack
+		}
+		if base == e {
+			return nil, fmt.Errorf("invalid pack: object at offset %d is its own delta base", e.offset)
+		}
+		baseData, err := res.data(base)
+		if err != nil {
+			return nil, err
+		}
+		data, err = applyDelta(baseData, data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pack: object at offset %d: %v", e.offset, err)
+		}
+		e.typ = base.typ
+	}
+	if res.cached+len(data) > maxCached {
+		res.cache = make(map[int64][]byte)
+		res.cached = 0
+	}
+	res.cache[e.offset] = data
+	res.cached += len(data)
+	return data, nil
+}
+
+func (res *resolver) inflate(e *entry) ([]byte, error) {
+	zr, err := zlib.NewReader(bufio.NewReader(io.NewSectionReader(res.r, e.dataOffset, res.size-e.dataOffset)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid pack: object at offset %d: %v", e.offset, err)
+	}
+	data := make([]byte, e.size)
+	if _, err := io.ReadFull(zr, data); err != nil {
+		return nil, fmt.Errorf("invalid pack: object at offset %d: %v", e.offset, err)
+	}
+	return data, nil
+}
+
+// applyDelta returns the result of applying delta to base.
+func applyDelta(base, delta []byte) ([]byte, error) {
+	readSize := func() (int64, bool) {
+		var size int64
+		for shift := uint(0); len(delta) > 0 && shift < 64; shift += 7 {
+			c := delta[0]
+			delta = delta[1:]
+			size |= int64(c&0x7f) << shift
+			if c&0x80 == 0 {
+				return size, true
+			}
+		}
+		return 0, false
+	}
+	baseSize, ok1 := readSize()
+	resultSize, ok2 := readSize()
+	if !ok1 || !ok2 || baseSize != int64(len(base)) {
+		return nil, fmt.Errorf("delta does not match its base")
+	}
+	if resultSize > int64(len(delta))<<24 {
+		// Each copy command takes at least a byte and copies at most 16MB.
+		return nil, fmt.Errorf("delta result size out of bounds")
+	}
+	capacity := resultSize
+	if capacity > 1<<20 {
+		capacity = 1 << 20
+	}
+	result := make([]byte, 0, capacity)
+	for len(delta) > 0 {
+		cmd := delta[0]
+		delta = delta[1:]
+		switch {
+		case cmd&0x80 != 0:
+			var offset, size int64
+			for i := uint(0); i < 7; i++ {
+				if cmd&(1<<i) == 0 {
+					continue
+				}
+				if len(delta) == 0 {
+					return nil, fmt.Errorf("truncated delta")
+				}
+				if i < 4 {
+					offset |= int64(delta[0]) << (8 * i)
+				} else {
+					size |= int64(delta[0]) << (8 * (i - 4))
+				}
+				delta = delta[1:]
+			}
+			if size == 0 {
+				size = 0x10000
+			}
+			if offset+size > int64(len(base)) || int64(len(result))+size > resultSize {
+				return nil, fmt.Errorf("delta copy out of bounds")
+			}
+			result = append(result, base[offset:offset+size]...)
+		case cmd != 0:
+			if int(cmd) > len(delta) || int64(len(result))+int64(cmd) > resultSize {
+				return nil, fmt.Errorf("delta insert out of bounds")
+			}
+			result = append(result, delta[:cmd]...)
+			delta = delta[cmd:]
+		default:
+			return nil, fmt.Errorf("invalid delta command")
+		}
+	}
+	if int64(len(result)) != resultSize {
+		return nil, fmt.Errorf("delta result size mismatch")
+	}
+	return result, nil
+}
+
+// writeIndex writes the version 2 index for the resolved entries.
+func writeIndex(w io.Writer, entries []*entry, checksum [20]byte) error {
+	sorted := make([]*entry, len(entries))
+	copy(sorted, entries)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].id[:], sorted[j].id[:]) < 0
+	})
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i].id == sorted[i-1].id {
+			return fmt.Errorf("invalid pack: duplicate object %x", sorted[i].id)
+		}
+	}
+
+	h := sha1.New()
+	bw := bufio.NewWriter(io.MultiWriter(w, h))
+	put := func(v uint32) {
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], v)
+		bw.Write(b[:])
+	}
+
+	bw.WriteString("\xfftOc")
+	put(2)
+	var fanout [256]uint32
+	for _, e := range sorted {
+		fanout[e.id[0]]++
+	}
+	for i, total := 0, uint32(0); i < 256; i++ {
+		total += fanout[i]
+		put(total)
+	}
+	for _, e := range sorted {
+		bw.Write(e.id[:])
+	}
+	for _, e := range sorted {
+		put(e.crc)
+	}
+	var large []int64
+	for _, e := range sorted {
+		if e.offset < 1<<31 {
+			put(uint32(e.offset))
+		} else {
+			put(1<<31 | uint32(len(large)))
+			large = append(large, e.offset)
+		}
+	}
+	for _, offset := range large {
+		put(uint32(offset >> 32))
+		put(uint32(offset))
+	}
+	bw.Write(checksum[:])
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	_, err := w.Write(h.Sum(nil))
+	return err
+}
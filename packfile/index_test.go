@@ -0,0 +1,170 @@
+package packfile_test
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/niemeyer/gopkg/packfile"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+var _ = Suite(&S{})
+
+type S struct{}
+
+// packBuilder encodes objects into a pack for tests.
+type packBuilder struct {
+	buf     bytes.Buffer
+	count   int
+	offsets []int
+}
+
+func (b *packBuilder) add(typ byte, data []byte, base interface{}) {
+	b.offsets = append(b.offsets, b.buf.Len()+12)
+	b.count++
+	size := len(data)
+	c := typ<<4 | byte(size&15)
+	size >>= 4
+	for size > 0 {
+		b.buf.WriteByte(c | 0x80)
+		c = byte(size & 0x7f)
+		size >>= 7
+	}
+	b.buf.WriteByte(c)
+	switch base := base.(type) {
+	case int:
+		// Offset delta against the object added with the given index.
+		rel := b.offsets[len(b.offsets)-1] - b.offsets[base]
+		enc := []byte{byte(rel & 0x7f)}
+		for rel >>= 7; rel > 0; rel >>= 7 {
+			rel--
+			enc = append([]byte{byte(0x80 | rel&0x7f)}, enc...)
+		}
+		b.buf.Write(enc)
+	case string:
+		// Reference delta against the object with the given name.
+		var id []byte
+		fmt.Sscanf(base, "%x", &id)
+		b.buf.Write(id)
+	}
+	w := zlib.NewWriter(&b.buf)
+	w.Write(data)
+	w.Close()
+}
+
+func (b *packBuilder) bytes() []byte {
+	var pack bytes.Buffer
+	pack.WriteString("PACK")
+	binary.Write(&pack, binary.BigEndian, uint32(2))
+	binary.Write(&pack, binary.BigEndian, uint32(b.count))
+	pack.Write(b.buf.Bytes())
+	sum := sha1.Sum(pack.Bytes())
+	pack.Write(sum[:])
+	return pack.Bytes()
+}
+
+func objectID(typ string, data string) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(fmt.Sprintf("%s %d\x00%s", typ, len(data), data))))
+}
+
+// delta encodes a delta copying the first n bytes of base and appending suffix.
+func delta(base string, n int, suffix string) []byte {
+	d := []byte{byte(len(base)), byte(n + len(suffix)), 0x90, byte(n), byte(len(suffix))}
+	return append(d, suffix...)
+}
+
+// indexNames returns the object names listed in a version 2 index, and
+// verifies the index checksum.
+func indexNames(c *C, index []byte, checksum [20]byte) []string {
+	c.Assert(string(index[:8]), Equals, "\xfftOc\x00\x00\x00\x02")
+	sum := sha1.Sum(index[:len(index)-20])
+	c.Assert(index[len(index)-20:], DeepEquals, sum[:])
+	c.Assert(index[len(index)-40:len(index)-20], DeepEquals, checksum[:])
+	count := int(binary.BigEndian.Uint32(index[8+255*4:]))
+	var names []string
+	for i := 0; i < count; i++ {
+		names = append(names, fmt.Sprintf("%x", index[8+256*4+i*20:8+256*4+(i+1)*20]))
+	}
+	c.Assert(len(index), Equals, 8+256*4+count*28+40)
+	return names
+}
+
+func (s *S) TestWriteIndex(c *C) {
+	const hello = "hello world\n"
+	var b packBuilder
+	b.add(3, []byte(hello), nil)
+	b.add(6, delta(hello, 11, "!\n"), 0)
+	b.add(7, delta("hello world!\n", 5, "?\n"), objectID("blob", "hello world!\n"))
+	b.add(1, []byte("tree "+objectID("tree", "")+"\n\ncommit\n"), nil)
+	pack := b.bytes()
+
+	var index bytes.Buffer
+	checksum, err := packfile.WriteIndex(&index, bytes.NewReader(pack), int64(len(pack)))
+	c.Assert(err, IsNil)
+	c.Assert(checksum[:], DeepEquals, pack[len(pack)-20:])
+
+	names := indexNames(c, index.Bytes(), checksum)
+	expected := []string{
+		objectID("blob", hello),
+		objectID("blob", "hello world!\n"),
+		objectID("blob", "hello?\n"),
+		objectID("commit", "tree "+objectID("tree", "")+"\n\ncommit\n"),
+	}
+	c.Assert(names, HasLen, len(expected))
+	for _, name := range expected {
+		c.Assert(names, Contains, name)
+	}
+}
+
+func (s *S) TestWriteIndexErrors(c *C) {
+	var b packBuilder
+	b.add(7, delta("missing", 3, ""), objectID("blob", "missing"))
+	pack := b.bytes()
+	_, err := packfile.WriteIndex(&bytes.Buffer{}, bytes.NewReader(pack), int64(len(pack)))
+	c.Assert(err, Equals, packfile.ErrThinPack)
+
+	b = packBuilder{}
+	b.add(3, []byte("data"), nil)
+	pack = b.bytes()
+	pack[len(pack)-1] ^= 1
+	_, err = packfile.WriteIndex(&bytes.Buffer{}, bytes.NewReader(pack), int64(len(pack)))
+	c.Assert(err, ErrorMatches, "invalid pack: checksum mismatch")
+
+	b = packBuilder{}
+	b.add(3, []byte("base"), nil)
+	b.add(6, delta("other", 3, ""), 0)
+	pack = b.bytes()
+	_, err = packfile.WriteIndex(&bytes.Buffer{}, bytes.NewReader(pack), int64(len(pack)))
+	c.Assert(err, ErrorMatches, "invalid pack: object at offset [0-9]+: delta does not match its base")
+}
+
+// Contains checks that a slice of strings holds a value.
+var Contains Checker = &containsChecker{&CheckerInfo{Name: "Contains", Params: []string{"obtained", "value"}}}
+
+type containsChecker struct{ *CheckerInfo }
+
+func (checker *containsChecker) Check(params []interface{}, names []string) (bool, string) {
+	for _, s := range params[0].([]string) {
+		if s == params[1] {
+			return true, ""
+		}
+	}
+	return false, ""
+}
+
+func FuzzWriteIndex(f *testing.F) {
+	var b packBuilder
+	b.add(3, []byte("hello world\n"), nil)
+	b.add(6, delta("hello world\n", 11, "!\n"), 0)
+	f.Add(b.bytes())
+	f.Fuzz(func(t *testing.T, pack []byte) {
+		packfile.WriteIndex(&bytes.Buffer{}, bytes.NewReader(pack), int64(len(pack)))
+	})
+}
@@ -1,18 +1,20 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"html/template"
 	"io/ioutil"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
 	"regexp"
 	"sort"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/niemeyer/gopkg/resolver"
 )
 
 const packageTemplateString = `<!DOCTYPE html>
@@ -23,6 +25,7 @@ const packageTemplateString = `<!DOCTYPE html>
 		<link href='//fonts.googleapis.com/css?family=Ubuntu+Mono|Ubuntu' rel='stylesheet' >
 		<link href="//netdna.bootstrapcdn.com/font-awesome/4.0.3/css/font-awesome.css" rel="stylesheet" >
 		<link href="//netdna.bootstrapcdn.com/bootstrap/3.1.1/css/bootstrap.min.css" rel="stylesheet" >
+		<link href="{{.FeedURL}}" rel="alternate" type="application/atom+xml" title="{{.Repo.Original.GopkgRoot}} versions" >
 		<style>
 			html,
 			body {
@@ -124,6 +127,21 @@ const packageTemplateString = `<!DOCTYPE html>
 						</div>
 					</div>
 				</div>
+				{{ if .PendingRedir }}
+					<div class="col-sm-12 alert alert-warning">
+						GitHub reports that this repository moved to <a href="https://{{.PendingRedir}}">{{.PendingRedir}}</a>.
+					</div>
+				{{ else if .Repo.RedirName }}
+					<div class="col-sm-12 alert alert-info">
+						This package is served from <a href="https://{{.Repo.GitHubRoot}}">{{.Repo.GitHubRoot}}</a>, which was moved from <a href="https://{{.Repo.Original.GitHubRoot}}">{{.Repo.Original.GitHubRoot}}</a>.
+					</div>
+				{{ end }}
+				{{ with .MovedTag }}
+					<div class="col-sm-12 alert alert-danger">
+						The tag for {{$.Repo.FullVersion}} was moved at GitHub since it was first seen on {{.FirstSeen.Format "2006-01-02"}}, from commit <code>{{.Hash}}</code> to <code>{{.MovedHash}}</code>.
+						{{ if $.TagsPinned }}The originally recorded commit is still being served.{{ end }}
+					</div>
+				{{ end }}
 				{{ if .Repo.MajorVersion.Unstable }}
 					<div class="col-sm-12 alert alert-danger">
 						This is an <b><i>unstable</i></b> package and should <i>not</i> be used in released code.
@@ -170,6 +188,20 @@ const packageTemplateString = `<!DOCTYPE html>
 								<span class="label label-default">master</span>
 							</div>
 						{{ end }}
+						<div>
+							<small><a href="{{.FeedURL}}"><i class="fa fa-rss"></i> New versions</a></small>
+						</div>
+						{{ if .Stats }}
+							<h2>Downloads</h2>
+							{{ range .Stats }}
+								<div>
+									{{.Major}} &rarr; {{.Packs}} fetches by ~{{.Clients}} daily clients
+								</div>
+							{{ end }}
+							<div>
+								<small>In the last {{.StatsDays}} days. <a href="{{.StatsURL}}">Details</a></small>
+							</div>
+						{{ end }}
 					</div>
 				</div>
 			</div>
@@ -179,7 +211,7 @@ const packageTemplateString = `<!DOCTYPE html>
 			<div class="container">
 				<div class="row">
 					<div class="col-sm-12">
-						<p class="text-muted credit"><a href="https://gopkg.in">gopkg.in<a></p>
+						<p class="text-muted credit"><a href="https://{{.Repo.Host}}">{{.Repo.Host}}</a></p>
 					</div>
 				</div>
 			</div>
@@ -192,7 +224,7 @@ const packageTemplateString = `<!DOCTYPE html>
 
 var packageTemplate *template.Template
 
-func gopkgVersionRoot(repo *Repo, version Version) string {
+func gopkgVersionRoot(repo *resolver.Repo, version resolver.Version) string {
 	return repo.GopkgVersionRoot(version)
 }
 
@@ -210,30 +242,46 @@ func init() {
 }
 
 type packageData struct {
-	Repo           *Repo
-	LatestVersions VersionList // Contains only the latest version for each major
-	PackageName    string      // Actual package identifier as specified in https://golang.org/ref/spec#PackageClause
+	Repo           *resolver.Repo
+	LatestVersions resolver.VersionList // Contains only the latest version for each major
+	PackageName    string               // Actual package identifier as specified in https://golang.org/ref/spec#PackageClause
 	Synopsis       string
 	GitTreeName    string
-}
-
-// SearchResults is used with the godoc.org search API
-type SearchResults struct {
-	Results []struct {
-		Path     string `json:"path"`
-		Synopsis string `json:"synopsis"`
-	} `json:"results"`
+	MovedTag       *tagRecord // Set if the tag for the selected version moved since first seen
+	TagsPinned     bool
+	PendingRedir   string        // GitHub root the repository was reported to have moved to, if not yet approved
+	Stats          []*statsTotal // Download statistics per major version
+	StatsDays      int
+	StatsURL       string
+	FeedURL        string
 }
 
 var regexpPackageName = regexp.MustCompile(`<h2 id="pkg-overview">package ([\p{L}_][\p{L}\p{Nd}_]*)</h2>`)
 
-func renderPackagePage(resp http.ResponseWriter, req *http.Request, repo *Repo) {
+// getContext obtains url with httpClient, giving up when ctx is done.
+func getContext(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return httpClient.Do(req)
+}
+
+func renderPackagePage(resp http.ResponseWriter, req *http.Request, repo *resolver.Repo) {
 	data := &packageData{
-		Repo: repo,
+		Repo:         repo,
+		MovedTag:     movedTag(repo.GitHubRoot(), repo.FullVersion),
+		TagsPinned:   *movedTagsFlag == movedTagsPin,
+		PendingRedir: pendingRedirect(repoBases(repo)[0]),
+		Synopsis:     packageSynopsis(repo),
+		Stats:        repoStats(repo, statsPageDays, time.Now()).Majors,
+		StatsDays:    statsPageDays,
+		StatsURL:     statsPath + strings.TrimPrefix(repo.Original().GopkgRoot(), repo.Host+"/"),
+		FeedURL:      feedPath + strings.TrimPrefix(repo.Original().GopkgRoot(), repo.Host+"/"),
 	}
 
 	// Calculate the latest version for each major version, both stable and unstable.
-	latestVersions := make(map[int]Version)
+	latestVersions := make(map[int]resolver.Version)
 	for _, v := range repo.AllVersions {
 		if v.Unstable {
 			continue
@@ -243,7 +291,7 @@ func renderPackagePage(resp http.ResponseWriter, req *http.Request, repo *Repo)
 			latestVersions[v.Major] = v
 		}
 	}
-	data.LatestVersions = make(VersionList, 0, len(latestVersions))
+	data.LatestVersions = make(resolver.VersionList, 0, len(latestVersions))
 	for _, v := range latestVersions {
 		data.LatestVersions = append(data.LatestVersions, v)
 	}
@@ -251,16 +299,18 @@ func renderPackagePage(resp http.ResponseWriter, req *http.Request, repo *Repo)
 
 	if repo.FullVersion.Unstable {
 		// Prepend post-sorting so it shows first.
-		data.LatestVersions = append([]Version{repo.FullVersion}, data.LatestVersions...)
+		data.LatestVersions = append([]resolver.Version{repo.FullVersion}, data.LatestVersions...)
 	}
 
 	var dataMutex sync.Mutex
-	wantResps := 2
+	wantResps := 1
 	gotResp := make(chan bool, wantResps)
 
 	go func() {
 		// Retrieve package name from godoc.org. This should be on a proper API.
-		godocResp, err := http.Get("https://godoc.org/" + repo.GopkgPath())
+		ctx, span := startSpan(req.Context(), "page.package_name", spanInternal, "path", repo.GopkgPath())
+		godocResp, err := getContext(ctx, "https://godoc.org/"+repo.GopkgPath())
+		span.end(err)
 		if err == nil {
 			godocRespBytes, err := ioutil.ReadAll(godocResp.Body)
 			godocResp.Body.Close()
@@ -276,29 +326,6 @@ func renderPackagePage(resp http.ResponseWriter, req *http.Request, repo *Repo)
 		gotResp <- true
 	}()
 
-	go func() {
-		// Retrieve synopsis from godoc.org. This should be on a package path API
-		// rather than a search.
-		searchResp, err := http.Get("https://api.godoc.org/search?q=" + url.QueryEscape(repo.GopkgPath()))
-		if err == nil {
-			searchResults := &SearchResults{}
-			err = json.NewDecoder(searchResp.Body).Decode(&searchResults)
-			searchResp.Body.Close()
-			if err == nil {
-				gopkgPath := repo.GopkgPath()
-				for _, result := range searchResults.Results {
-					if result.Path == gopkgPath {
-						dataMutex.Lock()
-						data.Synopsis = result.Synopsis
-						dataMutex.Unlock()
-						break
-					}
-				}
-			}
-		}
-		gotResp <- true
-	}()
-
 	r := 0
 	for r < wantResps {
 		select {
@@ -0,0 +1,219 @@
+// Package pktline implements reading and writing of the pkt-line format
+// used by the git wire protocol.
+//
+// Every packet starts with four hexadecimal digits holding the packet length,
+// including the length digits themselves. The lengths 0000, 0001 and 0002 are
+// special packets without a payload: flush, delimiter and response end.
+package pktline
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MaxPayload is the maximum payload size of a data packet.
+const MaxPayload = 65516
+
+// Type identifies the kind of a packet.
+type Type int
+
+const (
+	Data        Type = iota // A packet with a payload.
+	Flush                   // 0000
+	Delim                   // 0001
+	ResponseEnd             // 0002
+)
+
+func (t Type) String() string {
+	switch t {
+	case Data:
+		return "data"
+	case Flush:
+		return "flush"
+	case Delim:
+		return "delim"
+	case ResponseEnd:
+		return "response-end"
+	}
+	return fmt.Sprintf("Type(%d)", int(t))
+}
+
+// ErrTooLong is returned when writing a payload larger than MaxPayload.
+var ErrTooLong = errors.New("pkt-line payload too long")
+
+// Reader reads packets one at a time from an underlying reader, without
+// buffering more than a single packet.
+type Reader struct {
+	r       *bufio.Reader
+	buf     []byte
+	typ     Type
+	payload []byte
+	size    int
+	err     error
+}
+
+// NewReader returns a Reader reading packets from r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// Next advances to the next packet, which is then available via the Type
+// and Payload methods. It returns false at the end of the input or on
+// errors, and Err tells them apart.
+func (r *Reader) Next() bool {
+	if r.err != nil {
+		return false
+	}
+	var head [4]byte
+	n, err := io.ReadFull(r.r, head[:])
+	if err == io.EOF {
+		r.err = io.EOF
+		return false
+	}
+	if err != nil {
+		r.err = fmt.Errorf("cannot read pkt-line length after %d bytes: %w", n, io.ErrUnexpectedEOF)
+		return false
+	}
+	size := 0
+	for _, c := range head {
+		size <<= 4
+		switch {
+		case c >= '0' && c <= '9':
+			size |= int(c - '0')
+		case c >= 'a' && c <= 'f':
+			size |= int(c-'a') + 10
+		case c >= 'A' && c <= 'F':
+			size |= int(c-'A') + 10
+		default:
+			r.err = fmt.Errorf("invalid pkt-line length: %q", head[:])
+			return false
+		}
+	}
+	r.size = size
+	r.payload = nil
+	switch size {
+	case 0:
+		r.typ = Flush
+		r.size = 4
+		return true
+	case 1:
+		r.typ = Delim
+		r.size = 4
+		return true
+	case 2:
+		r.typ = ResponseEnd
+		r.size = 4
+		return true
+	case 3:
+		r.err = fmt.Errorf("invalid pkt-line length: %q", head[:])
+		return false
+	}
+	if size-4 > MaxPayload {
+		r.err = fmt.Errorf("pkt-line length %d exceeds the maximum", size)
+		return false
+	}
+	if cap(r.buf) < size-4 {
+		r.buf = make([]byte, size-4)
+	}
+	r.payload = r.buf[:size-4]
+	if _, err := io.ReadFull(r.r, r.payload); err != nil {
+		r.payload = nil
+		r.err = fmt.Errorf("cannot read pkt-line payload: %w", io.ErrUnexpectedEOF)
+		return false
+	}
+	r.typ = Data
+	return true
+}
+
+// Type returns the type of the current packet.
+func (r *Reader) Type() Type {
+	return r.typ
+}
+
+// Payload returns the payload of the current data packet. The returned
+// slice is only valid until the following call to Next.
+func (r *Reader) Payload() []byte {
+	return r.payload
+}
+
+// Size returns the encoded size of the current packet, including its length.
+func (r *Reader) Size() int {
+	return r.size
+}
+
+// Err returns the error that stopped Next, or nil if the input ended cleanly
+// at a packet boundary.
+func (r *Reader) Err() error {
+	if r.err == io.EOF {
+		return nil
+	}
+	return r.err
+}
+
+// Writer writes packets to an underlying writer.
+type Writer struct {
+	w io.Writer
+}
+
+// NewWriter returns a Writer writing packets to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w}
+}
+
+// Write writes payload as a single data packet.
+func (w *Writer) Write(payload []byte) (int, error) {
+	if len(payload) > MaxPayload {
+		return 0, ErrTooLong
+	}
+	buf := make([]byte, 4+len(payload))
+	hex(buf, 4+len(payload))
+	copy(buf[4:], payload)
+	if _, err := w.w.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(payload), nil
+}
+
+// WriteString writes s as a single data packet.
+func (w *Writer) WriteString(s string) error {
+	_, err := w.Write([]byte(s))
+	return err
+}
+
+// WriteSpecial writes a packet of the given type, without a payload.
+func (w *Writer) WriteSpecial(t Type) error {
+	var s string
+	switch t {
+	case Flush:
+		s = "0000"
+	case Delim:
+		s = "0001"
+	case ResponseEnd:
+		s = "0002"
+	default:
+		return fmt.Errorf("cannot write %s packet without a payload", t)
+	}
+	_, err := io.WriteString(w.w, s)
+	return err
+}
+
+// WriteFlush writes a flush packet.
+func (w *Writer) WriteFlush() error {
+	return w.WriteSpecial(Flush)
+}
+
+// WriteError writes an ERR packet with msg, which git clients report to
+// the user before aborting.
+func (w *Writer) WriteError(msg string) error {
+	return w.WriteString("ERR " + msg + "\n")
+}
+
+func hex(buf []byte, size int) {
+	const digits = "0123456789abcdef"
+	buf[0] = digits[size>>12&0xf]
+	buf[1] = digits[size>>8&0xf]
+	buf[2] = digits[size>>4&0xf]
+	buf[3] = digits[size&0xf]
+}
@@ -0,0 +1,180 @@
+package pktline_test
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/niemeyer/gopkg/pktline"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+var _ = Suite(&S{})
+
+type S struct{}
+
+type packet struct {
+	typ     pktline.Type
+	payload string
+}
+
+var readTests = []struct {
+	input   string
+	packets []packet
+	err     string
+}{{
+	input: "",
+}, {
+	input:   "0000",
+	packets: []packet{{pktline.Flush, ""}},
+}, {
+	input:   "0006a\n0001000bcommand0002",
+	packets: []packet{{pktline.Data, "a\n"}, {pktline.Delim, ""}, {pktline.Data, "command"}, {pktline.ResponseEnd, ""}},
+}, {
+	input:   "000Aabcdef",
+	packets: []packet{{pktline.Data, "abcdef"}},
+}, {
+	input: "0003",
+	err:   `invalid pkt-line length: "0003"`,
+}, {
+	input: "00zz",
+	err:   `invalid pkt-line length: "00zz"`,
+}, {
+	input: "00",
+	err:   "cannot read pkt-line length after 2 bytes: unexpected EOF",
+}, {
+	input:   "0008ab0009abc",
+	packets: []packet{{pktline.Data, "ab00"}},
+	err:     "cannot read pkt-line payload: unexpected EOF",
+}, {
+	input: "fff5",
+	err:   "pkt-line length 65525 exceeds the maximum",
+}}
+
+func (s *S) TestReader(c *C) {
+	for _, test := range readTests {
+		c.Logf("Input: %q", test.input)
+		r := pktline.NewReader(strings.NewReader(test.input))
+		var packets []packet
+		for r.Next() {
+			packets = append(packets, packet{r.Type(), string(r.Payload())})
+		}
+		c.Assert(packets, DeepEquals, test.packets)
+		if test.err == "" {
+			c.Assert(r.Err(), IsNil)
+		} else {
+			c.Assert(r.Err(), ErrorMatches, test.err)
+		}
+		c.Assert(r.Next(), Equals, false)
+	}
+}
+
+func (s *S) TestWriter(c *C) {
+	var buf bytes.Buffer
+	w := pktline.NewWriter(&buf)
+	c.Assert(w.WriteString("# service=git-upload-pack\n"), IsNil)
+	c.Assert(w.WriteFlush(), IsNil)
+	c.Assert(w.WriteString(""), IsNil)
+	c.Assert(w.WriteSpecial(pktline.Delim), IsNil)
+	c.Assert(w.WriteError("oops"), IsNil)
+	c.Assert(w.WriteSpecial(pktline.ResponseEnd), IsNil)
+	c.Assert(buf.String(), Equals, "001e# service=git-upload-pack\n000000040001000dERR oops\n0002")
+
+	_, err := w.Write(make([]byte, pktline.MaxPayload+1))
+	c.Assert(err, Equals, pktline.ErrTooLong)
+	c.Assert(w.WriteSpecial(pktline.Data), ErrorMatches, "cannot write data packet without a payload")
+}
+
+func (s *S) TestSideband(c *C) {
+	var buf bytes.Buffer
+	w := pktline.NewWriter(&buf)
+	progress := pktline.NewSidebandWriter(w, pktline.BandProgress, 999)
+	data := pktline.NewSidebandWriter(w, pktline.BandData, 4)
+	_, err := progress.Write([]byte("counting\n"))
+	c.Assert(err, IsNil)
+	n, err := data.Write([]byte("PACKdata"))
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 8)
+	c.Assert(w.WriteFlush(), IsNil)
+	c.Assert(buf.String(), Equals, "000e\x02counting\n0008\x01PAC0008\x01Kda0007\x01ta0000")
+
+	var msgs bytes.Buffer
+	r := pktline.NewSidebandReader(pktline.NewReader(&buf), &msgs)
+	got, err := io.ReadAll(r)
+	c.Assert(err, IsNil)
+	c.Assert(string(got), Equals, "PACKdata")
+	c.Assert(msgs.String(), Equals, "counting\n")
+
+	r = pktline.NewSidebandReader(pktline.NewReader(strings.NewReader("0006\x01a000a\x03fatal\n")), nil)
+	got, err = io.ReadAll(r)
+	c.Assert(string(got), Equals, "a")
+	c.Assert(err, ErrorMatches, "remote error: fatal")
+
+	r = pktline.NewSidebandReader(pktline.NewReader(strings.NewReader("0006\x01a")), nil)
+	_, err = io.ReadAll(r)
+	c.Assert(err, Equals, io.ErrUnexpectedEOF)
+}
+
+func FuzzReader(f *testing.F) {
+	f.Add([]byte("001e# service=git-upload-pack\n0000"))
+	f.Add([]byte("0006a\n0001000bcommand0002"))
+	f.Add([]byte("0032want 0000000000000000000000000000000000000000\n00000009done\n"))
+	f.Add([]byte("fff4"))
+	f.Add([]byte("00040000"))
+	f.Fuzz(func(t *testing.T, input []byte) {
+		// Packets read must be read back identically once written.
+		var buf bytes.Buffer
+		var packets []packet
+		w := pktline.NewWriter(&buf)
+		r := pktline.NewReader(bytes.NewReader(input))
+		total := 0
+		for r.Next() {
+			if r.Type() == pktline.Data {
+				if len(r.Payload()) > pktline.MaxPayload {
+					t.Fatalf("invalid payload size %d", len(r.Payload()))
+				}
+				if _, err := w.Write(r.Payload()); err != nil {
+					t.Fatal(err)
+				}
+			} else if err := w.WriteSpecial(r.Type()); err != nil {
+				t.Fatal(err)
+			}
+			packets = append(packets, packet{r.Type(), string(r.Payload())})
+			total += r.Size()
+		}
+		if total > len(input) {
+			t.Fatalf("read %d bytes from %d bytes of input", total, len(input))
+		}
+		if r.Err() == nil && total != len(input) {
+			t.Fatalf("clean end after %d bytes of %d bytes of input", total, len(input))
+		}
+		if buf.Len() != total {
+			t.Fatalf("packets written back with %d bytes, read from %d bytes", buf.Len(), total)
+		}
+		r = pktline.NewReader(&buf)
+		for i := 0; r.Next(); i++ {
+			if p := (packet{r.Type(), string(r.Payload())}); p != packets[i] {
+				t.Fatalf("packet %d read back as %v, written as %v", i, p, packets[i])
+			}
+		}
+		if r.Err() != nil {
+			t.Fatalf("cannot read back written packets: %v", r.Err())
+		}
+	})
+}
+
+func FuzzSidebandReader(f *testing.F) {
+	f.Add([]byte("000e\x02counting\n0008\x01PAC0008\x01Kda0007\x01ta0000"))
+	f.Add([]byte("0006\x01a000a\x03fatal\n"))
+	f.Fuzz(func(t *testing.T, input []byte) {
+		r := pktline.NewSidebandReader(pktline.NewReader(bytes.NewReader(input)), io.Discard)
+		data, _ := io.ReadAll(r)
+		if len(data) > len(input) {
+			t.Fatalf("read %d bytes of data from %d bytes of input", len(data), len(input))
+		}
+	})
+}
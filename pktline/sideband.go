@@ -0,0 +1,110 @@
+package pktline
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Sideband channels multiplexed over data packets when the side-band or
+// side-band-64k capabilities are in use.
+const (
+	BandData     = 1
+	BandProgress = 2
+	BandError    = 3
+)
+
+// SidebandWriter writes data to a single sideband channel, splitting it
+// over as many packets as necessary.
+type SidebandWriter struct {
+	w    *Writer
+	band byte
+	max  int
+}
+
+// NewSidebandWriter returns a writer of data for band over w. The max
+// argument is the maximum packet payload, including the band byte:
+// 999 for side-band and MaxPayload for side-band-64k.
+func NewSidebandWriter(w *Writer, band byte, max int) *SidebandWriter {
+	if max > MaxPayload || max < 2 {
+		max = MaxPayload
+	}
+	return &SidebandWriter{w, band, max}
+}
+
+func (s *SidebandWriter) Write(data []byte) (int, error) {
+	buf := make([]byte, 0, s.max)
+	written := 0
+	for len(data) > 0 {
+		n := len(data)
+		if n > s.max-1 {
+			n = s.max - 1
+		}
+		buf = append(append(buf[:0], s.band), data[:n]...)
+		if _, err := s.w.Write(buf); err != nil {
+			return written, err
+		}
+		written += n
+		data = data[n:]
+	}
+	return written, nil
+}
+
+// SidebandReader demultiplexes sideband channels from a Reader, returning
+// the data channel and copying progress messages to a separate writer.
+// Reading ends at the first flush packet, and a message on the error
+// channel is returned as an error.
+type SidebandReader struct {
+	r        *Reader
+	progress io.Writer
+	pending  []byte
+	err      error
+}
+
+// NewSidebandReader returns a reader of the data channel in r. Progress
+// messages are copied into progress, which may be nil to discard them.
+func NewSidebandReader(r *Reader, progress io.Writer) *SidebandReader {
+	return &SidebandReader{r: r, progress: progress}
+}
+
+// ErrRemote is wrapped by errors reported on the sideband error channel.
+var ErrRemote = errors.New("remote error")
+
+func (s *SidebandReader) Read(p []byte) (int, error) {
+	for len(s.pending) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		if !s.r.Next() {
+			s.err = s.r.Err()
+			if s.err == nil {
+				s.err = io.ErrUnexpectedEOF
+			}
+			continue
+		}
+		if s.r.Type() != Data {
+			s.err = io.EOF
+			continue
+		}
+		payload := s.r.Payload()
+		if len(payload) == 0 {
+			continue
+		}
+		switch payload[0] {
+		case BandData:
+			s.pending = payload[1:]
+		case BandProgress:
+			if s.progress != nil {
+				s.progress.Write(payload[1:])
+			}
+		case BandError:
+			s.err = fmt.Errorf("%w: %s", ErrRemote, strings.TrimSpace(string(payload[1:])))
+		default:
+			s.err = fmt.Errorf("invalid sideband channel %d", payload[0])
+		}
+	}
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/niemeyer/gopkg/resolver"
+)
+
+// proxyInfo describes an upload-pack request being proxied to GitHub.
+type proxyInfo struct {
+	ID      uint64    `json:"id"`
+	Remote  string    `json:"remote"`
+	Repo    string    `json:"repo"`
+	Started time.Time `json:"started"`
+	Bytes   int64     `json:"bytes"`
+	Wants   int       `json:"wants"`
+	Haves   int       `json:"haves"`
+}
+
+var proxies = make(map[uint64]*proxyInfo)
+var proxiesLock sync.Mutex
+var proxiesLastID uint64
+
+func startProxy(req *http.Request, repo *resolver.Repo, upr *uploadPackRequest) *proxyInfo {
+	proxiesLock.Lock()
+	defer proxiesLock.Unlock()
+	proxiesLastID++
+	info := &proxyInfo{
+		ID:      proxiesLastID,
+		Remote:  clientIP(req),
+		Repo:    repo.GitHubRoot(),
+		Started: time.Now(),
+		Wants:   len(upr.Wants),
+		Haves:   upr.Haves,
+	}
+	proxies[info.ID] = info
+	return info
+}
+
+func (info *proxyInfo) Write(data []byte) (int, error) {
+	atomic.AddInt64(&info.Bytes, int64(len(data)))
+	return len(data), nil
+}
+
+func (info *proxyInfo) done() {
+	proxiesLock.Lock()
+	delete(proxies, info.ID)
+	proxiesLock.Unlock()
+}
+
+// proxyList returns a snapshot of the in-flight upload-pack proxies, oldest first.
+func proxyList() []proxyInfo {
+	proxiesLock.Lock()
+	defer proxiesLock.Unlock()
+	list := make([]proxyInfo, 0, len(proxies))
+	for _, info := range proxies {
+		list = append(list, proxyInfo{
+			ID:      info.ID,
+			Remote:  info.Remote,
+			Repo:    info.Repo,
+			Started: info.Started,
+			Bytes:   atomic.LoadInt64(&info.Bytes),
+			Wants:   info.Wants,
+			Haves:   info.Haves,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// readUploadPack reads and parses the upload-pack request body, reporting
+// any problems to the client. The raw body is returned for forwarding.
+func readUploadPack(resp http.ResponseWriter, req *http.Request) ([]byte, *uploadPackRequest, bool) {
+	body, plain, ok := resolver.ReadUploadPack(resp, req, *maxRequestFlag)
+	if !ok {
+		return nil, nil, false
+	}
+	upr, err := parseUploadPack(bytes.NewReader(plain))
+	if err != nil {
+		resp.WriteHeader(http.StatusBadRequest)
+		resp.Write([]byte(fmt.Sprintf("Cannot parse upload-pack request: %v", err)))
+		return nil, nil, false
+	}
+	return body, upr, true
+}
+
+// proxyUploadPack forwards the upload-pack request with the provided body to
+// GitHub and streams back its response, unless it wants objects that may not
+// be fetched according to the resolution and -restrict-wants.
+func proxyUploadPack(resp http.ResponseWriter, req *http.Request, res *resolver.Resolution, body []byte, upr *uploadPackRequest) {
+	repo := res.Repo
+	if err := res.Selection.CheckWants(res.Refs, upr.Wants, upr.WantRefs, *restrictWantsFlag); err != nil {
+		resolver.SendUploadPackError(resp, "%v from %s", err, repo.Original().GopkgRoot())
+		return
+	}
+
+	info := startProxy(req, repo, upr)
+	defer info.done()
+
+	ctx, span := startSpan(req.Context(), "upload_pack.proxy", spanInternal,
+		"root", repo.GitHubRoot(),
+		"wants", strconv.Itoa(len(upr.Wants)),
+		"haves", strconv.Itoa(upr.Haves),
+	)
+	var spanErr error
+	defer func() {
+		span.end(spanErr, "bytes", strconv.FormatInt(atomic.LoadInt64(&info.Bytes), 10))
+	}()
+
+	key := packCacheKey(repo.GitHubRoot(), req.Header.Get("Git-Protocol"), upr)
+	if key != "" {
+		if serveCachedPack(resp, key, info) {
+			span.set("cached", "true")
+			return
+		}
+		packCacheMisses.inc()
+	}
+
+	presp, err := res.Handler.ForwardUploadPack(req.WithContext(ctx), repo, bytes.NewReader(body))
+	if err != nil {
+		spanErr = err
+		resp.WriteHeader(http.StatusBadGateway)
+		resp.Write([]byte(fmt.Sprintf("Cannot obtain data pack from GitHub: %v", err)))
+		return
+	}
+	defer presp.Body.Close()
+
+	var cached *packCacheWriter
+	if encoding := presp.Header.Get("Content-Encoding"); key != "" && presp.StatusCode == http.StatusOK && (encoding == "" || encoding == "identity") {
+		cached = createCachedPack(key)
+	}
+	var w io.Writer = info
+	if cached != nil {
+		w = io.MultiWriter(info, cached)
+	}
+
+	_, fromUpstream, err := res.Handler.CopyUploadPack(resp, presp, w)
+	if cached != nil {
+		if err == nil {
+			cached.commit()
+		} else {
+			cached.abort()
+		}
+	}
+	if fromUpstream {
+		spanErr = err
+		log.Printf("Error copying data from GitHub: %v", err)
+		if err == resolver.ErrResponseTooLarge {
+			proxyErrors.inc("too-large")
+		} else {
+			proxyErrors.inc("truncated")
+		}
+		// Break the response off so the client can't take the
+		// partial data it got so far as the complete response.
+		panic(http.ErrAbortHandler)
+	}
+	if err != nil {
+		// Dropped connections are usual and will make this fail.
+		log.Printf("Error copying data to client: %v", err)
+	}
+}
+
+var proxyErrors = newCounter("gopkg_proxy_errors_total", "Number of upload-pack responses from GitHub broken off.", "reason")
+
+// fetchPack obtains from GitHub a pack with all objects reachable from the
+// commit hash in the repository at githubRoot, through the resolver as
+// configured by the flags. The returned reader yields the pack data alone,
+// fails once -max-upload-pack-response is exceeded, and must be closed.
+func fetchPack(githubRoot, hash string) (io.ReadCloser, error) {
+	return resolver.New(resolverOptions()).FetchPack(context.Background(), githubRoot, hash)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Requests are rate limited per client IP with token buckets, separately
+// for packs, which are expensive to serve, and for everything else, such as
+// go-get pages and refs advertisements. Clients may also be allowed or
+// denied altogether by address.
+
+var (
+	allowedClients []*net.IPNet // Nil when all clients are allowed.
+	deniedClients  []*net.IPNet
+	metaLimiter    *rateLimiter // Nil when there's no limit.
+	packsLimiter   *rateLimiter
+)
+
+var (
+	rateLimited   = newCounter("gopkg_rate_limited_total", "Number of requests turned away for exceeding the client rate limit.", "class")
+	deniedTotal   = newCounter("gopkg_denied_total", "Number of requests refused due to the client address.")
+	rateLimitKeys = newGauge("gopkg_rate_limit_clients", "Number of client IPs being tracked for rate limiting.", "class")
+)
+
+// Request classes for rate limiting.
+const (
+	classMeta  = "meta"
+	classPacks = "packs"
+)
+
+func setupRateLimits() error {
+	var err error
+	if trustedProxies, err = parseCIDRs(*trustedProxiesFlag); err != nil {
+		return fmt.Errorf("invalid -trusted-proxies: %v", err)
+	}
+	if allowedClients, err = parseCIDRs(*allowFlag); err != nil {
+		return fmt.Errorf("invalid -allow: %v", err)
+	}
+	if deniedClients, err = parseCIDRs(*denyFlag); err != nil {
+		return fmt.Errorf("invalid -deny: %v", err)
+	}
+	metaLimiter = newRateLimiter(classMeta, *rateMetaFlag, *rateMetaBurstFlag)
+	packsLimiter = newRateLimiter(classPacks, *ratePacksFlag, *ratePacksBurstFlag)
+	return nil
+}
+
+// limitHandler wraps h so that requests from denied clients are refused,
+// and requests from clients over their rate limit are turned away.
+func limitHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if isHealthPath(req.URL.Path) {
+			h.ServeHTTP(resp, req)
+			return
+		}
+		ip := clientIP(req)
+		if !clientAllowed(net.ParseIP(ip)) {
+			deniedTotal.inc()
+			resp.WriteHeader(http.StatusForbidden)
+			resp.Write([]byte("Access denied."))
+			return
+		}
+		if req.URL.Path == "/readyz" {
+			// Readiness is polled often, and reuses its results.
+			h.ServeHTTP(resp, req)
+			return
+		}
+		limiter, class := metaLimiter, classMeta
+		if isPackRequest(req.URL.Path) {
+			limiter, class = packsLimiter, classPacks
+		}
+		if ok, wait := limiter.allow(ip, time.Now()); !ok {
+			rateLimited.inc(class)
+			resp.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			resp.WriteHeader(http.StatusTooManyRequests)
+			resp.Write([]byte("Too many requests from your address; please retry later."))
+			return
+		}
+		h.ServeHTTP(resp, req)
+	})
+}
+
+// clientAllowed returns whether the client at ip may be served.
+func clientAllowed(ip net.IP) bool {
+	if ip == nil {
+		return allowedClients == nil
+	}
+	return !containsIP(deniedClients, ip) && (allowedClients == nil || containsIP(allowedClients, ip))
+}
+
+// isHealthPath returns whether path is for one of the liveness checks, which
+// are never limited. The readiness check at /readyz does more work, so it's
+// only exempt from the rate limits.
+func isHealthPath(path string) bool {
+	return path == "/health-check" || path == "/healthz"
+}
+
+// isPackRequest returns whether the request path is for pack data, rather
+// than for metadata or refs.
+func isPackRequest(path string) bool {
+	return strings.HasSuffix(path, "/git-upload-pack") || strings.HasSuffix(path, bundlePath) || strings.Contains(path, "/objects/")
+}
+
+// rateLimiter holds a token bucket per client IP, refilled at rate tokens
+// per second up to burst tokens.
+type rateLimiter struct {
+	class   string
+	rate    float64
+	burst   float64
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateSweepInterval is how often buckets refilled to the brim are dropped.
+const rateSweepInterval = time.Minute
+
+func newRateLimiter(class string, rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		class:   class,
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// allow takes a token from the bucket for key, and reports whether there
+// was one available. If not, it also reports how long until there is.
+func (l *rateLimiter) allow(key string, now time.Time) (ok bool, wait time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.swept) >= rateSweepInterval {
+		l.sweep(now)
+	}
+	b, found := l.buckets[key]
+	if !found {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(l.burst, b.tokens+elapsed.Seconds()*l.rate)
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep drops the buckets that would be full by now, as they're no
+// different from new ones. It must be called with l.mu held.
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.swept = now
+	rateLimitKeys.set(float64(len(l.buckets)), l.class)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&RateLimitSuite{})
+
+type RateLimitSuite struct{}
+
+func (s *RateLimitSuite) TearDownTest(c *C) {
+	allowedClients = nil
+	deniedClients = nil
+	metaLimiter = nil
+	packsLimiter = nil
+}
+
+func (s *RateLimitSuite) TestRateLimiter(c *C) {
+	l := newRateLimiter(classMeta, 2, 3)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		ok, _ := l.allow("a", now)
+		c.Assert(ok, Equals, true)
+	}
+	ok, wait := l.allow("a", now)
+	c.Assert(ok, Equals, false)
+	c.Assert(wait, Equals, 500*time.Millisecond)
+
+	// Other clients have their own bucket.
+	ok, _ = l.allow("b", now)
+	c.Assert(ok, Equals, true)
+
+	ok, _ = l.allow("a", now.Add(500*time.Millisecond))
+	c.Assert(ok, Equals, true)
+	ok, wait = l.allow("a", now.Add(750*time.Millisecond))
+	c.Assert(ok, Equals, false)
+	c.Assert(wait, Equals, 250*time.Millisecond)
+
+	// Refilled buckets are swept.
+	l.allow("c", now.Add(rateSweepInterval))
+	c.Assert(l.buckets, HasLen, 1)
+
+	// No limit.
+	l = newRateLimiter(classMeta, 0, 3)
+	c.Assert(l, IsNil)
+	ok, _ = l.allow("a", now)
+	c.Assert(ok, Equals, true)
+}
+
+func (s *RateLimitSuite) limited(path, ip string) *httptest.ResponseRecorder {
+	h := limitHandler(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte("ok"))
+	}))
+	req := httptest.NewRequest("GET", path, nil)
+	req.RemoteAddr = ip + ":1234"
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	return resp
+}
+
+func (s *RateLimitSuite) TestLimitHandler(c *C) {
+	metaLimiter = newRateLimiter(classMeta, 0.001, 2)
+	packsLimiter = newRateLimiter(classPacks, 0.001, 1)
+
+	c.Assert(s.limited("/yaml.v2", "10.0.0.1").Code, Equals, 200)
+	c.Assert(s.limited("/yaml.v2/info/refs", "10.0.0.1").Code, Equals, 200)
+	resp := s.limited("/yaml.v2", "10.0.0.1")
+	c.Assert(resp.Code, Equals, 429)
+	c.Assert(resp.Header().Get("Retry-After"), Equals, "1000")
+
+	// Packs have a separate bucket.
+	c.Assert(s.limited("/yaml.v2/git-upload-pack", "10.0.0.1").Code, Equals, 200)
+	c.Assert(s.limited("/yaml.v2/objects/pack/pack-1234.pack", "10.0.0.1").Code, Equals, 429)
+	c.Assert(s.limited("/yaml.v2/info/bundle", "10.0.0.2").Code, Equals, 200)
+
+	// Health checks are never rate limited.
+	c.Assert(s.limited("/health-check", "10.0.0.1").Code, Equals, 200)
+	c.Assert(s.limited("/healthz", "10.0.0.1").Code, Equals, 200)
+	c.Assert(s.limited("/readyz", "10.0.0.1").Code, Equals, 200)
+}
+
+func (s *RateLimitSuite) TestAllowDeny(c *C) {
+	deniedClients, _ = parseCIDRs("10.0.0.0/24")
+	c.Assert(s.limited("/yaml.v2", "10.0.0.1").Code, Equals, 403)
+	c.Assert(s.limited("/yaml.v2", "10.0.1.1").Code, Equals, 200)
+	c.Assert(s.limited("/yaml.v2", "192.0.2.1").Code, Equals, 200)
+
+	allowedClients, _ = parseCIDRs("10.0.0.0/8")
+	c.Assert(s.limited("/yaml.v2", "10.0.0.1").Code, Equals, 403)
+	c.Assert(s.limited("/yaml.v2", "10.0.1.1").Code, Equals, 200)
+	c.Assert(s.limited("/yaml.v2", "192.0.2.1").Code, Equals, 403)
+	c.Assert(s.limited("/health-check", "192.0.2.1").Code, Equals, 200)
+	c.Assert(s.limited("/healthz", "192.0.2.1").Code, Equals, 200)
+	c.Assert(s.limited("/readyz", "192.0.2.1").Code, Equals, 403)
+	c.Assert(s.limited("/readyz", "10.0.1.1").Code, Equals, 200)
+}
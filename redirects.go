@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/niemeyer/gopkg/resolver"
+)
+
+// repoBase identifies a repository by the user and name used in its
+// gopkg.in path. An empty user refers to github.com/go-<name>/<name>.
+type repoBase struct {
+	user string
+	name string
+}
+
+func (base repoBase) String() string {
+	if base.user == "" {
+		return base.name
+	}
+	return base.user + "/" + base.name
+}
+
+// parseRepoBase parses a "name" or "user/name" string as used in gopkg.in paths.
+func parseRepoBase(s string) (base repoBase, ok bool) {
+	parts := strings.Split(s, "/")
+	switch {
+	case len(parts) == 1 && parts[0] != "":
+		return repoBase{"", parts[0]}, true
+	case len(parts) == 2 && parts[0] != "" && parts[1] != "":
+		return repoBase{parts[0], parts[1]}, true
+	}
+	return repoBase{}, false
+}
+
+// githubRepoBase returns the repoBase referring to the given GitHub repository.
+func githubRepoBase(owner, name string) repoBase {
+	if owner == "go-"+name {
+		return repoBase{"", name}
+	}
+	return repoBase{owner, name}
+}
+
+// gitHubRoot returns the repository root at GitHub for base, without a schema.
+func (base repoBase) gitHubRoot() string {
+	repo := resolver.Repo{User: base.user, Name: base.name}
+	return repo.GitHubRoot()
+}
+
+var redirect = map[repoBase]repoBase{
+	// https://github.com/go-fsnotify/fsnotify/issues/1
+	{"", "fsnotify"}: {"fsnotify", "fsnotify"},
+}
+
+const (
+	redirectBuiltin  = "builtin"
+	redirectPending  = "pending"
+	redirectApproved = "approved"
+	redirectRejected = "rejected"
+)
+
+// discoveredRedirect records a repository move reported by GitHub when
+// fetching refs. Only approved redirects change where a package is served
+// from; pending ones are merely reported on the package page.
+type discoveredRedirect struct {
+	Path      string    `json:"path"`   // As in gopkg.in, "name" or "user/name".
+	Target    string    `json:"target"` // GitHub root, without a schema.
+	Status    string    `json:"status"`
+	FirstSeen time.Time `json:"first-seen"`
+}
+
+const redirectsFile = "redirects.json"
+
+var redirects = make(map[repoBase]*discoveredRedirect)
+var redirectsLock sync.RWMutex
+
+func loadRedirects() error {
+	var list []*discoveredRedirect
+	if err := loadState(redirectsFile, &list); err != nil {
+		return err
+	}
+	redirectsLock.Lock()
+	defer redirectsLock.Unlock()
+	for _, r := range list {
+		base, ok := parseRepoBase(r.Path)
+		if !ok {
+			return fmt.Errorf("invalid path in %s: %q", redirectsFile, r.Path)
+		}
+		redirects[base] = r
+	}
+	return nil
+}
+
+// saveRedirects must be called with redirectsLock held.
+func saveRedirects() {
+	list := make([]*discoveredRedirect, 0, len(redirects))
+	for _, r := range redirects {
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+	if err := saveState(redirectsFile, list); err != nil {
+		log.Printf("Error saving redirects: %v", err)
+	}
+}
+
+// lookupRedirect returns the repository that base should be served from,
+// if either an approved or a built-in redirect is in place.
+func lookupRedirect(base repoBase) (target repoBase, ok bool) {
+	redirectsLock.RLock()
+	r, found := redirects[base]
+	redirectsLock.RUnlock()
+	if found && r.Status == redirectApproved {
+		owner, name, _ := strings.Cut(strings.TrimPrefix(r.Target, githubCom+"/"), "/")
+		return githubRepoBase(owner, name), true
+	}
+	target, ok = redirect[base]
+	return target, ok
+}
+
+// pendingRedirect returns the GitHub root that base was reported to have
+// moved to, if that move was not yet reviewed.
+func pendingRedirect(base repoBase) string {
+	redirectsLock.RLock()
+	defer redirectsLock.RUnlock()
+	if r, ok := redirects[base]; ok && r.Status == redirectPending {
+		return r.Target
+	}
+	return ""
+}
+
+// discoverRedirect records that GitHub redirected requests for the
+// repository of base to the provided GitHub root. A move to a different
+// target than previously recorded must be reviewed again.
+func discoverRedirect(base repoBase, target string) {
+	redirectsLock.Lock()
+	defer redirectsLock.Unlock()
+	if r, ok := redirects[base]; ok && strings.EqualFold(r.Target, target) {
+		return
+	}
+	log.Printf("GitHub reports %s moved to %s", base.gitHubRoot(), target)
+	redirects[base] = &discoveredRedirect{
+		Path:      base.String(),
+		Target:    target,
+		Status:    redirectPending,
+		FirstSeen: time.Now(),
+	}
+	saveRedirects()
+}
+
+// reviewRedirect sets the status of the redirect recorded for base.
+func reviewRedirect(base repoBase, status string) error {
+	redirectsLock.Lock()
+	defer redirectsLock.Unlock()
+	r, ok := redirects[base]
+	if !ok {
+		return fmt.Errorf("no redirect recorded for %s", base)
+	}
+	r.Status = status
+	saveRedirects()
+	return nil
+}
+
+// addRedirect records an approved redirect from base to the provided
+// GitHub root, replacing any previous redirect recorded for base.
+func addRedirect(base repoBase, target string) error {
+	owner, name, ok := strings.Cut(strings.TrimPrefix(target, githubCom+"/"), "/")
+	if !ok || owner == "" || name == "" || strings.Contains(name, "/") {
+		return fmt.Errorf("invalid redirect target %q; must be %s/<owner>/<name>", target, githubCom)
+	}
+	redirectsLock.Lock()
+	defer redirectsLock.Unlock()
+	redirects[base] = &discoveredRedirect{
+		Path:      base.String(),
+		Target:    githubCom + "/" + owner + "/" + name,
+		Status:    redirectApproved,
+		FirstSeen: time.Now(),
+	}
+	saveRedirects()
+	return nil
+}
+
+// removeRedirect forgets the redirect recorded for base. Built-in redirects
+// cannot be removed.
+func removeRedirect(base repoBase) error {
+	redirectsLock.Lock()
+	defer redirectsLock.Unlock()
+	if _, ok := redirects[base]; !ok {
+		if _, ok := redirect[base]; ok {
+			return fmt.Errorf("cannot remove built-in redirect for %s", base)
+		}
+		return fmt.Errorf("no redirect recorded for %s", base)
+	}
+	delete(redirects, base)
+	saveRedirects()
+	return nil
+}
+
+// redirectList returns a copy of all recorded and built-in redirects sorted by path.
+func redirectList() []discoveredRedirect {
+	redirectsLock.RLock()
+	defer redirectsLock.RUnlock()
+	list := make([]discoveredRedirect, 0, len(redirects)+len(redirect))
+	for _, r := range redirects {
+		list = append(list, *r)
+	}
+	for base, target := range redirect {
+		if _, ok := redirects[base]; !ok {
+			list = append(list, discoveredRedirect{
+				Path:   base.String(),
+				Target: target.gitHubRoot(),
+				Status: redirectBuiltin,
+			})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+	return list
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&RedirectsSuite{})
+
+type RedirectsSuite struct{}
+
+func (s *RedirectsSuite) TestDiscoverRedirect(c *C) {
+	base := repoBase{"old", "name"}
+	defer func() {
+		redirectsLock.Lock()
+		delete(redirects, base)
+		redirectsLock.Unlock()
+	}()
+
+	discoverRedirect(base, "github.com/new/name")
+	c.Assert(pendingRedirect(base), Equals, "github.com/new/name")
+	_, ok := lookupRedirect(base)
+	c.Assert(ok, Equals, false)
+
+	c.Assert(reviewRedirect(base, redirectApproved), IsNil)
+	c.Assert(pendingRedirect(base), Equals, "")
+	target, ok := lookupRedirect(base)
+	c.Assert(ok, Equals, true)
+	c.Assert(target, Equals, repoBase{"new", "name"})
+
+	// A further move must be reviewed again.
+	discoverRedirect(base, "github.com/go-name/name")
+	c.Assert(pendingRedirect(base), Equals, "github.com/go-name/name")
+	c.Assert(reviewRedirect(base, redirectApproved), IsNil)
+	target, _ = lookupRedirect(base)
+	c.Assert(target, Equals, repoBase{"", "name"})
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// When deployed behind load balancers or other reverse proxies, the client
+// address is the one reported by the proxies listed in -trusted-proxies,
+// either via the Forwarded and X-Forwarded-For headers or, with
+// -proxy-protocol, via the PROXY protocol header sent at the start of
+// every connection.
+
+var trustedProxies []*net.IPNet
+
+// parseCIDRs parses a comma-separated list of CIDRs or plain IP addresses.
+func parseCIDRs(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", s)
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipnet := range nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the IP address of the client that sent req, as reported
+// by trusted proxies in between, if any.
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !containsIP(trustedProxies, ip) {
+		return host
+	}
+	// Each proxy appends the address it got the request from, so walk
+	// back until reaching an address that isn't a trusted proxy.
+	hops := forwardedFor(req.Header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(hops[i])
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !containsIP(trustedProxies, ip) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+// forwardedFor returns the client addresses in the Forwarded header, or in
+// the X-Forwarded-For header if the former is missing, in order.
+func forwardedFor(header http.Header) []string {
+	var hops []string
+	if values := header["Forwarded"]; len(values) > 0 {
+		for _, element := range strings.Split(strings.Join(values, ","), ",") {
+			hop := ""
+			for _, pair := range strings.Split(element, ";") {
+				pair = strings.TrimSpace(pair)
+				if len(pair) > 4 && strings.EqualFold(pair[:4], "for=") {
+					hop = strings.Trim(pair[4:], `"`)
+				}
+			}
+			// Forms are 192.0.2.1, 192.0.2.1:80, [2001:db8::1] and [2001:db8::1]:80.
+			if h, _, err := net.SplitHostPort(hop); err == nil {
+				hop = h
+			}
+			hops = append(hops, strings.Trim(hop, "[]"))
+		}
+		return hops
+	}
+	for _, value := range header["X-Forwarded-For"] {
+		for _, hop := range strings.Split(value, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	return hops
+}
+
+// proxyProtoListener accepts connections that start with a PROXY protocol
+// header, in either version 1 or 2, and reports the client address it
+// holds as the connection remote address.
+type proxyProtoListener struct {
+	net.Listener
+}
+
+func (l proxyProtoListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtoConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// proxyProtoTimeout is how long to wait for the PROXY protocol header.
+const proxyProtoTimeout = 10 * time.Second
+
+// proxyProtoConn parses the PROXY protocol header on first use, which
+// happens in the connection goroutine rather than in the accept loop.
+type proxyProtoConn struct {
+	net.Conn
+	r      *bufio.Reader
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyProtoConn) init() {
+	c.once.Do(func() {
+		c.remote = c.Conn.RemoteAddr()
+		if tcp, ok := c.remote.(*net.TCPAddr); ok && len(trustedProxies) > 0 && !containsIP(trustedProxies, tcp.IP) {
+			c.err = fmt.Errorf("PROXY protocol header from untrusted address %s", c.remote)
+			return
+		}
+		c.Conn.SetReadDeadline(time.Now().Add(proxyProtoTimeout))
+		remote, err := readProxyHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			c.err = fmt.Errorf("invalid PROXY protocol header from %s: %v", c.remote, err)
+		} else if remote != nil {
+			c.remote = remote
+		}
+	})
+}
+
+func (c *proxyProtoConn) Read(p []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(p)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.init()
+	return c.remote
+}
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// readProxyHeader reads a PROXY protocol header from r, and returns the
+// client address it holds, or nil if the connection isn't being proxied.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	start, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(start, proxyV2Signature) {
+		return readProxyHeaderV1(r)
+	}
+
+	var header [16]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported version")
+	}
+	data := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	if header[12]&0xf == 0 {
+		// LOCAL command, such as health checks from the proxy itself.
+		return nil, nil
+	}
+	switch header[13] {
+	case 0x11: // TCP over IPv4
+		if len(data) < 12 {
+			return nil, fmt.Errorf("short address block")
+		}
+		return &net.TCPAddr{IP: net.IP(data[:4]), Port: int(binary.BigEndian.Uint16(data[8:]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(data) < 36 {
+			return nil, fmt.Errorf("short address block")
+		}
+		return &net.TCPAddr{IP: net.IP(data[:16]), Port: int(binary.BigEndian.Uint16(data[32:]))}, nil
+	}
+	return nil, nil
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	// The longest header is 107 bytes long, including the CRLF.
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("header line too long")
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return nil, fmt.Errorf("missing PROXY signature")
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, fmt.Errorf("malformed header line")
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("malformed header line")
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// listenPublic listens on addr for one of the public servers, expecting a
+// PROXY protocol header on every connection if -proxy-protocol is set.
+func listenPublic(name, addr string) (net.Listener, error) {
+	l, err := listen(name, addr)
+	if err != nil {
+		return nil, err
+	}
+	if *proxyProtocolFlag {
+		l = proxyProtoListener{l}
+	}
+	return l, nil
+}
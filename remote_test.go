@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&RemoteSuite{})
+
+type RemoteSuite struct{}
+
+func (s *RemoteSuite) TearDownTest(c *C) {
+	trustedProxies = nil
+}
+
+func (s *RemoteSuite) TestParseCIDRs(c *C) {
+	nets, err := parseCIDRs("10.0.0.0/8, 192.0.2.1,2001:db8::/32,,")
+	c.Assert(err, IsNil)
+	c.Assert(nets, HasLen, 3)
+	c.Assert(containsIP(nets, net.ParseIP("10.1.2.3")), Equals, true)
+	c.Assert(containsIP(nets, net.ParseIP("192.0.2.1")), Equals, true)
+	c.Assert(containsIP(nets, net.ParseIP("192.0.2.2")), Equals, false)
+	c.Assert(containsIP(nets, net.ParseIP("2001:db8::1")), Equals, true)
+
+	_, err = parseCIDRs("10.0.0.0/33")
+	c.Assert(err, ErrorMatches, `invalid CIDR "10.0.0.0/33"`)
+	_, err = parseCIDRs("example.com")
+	c.Assert(err, ErrorMatches, `invalid IP address "example.com"`)
+}
+
+var clientIPTests = []struct {
+	remote string
+	header http.Header
+	ip     string
+}{{
+	remote: "192.0.2.1:1234",
+	header: http.Header{"X-Forwarded-For": {"198.51.100.1"}},
+	ip:     "192.0.2.1",
+}, {
+	remote: "10.0.0.1:1234",
+	header: http.Header{"X-Forwarded-For": {"198.51.100.1"}},
+	ip:     "198.51.100.1",
+}, {
+	remote: "10.0.0.1:1234",
+	header: http.Header{"X-Forwarded-For": {"203.0.113.9, 198.51.100.1, 10.0.0.2"}},
+	ip:     "198.51.100.1",
+}, {
+	remote: "10.0.0.1:1234",
+	header: http.Header{"X-Forwarded-For": {"203.0.113.9", "10.0.0.2"}},
+	ip:     "203.0.113.9",
+}, {
+	remote: "10.0.0.1:1234",
+	header: http.Header{"X-Forwarded-For": {"bogus, 10.0.0.2"}},
+	ip:     "10.0.0.2",
+}, {
+	remote: "10.0.0.1:1234",
+	header: http.Header{},
+	ip:     "10.0.0.1",
+}, {
+	remote: "10.0.0.1:1234",
+	header: http.Header{
+		"Forwarded":       {`for=198.51.100.1;proto=https, for="[2001:db8::1]:4711"`},
+		"X-Forwarded-For": {"203.0.113.9"},
+	},
+	ip: "2001:db8::1",
+}, {
+	remote: "10.0.0.1:1234",
+	header: http.Header{"Forwarded": {`for="198.51.100.1:80"`, "for=10.0.0.2"}},
+	ip:     "198.51.100.1",
+}, {
+	remote: "10.0.0.1:1234",
+	header: http.Header{"Forwarded": {"for=_hidden, for=10.0.0.2"}},
+	ip:     "10.0.0.2",
+}}
+
+func (s *RemoteSuite) TestClientIP(c *C) {
+	trustedProxies, _ = parseCIDRs("10.0.0.0/8")
+	for _, test := range clientIPTests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = test.remote
+		req.Header = test.header
+		c.Check(clientIP(req), Equals, test.ip, Commentf("remote %s, header %v", test.remote, test.header))
+	}
+}
+
+var proxyHeaderV1Tests = []struct {
+	header string
+	addr   string
+	err    string
+}{
+	{header: "PROXY TCP4 198.51.100.1 10.0.0.1 4711 443\r\n", addr: "198.51.100.1:4711"},
+	{header: "PROXY TCP6 2001:db8::1 2001:db8::2 4711 443\r\n", addr: "[2001:db8::1]:4711"},
+	{header: "PROXY UNKNOWN\r\n"},
+	{header: "GET / HTTP/1.1\r\n", err: "missing PROXY signature"},
+	{header: "PROXY TCP4 bogus 10.0.0.1 4711 443\r\n", err: "malformed header line"},
+	{header: "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", err: "header line too long"},
+}
+
+func (s *RemoteSuite) TestReadProxyHeaderV1(c *C) {
+	for _, test := range proxyHeaderV1Tests {
+		r := bufio.NewReader(strings.NewReader(test.header + "GET / HTTP/1.1\r\n"))
+		addr, err := readProxyHeader(r)
+		if test.err != "" {
+			c.Check(err, ErrorMatches, test.err)
+			continue
+		}
+		c.Assert(err, IsNil)
+		if test.addr == "" {
+			c.Check(addr, IsNil)
+		} else {
+			c.Check(addr.String(), Equals, test.addr)
+		}
+		rest, _ := r.ReadString('\n')
+		c.Check(rest, Equals, "GET / HTTP/1.1\r\n")
+	}
+}
+
+func proxyHeaderV2(command byte, family byte, addr []byte) []byte {
+	header := append([]byte(nil), proxyV2Signature...)
+	header = append(header, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(addr)))
+	return append(header, addr...)
+}
+
+func (s *RemoteSuite) TestProxyProtoConn(c *C) {
+	ipv4 := []byte{198, 51, 100, 1, 10, 0, 0, 1, 0x12, 0x67, 0x01, 0xbb}
+	ipv6 := make([]byte, 36)
+	copy(ipv6, net.ParseIP("2001:db8::1"))
+	binary.BigEndian.PutUint16(ipv6[32:], 4711)
+
+	tests := []struct {
+		header []byte
+		addr   string
+	}{
+		{proxyHeaderV2(1, 0x11, ipv4), "198.51.100.1:4711"},
+		{proxyHeaderV2(1, 0x21, ipv6), "[2001:db8::1]:4711"},
+		{proxyHeaderV2(0, 0x00, nil), "pipe"},
+		{[]byte("PROXY TCP4 198.51.100.1 10.0.0.1 4711 443\r\n"), "198.51.100.1:4711"},
+	}
+	for _, test := range tests {
+		client, server := net.Pipe()
+		go func() {
+			client.Write(test.header)
+			client.Write([]byte("hello"))
+			client.Close()
+		}()
+		conn := &proxyProtoConn{Conn: server, r: bufio.NewReader(server)}
+		c.Check(conn.RemoteAddr().String(), Equals, test.addr)
+		buf := make([]byte, 5)
+		_, err := conn.Read(buf)
+		c.Check(err, IsNil)
+		c.Check(string(buf), Equals, "hello")
+		server.Close()
+	}
+
+	client, server := net.Pipe()
+	go func() {
+		client.Write([]byte("GET / HTTP/1.1\r\n"))
+		client.Close()
+	}()
+	conn := &proxyProtoConn{Conn: server, r: bufio.NewReader(server)}
+	_, err := conn.Read(make([]byte, 5))
+	c.Check(err, ErrorMatches, "invalid PROXY protocol header from pipe: missing PROXY signature")
+	server.Close()
+}
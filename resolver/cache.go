@@ -0,0 +1,158 @@
+package resolver
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Cache holds the refs advertisements obtained from the upstream server,
+// by repository root.
+type Cache interface {
+	// Get returns the refs cached for root, or nil if there are none
+	// or they're stale.
+	Get(root string) []byte
+	Set(root string, refs []byte)
+}
+
+// MemoryCache is a Cache holding refs in memory for a fixed time.
+type MemoryCache struct {
+	ttl     time.Duration
+	mu      sync.RWMutex
+	entries map[string]*cacheEntry
+}
+
+type cacheEntry struct {
+	refs      []byte
+	timestamp time.Time
+}
+
+// CacheInfo describes an entry in a MemoryCache.
+type CacheInfo struct {
+	Root    string    `json:"root"`
+	Size    int       `json:"size"`
+	Fetched time.Time `json:"fetched"`
+	Expired bool      `json:"expired"`
+}
+
+// NewMemoryCache returns a MemoryCache holding refs for ttl.
+func NewMemoryCache(ttl time.Duration) *MemoryCache {
+	return &MemoryCache{
+		ttl:     ttl,
+		entries: make(map[string]*cacheEntry),
+	}
+}
+
+func (c *MemoryCache) Get(root string) []byte {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if entry, ok := c.entries[root]; ok {
+		if time.Since(entry.timestamp) < c.ttl {
+			return entry.refs
+		}
+	}
+	return nil
+}
+
+func (c *MemoryCache) Set(root string, refs []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry, ok := c.entries[root]; ok {
+		if time.Since(entry.timestamp) < c.ttl {
+			return
+		}
+	}
+	c.entries[root] = &cacheEntry{
+		refs:      refs,
+		timestamp: time.Now(),
+	}
+}
+
+func (c *MemoryCache) info(root string, entry *cacheEntry) CacheInfo {
+	return CacheInfo{
+		Root:    root,
+		Size:    len(entry.refs),
+		Fetched: entry.timestamp,
+		Expired: time.Since(entry.timestamp) >= c.ttl,
+	}
+}
+
+// List returns details about all entries sorted by root.
+func (c *MemoryCache) List() []CacheInfo {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	list := make([]CacheInfo, 0, len(c.entries))
+	for root, entry := range c.entries {
+		list = append(list, c.info(root, entry))
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Root < list[j].Root })
+	return list
+}
+
+// Lookup returns details about the entry for root and the refs it holds,
+// even if stale.
+func (c *MemoryCache) Lookup(root string) (info CacheInfo, refs []byte, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	entry, ok := c.entries[root]
+	if !ok {
+		return CacheInfo{}, nil, false
+	}
+	return c.info(root, entry), entry.refs, true
+}
+
+// Purge drops the entry for root, or all entries if root is empty, and
+// reports whether anything was dropped.
+func (c *MemoryCache) Purge(root string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if root == "" {
+		purged := len(c.entries) > 0
+		c.entries = make(map[string]*cacheEntry)
+		return purged
+	}
+	_, ok := c.entries[root]
+	delete(c.entries, root)
+	return ok
+}
+
+type cacheEntryJSON struct {
+	Refs    []byte    `json:"refs"`
+	Fetched time.Time `json:"fetched"`
+}
+
+// MarshalJSON encodes all entries that aren't stale, so that they may be
+// restored with UnmarshalJSON by another process.
+func (c *MemoryCache) MarshalJSON() ([]byte, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	entries := make(map[string]cacheEntryJSON)
+	for root, entry := range c.entries {
+		if time.Since(entry.timestamp) < c.ttl {
+			entries[root] = cacheEntryJSON{entry.refs, entry.timestamp}
+		}
+	}
+	return json.Marshal(entries)
+}
+
+// UnmarshalJSON adds the entries encoded by MarshalJSON that aren't stale
+// yet, replacing any older entries for the same roots.
+func (c *MemoryCache) UnmarshalJSON(data []byte) error {
+	var entries map[string]cacheEntryJSON
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for root, e := range entries {
+		if time.Since(e.Fetched) >= c.ttl {
+			continue
+		}
+		if old, ok := c.entries[root]; ok && !old.timestamp.Before(e.Fetched) {
+			continue
+		}
+		c.entries[root] = &cacheEntry{refs: e.Refs, timestamp: e.Fetched}
+	}
+	return nil
+}
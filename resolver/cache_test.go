@@ -0,0 +1,50 @@
+package resolver
+
+import (
+	"encoding/json"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&CacheSuite{})
+
+type CacheSuite struct{}
+
+func (s *CacheSuite) TestMemoryCache(c *C) {
+	cache := NewMemoryCache(time.Minute)
+	c.Assert(cache.Get("github.com/user/repo"), IsNil)
+	cache.Set("github.com/user/repo", []byte("refs"))
+	c.Assert(string(cache.Get("github.com/user/repo")), Equals, "refs")
+
+	info, refs, ok := cache.Lookup("github.com/user/repo")
+	c.Assert(ok, Equals, true)
+	c.Assert(string(refs), Equals, "refs")
+	c.Assert(info.Size, Equals, 4)
+	c.Assert(info.Expired, Equals, false)
+	c.Assert(cache.List(), DeepEquals, []CacheInfo{info})
+
+	c.Assert(cache.Purge("github.com/other/repo"), Equals, false)
+	c.Assert(cache.Purge("github.com/user/repo"), Equals, true)
+	c.Assert(cache.Get("github.com/user/repo"), IsNil)
+}
+
+func (s *CacheSuite) TestMemoryCacheJSON(c *C) {
+	cache := NewMemoryCache(time.Minute)
+	cache.Set("github.com/user/fresh", []byte("fresh"))
+	cache.Set("github.com/user/stale", []byte("stale"))
+	cache.entries["github.com/user/stale"].timestamp = time.Now().Add(-time.Hour)
+
+	data, err := json.Marshal(cache)
+	c.Assert(err, IsNil)
+
+	restored := NewMemoryCache(time.Minute)
+	c.Assert(json.Unmarshal(data, restored), IsNil)
+	c.Assert(string(restored.Get("github.com/user/fresh")), Equals, "fresh")
+	_, _, ok := restored.Lookup("github.com/user/stale")
+	c.Assert(ok, Equals, false)
+
+	info, _, _ := restored.Lookup("github.com/user/fresh")
+	orig, _, _ := cache.Lookup("github.com/user/fresh")
+	c.Assert(info.Fetched.Equal(orig.Fetched), Equals, true)
+}
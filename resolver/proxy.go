@@ -0,0 +1,275 @@
+package resolver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/niemeyer/gopkg/pktline"
+)
+
+// Headers forwarded between the client and Upstream when proxying
+// upload-pack requests. Everything else, such as hop-by-hop headers,
+// cookies and credentials, is dropped.
+var (
+	proxyRequestHeaders  = []string{"Accept", "Accept-Encoding", "Content-Encoding", "Content-Type", "Git-Protocol"}
+	proxyResponseHeaders = []string{"Cache-Control", "Content-Encoding", "Content-Type", "Expires", "Pragma"}
+)
+
+// ErrResponseTooLarge is returned by CopyUploadPack when the response from
+// Upstream is larger than the MaxResponse option allows.
+var ErrResponseTooLarge = errors.New("upload-pack response too large")
+
+// ForwardUploadPack sends the upload-pack request for repo to Upstream, with
+// body in place of the original request body, and returns the response.
+// Only the headers relevant to the git protocol are forwarded.
+func (h *Handler) ForwardUploadPack(req *http.Request, repo *Repo, body io.Reader) (*http.Response, error) {
+	header := make(http.Header)
+	copyHeader(header, req.Header, proxyRequestHeaders)
+	return h.forwardUploadPack(req.Context(), repo.GitHubRoot(), header, req.Header.Get("Via"), body)
+}
+
+func (h *Handler) forwardUploadPack(ctx context.Context, root string, header http.Header, via string, body io.Reader) (*http.Response, error) {
+	preq, err := http.NewRequestWithContext(ctx, "POST", "https://"+root+".git/git-upload-pack", body)
+	if err != nil {
+		return nil, err
+	}
+	preq.Header = header
+	preq.Header.Set("User-Agent", h.opts.UserAgent)
+	preq.Header.Set("Via", h.via(via))
+	return h.opts.PackClient.Do(preq)
+}
+
+// FetchPack obtains from Upstream a pack with all objects reachable from the
+// commit hash in the repository at root, as returned by Repo.GitHubRoot.
+// The returned reader yields the pack data alone, fails with
+// ErrResponseTooLarge once more than the MaxResponse option allows is read,
+// and must be closed.
+func (h *Handler) FetchPack(ctx context.Context, root, hash string) (io.ReadCloser, error) {
+	var body bytes.Buffer
+	pw := pktline.NewWriter(&body)
+	pw.WriteString("want " + hash + " ofs-delta agent=" + h.opts.Host + "\n")
+	pw.WriteFlush()
+	pw.WriteString("done\n")
+
+	header := http.Header{
+		"Content-Type": {"application/x-git-upload-pack-request"},
+		"Accept":       {"application/x-git-upload-pack-result"},
+	}
+	resp, err := h.forwardUploadPack(ctx, root, header, "", &body)
+	if err != nil {
+		return nil, fmt.Errorf("cannot obtain data pack from %s: %v", h.opts.Upstream, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("cannot obtain data pack from %s: %s", h.opts.Upstream, resp.Status)
+	}
+
+	// Without side-band the NAK line is followed by the raw pack.
+	var nak [8]byte
+	if _, err := io.ReadFull(resp.Body, nak[:]); err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("cannot obtain data pack from %s: %v", h.opts.Upstream, err)
+	}
+	if string(nak[:]) != "0008NAK\n" {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected upload-pack response from %s: %q", h.opts.Upstream, nak[:])
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{&upstreamReader{r: resp.Body, max: h.opts.MaxResponse}, resp.Body}, nil
+}
+
+// CopyUploadPack copies the upload-pack response obtained from Upstream to
+// resp, and to w as well if it's not nil. It returns an error if the
+// response couldn't be copied completely. Errors writing to the client are
+// usual, as connections get dropped. Errors reading from Upstream, including
+// ErrResponseTooLarge, are reported with fromUpstream set, and the caller
+// must then break the response off, such as by panicking with
+// http.ErrAbortHandler, so the client can't take the partial data it got so
+// far as the complete response.
+func (h *Handler) CopyUploadPack(resp http.ResponseWriter, presp *http.Response, w io.Writer) (n int64, fromUpstream bool, err error) {
+	copyHeader(resp.Header(), presp.Header, proxyResponseHeaders)
+	resp.Header().Set("Via", h.via(presp.Header.Get("Via")))
+	resp.WriteHeader(presp.StatusCode)
+
+	var dst io.Writer = resp
+	if w != nil {
+		dst = io.MultiWriter(resp, w)
+	}
+	upstream := &upstreamReader{r: presp.Body, max: h.opts.MaxResponse}
+	n, err = io.Copy(dst, upstream)
+	if upstream.err != nil {
+		return n, true, upstream.err
+	}
+	return n, false, err
+}
+
+// proxyUploadPack forwards the upload-pack request for repo to Upstream,
+// unless it wants objects that may not be fetched according to sel.
+func (h *Handler) proxyUploadPack(resp http.ResponseWriter, req *http.Request, repo *Repo, sel *Selection, refs []byte) {
+	if req.Method != "POST" {
+		resp.Header().Set("Allow", "POST")
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	body, plain, ok := ReadUploadPack(resp, req, h.opts.MaxRequest)
+	if !ok {
+		return
+	}
+	wants, wantRefs, err := parseWants(plain)
+	if err != nil {
+		resp.WriteHeader(http.StatusBadRequest)
+		resp.Write([]byte(fmt.Sprintf("Cannot parse upload-pack request: %v", err)))
+		return
+	}
+	if err := sel.CheckWants(refs, wants, wantRefs, false); err != nil {
+		SendUploadPackError(resp, "%v from %s", err, repo.Original().GopkgRoot())
+		return
+	}
+
+	ctx, end := h.trace(req.Context(), "resolver.proxy_upload_pack", "root", repo.GitHubRoot())
+	presp, err := h.ForwardUploadPack(req.WithContext(ctx), repo, bytes.NewReader(body))
+	if err != nil {
+		end(err)
+		resp.WriteHeader(http.StatusBadGateway)
+		resp.Write([]byte(fmt.Sprintf("Cannot obtain data pack from %s: %v", repo.upstream(), err)))
+		return
+	}
+	defer presp.Body.Close()
+	n, fromUpstream, err := h.CopyUploadPack(resp, presp, nil)
+	end(err, "bytes", strconv.FormatInt(n, 10))
+	if fromUpstream {
+		h.opts.Logger.Printf("Error copying data from %s: %v", repo.upstream(), err)
+		panic(http.ErrAbortHandler)
+	}
+	if err != nil {
+		h.opts.Logger.Printf("Error copying data to client: %v", err)
+	}
+}
+
+// ReadUploadPack reads the upload-pack request body, of up to max bytes both
+// as sent and uncompressed, reporting any problems to the client. It returns
+// the body as sent, for forwarding, and uncompressed.
+func ReadUploadPack(resp http.ResponseWriter, req *http.Request, max int64) (body, plain []byte, ok bool) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(resp, req.Body, max))
+	if err != nil {
+		status := http.StatusBadRequest
+		if _, ok := err.(*http.MaxBytesError); ok {
+			status = http.StatusRequestEntityTooLarge
+		}
+		resp.WriteHeader(status)
+		resp.Write([]byte(fmt.Sprintf("Cannot read upload-pack request: %v", err)))
+		return nil, nil, false
+	}
+	r, err := uploadPackBody(body, req.Header.Get("Content-Encoding"))
+	if err == nil {
+		// Compressed bodies are limited in size once uncompressed as well.
+		plain, err = ioutil.ReadAll(io.LimitReader(r, max+1))
+	}
+	if err != nil {
+		resp.WriteHeader(http.StatusBadRequest)
+		resp.Write([]byte(fmt.Sprintf("Cannot read upload-pack request: %v", err)))
+		return nil, nil, false
+	}
+	if int64(len(plain)) > max {
+		resp.WriteHeader(http.StatusRequestEntityTooLarge)
+		resp.Write([]byte("Cannot read upload-pack request: uncompressed request body too large"))
+		return nil, nil, false
+	}
+	return body, plain, true
+}
+
+// uploadPackBody returns a reader for the uncompressed upload-pack request
+// body, as sent with the given Content-Encoding header.
+func uploadPackBody(body []byte, encoding string) (io.Reader, error) {
+	switch encoding {
+	case "", "identity":
+		return bytes.NewReader(body), nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(bytes.NewReader(body))
+	}
+	return nil, fmt.Errorf("unsupported upload-pack request encoding %q", encoding)
+}
+
+// parseWants returns the object hashes and references wanted in the
+// uncompressed upload-pack request body.
+func parseWants(body []byte) (wants, wantRefs []string, err error) {
+	pr := pktline.NewReader(bytes.NewReader(body))
+	for pr.Next() {
+		if pr.Type() != pktline.Data || !bytes.HasPrefix(pr.Payload(), []byte("want")) {
+			continue
+		}
+		line := strings.TrimSuffix(string(pr.Payload()), "\n")
+		fields := strings.Fields(line)
+		switch {
+		case fields[0] == "want-ref" && len(fields) == 2:
+			wantRefs = append(wantRefs, fields[1])
+		case fields[0] == "want" && len(fields) >= 2 && len(fields[1]) == 40:
+			wants = append(wants, fields[1])
+		case fields[0] == "want" || fields[0] == "want-ref":
+			return nil, nil, fmt.Errorf("invalid upload-pack %s line: %q", fields[0], line)
+		}
+	}
+	if err := pr.Err(); err != nil {
+		return nil, nil, fmt.Errorf("cannot parse upload-pack request: %v", err)
+	}
+	return wants, wantRefs, nil
+}
+
+// SendUploadPackError reports an error to the git client in the upload-pack
+// protocol, so that the message is shown to the user.
+func SendUploadPackError(resp http.ResponseWriter, msg string, args ...interface{}) {
+	if len(args) > 0 {
+		msg = fmt.Sprintf(msg, args...)
+	}
+	resp.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+	resp.Header().Set("Cache-Control", "no-cache")
+	pktline.NewWriter(resp).WriteError(msg)
+}
+
+// via returns the Via header value with the Host option appended to via.
+func (h *Handler) via(via string) string {
+	if via == "" {
+		return "1.1 " + h.opts.Host
+	}
+	return via + ", 1.1 " + h.opts.Host
+}
+
+func copyHeader(dst, src http.Header, keys []string) {
+	for _, key := range keys {
+		if values, ok := src[key]; ok {
+			dst[key] = append([]string(nil), values...)
+		}
+	}
+}
+
+// upstreamReader reads the response body from Upstream, recording errors
+// other than io.EOF so they can be told apart from errors writing to the
+// client, and failing once more than max bytes are read, if max is positive.
+type upstreamReader struct {
+	r   io.Reader
+	n   int64
+	max int64
+	err error
+}
+
+func (r *upstreamReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	if r.max > 0 && r.n > r.max {
+		err = ErrResponseTooLarge
+	}
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
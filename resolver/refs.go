@@ -0,0 +1,389 @@
+package resolver
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/niemeyer/gopkg/pktline"
+)
+
+// RefLine describes a reference line in a refs advertisement.
+type RefLine struct {
+	Hash string
+	Name string
+	Caps string
+
+	// HashOffset is the offset of the hash in the refs advertisement.
+	HashOffset int
+}
+
+// parseRefLine parses the payload of a reference line, in the form
+// "<hash> <name>[\x00<capabilities>]\n".
+func parseRefLine(payload []byte) (line RefLine, ok bool) {
+	payload = bytes.TrimSuffix(payload, []byte("\n"))
+	if len(payload) < 42 || payload[40] != ' ' {
+		return line, false
+	}
+	line.Hash = string(payload[:40])
+	name := payload[41:]
+	if i := bytes.IndexByte(name, 0); i >= 0 {
+		line.Caps = string(name[i+1:])
+		name = name[:i]
+	}
+	line.Name = string(name)
+	return line, true
+}
+
+// ScanRefs calls f for every reference line in the refs advertisement read from r.
+func ScanRefs(r io.Reader, f func(line RefLine)) error {
+	pr := pktline.NewReader(r)
+	offset := 0
+	for pr.Next() {
+		size := pr.Size()
+		if pr.Type() == pktline.Data {
+			if line, ok := parseRefLine(pr.Payload()); ok {
+				line.HashOffset = offset + 4
+				f(line)
+			}
+		}
+		offset += size
+	}
+	if err := pr.Err(); err != nil {
+		return fmt.Errorf("cannot parse refs received from GitHub: %v", err)
+	}
+	return nil
+}
+
+// Selection holds the outcome of selecting the best reference matching
+// a major version in a refs advertisement.
+type Selection struct {
+	Versions VersionList // All versions available, including duplicates from peeled tags.
+
+	Keep bool   // Advertisement must be served unchanged.
+	caps string // Original HEAD capabilities.
+
+	// When Filter is set, only HEAD, master, and references to versions
+	// matching major are advertised. References to blocked versions are
+	// never advertised.
+	Filter  bool
+	major   Version
+	blocked func(v Version) bool
+
+	Version Version // Best version matching, with its reference hash and name.
+	Hash    string
+	Name    string
+}
+
+// SelectRefs reads the refs advertisement from r and selects the best
+// version matching major. Versions for which blocked returns true are
+// neither selected nor reported in versions. The blocked function may be nil.
+func SelectRefs(r io.Reader, major Version, blocked func(v Version) bool) (*Selection, error) {
+	sel := &Selection{
+		Versions: make(VersionList, 0),
+		Version:  InvalidVersion,
+		major:    major,
+		blocked:  blocked,
+	}
+	var hasHead, hasBlocked bool
+
+	// Record all available versions, the HEAD capabilities, and details
+	// of the best reference satisfying the requested major version.
+	err := ScanRefs(r, func(line RefLine) {
+		name := line.Name
+
+		if name == "HEAD" {
+			hasHead = true
+			sel.caps = line.Caps
+		}
+
+		if strings.HasPrefix(name, "refs/heads/v") || strings.HasPrefix(name, "refs/tags/v") {
+			// Annotated tag is peeled off and overrides the same version just parsed.
+			name = strings.TrimSuffix(name, "^{}")
+
+			v, ok := ParseVersion(name[strings.IndexByte(name, 'v'):])
+			if ok && blocked != nil && blocked(v) {
+				hasBlocked = hasBlocked || major.Contains(v)
+				return
+			}
+			if ok && major.Contains(v) && (v == sel.Version || !sel.Version.IsValid() || sel.Version.Less(v)) {
+				sel.Version = v
+				sel.Hash = line.Hash
+				sel.Name = name
+			}
+			if ok {
+				sel.Versions = append(sel.Versions, v)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// If there were absolutely no versions, and v0 was requested, accept the master as-is.
+	if len(sel.Versions) == 0 && !hasBlocked && major == (Version{0, -1, -1, false}) {
+		sel.Keep = true
+		return sel, nil
+	}
+
+	// If there is no HEAD line or the version was not found, report as unavailable.
+	if !hasHead || sel.Hash == "" {
+		if hasBlocked {
+			return nil, ErrBlocked
+		}
+		return nil, ErrNoVersion
+	}
+	return sel, nil
+}
+
+// WriteRefs writes to w the refs advertisement read from r, which must be
+// the same one the selection was made from, with the HEAD and master
+// references pointing to the selected version, and without references
+// to blocked versions.
+func (sel *Selection) WriteRefs(w io.Writer, r io.Reader) error {
+	pw := pktline.NewWriter(w)
+	return sel.rewriteRefs(r, func(t pktline.Type, payload []byte) error {
+		if t != pktline.Data {
+			return pw.WriteSpecial(t)
+		}
+		_, err := pw.Write(payload)
+		return err
+	})
+}
+
+// rewriteRefs reads the refs advertisement from r one packet at a time,
+// and calls f with every packet that WriteRefs advertises in its place.
+func (sel *Selection) rewriteRefs(r io.Reader, f func(t pktline.Type, payload []byte) error) error {
+	pr := pktline.NewReader(r)
+	for pr.Next() {
+		var err error
+		if pr.Type() != pktline.Data {
+			err = f(pr.Type(), nil)
+		} else if line, ok := parseRefLine(pr.Payload()); sel.Keep || !ok {
+			err = f(pktline.Data, pr.Payload())
+		} else if line.Name == "HEAD" {
+			head, master := sel.headLines()
+			if err = f(pktline.Data, []byte(head)); err == nil {
+				err = f(pktline.Data, []byte(master))
+			}
+		} else if line.Name != "refs/heads/master" && !sel.isBlocked(line.Name) && (!sel.Filter || sel.matches(line.Name)) {
+			// The original master line is dropped in favor of the one written with HEAD.
+			err = f(pktline.Data, pr.Payload())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := pr.Err(); err != nil {
+		return fmt.Errorf("cannot parse refs received from GitHub: %v", err)
+	}
+	return nil
+}
+
+// WriteLsRefs writes to w the response to a protocol v2 ls-refs command
+// with the provided arguments, listing the same references that WriteRefs
+// would advertise for the refs advertisement read from r.
+func (sel *Selection) WriteLsRefs(w io.Writer, r io.Reader, args []string) error {
+	var peel, symrefs bool
+	var prefixes []string
+	for _, arg := range args {
+		switch {
+		case arg == "peel":
+			peel = true
+		case arg == "symrefs":
+			symrefs = true
+		case strings.HasPrefix(arg, "ref-prefix "):
+			prefixes = append(prefixes, strings.TrimPrefix(arg, "ref-prefix "))
+		}
+	}
+
+	// Each line is held until the following one is seen, as peeled tags
+	// follow the tag itself and are reported in the same line.
+	pw := pktline.NewWriter(w)
+	var pending, last string
+	writePending := func() error {
+		if pending == "" {
+			return nil
+		}
+		err := pw.WriteString(pending + "\n")
+		pending, last = "", ""
+		return err
+	}
+	err := sel.rewriteRefs(r, func(t pktline.Type, payload []byte) error {
+		line, ok := parseRefLine(payload)
+		if t != pktline.Data || !ok {
+			return nil
+		}
+		if strings.HasSuffix(line.Name, "^{}") {
+			if peel && last != "" && strings.TrimSuffix(line.Name, "^{}") == last {
+				pending += " peeled:" + line.Hash
+			}
+			return nil
+		}
+		if err := writePending(); err != nil {
+			return err
+		}
+		if len(prefixes) > 0 && !hasAnyPrefix(line.Name, prefixes) {
+			return nil
+		}
+		text := line.Hash + " " + line.Name
+		if symrefs && line.Name == "HEAD" {
+			for _, capability := range strings.Fields(line.Caps) {
+				if strings.HasPrefix(capability, "symref=HEAD:") {
+					text += " symref-target:" + strings.TrimPrefix(capability, "symref=HEAD:")
+				}
+			}
+		}
+		pending, last = text, line.Name
+		return nil
+	})
+	if err == nil {
+		err = writePending()
+	}
+	if err != nil {
+		return err
+	}
+	return pw.WriteFlush()
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// matches returns whether the reference name, which may be a peeled tag,
+// holds a version matching the selected major version that isn't blocked.
+func (sel *Selection) matches(name string) bool {
+	name = strings.TrimSuffix(name, "^{}")
+	if !strings.HasPrefix(name, "refs/heads/v") && !strings.HasPrefix(name, "refs/tags/v") {
+		return false
+	}
+	v, ok := ParseVersion(name[strings.IndexByte(name, 'v'):])
+	return ok && sel.major.Contains(v) && !sel.isBlocked(name)
+}
+
+// isBlocked returns whether the reference name, which may be a peeled tag,
+// holds a blocked version.
+func (sel *Selection) isBlocked(name string) bool {
+	name = strings.TrimSuffix(name, "^{}")
+	if sel.blocked == nil || !strings.HasPrefix(name, "refs/heads/v") && !strings.HasPrefix(name, "refs/tags/v") {
+		return false
+	}
+	v, ok := ParseVersion(name[strings.IndexByte(name, 'v'):])
+	return ok && sel.blocked(v)
+}
+
+// BlockedHashes returns the hashes that are only referenced by blocked
+// versions in the refs advertisement read from r, and so must not be
+// wanted by clients.
+func (sel *Selection) BlockedHashes(r io.Reader) (map[string]bool, error) {
+	blocked := make(map[string]bool)
+	allowed := make(map[string]bool)
+	err := ScanRefs(r, func(line RefLine) {
+		if sel.isBlocked(line.Name) {
+			blocked[line.Hash] = true
+		} else {
+			allowed[line.Hash] = true
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	for hash := range allowed {
+		delete(blocked, hash)
+	}
+	return blocked, nil
+}
+
+// Hashes returns the hashes of the references advertised for the selected
+// version, as filtered, in the refs advertisement read from r.
+func (sel *Selection) Hashes(r io.Reader) (map[string]bool, error) {
+	hashes := make(map[string]bool)
+	if !sel.Keep {
+		hashes[sel.Hash] = true
+	}
+	err := ScanRefs(r, func(line RefLine) {
+		if sel.Keep || sel.matches(line.Name) {
+			hashes[line.Hash] = true
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
+
+// CheckWants returns an error if any of the wanted object hashes may not be
+// fetched, given the refs advertisement in data, which must be the same one
+// the selection was made from. Objects referenced only by blocked versions
+// may never be wanted, and if restrict is set, only objects advertised for
+// the selected version may be. References may not be wanted by name, as
+// Upstream would resolve them on its own rather than as advertised.
+func (sel *Selection) CheckWants(data []byte, wants, wantRefs []string, restrict bool) error {
+	if len(wantRefs) > 0 {
+		return fmt.Errorf("want-ref %s is not available", wantRefs[0])
+	}
+	blocked, err := sel.BlockedHashes(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	var wantable map[string]bool
+	if restrict {
+		wantable, err = sel.Hashes(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+	}
+	for _, want := range wants {
+		if blocked[want] || restrict && !wantable[want] {
+			return fmt.Errorf("want %s is not available", want)
+		}
+	}
+	return nil
+}
+
+// headLines returns the payloads of the HEAD reference line with the selected
+// hash and a proper symref capability, and of the master reference line.
+func (sel *Selection) headLines() (head, master string) {
+	caps := strings.Replace(sel.caps, "symref=", "oldref=", -1)
+
+	if strings.HasPrefix(sel.Name, "refs/heads/") {
+		if caps == "" {
+			head = fmt.Sprintf("%s HEAD\x00symref=HEAD:%s\n", sel.Hash, sel.Name)
+		} else {
+			head = fmt.Sprintf("%s HEAD\x00symref=HEAD:%s %s\n", sel.Hash, sel.Name, caps)
+		}
+	} else {
+		if caps == "" {
+			head = fmt.Sprintf("%s HEAD\n", sel.Hash)
+		} else {
+			head = fmt.Sprintf("%s HEAD\x00%s\n", sel.Hash, caps)
+		}
+	}
+	return head, fmt.Sprintf("%s refs/heads/master\n", sel.Hash)
+}
+
+// ChangeRefs rewrites the refs advertisement in data so that HEAD and master
+// point to the best version matching major. Versions for which blocked
+// returns true are neither selected nor reported in versions. The blocked
+// function may be nil.
+func ChangeRefs(data []byte, major Version, blocked func(v Version) bool) (changed []byte, versions VersionList, err error) {
+	sel, err := SelectRefs(bytes.NewReader(data), major, blocked)
+	if err != nil {
+		return nil, nil, err
+	}
+	if sel.Keep {
+		return data, nil, nil
+	}
+	var buf bytes.Buffer
+	buf.Grow(len(data) + 256)
+	if err := sel.WriteRefs(&buf, bytes.NewReader(data)); err != nil {
+		return nil, nil, err
+	}
+	return buf.Bytes(), sel.Versions, nil
+}
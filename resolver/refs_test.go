@@ -0,0 +1,376 @@
+package resolver
+
+import (
+	"bytes"
+	"fmt"
+	. "gopkg.in/check.v1"
+	"sort"
+	"strings"
+)
+
+var _ = Suite(&RefsSuite{})
+
+type RefsSuite struct{}
+
+type refsTest struct {
+	summary  string
+	original string
+	version  string
+	changed  string
+	versions []string
+	blocked  []string
+}
+
+var refsTests = []refsTest{{
+	"Version v0 works even without any references",
+	reflines(
+		"hash1 HEAD",
+	),
+	"v0",
+	reflines(
+		"hash1 HEAD",
+	),
+	nil,
+	nil,
+}, {
+	"Preserve original capabilities",
+	reflines(
+		"hash1 HEAD\x00caps",
+	),
+	"v0",
+	reflines(
+		"hash1 HEAD\x00caps",
+	),
+	nil,
+	nil,
+}, {
+	"Matching major version branch",
+	reflines(
+		"00000000000000000000000000000000000hash1 HEAD",
+		"00000000000000000000000000000000000hash2 refs/heads/v0",
+		"00000000000000000000000000000000000hash3 refs/heads/v1",
+		"00000000000000000000000000000000000hash4 refs/heads/v2",
+	),
+	"v1",
+	reflines(
+		"00000000000000000000000000000000000hash3 HEAD\x00symref=HEAD:refs/heads/v1",
+		"00000000000000000000000000000000000hash3 refs/heads/master",
+		"00000000000000000000000000000000000hash2 refs/heads/v0",
+		"00000000000000000000000000000000000hash3 refs/heads/v1",
+		"00000000000000000000000000000000000hash4 refs/heads/v2",
+	),
+	[]string{"v0", "v1", "v2"},
+	nil,
+}, {
+	"Matching minor version branch",
+	reflines(
+		"00000000000000000000000000000000000hash1 HEAD",
+		"00000000000000000000000000000000000hash2 refs/heads/v1.1",
+		"00000000000000000000000000000000000hash3 refs/heads/v1.3",
+		"00000000000000000000000000000000000hash4 refs/heads/v1.2",
+	),
+	"v1",
+	reflines(
+		"00000000000000000000000000000000000hash3 HEAD\x00symref=HEAD:refs/heads/v1.3",
+		"00000000000000000000000000000000000hash3 refs/heads/master",
+		"00000000000000000000000000000000000hash2 refs/heads/v1.1",
+		"00000000000000000000000000000000000hash3 refs/heads/v1.3",
+		"00000000000000000000000000000000000hash4 refs/heads/v1.2",
+	),
+	[]string{"v1.1", "v1.2", "v1.3"},
+	nil,
+}, {
+	"Disable original symref capability",
+	reflines(
+		"00000000000000000000000000000000000hash1 HEAD\x00foo symref=bar baz",
+		"00000000000000000000000000000000000hash2 refs/heads/v1",
+	),
+	"v1",
+	reflines(
+		"00000000000000000000000000000000000hash2 HEAD\x00symref=HEAD:refs/heads/v1 foo oldref=bar baz",
+		"00000000000000000000000000000000000hash2 refs/heads/master",
+		"00000000000000000000000000000000000hash2 refs/heads/v1",
+	),
+	[]string{"v1"},
+	nil,
+}, {
+	"Replace original master branch",
+	reflines(
+		"00000000000000000000000000000000000hash1 HEAD",
+		"00000000000000000000000000000000000hash1 refs/heads/master",
+		"00000000000000000000000000000000000hash2 refs/heads/v1",
+	),
+	"v1",
+	reflines(
+		"00000000000000000000000000000000000hash2 HEAD\x00symref=HEAD:refs/heads/v1",
+		"00000000000000000000000000000000000hash2 refs/heads/master",
+		"00000000000000000000000000000000000hash2 refs/heads/v1",
+	),
+	[]string{"v1"},
+	nil,
+}, {
+	"Matching tag",
+	reflines(
+		"00000000000000000000000000000000000hash1 HEAD",
+		"00000000000000000000000000000000000hash2 refs/tags/v0",
+		"00000000000000000000000000000000000hash3 refs/tags/v1",
+		"00000000000000000000000000000000000hash4 refs/tags/v2",
+	),
+	"v1",
+	reflines(
+		"00000000000000000000000000000000000hash3 HEAD",
+		"00000000000000000000000000000000000hash3 refs/heads/master",
+		"00000000000000000000000000000000000hash2 refs/tags/v0",
+		"00000000000000000000000000000000000hash3 refs/tags/v1",
+		"00000000000000000000000000000000000hash4 refs/tags/v2",
+	),
+	[]string{"v0", "v1", "v2"},
+	nil,
+}, {
+	"Tag peeling",
+	reflines(
+		"00000000000000000000000000000000000hash1 HEAD",
+		"00000000000000000000000000000000000hash2 refs/heads/master",
+		"00000000000000000000000000000000000hash3 refs/tags/v1",
+		"00000000000000000000000000000000000hash4 refs/tags/v1^{}",
+		"00000000000000000000000000000000000hash5 refs/tags/v2",
+	),
+	"v1",
+	reflines(
+		"00000000000000000000000000000000000hash4 HEAD",
+		"00000000000000000000000000000000000hash4 refs/heads/master",
+		"00000000000000000000000000000000000hash3 refs/tags/v1",
+		"00000000000000000000000000000000000hash4 refs/tags/v1^{}",
+		"00000000000000000000000000000000000hash5 refs/tags/v2",
+	),
+	[]string{"v1", "v1", "v2"},
+	nil,
+}, {
+	"Matching unstable versions",
+	reflines(
+		"00000000000000000000000000000000000hash1 HEAD",
+		"00000000000000000000000000000000000hash2 refs/heads/master",
+		"00000000000000000000000000000000000hash3 refs/heads/v1",
+		"00000000000000000000000000000000000hash4 refs/heads/v1.1-unstable",
+		"00000000000000000000000000000000000hash5 refs/heads/v1.3-unstable",
+		"00000000000000000000000000000000000hash6 refs/heads/v1.2-unstable",
+		"00000000000000000000000000000000000hash7 refs/heads/v2",
+	),
+	"v1-unstable",
+	reflines(
+		"00000000000000000000000000000000000hash5 HEAD\x00symref=HEAD:refs/heads/v1.3-unstable",
+		"00000000000000000000000000000000000hash5 refs/heads/master",
+		"00000000000000000000000000000000000hash3 refs/heads/v1",
+		"00000000000000000000000000000000000hash4 refs/heads/v1.1-unstable",
+		"00000000000000000000000000000000000hash5 refs/heads/v1.3-unstable",
+		"00000000000000000000000000000000000hash6 refs/heads/v1.2-unstable",
+		"00000000000000000000000000000000000hash7 refs/heads/v2",
+	),
+	[]string{"v1", "v1.1-unstable", "v1.2-unstable", "v1.3-unstable", "v2"},
+	nil,
+}, {
+	"Blocked versions are skipped",
+	reflines(
+		"00000000000000000000000000000000000hash1 HEAD",
+		"00000000000000000000000000000000000hash2 refs/tags/v1.1",
+		"00000000000000000000000000000000000hash3 refs/tags/v1.2.0",
+		"00000000000000000000000000000000000hash4 refs/tags/v1.2.1",
+		"00000000000000000000000000000000000hash5 refs/tags/v2",
+	),
+	"v1",
+	reflines(
+		"00000000000000000000000000000000000hash2 HEAD",
+		"00000000000000000000000000000000000hash2 refs/heads/master",
+		"00000000000000000000000000000000000hash2 refs/tags/v1.1",
+		"00000000000000000000000000000000000hash5 refs/tags/v2",
+	),
+	[]string{"v1.1", "v2"},
+	[]string{"v1.2"},
+}}
+
+func (s *RefsSuite) TestChangeRefsAllBlocked(c *C) {
+	original := reflines(
+		"00000000000000000000000000000000000hash1 HEAD",
+		"00000000000000000000000000000000000hash2 refs/tags/v1.0.0",
+	)
+	blocked := func(v Version) bool { return true }
+	_, _, err := ChangeRefs([]byte(original), Version{1, -1, -1, false}, blocked)
+	c.Assert(err, Equals, ErrBlocked)
+	_, _, err = ChangeRefs([]byte(original), Version{2, -1, -1, false}, blocked)
+	c.Assert(err, Equals, ErrNoVersion)
+}
+
+func reflines(lines ...string) string {
+	var buf bytes.Buffer
+	buf.WriteString("001e# service=git-upload-pack\n0000")
+	for _, l := range lines {
+		buf.WriteString(fmt.Sprintf("%04x%s\n", len(l)+5, l))
+	}
+	buf.WriteString("0000")
+	return buf.String()
+}
+
+func (s *RefsSuite) TestChangeRefs(c *C) {
+	for _, test := range refsTests {
+		c.Logf(test.summary)
+
+		v, ok := ParseVersion(test.version)
+		if !ok {
+			c.Fatalf("Test has an invalid version: %q", test.version)
+		}
+
+		blocked := func(v Version) bool {
+			for _, s := range test.blocked {
+				if bv, _ := ParseVersion(s); bv.Contains(v) {
+					return true
+				}
+			}
+			return false
+		}
+
+		changed, versions, err := ChangeRefs([]byte(test.original), v, blocked)
+		c.Assert(err, IsNil)
+
+		c.Assert(string(changed), Equals, test.changed)
+
+		sort.Sort(versions)
+
+		var vs []string
+		for _, v := range versions {
+			vs = append(vs, v.String())
+		}
+		c.Assert(vs, DeepEquals, test.versions)
+	}
+}
+
+func (s *RefsSuite) TestChangeRefsMalformed(c *C) {
+	original := reflines("00000000000000000000000000000000000hash1 HEAD")
+	_, _, err := ChangeRefs([]byte(original[:len(original)-10]), Version{0, -1, -1, false}, nil)
+	c.Assert(err, ErrorMatches, "cannot parse refs received from GitHub: cannot read pkt-line payload: unexpected EOF")
+	_, _, err = ChangeRefs([]byte("zzzz"), Version{0, -1, -1, false}, nil)
+	c.Assert(err, ErrorMatches, `cannot parse refs received from GitHub: invalid pkt-line length: "zzzz"`)
+}
+
+func (s *RefsSuite) TestFilterRefs(c *C) {
+	original := reflines(
+		"00000000000000000000000000000000000hash1 HEAD\x00symref=HEAD:refs/heads/master",
+		"00000000000000000000000000000000000hash1 refs/heads/master",
+		"00000000000000000000000000000000000hash2 refs/heads/feature",
+		"00000000000000000000000000000000000hash3 refs/heads/v1",
+		"00000000000000000000000000000000000hash4 refs/heads/v2",
+		"00000000000000000000000000000000000hash5 refs/pull/1/head",
+		"00000000000000000000000000000000000hash6 refs/tags/v1.0.0",
+		"00000000000000000000000000000000000hash7 refs/tags/v1.0.0^{}",
+		"00000000000000000000000000000000000hash8 refs/tags/v1.0.1",
+		"00000000000000000000000000000000000hash9 refs/tags/v2.0.0",
+	)
+	blocked := func(v Version) bool { return v == Version{1, 0, 1, false} }
+	sel, err := SelectRefs(strings.NewReader(original), Version{1, -1, -1, false}, blocked)
+	c.Assert(err, IsNil)
+	sel.Filter = true
+
+	var buf bytes.Buffer
+	c.Assert(sel.WriteRefs(&buf, strings.NewReader(original)), IsNil)
+	c.Assert(buf.String(), Equals, reflines(
+		"00000000000000000000000000000000000hash7 HEAD\x00oldref=HEAD:refs/heads/master",
+		"00000000000000000000000000000000000hash7 refs/heads/master",
+		"00000000000000000000000000000000000hash3 refs/heads/v1",
+		"00000000000000000000000000000000000hash6 refs/tags/v1.0.0",
+		"00000000000000000000000000000000000hash7 refs/tags/v1.0.0^{}",
+	))
+}
+
+func (s *RefsSuite) TestLsRefs(c *C) {
+	original := reflines(
+		"00000000000000000000000000000000000hash1 HEAD\x00symref=HEAD:refs/heads/master",
+		"00000000000000000000000000000000000hash1 refs/heads/master",
+		"00000000000000000000000000000000000hash2 refs/heads/v1",
+		"00000000000000000000000000000000000hash3 refs/tags/v0.1.0",
+		"00000000000000000000000000000000000hash4 refs/tags/v0.1.0^{}",
+		"00000000000000000000000000000000000hash5 refs/tags/v1.0.0",
+		"00000000000000000000000000000000000hash6 refs/tags/v1.0.0^{}",
+	)
+	sel, err := SelectRefs(strings.NewReader(original), Version{1, -1, -1, false}, nil)
+	c.Assert(err, IsNil)
+
+	var buf bytes.Buffer
+	args := []string{"peel", "symrefs", "ref-prefix HEAD", "ref-prefix refs/tags/v1"}
+	c.Assert(sel.WriteLsRefs(&buf, strings.NewReader(original), args), IsNil)
+	c.Assert(buf.String(), Equals, pktlines(
+		"00000000000000000000000000000000000hash6 HEAD\n",
+		"00000000000000000000000000000000000hash5 refs/tags/v1.0.0 peeled:00000000000000000000000000000000000hash6\n",
+		"0000",
+	))
+
+	// Branches are symbolic references and peeling is optional.
+	original = reflines(
+		"00000000000000000000000000000000000hash1 HEAD\x00symref=HEAD:refs/heads/master",
+		"00000000000000000000000000000000000hash2 refs/heads/v1",
+		"00000000000000000000000000000000000hash3 refs/tags/v0.1.0",
+		"00000000000000000000000000000000000hash4 refs/tags/v0.1.0^{}",
+	)
+	sel, err = SelectRefs(strings.NewReader(original), Version{1, -1, -1, false}, nil)
+	c.Assert(err, IsNil)
+	buf.Reset()
+	c.Assert(sel.WriteLsRefs(&buf, strings.NewReader(original), []string{"symrefs"}), IsNil)
+	c.Assert(buf.String(), Equals, pktlines(
+		"00000000000000000000000000000000000hash2 HEAD symref-target:refs/heads/v1\n",
+		"00000000000000000000000000000000000hash2 refs/heads/master\n",
+		"00000000000000000000000000000000000hash2 refs/heads/v1\n",
+		"00000000000000000000000000000000000hash3 refs/tags/v0.1.0\n",
+		"0000",
+	))
+}
+
+func (s *RefsSuite) TestHashes(c *C) {
+	original := reflines(
+		"00000000000000000000000000000000000hash1 HEAD",
+		"00000000000000000000000000000000000hash2 refs/heads/master",
+		"00000000000000000000000000000000000hash3 refs/heads/v1",
+		"00000000000000000000000000000000000hash4 refs/tags/v1.0.0",
+		"00000000000000000000000000000000000hash5 refs/tags/v1.0.0^{}",
+		"00000000000000000000000000000000000hash6 refs/tags/v2.0.0",
+	)
+	sel, err := SelectRefs(strings.NewReader(original), Version{1, -1, -1, false}, nil)
+	c.Assert(err, IsNil)
+	hashes, err := sel.Hashes(strings.NewReader(original))
+	c.Assert(err, IsNil)
+	c.Assert(hashes, DeepEquals, map[string]bool{
+		"00000000000000000000000000000000000hash3": true,
+		"00000000000000000000000000000000000hash4": true,
+		"00000000000000000000000000000000000hash5": true,
+	})
+}
+
+func (s *RefsSuite) TestBlockedRefs(c *C) {
+	original := reflines(
+		"00000000000000000000000000000000000hash1 HEAD\x00symref=HEAD:refs/heads/master",
+		"00000000000000000000000000000000000hash1 refs/heads/master",
+		"00000000000000000000000000000000000hash2 refs/tags/v1.0.0",
+		"00000000000000000000000000000000000hash3 refs/tags/v1.0.1",
+		"00000000000000000000000000000000000hash4 refs/tags/v1.0.1^{}",
+		"00000000000000000000000000000000000hash5 refs/tags/v1.0.2",
+		"00000000000000000000000000000000000hash2 refs/tags/v1.0.3",
+	)
+	blocked := func(v Version) bool { return v == Version{1, 0, 1, false} || v == Version{1, 0, 3, false} }
+	sel, err := SelectRefs(strings.NewReader(original), Version{1, -1, -1, false}, blocked)
+	c.Assert(err, IsNil)
+
+	var buf bytes.Buffer
+	c.Assert(sel.WriteLsRefs(&buf, strings.NewReader(original), []string{"peel"}), IsNil)
+	c.Assert(buf.String(), Equals, pktlines(
+		"00000000000000000000000000000000000hash5 HEAD\n",
+		"00000000000000000000000000000000000hash5 refs/heads/master\n",
+		"00000000000000000000000000000000000hash2 refs/tags/v1.0.0\n",
+		"00000000000000000000000000000000000hash5 refs/tags/v1.0.2\n",
+		"0000",
+	))
+
+	// Hashes also referenced by versions that aren't blocked may be wanted.
+	hashes, err := sel.BlockedHashes(strings.NewReader(original))
+	c.Assert(err, IsNil)
+	c.Assert(hashes, DeepEquals, map[string]bool{
+		"00000000000000000000000000000000000hash3": true,
+		"00000000000000000000000000000000000hash4": true,
+	})
+}
@@ -0,0 +1,168 @@
+package resolver
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	githubCom = "github.com"
+	gopkgIn   = "gopkg.in"
+)
+
+// Repo represents a source code repository at the upstream host.
+type Repo struct {
+	User         string
+	Name         string
+	SubPath      string
+	OldFormat    bool // The old /v2/pkg format.
+	MajorVersion Version
+
+	// FullVersion is the best version in AllVersions that matches MajorVersion.
+	// It defaults to InvalidVersion if there are no matches.
+	FullVersion Version
+
+	// AllVersions holds all versions currently available in the repository,
+	// either coming from branch names or from tag names. Version zero (v0)
+	// is only present in the list if it really exists in the repository.
+	AllVersions VersionList
+
+	// When there is a redirect in place, these are from the original request.
+	RedirUser string
+	RedirName string
+
+	// Host and Upstream are the host names the package is served under
+	// and the repository is hosted at. They default to gopkg.in and
+	// github.com respectively.
+	Host     string
+	Upstream string
+}
+
+// SetVersions records in the relevant fields the details about which
+// package versions are available in the repository.
+func (repo *Repo) SetVersions(all []Version) {
+	repo.AllVersions = all
+	for _, v := range repo.AllVersions {
+		if v.Major == repo.MajorVersion.Major && v.Unstable == repo.MajorVersion.Unstable && repo.FullVersion.Less(v) {
+			repo.FullVersion = v
+		}
+	}
+}
+
+// When there is a redirect in place, this will return the original repository
+// but preserving the data for the new repository.
+func (repo *Repo) Original() *Repo {
+	if repo.RedirName == "" {
+		return repo
+	}
+	orig := *repo
+	orig.User = repo.RedirUser
+	orig.Name = repo.RedirName
+	return &orig
+}
+
+func (repo *Repo) host() string {
+	if repo.Host == "" {
+		return gopkgIn
+	}
+	return repo.Host
+}
+
+func (repo *Repo) upstream() string {
+	if repo.Upstream == "" {
+		return githubCom
+	}
+	return repo.Upstream
+}
+
+// GitHubRoot returns the repository root at the upstream host, which is
+// github.com by default, without a schema.
+func (repo *Repo) GitHubRoot() string {
+	if repo.User == "" {
+		return repo.upstream() + "/go-" + repo.Name + "/" + repo.Name
+	} else {
+		return repo.upstream() + "/" + repo.User + "/" + repo.Name
+	}
+}
+
+// GitHubTree returns the repository tree name at the upstream host for the
+// selected version.
+func (repo *Repo) GitHubTree() string {
+	if repo.FullVersion == InvalidVersion {
+		return "master"
+	}
+	return repo.FullVersion.String()
+}
+
+// GopkgRoot returns the package root at gopkg.in, without a schema.
+func (repo *Repo) GopkgRoot() string {
+	return repo.GopkgVersionRoot(repo.MajorVersion)
+}
+
+// GopkgPath returns the package path at gopkg.in, without a schema.
+func (repo *Repo) GopkgPath() string {
+	return repo.GopkgVersionRoot(repo.MajorVersion) + repo.SubPath
+}
+
+// GopkgVersionRoot returns the package root in gopkg.in for the
+// provided version, without a schema.
+func (repo *Repo) GopkgVersionRoot(version Version) string {
+	version.Minor = -1
+	version.Patch = -1
+	v := version.String()
+	if repo.OldFormat {
+		if repo.User == "" {
+			return repo.host() + "/" + v + "/" + repo.Name
+		} else {
+			return repo.host() + "/" + repo.User + "/" + v + "/" + repo.Name
+		}
+	} else {
+		if repo.User == "" {
+			return repo.host() + "/" + repo.Name + "." + v
+		} else {
+			return repo.host() + "/" + repo.User + "/" + repo.Name + "." + v
+		}
+	}
+}
+
+var patternOld = regexp.MustCompile(`^/(?:([a-z0-9][-a-z0-9]+)/)?((?:v0|v[1-9][0-9]*)(?:\.0|\.[1-9][0-9]*){0,2}(?:-unstable)?)/([a-zA-Z][-a-zA-Z0-9]*)(?:\.git)?((?:/[a-zA-Z][-a-zA-Z0-9]*)*)$`)
+var patternNew = regexp.MustCompile(`^/(?:([a-zA-Z0-9][-a-zA-Z0-9]+)/)?([a-zA-Z][-.a-zA-Z0-9]*)\.((?:v0|v[1-9][0-9]*)(?:\.0|\.[1-9][0-9]*){0,2}(?:-unstable)?)(?:\.git)?((?:/[a-zA-Z0-9][-.a-zA-Z0-9]*)*)$`)
+
+// ParsePath parses the path of a request for a package, in the form
+// /[user/]name.vN[/subpath] or the old /[user/]vN/name[/subpath]. The
+// error message is meant to be shown to the user.
+func ParsePath(path string) (*Repo, error) {
+	m := patternNew.FindStringSubmatch(path)
+	oldFormat := false
+	if m == nil {
+		m = patternOld.FindStringSubmatch(path)
+		if m == nil {
+			return nil, errors.New("Unsupported URL pattern; see the documentation at gopkg.in for details.")
+		}
+		// "/v2/name" <= "/name.v2"
+		m[2], m[3] = m[3], m[2]
+		oldFormat = true
+	}
+
+	if strings.Contains(m[3], ".") {
+		return nil, fmt.Errorf("Import paths take the major version only (.%s instead of .%s); see docs at gopkg.in for the reasoning.",
+			m[3][:strings.Index(m[3], ".")], m[3])
+	}
+
+	repo := &Repo{
+		User:        m[1],
+		Name:        m[2],
+		SubPath:     m[4],
+		OldFormat:   oldFormat,
+		FullVersion: InvalidVersion,
+	}
+
+	var ok bool
+	repo.MajorVersion, ok = ParseVersion(m[3])
+	if !ok {
+		return nil, fmt.Errorf("Version %q improperly considered invalid; please warn the service maintainers.", m[3])
+	}
+	return repo, nil
+}
@@ -0,0 +1,406 @@
+// Package resolver serves versioned Go packages in the style of gopkg.in,
+// resolving import paths such as example.com/yaml.v2 to the best matching
+// branch or tag of the respective repository at the upstream host, which
+// is github.com unless configured otherwise.
+//
+// The Handler answers go-get requests and serves the git smart HTTP
+// protocol, advertising the repository refs with HEAD and master pointing
+// to the selected version and forwarding fetches upstream.
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/niemeyer/gopkg/pktline"
+)
+
+// Options configures a Handler. All fields are optional.
+type Options struct {
+	// Host is the host name packages are served under. Defaults to gopkg.in.
+	Host string
+
+	// Upstream is the host name repositories are obtained from, which must
+	// serve the same paths GitHub does. Defaults to github.com.
+	Upstream string
+
+	// Client is used to obtain refs from Upstream. Defaults to a client
+	// with a 10 seconds timeout.
+	Client *http.Client
+
+	// PackClient is used to forward fetches to Upstream. Defaults to a
+	// client with a 5 minutes timeout.
+	PackClient *http.Client
+
+	// Cache holds the refs obtained from Upstream. Defaults to a
+	// MemoryCache holding refs for a minute.
+	Cache Cache
+
+	// UserAgent is sent to Upstream when forwarding fetches. Defaults to
+	// Host followed by its URL in parenthesis.
+	UserAgent string
+
+	// MaxRequest is the maximum size in bytes of upload-pack request
+	// bodies forwarded to Upstream. Defaults to 10MB.
+	MaxRequest int64
+
+	// MaxResponse is the maximum size in bytes of upload-pack responses
+	// from Upstream, or 0 for no limit.
+	MaxResponse int64
+
+	// Logger is used to report errors. Defaults to the standard logger.
+	Logger *log.Logger
+
+	// FilterRefs restricts the refs advertised to the ones matching the
+	// requested major version, besides HEAD and master.
+	FilterRefs bool
+
+	// Rename, if set, reports that the repository for user and name
+	// must be obtained from the one for newUser and newName instead.
+	Rename func(user, name string) (newUser, newName string, ok bool)
+
+	// Blocked, if set, reports whether version v of repo must not be
+	// served. It's called with the major version requested, and with
+	// every version available in the repository.
+	Blocked func(repo *Repo, v Version) bool
+
+	// Moved, if set, is called when Upstream reports that repo now
+	// lives at root.
+	Moved func(repo *Repo, root string)
+
+	// CheckRefs, if set, is called with every refs advertisement
+	// obtained from Upstream before it's cached, and may alter it.
+	CheckRefs func(repo *Repo, refs []byte) ([]byte, error)
+
+	// Serve, if set, is called for every request resolved successfully,
+	// and reports whether it handled the request. If not, the Handler
+	// serves it as usual.
+	Serve func(resp http.ResponseWriter, req *http.Request, res *Resolution) bool
+
+	// Error, if set, is called for every request that can't be resolved,
+	// and reports whether it handled the request. If not, the Handler
+	// reports the error as usual.
+	Error func(resp http.ResponseWriter, req *http.Request, repo *Repo, err error) bool
+
+	// Trace, if set, is called when starting each step in resolving a
+	// request, with attributes as key and value pairs. It returns the
+	// context for nested steps, and a function ending the step with its
+	// error, if any, and further attributes.
+	Trace func(ctx context.Context, name string, attrs ...string) (context.Context, func(err error, attrs ...string))
+}
+
+// Resolution holds the outcome of resolving a request.
+type Resolution struct {
+	Repo      *Repo
+	Refs      []byte // Refs advertisement obtained from Upstream, unchanged.
+	Selection *Selection
+	Handler   *Handler // Handler that resolved the request.
+}
+
+// Handler resolves requests for packages. It must be created with New.
+type Handler struct {
+	opts Options
+}
+
+var (
+	ErrNoRepo    = errors.New("repository not found in GitHub")
+	ErrNoVersion = errors.New("version reference not found in GitHub")
+	ErrBlocked   = errors.New("all matching versions are blocked")
+	ErrTimeout   = errors.New("timeout")
+)
+
+const (
+	refsPath   = "/info/refs"
+	refsSuffix = ".git" + refsPath + "?service=git-upload-pack"
+)
+
+// New returns a Handler configured with opts.
+func New(opts Options) *Handler {
+	if opts.Host == "" {
+		opts.Host = gopkgIn
+	}
+	if opts.Upstream == "" {
+		opts.Upstream = githubCom
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	if opts.PackClient == nil {
+		opts.PackClient = &http.Client{Timeout: 5 * time.Minute}
+	}
+	if opts.Cache == nil {
+		opts.Cache = NewMemoryCache(time.Minute)
+	}
+	if opts.UserAgent == "" {
+		opts.UserAgent = opts.Host + " (+https://" + opts.Host + ")"
+	}
+	if opts.MaxRequest == 0 {
+		opts.MaxRequest = 10 << 20
+	}
+	if opts.Logger == nil {
+		opts.Logger = log.Default()
+	}
+	return &Handler{opts}
+}
+
+var gogetTemplate = template.Must(template.New("").Parse(`
+<html>
+<head>
+<meta name="go-import" content="{{.Original.GopkgRoot}} git https://{{.Original.GopkgRoot}}">
+{{$root := .GitHubRoot}}{{$tree := .GitHubTree}}<meta name="go-source" content="{{.Original.GopkgRoot}} _ https://{{$root}}/tree/{{$tree}}{/dir} https://{{$root}}/blob/{{$tree}}{/dir}/{file}#L{line}">
+</head>
+<body>
+go get {{.GopkgPath}}
+</body>
+</html>
+`))
+
+func (h *Handler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	_, end := h.trace(ctx, "resolver.parse_path", "path", req.URL.Path)
+	repo, err := ParsePath(req.URL.Path)
+	end(err)
+	if err != nil {
+		sendNotFound(resp, "%s", err)
+		return
+	}
+	repo.Host = h.opts.Host
+	repo.Upstream = h.opts.Upstream
+
+	if h.opts.Rename != nil {
+		if user, name, ok := h.opts.Rename(repo.User, repo.Name); ok {
+			repo.RedirUser, repo.RedirName = repo.User, repo.Name
+			repo.User, repo.Name = user, name
+		}
+	}
+
+	if repo.SubPath == "/git-receive-pack" || repo.SubPath == refsPath && req.FormValue("service") == "git-receive-pack" {
+		sendReceivePackError(resp, repo.SubPath == refsPath, "%s is read-only; push to https://%s instead", repo.Original().GopkgRoot(), repo.GitHubRoot())
+		return
+	}
+
+	var blocked func(v Version) bool
+	if h.opts.Blocked != nil {
+		if h.opts.Blocked(repo, repo.MajorVersion) {
+			h.sendError(resp, req, repo, ErrBlocked)
+			return
+		}
+		blocked = func(v Version) bool { return h.opts.Blocked(repo, v) }
+	}
+
+	var sel *Selection
+	original, err := h.fetchRefs(ctx, repo, 1)
+	if err == ErrTimeout {
+		// Retry once.
+		h.opts.Client.CloseIdleConnections()
+		original, err = h.fetchRefs(ctx, repo, 2)
+	}
+	if err == nil {
+		_, end := h.trace(ctx, "resolver.select_refs", "version", repo.MajorVersion.String())
+		sel, err = SelectRefs(bytes.NewReader(original), repo.MajorVersion, blocked)
+		end(err)
+	}
+	if err != nil {
+		h.sendError(resp, req, repo, err)
+		return
+	}
+	repo.SetVersions(sel.Versions)
+	sel.Filter = h.opts.FilterRefs
+
+	if h.opts.Serve != nil && h.opts.Serve(resp, req, &Resolution{repo, original, sel, h}) {
+		return
+	}
+
+	switch {
+	case repo.SubPath == "/git-upload-pack":
+		h.proxyUploadPack(resp, req, repo, sel, original)
+
+	case repo.SubPath == refsPath:
+		resp.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
+		_, end := h.trace(ctx, "resolver.write_refs")
+		err := sel.WriteRefs(resp, bytes.NewReader(original))
+		end(err)
+		if err != nil {
+			h.opts.Logger.Printf("Error writing refs: %v", err)
+		}
+
+	case req.FormValue("go-get") == "1":
+		resp.Header().Set("Content-Type", "text/html")
+		if err := gogetTemplate.Execute(resp, repo); err != nil {
+			h.opts.Logger.Printf("error executing go get template: %s\n", err)
+		}
+
+	default:
+		http.Redirect(resp, req, "https://"+repo.GitHubRoot()+"/tree/"+repo.GitHubTree()+repo.SubPath, http.StatusTemporaryRedirect)
+	}
+}
+
+// sendError reports that the request for repo can't be resolved due to err.
+func (h *Handler) sendError(resp http.ResponseWriter, req *http.Request, repo *Repo, err error) {
+	if h.opts.Error != nil && h.opts.Error(resp, req, repo, err) {
+		return
+	}
+	switch err {
+	case ErrNoRepo:
+		sendNotFound(resp, "GitHub repository not found at https://%s", repo.GitHubRoot())
+	case ErrNoVersion:
+		major := repo.MajorVersion
+		suffix := ""
+		if major.Unstable {
+			major.Unstable = false
+			suffix = unstableSuffix
+		}
+		v := major.String()
+		sendNotFound(resp, `GitHub repository at https://%s has no branch or tag "%s%s", "%s.N%s" or "%s.N.M%s"`, repo.GitHubRoot(), v, suffix, v, suffix, v, suffix)
+	case ErrBlocked:
+		sendNotFound(resp, "All versions matching %s at https://%s are blocked.", repo.MajorVersion, repo.GitHubRoot())
+	default:
+		resp.WriteHeader(http.StatusBadGateway)
+		resp.Write([]byte(fmt.Sprintf("Cannot obtain refs from GitHub: %v", err)))
+	}
+}
+
+func sendNotFound(resp http.ResponseWriter, msg string, args ...interface{}) {
+	if len(args) > 0 {
+		msg = fmt.Sprintf(msg, args...)
+	}
+	resp.WriteHeader(http.StatusNotFound)
+	resp.Write([]byte(msg))
+}
+
+// sendReceivePackError rejects a push in the receive-pack protocol, either
+// in the refs advertisement or in the response to the push itself, so that
+// the message is shown to the user.
+func sendReceivePackError(resp http.ResponseWriter, advertisement bool, msg string, args ...interface{}) {
+	if len(args) > 0 {
+		msg = fmt.Sprintf(msg, args...)
+	}
+	pw := pktline.NewWriter(resp)
+	resp.Header().Set("Cache-Control", "no-cache")
+	if advertisement {
+		resp.Header().Set("Content-Type", "application/x-git-receive-pack-advertisement")
+		pw.WriteString("# service=git-receive-pack\n")
+		pw.WriteFlush()
+	} else {
+		resp.Header().Set("Content-Type", "application/x-git-receive-pack-result")
+	}
+	pw.WriteError(msg)
+}
+
+// trace starts a step with the Trace option, if set.
+func (h *Handler) trace(ctx context.Context, name string, attrs ...string) (context.Context, func(err error, attrs ...string)) {
+	if h.opts.Trace == nil {
+		return ctx, func(error, ...string) {}
+	}
+	return h.opts.Trace(ctx, name, attrs...)
+}
+
+// FetchRefs returns the refs advertisement for repo as obtained from Upstream,
+// or from the cache while fresh.
+func (h *Handler) FetchRefs(ctx context.Context, repo *Repo) ([]byte, error) {
+	return h.fetchRefs(ctx, repo, 1)
+}
+
+func (h *Handler) fetchRefs(ctx context.Context, repo *Repo, attempt int) (data []byte, err error) {
+	ctx, end := h.trace(ctx, "resolver.fetch_refs", "root", repo.GitHubRoot(), "attempt", strconv.Itoa(attempt))
+	defer func() { end(err) }()
+
+	_, endLookup := h.trace(ctx, "resolver.cache_lookup", "root", repo.GitHubRoot())
+	refs := h.opts.Cache.Get(repo.GitHubRoot())
+	endLookup(nil, "hit", strconv.FormatBool(refs != nil))
+	if refs != nil {
+		return refs, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", "https://"+repo.GitHubRoot()+refsSuffix, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := h.opts.Client.Do(req)
+	if err != nil {
+		if os.IsTimeout(err) {
+			return nil, ErrTimeout
+		}
+		return nil, fmt.Errorf("cannot talk to GitHub: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case 200:
+		// ok
+	case 401, 404:
+		return nil, ErrNoRepo
+	default:
+		return nil, fmt.Errorf("error from GitHub: %v", resp.Status)
+	}
+
+	data, err = readRefs(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading from GitHub: %v", err)
+	}
+
+	// Upstream redirects requests for renamed or transferred repositories,
+	// as GitHub does.
+	if root, ok := refsURLRoot(resp.Request.URL, repo.upstream()); ok && !strings.EqualFold(root, repo.GitHubRoot()) && h.opts.Moved != nil {
+		h.opts.Moved(repo, root)
+	}
+	if h.opts.CheckRefs != nil {
+		data, err = h.opts.CheckRefs(repo, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	h.opts.Cache.Set(repo.GitHubRoot(), data)
+	return data, nil
+}
+
+// readRefs reads the refs advertisement from r one packet at a time, failing
+// as soon as a malformed packet arrives. The advertisement is still kept
+// whole for caching and because the HEAD line, which comes first, depends on
+// all the references that follow.
+func readRefs(r io.Reader) ([]byte, error) {
+	// Empty data must still be non-nil, as nil means a cache miss.
+	buf := bytes.NewBuffer([]byte{})
+	pr := pktline.NewReader(r)
+	pw := pktline.NewWriter(buf)
+	for pr.Next() {
+		var err error
+		if pr.Type() != pktline.Data {
+			err = pw.WriteSpecial(pr.Type())
+		} else {
+			_, err = pw.Write(pr.Payload())
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := pr.Err(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// refsURLRoot returns the repository root for a refs URL at upstream,
+// without a schema.
+func refsURLRoot(u *url.URL, upstream string) (root string, ok bool) {
+	if u.Host != upstream || !strings.HasSuffix(u.Path, refsPath) {
+		return "", false
+	}
+	path := strings.TrimSuffix(strings.TrimSuffix(u.Path, refsPath), ".git")
+	owner, name, ok := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	if !ok || owner == "" || name == "" || strings.Contains(name, "/") {
+		return "", false
+	}
+	return upstream + "/" + owner + "/" + name, true
+}
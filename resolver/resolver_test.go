@@ -0,0 +1,427 @@
+package resolver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&ResolverSuite{})
+
+type ResolverSuite struct{}
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// pktlines encodes each line as a data packet, except for the special
+// packets "0000", "0001" and "0002" which are included as-is.
+func pktlines(lines ...string) string {
+	var buf bytes.Buffer
+	for _, l := range lines {
+		if l == "0000" || l == "0001" || l == "0002" {
+			buf.WriteString(l)
+		} else {
+			fmt.Fprintf(&buf, "%04x%s", len(l)+4, l)
+		}
+	}
+	return buf.String()
+}
+
+var resolverRefs = reflines(
+	"00000000000000000000000000000000000hash1 HEAD\x00symref=HEAD:refs/heads/master",
+	"00000000000000000000000000000000000hash1 refs/heads/master",
+	"00000000000000000000000000000000000hash2 refs/tags/v1.0.0",
+	"00000000000000000000000000000000000hash3 refs/tags/v1.1.0",
+)
+
+// upstream serves resolverRefs for every repository, and records the URLs
+// requested in the provided slice.
+func upstream(requested *[]string) *http.Client {
+	return &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		*requested = append(*requested, req.URL.String())
+		if strings.Contains(req.URL.Path, "/missing/") {
+			return &http.Response{StatusCode: 404, Body: ioutil.NopCloser(strings.NewReader("")), Request: req}, nil
+		}
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(resolverRefs)), Request: req}, nil
+	})}
+}
+
+func serve(h http.Handler, url string) *httptest.ResponseRecorder {
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, httptest.NewRequest("GET", url, nil))
+	return resp
+}
+
+func (s *ResolverSuite) TestServe(c *C) {
+	var requested []string
+	h := New(Options{Host: "go.example.com", Upstream: "git.example.com", Client: upstream(&requested)})
+
+	resp := serve(h, "/user/repo.v1/sub?go-get=1")
+	c.Assert(resp.Code, Equals, http.StatusOK)
+	c.Assert(resp.Body.String(), Matches, `(?s).*<meta name="go-import" content="go.example.com/user/repo.v1 git https://go.example.com/user/repo.v1">.*`)
+	c.Assert(resp.Body.String(), Matches, `(?s).*https://git.example.com/user/repo/tree/v1.1.0\{/dir\}.*`)
+	c.Assert(requested, DeepEquals, []string{"https://git.example.com/user/repo.git/info/refs?service=git-upload-pack"})
+
+	// Refs are cached.
+	resp = serve(h, "/user/repo.v1.git/info/refs?service=git-upload-pack")
+	c.Assert(resp.Code, Equals, http.StatusOK)
+	c.Assert(resp.Header().Get("Content-Type"), Equals, "application/x-git-upload-pack-advertisement")
+	c.Assert(resp.Body.String(), Equals, reflines(
+		"00000000000000000000000000000000000hash3 HEAD\x00oldref=HEAD:refs/heads/master",
+		"00000000000000000000000000000000000hash3 refs/heads/master",
+		"00000000000000000000000000000000000hash2 refs/tags/v1.0.0",
+		"00000000000000000000000000000000000hash3 refs/tags/v1.1.0",
+	))
+	c.Assert(requested, HasLen, 1)
+
+	resp = serve(h, "/user/repo.v1/sub")
+	c.Assert(resp.Code, Equals, http.StatusTemporaryRedirect)
+	c.Assert(resp.Header().Get("Location"), Equals, "https://git.example.com/user/repo/tree/v1.1.0/sub")
+
+	resp = serve(h, "/user/repo.v2")
+	c.Assert(resp.Code, Equals, http.StatusNotFound)
+	c.Assert(resp.Body.String(), Equals, `GitHub repository at https://git.example.com/user/repo has no branch or tag "v2", "v2.N" or "v2.N.M"`)
+
+	resp = serve(h, "/missing/repo.v1")
+	c.Assert(resp.Code, Equals, http.StatusNotFound)
+	c.Assert(resp.Body.String(), Equals, "GitHub repository not found at https://git.example.com/missing/repo")
+
+	resp = serve(h, "/user/repo.v1.2")
+	c.Assert(resp.Code, Equals, http.StatusNotFound)
+	c.Assert(resp.Body.String(), Matches, `Import paths take the major version only \(.v1 instead of .v1.2\).*`)
+}
+
+func (s *ResolverSuite) TestHooks(c *C) {
+	var requested []string
+	var moved []string
+	h := New(Options{
+		Client: upstream(&requested),
+		Rename: func(user, name string) (string, string, bool) {
+			return "new", name, user == "old"
+		},
+		Blocked: func(repo *Repo, v Version) bool {
+			return repo.Name == "blocked" || v == Version{1, 1, 0, false}
+		},
+		Moved: func(repo *Repo, root string) {
+			moved = append(moved, repo.GitHubRoot()+" => "+root)
+		},
+		CheckRefs: func(repo *Repo, refs []byte) ([]byte, error) {
+			return bytes.Replace(refs, []byte("hash2"), []byte("hashX"), -1), nil
+		},
+		Serve: func(resp http.ResponseWriter, req *http.Request, res *Resolution) bool {
+			if res.Repo.SubPath != "/custom" {
+				return false
+			}
+			fmt.Fprintf(resp, "%s %s %s %s", res.Repo.Original().GopkgRoot(), res.Repo.GitHubRoot(), res.Repo.FullVersion, res.Selection.Hash)
+			return true
+		},
+		Error: func(resp http.ResponseWriter, req *http.Request, repo *Repo, err error) bool {
+			if err != ErrBlocked {
+				return false
+			}
+			resp.WriteHeader(http.StatusGone)
+			return true
+		},
+	})
+
+	resp := serve(h, "/old/repo.v1/custom")
+	c.Assert(resp.Body.String(), Equals, "gopkg.in/old/repo.v1 github.com/new/repo v1.0.0 00000000000000000000000000000000000hashX")
+	c.Assert(requested, DeepEquals, []string{"https://github.com/new/repo.git/info/refs?service=git-upload-pack"})
+	c.Assert(moved, HasLen, 0)
+
+	resp = serve(h, "/blocked.v1")
+	c.Assert(resp.Code, Equals, http.StatusGone)
+	c.Assert(requested, HasLen, 1)
+
+	resp = serve(h, "/user/repo.v2")
+	c.Assert(resp.Code, Equals, http.StatusNotFound)
+
+	// Upstream redirects requests for moved repositories.
+	h.opts.Client.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		req.URL.Path = strings.Replace(req.URL.Path, "/user/", "/other/", 1)
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(resolverRefs)), Request: req}, nil
+	})
+	resp = serve(h, "/user/moved.v1?go-get=1")
+	c.Assert(resp.Code, Equals, http.StatusOK)
+	c.Assert(moved, DeepEquals, []string{"github.com/user/moved => github.com/other/moved"})
+}
+
+func (s *ResolverSuite) TestMalformedRefs(c *C) {
+	var requested []string
+	h := New(Options{Client: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		requested = append(requested, req.URL.String())
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader(resolverRefs[:34] + "zzzz")), Request: req}, nil
+	})}})
+
+	// Malformed refs are refused, and not cached.
+	for i := 0; i < 2; i++ {
+		resp := serve(h, "/user/repo.v1?go-get=1")
+		c.Assert(resp.Code, Equals, http.StatusBadGateway)
+		c.Assert(resp.Body.String(), Equals, `Cannot obtain refs from GitHub: error reading from GitHub: invalid pkt-line length: "zzzz"`)
+	}
+	c.Assert(requested, HasLen, 2)
+}
+
+type traceKey struct{}
+
+func (s *ResolverSuite) TestTrace(c *C) {
+	var requested []string
+	var steps []string
+	h := New(Options{
+		Client: upstream(&requested),
+		Trace: func(ctx context.Context, name string, attrs ...string) (context.Context, func(error, ...string)) {
+			if parent, ok := ctx.Value(traceKey{}).(string); ok {
+				name = parent + "/" + name
+			}
+			steps = append(steps, "start "+name+" "+strings.Join(attrs, " "))
+			return context.WithValue(ctx, traceKey{}, name), func(err error, attrs ...string) {
+				steps = append(steps, fmt.Sprintf("end %s %v %s", name, err, strings.Join(attrs, " ")))
+			}
+		},
+	})
+
+	serve(h, "/user/repo.v1.git/info/refs?service=git-upload-pack")
+	c.Assert(steps, DeepEquals, []string{
+		"start resolver.parse_path path /user/repo.v1.git/info/refs",
+		"end resolver.parse_path <nil> ",
+		"start resolver.fetch_refs root github.com/user/repo attempt 1",
+		"start resolver.fetch_refs/resolver.cache_lookup root github.com/user/repo",
+		"end resolver.fetch_refs/resolver.cache_lookup <nil> hit false",
+		"end resolver.fetch_refs <nil> ",
+		"start resolver.select_refs version v1",
+		"end resolver.select_refs <nil> ",
+		"start resolver.write_refs ",
+		"end resolver.write_refs <nil> ",
+	})
+
+	steps = nil
+	serve(h, "/user/repo.v2")
+	c.Assert(steps[3:6], DeepEquals, []string{
+		"start resolver.fetch_refs/resolver.cache_lookup root github.com/user/repo",
+		"end resolver.fetch_refs/resolver.cache_lookup <nil> hit true",
+		"end resolver.fetch_refs <nil> ",
+	})
+	c.Assert(steps[7], Matches, `end resolver.select_refs version reference not found in GitHub `)
+}
+
+func (s *ResolverSuite) TestRejectReceivePack(c *C) {
+	h := New(Options{})
+
+	resp := serve(h, "/user/repo.v1/info/refs?service=git-receive-pack")
+	c.Assert(resp.Code, Equals, http.StatusOK)
+	c.Assert(resp.Header().Get("Content-Type"), Equals, "application/x-git-receive-pack-advertisement")
+	c.Assert(resp.Body.String(), Equals, pktlines(
+		"# service=git-receive-pack\n",
+		"0000",
+		"ERR gopkg.in/user/repo.v1 is read-only; push to https://github.com/user/repo instead\n",
+	))
+
+	req := httptest.NewRequest("POST", "/repo.v2.git/git-receive-pack", nil)
+	resp = httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	c.Assert(resp.Code, Equals, http.StatusOK)
+	c.Assert(resp.Header().Get("Content-Type"), Equals, "application/x-git-receive-pack-result")
+	c.Assert(resp.Body.String(), Equals, pktlines("ERR gopkg.in/repo.v2 is read-only; push to https://github.com/go-repo/repo instead\n"))
+}
+
+func (s *ResolverSuite) TestProxyUploadPack(c *C) {
+	var requested []string
+	var sent *http.Request
+	var sentBody string
+	h := New(Options{
+		Client: upstream(&requested),
+		PackClient: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			sent = req
+			body, _ := ioutil.ReadAll(req.Body)
+			sentBody = string(body)
+			return &http.Response{
+				StatusCode: 200,
+				Header: http.Header{
+					"Content-Type": {"application/x-git-upload-pack-result"},
+					"Set-Cookie":   {"logged_in=no"},
+				},
+				Body:    ioutil.NopCloser(strings.NewReader("0008NAK\n")),
+				Request: req,
+			}, nil
+		})},
+	})
+
+	req := httptest.NewRequest("POST", "/user/repo.v1/git-upload-pack", strings.NewReader("0000"))
+	req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+	req.Header.Set("Cookie", "secret=1")
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+
+	c.Assert(sent.URL.String(), Equals, "https://github.com/user/repo.git/git-upload-pack")
+	c.Assert(sent.Header, DeepEquals, http.Header{
+		"Content-Type": {"application/x-git-upload-pack-request"},
+		"User-Agent":   {"gopkg.in (+https://gopkg.in)"},
+		"Via":          {"1.1 gopkg.in"},
+	})
+	c.Assert(sentBody, Equals, "0000")
+	c.Assert(resp.Header(), DeepEquals, http.Header{
+		"Content-Type": {"application/x-git-upload-pack-result"},
+		"Via":          {"1.1 gopkg.in"},
+	})
+	c.Assert(resp.Body.String(), Equals, "0008NAK\n")
+}
+
+func (s *ResolverSuite) TestProxyUploadPackLimits(c *C) {
+	var requested []string
+	var sentBody []byte
+	var sentErr error
+	h := New(Options{
+		Client:      upstream(&requested),
+		UserAgent:   "test",
+		MaxRequest:  4,
+		MaxResponse: 8,
+		PackClient: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			sentBody, sentErr = ioutil.ReadAll(req.Body)
+			if sentErr != nil {
+				return nil, sentErr
+			}
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(strings.NewReader("0008NAK\nPACK")),
+				Request:    req,
+			}, nil
+		})},
+	})
+
+	req := httptest.NewRequest("POST", "/user/repo.v1/git-upload-pack", strings.NewReader("00000000"))
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	c.Assert(resp.Code, Equals, http.StatusRequestEntityTooLarge)
+	c.Assert(sentBody, IsNil)
+	c.Assert(sentErr, IsNil)
+
+	req = httptest.NewRequest("POST", "/user/repo.v1/git-upload-pack", strings.NewReader("0000"))
+	c.Assert(func() { h.ServeHTTP(httptest.NewRecorder(), req) }, PanicMatches, "net/http: abort Handler")
+	c.Assert(string(sentBody), Equals, "0000")
+
+	req = httptest.NewRequest("GET", "/user/repo.v1/git-upload-pack", nil)
+	resp = httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	c.Assert(resp.Code, Equals, http.StatusMethodNotAllowed)
+}
+
+func (s *ResolverSuite) TestProxyUploadPackBlocked(c *C) {
+	var requested []string
+	var sentBody string
+	h := New(Options{
+		Client: upstream(&requested),
+		Blocked: func(repo *Repo, v Version) bool {
+			return v == Version{Major: 1, Minor: 0, Patch: 0}
+		},
+		PackClient: &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			body, _ := ioutil.ReadAll(req.Body)
+			sentBody = string(body)
+			return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader("0008NAK\n")), Request: req}, nil
+		})},
+	})
+
+	// Objects only referenced by blocked versions may not be wanted.
+	blocked := pktlines("want 00000000000000000000000000000000000hash2 ofs-delta\n", "0000", "done\n")
+	req := httptest.NewRequest("POST", "/user/repo.v1/git-upload-pack", strings.NewReader(blocked))
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	c.Assert(resp.Code, Equals, http.StatusOK)
+	c.Assert(resp.Body.String(), Equals, pktlines("ERR want 00000000000000000000000000000000000hash2 is not available from gopkg.in/user/repo.v1\n"))
+	c.Assert(sentBody, Equals, "")
+
+	// Nor when the request is compressed.
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write([]byte(blocked))
+	w.Close()
+	req = httptest.NewRequest("POST", "/user/repo.v1/git-upload-pack", &buf)
+	req.Header.Set("Content-Encoding", "gzip")
+	resp = httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	c.Assert(resp.Body.String(), Equals, pktlines("ERR want 00000000000000000000000000000000000hash2 is not available from gopkg.in/user/repo.v1\n"))
+	c.Assert(sentBody, Equals, "")
+
+	// Nor may references be wanted by name.
+	wantRef := pktlines("command=fetch\n", "0001", "want-ref refs/tags/v1.0.0\n", "done\n", "0000")
+	req = httptest.NewRequest("POST", "/user/repo.v1/git-upload-pack", strings.NewReader(wantRef))
+	resp = httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	c.Assert(resp.Body.String(), Equals, pktlines("ERR want-ref refs/tags/v1.0.0 is not available from gopkg.in/user/repo.v1\n"))
+	c.Assert(sentBody, Equals, "")
+
+	allowed := pktlines("want 00000000000000000000000000000000000hash3 ofs-delta\n", "0000", "done\n")
+	req = httptest.NewRequest("POST", "/user/repo.v1/git-upload-pack", strings.NewReader(allowed))
+	resp = httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	c.Assert(resp.Body.String(), Equals, "0008NAK\n")
+	c.Assert(sentBody, Equals, allowed)
+}
+
+func (s *ResolverSuite) TestReadUploadPack(c *C) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write([]byte("0009done\n"))
+	w.Close()
+
+	req := httptest.NewRequest("POST", "/user/repo.v1/git-upload-pack", bytes.NewReader(buf.Bytes()))
+	req.Header.Set("Content-Encoding", "gzip")
+	body, plain, ok := ReadUploadPack(httptest.NewRecorder(), req, 64)
+	c.Assert(ok, Equals, true)
+	c.Assert(body, DeepEquals, buf.Bytes())
+	c.Assert(string(plain), Equals, "0009done\n")
+
+	// Compressed bodies are limited in size once uncompressed as well.
+	var large bytes.Buffer
+	w = gzip.NewWriter(&large)
+	w.Write(bytes.Repeat([]byte("0009done\n"), 100))
+	w.Close()
+	req = httptest.NewRequest("POST", "/user/repo.v1/git-upload-pack", &large)
+	req.Header.Set("Content-Encoding", "gzip")
+	resp := httptest.NewRecorder()
+	_, _, ok = ReadUploadPack(resp, req, 500)
+	c.Assert(ok, Equals, false)
+	c.Assert(resp.Code, Equals, http.StatusRequestEntityTooLarge)
+	c.Assert(resp.Body.String(), Equals, "Cannot read upload-pack request: uncompressed request body too large")
+
+	req = httptest.NewRequest("POST", "/user/repo.v1/git-upload-pack", bytes.NewReader(buf.Bytes()))
+	req.Header.Set("Content-Encoding", "br")
+	resp = httptest.NewRecorder()
+	_, _, ok = ReadUploadPack(resp, req, 64)
+	c.Assert(ok, Equals, false)
+	c.Assert(resp.Code, Equals, http.StatusBadRequest)
+	c.Assert(resp.Body.String(), Equals, `Cannot read upload-pack request: unsupported upload-pack request encoding "br"`)
+}
+
+var refsURLRootTests = []struct {
+	url  string
+	root string
+}{
+	{"https://github.com/foo/bar.git/info/refs?service=git-upload-pack", "github.com/foo/bar"},
+	{"https://github.com/foo/bar/info/refs?service=git-upload-pack", "github.com/foo/bar"},
+	{"https://github.com/foo/bar.git/info/refs", "github.com/foo/bar"},
+	{"https://example.com/foo/bar.git/info/refs", ""},
+	{"https://github.com/foo/bar/baz.git/info/refs", ""},
+	{"https://github.com/foo.git/info/refs", ""},
+	{"https://github.com/login", ""},
+}
+
+func (s *ResolverSuite) TestRefsURLRoot(c *C) {
+	for _, test := range refsURLRootTests {
+		u, err := url.Parse(test.url)
+		c.Assert(err, IsNil)
+		root, ok := refsURLRoot(u, "github.com")
+		c.Assert(root, Equals, test.root, Commentf("URL: %s", test.url))
+		c.Assert(ok, Equals, test.root != "")
+	}
+}
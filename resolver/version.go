@@ -1,4 +1,4 @@
-package main
+package resolver
 
 import (
 	"fmt"
@@ -75,7 +75,8 @@ func (v Version) IsValid() bool {
 // InvalidVersion represents a version that can't be parsed.
 var InvalidVersion = Version{-1, -1, -1, false}
 
-func parseVersion(s string) (v Version, ok bool) {
+// ParseVersion parses a version such as "v1", "v1.2" or "v1.2.3-unstable".
+func ParseVersion(s string) (v Version, ok bool) {
 	v = InvalidVersion
 	if len(s) < 2 {
 		return
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// On SIGTERM or SIGINT the servers stop accepting connections and drain the
+// requests in flight for up to -shutdown-timeout before the process exits.
+//
+// Listeners may be inherited from systemd socket activation, or from a
+// previous process on SIGHUP: it starts a copy of itself handing over its
+// listeners, waits for the copy to be serving, and then shuts down
+// gracefully as above. Both use the LISTEN_FDS protocol. The state in the
+// -data directory is handed over as well, so the requests still drained by
+// the previous process no longer write to it.
+
+const (
+	listenFDsStart = 3
+	readyFDEnv     = "GOPKG_READY_FD"
+	handOffTimeout = time.Minute
+	refsCacheFile  = "refs.json"
+)
+
+var (
+	listenersLock sync.Mutex
+	inherited     []namedListener // Not yet taken by listen.
+	listeners     []namedListener // Opened or taken, to be handed off.
+)
+
+type namedListener struct {
+	name string
+	l    net.Listener
+}
+
+// inheritListeners takes the listeners passed on by systemd or by a
+// previous process, if any.
+func inheritListeners() error {
+	n := os.Getenv("LISTEN_FDS")
+	if n == "" {
+		return nil
+	}
+	if pid := os.Getenv("LISTEN_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return nil
+	}
+	count, err := strconv.Atoi(n)
+	if err != nil || count < 0 {
+		return fmt.Errorf("invalid LISTEN_FDS: %q", n)
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	files := make([]*os.File, count)
+	for i := range files {
+		files[i] = os.NewFile(uintptr(listenFDsStart+i), "listener")
+	}
+	for _, name := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		os.Unsetenv(name)
+	}
+	return takeListeners(files, names)
+}
+
+// takeListeners adds the listeners in files to the inherited ones, named
+// after the respective entries in names, and closes the files.
+func takeListeners(files []*os.File, names []string) error {
+	listenersLock.Lock()
+	defer listenersLock.Unlock()
+	var err error
+	for i, f := range files {
+		l, ferr := net.FileListener(f)
+		f.Close()
+		if ferr != nil {
+			if err == nil {
+				err = fmt.Errorf("cannot use inherited listener: %v", ferr)
+			}
+			continue
+		}
+		var name string
+		if i < len(names) {
+			name = names[i]
+		}
+		inherited = append(inherited, namedListener{name, l})
+	}
+	return err
+}
+
+// closeInherited closes the inherited listeners that weren't taken.
+func closeInherited() {
+	listenersLock.Lock()
+	defer listenersLock.Unlock()
+	for _, nl := range inherited {
+		log.Printf("Closing unused inherited listener %s at %s", nl.name, nl.l.Addr())
+		nl.l.Close()
+	}
+	inherited = nil
+}
+
+// listen returns the inherited listener with the provided name or address,
+// or listens on addr if there's none.
+func listen(name, addr string) (net.Listener, error) {
+	listenersLock.Lock()
+	defer listenersLock.Unlock()
+	l := takeInherited(name, addr)
+	if l == nil {
+		var err error
+		l, err = net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	listeners = append(listeners, namedListener{name, l})
+	return l, nil
+}
+
+// takeInherited must be called with listenersLock held.
+func takeInherited(name, addr string) net.Listener {
+	for _, byName := range []bool{true, false} {
+		for i, nl := range inherited {
+			if byName && nl.name == name || !byName && addrMatches(nl.l.Addr(), addr) {
+				inherited = append(inherited[:i], inherited[i+1:]...)
+				return nl.l
+			}
+		}
+	}
+	return nil
+}
+
+// addrMatches returns whether the listener at laddr serves addr, in the
+// host:port form taken by net.Listen.
+func addrMatches(laddr net.Addr, addr string) bool {
+	tcp, ok := laddr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || port != strconv.Itoa(tcp.Port) {
+		return false
+	}
+	if host == "" {
+		return tcp.IP.IsUnspecified()
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.Equal(tcp.IP)
+}
+
+// notifyReady tells the previous process that handed off its listeners
+// that this one is serving them now.
+func notifyReady() {
+	fd := os.Getenv(readyFDEnv)
+	if fd == "" {
+		return
+	}
+	os.Unsetenv(readyFDEnv)
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		log.Printf("Invalid %s: %q", readyFDEnv, fd)
+		return
+	}
+	f := os.NewFile(uintptr(n), "ready")
+	f.Write([]byte("ready\n"))
+	f.Close()
+}
+
+// handOff starts a new process running the current executable with the
+// same arguments, passing on the open listeners, and waits until it's
+// serving them.
+func handOff() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	listenersLock.Lock()
+	var files []*os.File
+	var names []string
+	for _, nl := range listeners {
+		fl, ok := nl.l.(interface{ File() (*os.File, error) })
+		if !ok {
+			continue
+		}
+		f, err := fl.File()
+		if err != nil {
+			listenersLock.Unlock()
+			w.Close()
+			closeFiles(files)
+			return fmt.Errorf("cannot hand off listener %s: %v", nl.name, err)
+		}
+		files = append(files, f)
+		names = append(names, nl.name)
+	}
+	listenersLock.Unlock()
+
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "LISTEN_") && !strings.HasPrefix(kv, readyFDEnv+"=") {
+			env = append(env, kv)
+		}
+	}
+	env = append(env,
+		"LISTEN_FDS="+strconv.Itoa(len(files)),
+		"LISTEN_FDNAMES="+strings.Join(names, ":"),
+		readyFDEnv+"="+strconv.Itoa(listenFDsStart+len(files)),
+	)
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = env
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, w)
+	err = cmd.Start()
+	w.Close()
+	closeFiles(files)
+	if err != nil {
+		return err
+	}
+
+	ready := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		_, err := r.Read(buf)
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+		if err != nil {
+			err = fmt.Errorf("new process failed before serving: %v", err)
+		}
+	case <-time.After(handOffTimeout):
+		err = fmt.Errorf("new process not serving after %v", handOffTimeout)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	log.Printf("Handed off listeners to process %d", cmd.Process.Pid)
+	go cmd.Wait()
+	return nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// shutdown stops the servers from accepting new connections and waits for
+// the requests in flight, for up to timeout before closing them anyway.
+func shutdown(servers []*http.Server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				log.Printf("Closing connections still active after %v: %v", timeout, err)
+				server.Close()
+			}
+		}(server)
+	}
+	wg.Wait()
+}
+
+// loadCaches restores the state saved by saveCaches.
+func loadCaches() error {
+	return loadState(refsCacheFile, refsCache)
+}
+
+// saveCaches persists the state that is otherwise only held in memory.
+func saveCaches() {
+	if err := saveState(refsCacheFile, refsCache); err != nil {
+		log.Printf("Error saving refs cache: %v", err)
+	}
+	saveBundleDemands()
+	saveIndex()
+	saveStats()
+}
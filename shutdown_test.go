@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&ShutdownSuite{})
+
+type ShutdownSuite struct{}
+
+func (s *ShutdownSuite) TearDownTest(c *C) {
+	closeInherited()
+	listenersLock.Lock()
+	for _, nl := range listeners {
+		nl.l.Close()
+	}
+	listeners = nil
+	listenersLock.Unlock()
+}
+
+var addrMatchesTests = []struct {
+	laddr   string
+	addr    string
+	matches bool
+}{
+	{"0.0.0.0:80", ":80", true},
+	{"[::]:80", ":80", true},
+	{"[::]:80", ":443", false},
+	{"127.0.0.1:8080", ":8080", false},
+	{"127.0.0.1:8080", "127.0.0.1:8080", true},
+	{"127.0.0.1:8080", "localhost:8080", false},
+	{"[::1]:8080", "[::1]:8080", true},
+	{"127.0.0.1:8080", "bad", false},
+}
+
+func (s *ShutdownSuite) TestAddrMatches(c *C) {
+	for _, test := range addrMatchesTests {
+		laddr, err := net.ResolveTCPAddr("tcp", test.laddr)
+		c.Assert(err, IsNil)
+		c.Assert(addrMatches(laddr, test.addr), Equals, test.matches, Commentf("%s %s", test.laddr, test.addr))
+	}
+}
+
+func (s *ShutdownSuite) TestInheritListeners(c *C) {
+	var files []*os.File
+	var addrs []string
+	for i := 0; i < 3; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		c.Assert(err, IsNil)
+		f, err := l.(*net.TCPListener).File()
+		c.Assert(err, IsNil)
+		l.Close()
+		files = append(files, f)
+		addrs = append(addrs, l.Addr().String())
+	}
+	c.Assert(takeListeners(files, []string{"https", "unknown"}), IsNil)
+
+	// By name first, and then by address.
+	l, err := listen("https", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	c.Assert(l.Addr().String(), Equals, addrs[0])
+	l, err = listen("http", addrs[2])
+	c.Assert(err, IsNil)
+	c.Assert(l.Addr().String(), Equals, addrs[2])
+
+	// The inherited listener works.
+	done := make(chan bool)
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			conn.Write([]byte("hello"))
+			conn.Close()
+		}
+		done <- true
+	}()
+	conn, err := net.Dial("tcp", addrs[2])
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadAll(conn)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "hello")
+	conn.Close()
+	<-done
+
+	// Unknown listeners are opened anew.
+	l, err = listen("admin", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	c.Assert(l.Addr().String(), Not(Equals), addrs[1])
+
+	c.Assert(inherited, HasLen, 1)
+	closeInherited()
+	c.Assert(inherited, HasLen, 0)
+	_, err = net.Dial("tcp", addrs[1])
+	c.Assert(err, NotNil)
+
+	c.Assert(listeners, HasLen, 3)
+	c.Assert(listeners[0].name, Equals, "https")
+	c.Assert(listeners[1].name, Equals, "http")
+	c.Assert(listeners[2].name, Equals, "admin")
+}
+
+func (s *ShutdownSuite) TestShutdownDrains(c *C) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	started := make(chan bool)
+	release := make(chan bool)
+	server := newServer()
+	server.Handler = http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		started <- true
+		<-release
+		resp.Write([]byte("done"))
+	})
+	go server.Serve(l)
+
+	got := make(chan string)
+	go func() {
+		resp, err := http.Get("http://" + l.Addr().String())
+		if err != nil {
+			got <- err.Error()
+			return
+		}
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		got <- string(data)
+	}()
+	<-started
+
+	stopped := make(chan bool)
+	go func() {
+		shutdown([]*http.Server{server}, time.Minute)
+		stopped <- true
+	}()
+
+	// No longer accepting connections.
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			break
+		}
+		conn.Close()
+		c.Assert(i < 100, Equals, true)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	select {
+	case <-stopped:
+		c.Fatalf("Shut down with a request in flight")
+	default:
+	}
+	close(release)
+	c.Assert(<-got, Equals, "done")
+	<-stopped
+}
+
+func (s *ShutdownSuite) TestShutdownTimeout(c *C) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	started := make(chan bool)
+	release := make(chan bool)
+	defer close(release)
+	server := newServer()
+	server.Handler = http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		started <- true
+		<-release
+	})
+	go server.Serve(l)
+
+	failed := make(chan error)
+	go func() {
+		_, err := http.Get("http://" + l.Addr().String())
+		failed <- err
+	}()
+	<-started
+
+	shutdown([]*http.Server{server}, 50*time.Millisecond)
+	c.Assert(<-failed, NotNil)
+}
+
+func (s *ShutdownSuite) TestHandOffState(c *C) {
+	*dataFlag = c.MkDir()
+	defer func() {
+		*dataFlag = ""
+		stateHandedOff = false
+	}()
+	path := filepath.Join(*dataFlag, "test.jsonl")
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	started := make(chan bool)
+	release := make(chan bool)
+	server := newServer()
+	server.Handler = http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		started <- true
+		<-release
+		if err := appendState("test.jsonl", req.URL.Path); err != nil {
+			resp.Write([]byte(err.Error()))
+			return
+		}
+		resp.Write([]byte("done"))
+	})
+	go server.Serve(l)
+
+	got := make(chan string)
+	get := func(path string) {
+		resp, err := http.Get("http://" + l.Addr().String() + path)
+		if err != nil {
+			got <- err.Error()
+			return
+		}
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		got <- string(data)
+	}
+
+	// A failed handoff holds writes until it's known to have failed.
+	go get("/failed")
+	<-started
+	err = handOffState(func() error {
+		close(release)
+		time.Sleep(50 * time.Millisecond)
+		data, err := ioutil.ReadFile(path)
+		c.Check(os.IsNotExist(err), Equals, true, Commentf("%q", data))
+		return errors.New("failed")
+	})
+	c.Assert(err, ErrorMatches, "failed")
+	c.Assert(<-got, Equals, "done")
+
+	// Once handed off, requests still in flight don't write anymore.
+	release = make(chan bool)
+	go get("/handed-off")
+	<-started
+	var loaded []byte
+	err = handOffState(func() error {
+		close(release)
+		time.Sleep(50 * time.Millisecond)
+		loaded, err = ioutil.ReadFile(path)
+		return err
+	})
+	c.Assert(err, IsNil)
+	shutdown([]*http.Server{server}, time.Minute)
+	c.Assert(<-got, Equals, "done")
+
+	c.Assert(string(loaded), Equals, `"/failed"`+"\n")
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, string(loaded))
+	c.Assert(saveState("test.json", 1), IsNil)
+	_, err = os.Stat(filepath.Join(*dataFlag, "test.json"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"crypto/rand"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/niemeyer/gopkg/resolver"
+)
+
+// Download statistics count, for every package version and day, the go get
+// meta requests, the refs fetches, and the upload-pack transfers served,
+// and estimate how many distinct clients made them. Client addresses are
+// only ever added to HyperLogLog sketches, so they can't be listed back,
+// and they're hashed with a secret key replaced every day, so once the day
+// is over they can't be tested against the sketches either. Clients seen
+// over several days are thus counted once per day.
+//
+// The statistics are shown on the package page, and are reported in JSON
+// at /_stats/<package path>?days=<n>.
+
+const (
+	statsFile       = "stats.json"
+	statsSecretFile = "stats-secret.json"
+)
+
+// statsPath is where the statistics are served. Like sitePath, it can't
+// clash with package paths.
+const statsPath = "/_stats/"
+
+// statsPageDays is how many days of statistics the package page shows.
+const statsPageDays = 30
+
+const (
+	statsMeta  = "meta"
+	statsRefs  = "refs"
+	statsPacks = "packs"
+)
+
+type statsKey struct {
+	Repo    string // Original GitHub root.
+	Major   string
+	Version string
+	Day     string
+}
+
+// statsRecord holds the statistics for a package version on a day.
+type statsRecord struct {
+	Repo    string       `json:"repo"`
+	Major   string       `json:"major"`
+	Version string       `json:"version"`
+	Day     string       `json:"day"`
+	Meta    int64        `json:"meta"`
+	Refs    int64        `json:"refs"`
+	Packs   int64        `json:"packs"`
+	Clients *hyperLogLog `json:"clients"`
+}
+
+func (r *statsRecord) key() statsKey {
+	return statsKey{r.Repo, r.Major, r.Version, r.Day}
+}
+
+// statsSecret holds the key client addresses are hashed with on a day.
+type statsSecret struct {
+	Day string `json:"day"`
+	Key []byte `json:"key"`
+}
+
+var (
+	stats       = make(map[statsKey]*statsRecord)
+	statsDayKey statsSecret
+	statsLock   sync.Mutex
+)
+
+var statsRecords = newGauge("gopkg_stats_records", "Number of package version and day records in the download statistics.")
+
+func loadStats() error {
+	var records []*statsRecord
+	if err := loadState(statsFile, &records); err != nil {
+		return err
+	}
+	var secret statsSecret
+	if err := loadState(statsSecretFile, &secret); err != nil {
+		return err
+	}
+	statsLock.Lock()
+	defer statsLock.Unlock()
+	statsDayKey = secret
+	for _, r := range records {
+		if r.Clients == nil {
+			r.Clients = &hyperLogLog{}
+		}
+		stats[r.key()] = r
+	}
+	statsRecords.set(float64(len(stats)))
+	return nil
+}
+
+func saveStats() {
+	statsLock.Lock()
+	defer statsLock.Unlock()
+	records := make([]*statsRecord, 0, len(stats))
+	for _, r := range stats {
+		records = append(records, r)
+	}
+	if err := saveState(statsFile, records); err != nil {
+		log.Printf("Error saving download statistics: %v", err)
+	}
+}
+
+// statsLoop drops the statistics older than -stats-days, and saves them,
+// every indexSaveInterval.
+func statsLoop() {
+	for range time.Tick(indexSaveInterval) {
+		pruneStats(time.Now())
+		saveStats()
+	}
+}
+
+// statsDay returns the day t is in, as recorded in the statistics.
+func statsDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+func pruneStats(now time.Time) {
+	oldest := statsDay(now.AddDate(0, 0, 1-*statsDaysFlag))
+	statsLock.Lock()
+	defer statsLock.Unlock()
+	for key := range stats {
+		if key.Day < oldest {
+			delete(stats, key)
+		}
+	}
+	statsRecords.set(float64(len(stats)))
+}
+
+// countDownload records a request of the given kind for the version of
+// repo being served.
+func countDownload(req *http.Request, repo *resolver.Repo, kind string, now time.Time) {
+	major := repo.MajorVersion
+	major.Minor = -1
+	major.Patch = -1
+	key := statsKey{
+		Repo:    repo.Original().GitHubRoot(),
+		Major:   major.String(),
+		Version: repo.GitHubTree(),
+		Day:     statsDay(now),
+	}
+
+	statsLock.Lock()
+	defer statsLock.Unlock()
+	r, ok := stats[key]
+	if !ok {
+		r = &statsRecord{Repo: key.Repo, Major: key.Major, Version: key.Version, Day: key.Day, Clients: &hyperLogLog{}}
+		stats[key] = r
+		statsRecords.set(float64(len(stats)))
+	}
+	switch kind {
+	case statsMeta:
+		r.Meta++
+	case statsRefs:
+		r.Refs++
+	case statsPacks:
+		r.Packs++
+	}
+	r.Clients.add(statsKeyFor(key.Day), clientIP(req))
+}
+
+// statsKeyFor returns the secret key client addresses are hashed with on
+// day, replacing the one for the previous day. The key is kept in -data so
+// that clients are still counted once after a restart on the same day.
+// It must be called with statsLock held.
+func statsKeyFor(day string) []byte {
+	if statsDayKey.Day == day {
+		return statsDayKey.Key
+	}
+	key := make([]byte, 32)
+	rand.Read(key)
+	statsDayKey = statsSecret{day, key}
+	if err := saveState(statsSecretFile, &statsDayKey); err != nil {
+		log.Printf("Error saving statistics key: %v", err)
+	}
+	return key
+}
+
+// statsTotal holds the statistics aggregated over days, and possibly over
+// versions, with the number of distinct clients estimated.
+type statsTotal struct {
+	Major   string `json:"major"`
+	Version string `json:"version,omitempty"`
+	Day     string `json:"day,omitempty"`
+	Meta    int64  `json:"meta"`
+	Refs    int64  `json:"refs"`
+	Packs   int64  `json:"packs"`
+	Clients int64  `json:"clients"`
+
+	clients hyperLogLog // Only used while aggregating.
+}
+
+// statsReport holds the statistics for a repository since a day.
+type statsReport struct {
+	Repo     string        `json:"repo"`
+	Since    string        `json:"since"`
+	Majors   []*statsTotal `json:"majors"`   // Per major version.
+	Versions []*statsTotal `json:"versions"` // Per full version.
+	Days     []*statsTotal `json:"days"`     // Per full version and day.
+}
+
+// repoStats reports the statistics for the original repository of repo
+// over the last days, the latest versions first.
+func repoStats(repo *resolver.Repo, days int, now time.Time) *statsReport {
+	report := &statsReport{
+		Repo:     repo.Original().GitHubRoot(),
+		Since:    statsDay(now.AddDate(0, 0, 1-days)),
+		Majors:   []*statsTotal{},
+		Versions: []*statsTotal{},
+		Days:     []*statsTotal{},
+	}
+	majors := make(map[string]*statsTotal)
+	versions := make(map[string]*statsTotal)
+	statsLock.Lock()
+	for key, r := range stats {
+		if key.Repo != report.Repo || key.Day < report.Since {
+			continue
+		}
+		m, ok := majors[key.Major]
+		if !ok {
+			m = &statsTotal{Major: key.Major}
+			majors[key.Major] = m
+			report.Majors = append(report.Majors, m)
+		}
+		v, ok := versions[key.Major+" "+key.Version]
+		if !ok {
+			v = &statsTotal{Major: key.Major, Version: key.Version}
+			versions[key.Major+" "+key.Version] = v
+			report.Versions = append(report.Versions, v)
+		}
+		d := &statsTotal{Major: key.Major, Version: key.Version, Day: key.Day}
+		report.Days = append(report.Days, d)
+		for _, t := range []*statsTotal{m, v, d} {
+			t.Meta += r.Meta
+			t.Refs += r.Refs
+			t.Packs += r.Packs
+			t.clients.merge(r.Clients)
+		}
+	}
+	statsLock.Unlock()
+	for _, totals := range [][]*statsTotal{report.Majors, report.Versions, report.Days} {
+		for _, t := range totals {
+			t.Clients = t.clients.count()
+			t.clients = hyperLogLog{}
+		}
+		sortStats(totals)
+	}
+	return report
+}
+
+// sortStats sorts totals by day, then by version, the latest first.
+func sortStats(totals []*statsTotal) {
+	version := func(t *statsTotal) resolver.Version {
+		s := t.Version
+		if s == "" {
+			s = t.Major
+		}
+		v, ok := resolver.ParseVersion(s)
+		if !ok {
+			// Branches such as master go last.
+			v = resolver.InvalidVersion
+		}
+		return v
+	}
+	sort.Slice(totals, func(i, j int) bool {
+		ti, tj := totals[i], totals[j]
+		if ti.Day != tj.Day {
+			return ti.Day > tj.Day
+		}
+		vi, vj := version(ti), version(tj)
+		if vi != vj {
+			return vj.Less(vi)
+		}
+		return ti.Version < tj.Version
+	})
+}
+
+// statsHandler reports the statistics for the package at the path after
+// statsPath, over the last ?days, which defaults to statsPageDays.
+func statsHandler(resp http.ResponseWriter, req *http.Request) {
+	repo, err := resolver.ParsePath("/" + strings.TrimPrefix(req.URL.Path, statsPath))
+	if err != nil {
+		sendJSON(resp, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	repo.Host = *hostFlag
+	days := statsPageDays
+	if s := req.FormValue("days"); s != "" {
+		days, err = strconv.Atoi(s)
+		if err != nil || days < 1 || days > *statsDaysFlag {
+			sendJSON(resp, http.StatusBadRequest, map[string]string{"error": "days must be between 1 and " + strconv.Itoa(*statsDaysFlag)})
+			return
+		}
+	}
+	sendJSON(resp, http.StatusOK, repoStats(repo, days, time.Now()))
+}
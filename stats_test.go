@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/niemeyer/gopkg/resolver"
+)
+
+var _ = Suite(&StatsSuite{})
+
+type StatsSuite struct{}
+
+func (s *StatsSuite) TearDownTest(c *C) {
+	*dataFlag = ""
+	statsLock.Lock()
+	stats = make(map[statsKey]*statsRecord)
+	statsDayKey = statsSecret{}
+	statsLock.Unlock()
+}
+
+var hllKey = []byte("key")
+
+func (s *StatsSuite) TestHyperLogLog(c *C) {
+	var h hyperLogLog
+	c.Assert(h.count(), Equals, int64(0))
+	for i := 0; i < 3; i++ {
+		h.add(hllKey, "192.0.2.1")
+		h.add(hllKey, "192.0.2.2")
+	}
+	c.Assert(h.count(), Equals, int64(2))
+	c.Assert(h.dense, IsNil)
+
+	// The same values hashed with another key are different.
+	h.add([]byte("other"), "192.0.2.1")
+	c.Assert(h.count(), Equals, int64(3))
+
+	for _, n := range []int{100, 1000, 100000} {
+		var h hyperLogLog
+		for i := 0; i < n; i++ {
+			h.add(hllKey, fmt.Sprintf("10.%d.%d.%d", i>>16&0xff, i>>8&0xff, i&0xff))
+		}
+		errorRate := float64(h.count()-int64(n)) / float64(n)
+		c.Assert(errorRate < 0.1 && errorRate > -0.1, Equals, true, Commentf("%d estimated as %d", n, h.count()))
+	}
+}
+
+func (s *StatsSuite) TestHyperLogLogMergeAndJSON(c *C) {
+	var a, b, small hyperLogLog
+	for i := 0; i < 1000; i++ {
+		a.add(hllKey, fmt.Sprint("a", i))
+		b.add(hllKey, fmt.Sprint("b", i))
+	}
+	small.add(hllKey, "a1")
+	small.add(hllKey, "c1")
+	count := a.count()
+	a.merge(&b)
+	a.merge(&small)
+	c.Assert(a.count() > count*19/10, Equals, true)
+
+	for _, h := range []*hyperLogLog{&a, &small, {}} {
+		data, err := json.Marshal(h)
+		c.Assert(err, IsNil)
+		var decoded hyperLogLog
+		c.Assert(json.Unmarshal(data, &decoded), IsNil)
+		c.Assert(decoded.count(), Equals, h.count())
+	}
+	var decoded hyperLogLog
+	c.Assert(json.Unmarshal([]byte(`"AAA="`), &decoded), ErrorMatches, "invalid sketch length 2")
+	c.Assert(json.Unmarshal([]byte(`"/wAB"`), &decoded), ErrorMatches, "invalid sketch register 65280")
+}
+
+func download(c *C, path, ip, kind string, version resolver.Version, now time.Time) {
+	repo, err := resolver.ParsePath(path)
+	c.Assert(err, IsNil)
+	repo.FullVersion = version
+	req := httptest.NewRequest("GET", path, nil)
+	req.RemoteAddr = ip + ":1234"
+	countDownload(req, repo, kind, now)
+}
+
+func (s *StatsSuite) TestRepoStats(c *C) {
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	v240 := resolver.Version{Major: 2, Minor: 4, Patch: 0}
+	v300 := resolver.Version{Major: 3, Minor: 0, Patch: 0}
+	download(c, "/yaml.v2", "192.0.2.1", statsMeta, v240, now)
+	download(c, "/yaml.v2/info/refs", "192.0.2.1", statsRefs, v240, now)
+	download(c, "/yaml.v2/git-upload-pack", "192.0.2.1", statsPacks, v240, now)
+	download(c, "/yaml.v2/git-upload-pack", "192.0.2.2", statsPacks, v240, now.AddDate(0, 0, -1))
+	download(c, "/yaml.v3/git-upload-pack", "192.0.2.1", statsPacks, v300, now)
+	download(c, "/yaml.v0/git-upload-pack", "192.0.2.3", statsPacks, resolver.InvalidVersion, now)
+	download(c, "/yaml.v2/git-upload-pack", "192.0.2.4", statsPacks, v240, now.AddDate(0, 0, -30))
+	download(c, "/other.v2/git-upload-pack", "192.0.2.5", statsPacks, v240, now)
+
+	repo, err := resolver.ParsePath("/yaml.v2")
+	c.Assert(err, IsNil)
+	report := repoStats(repo, 30, now)
+	c.Assert(report.Repo, Equals, "github.com/go-yaml/yaml")
+	c.Assert(report.Since, Equals, "2024-04-11")
+	c.Assert(report.Majors, DeepEquals, []*statsTotal{
+		{Major: "v3", Packs: 1, Clients: 1},
+		{Major: "v2", Meta: 1, Refs: 1, Packs: 2, Clients: 2},
+		{Major: "v0", Packs: 1, Clients: 1},
+	})
+	c.Assert(report.Versions, HasLen, 3)
+	c.Assert(report.Versions[1].Version, Equals, "v2.4.0")
+	c.Assert(report.Versions[2].Version, Equals, "master")
+	c.Assert(report.Days, HasLen, 4)
+	c.Assert(*report.Days[0], DeepEquals, statsTotal{Major: "v3", Version: "v3.0.0", Day: "2024-05-10", Packs: 1, Clients: 1})
+	c.Assert(*report.Days[3], DeepEquals, statsTotal{Major: "v2", Version: "v2.4.0", Day: "2024-05-09", Packs: 1, Clients: 1})
+
+	c.Assert(repoStats(repo, 1, now).Majors[1].Packs, Equals, int64(1))
+}
+
+func (s *StatsSuite) TestPruneAndPersist(c *C) {
+	defer func(days int) { *statsDaysFlag = days }(*statsDaysFlag)
+	*statsDaysFlag = 7
+	*dataFlag = c.MkDir()
+
+	now := time.Now()
+	v1 := resolver.Version{Major: 1, Minor: 0, Patch: 0}
+	download(c, "/pkg.v1", "192.0.2.3", statsMeta, v1, now.AddDate(0, 0, -7))
+	download(c, "/pkg.v1", "192.0.2.2", statsMeta, v1, now.AddDate(0, 0, -6))
+	download(c, "/pkg.v1", "192.0.2.1", statsMeta, v1, now)
+	pruneStats(now)
+	c.Assert(stats, HasLen, 2)
+	c.Assert(statsRecords.values[""], Equals, float64(2))
+
+	saveStats()
+	stats = make(map[statsKey]*statsRecord)
+	statsDayKey = statsSecret{}
+	c.Assert(loadStats(), IsNil)
+	c.Assert(stats, HasLen, 2)
+
+	// Clients keep being counted once after a restart.
+	download(c, "/pkg.v1", "192.0.2.1", statsMeta, v1, now)
+	repo, _ := resolver.ParsePath("/pkg.v1")
+	c.Assert(repoStats(repo, 7, now).Majors, DeepEquals, []*statsTotal{{Major: "v1", Meta: 3, Clients: 2}})
+}
+
+func (s *StatsSuite) TestDayKey(c *C) {
+	*dataFlag = c.MkDir()
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	v1 := resolver.Version{Major: 1, Minor: 0, Patch: 0}
+	download(c, "/pkg.v1", "192.0.2.1", statsMeta, v1, now)
+	key := statsDayKey.Key
+	c.Assert(key, HasLen, 32)
+
+	var saved statsSecret
+	c.Assert(loadState(statsSecretFile, &saved), IsNil)
+	c.Assert(saved, DeepEquals, statsSecret{"2024-05-10", key})
+
+	// The key is replaced, and forgotten, on the next day.
+	download(c, "/pkg.v1", "192.0.2.1", statsMeta, v1, now.AddDate(0, 0, 1))
+	c.Assert(statsDayKey.Day, Equals, "2024-05-11")
+	c.Assert(statsDayKey.Key, Not(DeepEquals), key)
+	c.Assert(loadState(statsSecretFile, &saved), IsNil)
+	c.Assert(saved, DeepEquals, statsDayKey)
+
+	// The same client is counted again on another day.
+	repo, _ := resolver.ParsePath("/pkg.v1")
+	c.Assert(repoStats(repo, 7, now.AddDate(0, 0, 1)).Majors, DeepEquals, []*statsTotal{{Major: "v1", Meta: 2, Clients: 2}})
+}
+
+func (s *StatsSuite) TestHandler(c *C) {
+	download(c, "/user/pkg.v1/git-upload-pack", "192.0.2.1", statsPacks, resolver.Version{Major: 1, Minor: 2, Patch: 3}, time.Now())
+
+	resp := httptest.NewRecorder()
+	statsHandler(resp, httptest.NewRequest("GET", "/_stats/user/pkg.v1?days=7", nil))
+	c.Assert(resp.Code, Equals, http.StatusOK)
+	var report statsReport
+	c.Assert(json.Unmarshal(resp.Body.Bytes(), &report), IsNil)
+	c.Assert(report.Repo, Equals, "github.com/user/pkg")
+	c.Assert(report.Versions, HasLen, 1)
+	c.Assert(report.Versions[0].Version, Equals, "v1.2.3")
+	c.Assert(report.Versions[0].Clients, Equals, int64(1))
+
+	// The old path format refers to the same package.
+	resp = httptest.NewRecorder()
+	statsHandler(resp, httptest.NewRequest("GET", "/_stats/user/v1/pkg", nil))
+	c.Assert(resp.Code, Equals, http.StatusOK)
+	c.Assert(json.Unmarshal(resp.Body.Bytes(), &report), IsNil)
+	c.Assert(report.Majors, HasLen, 1)
+
+	resp = httptest.NewRecorder()
+	statsHandler(resp, httptest.NewRequest("GET", "/_stats/user/pkg.v1?days=1000", nil))
+	c.Assert(resp.Code, Equals, http.StatusBadRequest)
+	c.Assert(resp.Body.String(), Matches, `(?s).*days must be between 1 and 90.*`)
+
+	resp = httptest.NewRecorder()
+	statsHandler(resp, httptest.NewRequest("GET", "/_stats/nothing", nil))
+	c.Assert(resp.Code, Equals, http.StatusNotFound)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Only one process writes to the -data directory at a time. When restarting,
+// writes are held while the state is handed off to the new process, and
+// dropped from then on if it took over.
+var (
+	stateLock      sync.RWMutex
+	stateHandedOff bool
+)
+
+// handOffState holds all state writes while calling start, which starts the
+// process taking over the state and returns once that process is serving.
+// If start succeeds, writes from this process are dropped from then on.
+func handOffState(start func() error) error {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	err := start()
+	stateHandedOff = err == nil
+	return err
+}
+
+// loadState decodes the named state file from the -data directory into value.
+// Nothing is done and no error is returned if -data is unset or the file
+// doesn't exist yet.
+func loadState(name string, value interface{}) error {
+	if *dataFlag == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(filepath.Join(*dataFlag, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read state: %v", err)
+	}
+	if err := json.Unmarshal(data, value); err != nil {
+		return fmt.Errorf("cannot decode state file %s: %v", name, err)
+	}
+	return nil
+}
+
+// saveState atomically replaces the named state file in the -data directory
+// with the JSON encoding of value. Nothing is done if -data is unset or the
+// state was handed off.
+func saveState(name string, value interface{}) error {
+	stateLock.RLock()
+	defer stateLock.RUnlock()
+	if *dataFlag == "" || stateHandedOff {
+		return nil
+	}
+	data, err := json.MarshalIndent(value, "", "\t")
+	if err != nil {
+		return fmt.Errorf("cannot encode state file %s: %v", name, err)
+	}
+	path := filepath.Join(*dataFlag, name)
+	tmp, err := ioutil.TempFile(*dataFlag, name+".tmp")
+	if err != nil {
+		return fmt.Errorf("cannot write state: %v", err)
+	}
+	_, err = tmp.Write(append(data, '\n'))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("cannot write state: %v", err)
+	}
+	return nil
+}
+
+// appendState appends the JSON encoding of each value as a new line at the
+// end of the named state file in the -data directory. Nothing is done if
+// -data is unset or the state was handed off.
+func appendState(name string, values ...interface{}) error {
+	stateLock.RLock()
+	defer stateLock.RUnlock()
+	if *dataFlag == "" || stateHandedOff || len(values) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, value := range values {
+		if err := enc.Encode(value); err != nil {
+			return fmt.Errorf("cannot encode state file %s: %v", name, err)
+		}
+	}
+	f, err := os.OpenFile(filepath.Join(*dataFlag, name), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot write state: %v", err)
+	}
+	_, err = f.Write(buf.Bytes())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("cannot write state: %v", err)
+	}
+	return nil
+}
+
+// loadStateLines calls f with every line of the named state file written
+// with appendState. Nothing is done and no error is returned if -data is
+// unset or the file doesn't exist yet.
+func loadStateLines(name string, f func(line []byte) error) error {
+	if *dataFlag == "" {
+		return nil
+	}
+	file, err := os.Open(filepath.Join(*dataFlag, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read state: %v", err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		if err := f(scanner.Bytes()); err != nil {
+			return fmt.Errorf("cannot decode state file %s at line %d: %v", name, n, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("cannot read state: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/sumdb/note"
+	"golang.org/x/mod/sumdb/tlog"
+
+	"github.com/niemeyer/gopkg/resolver"
+)
+
+// The transparency log is an append-only Merkle tree holding every
+// (path, version, commit) resolution served for version tags. It's served
+// with the same endpoints and formats as the Go checksum database, so that
+// auditors can verify with existing tooling that gopkg.in never served two
+// different commits for the same version:
+//
+//	/tlog/latest                 Signed tree head.
+//	/tlog/lookup/<path>@<version>  Latest record for the version and signed tree head.
+//	/tlog/tile/<H>/<L>/<N>[.p/<W>] Hash tiles.
+//	/tlog/tile/<H>/data/<N>[.p/<W>] Record data tiles.
+//	/tlog/key                    Verifier key for the signed tree heads.
+
+const tlogTileHeight = 8
+
+// tlogEntry is a line in the append-only transparency log file.
+type tlogEntry struct {
+	Path    string    `json:"path"`
+	Version string    `json:"version"`
+	Hash    string    `json:"hash"`
+	Time    time.Time `json:"time"`
+}
+
+func (e *tlogEntry) text() []byte {
+	return []byte(fmt.Sprintf("%s %s %s\n", e.Path, e.Version, e.Hash))
+}
+
+const tlogFile = "tlog.jsonl"
+const tlogKeyFile = "tlog.key"
+
+var (
+	tlogRecords [][]byte
+	tlogHashes  []tlog.Hash
+	tlogLookup  = make(map[string]int64) // path@version => latest record id
+	tlogSeen    = make(map[string]bool)  // record text => true
+	tlogLock    sync.RWMutex
+
+	tlogSigner      note.Signer
+	tlogVerifierKey string
+)
+
+var tlogSize = newGauge("gopkg_tlog_records", "Number of records in the transparency log.")
+
+func loadTlog() error {
+	if err := loadTlogKey(); err != nil {
+		return err
+	}
+	tlogLock.Lock()
+	defer tlogLock.Unlock()
+	return loadStateLines(tlogFile, func(line []byte) error {
+		var e tlogEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return err
+		}
+		return appendTlogRecord(&e)
+	})
+}
+
+// loadTlogKey loads the note signer key from the -tlog-key file or the -data
+// directory, generating and storing a new key in the latter if necessary.
+// The key is named after -host, and a stored key for another name is refused.
+func loadTlogKey() error {
+	path := *tlogKeyFlag
+	if path == "" && *dataFlag != "" {
+		path = filepath.Join(*dataFlag, tlogKeyFile)
+	}
+	var skey, vkey string
+	data, err := ioutil.ReadFile(path)
+	if path == "" || *tlogKeyFlag == "" && os.IsNotExist(err) {
+		skey, vkey, err = note.GenerateKey(rand.Reader, *hostFlag)
+		if err != nil {
+			return fmt.Errorf("cannot generate transparency log key: %v", err)
+		}
+		if path == "" {
+			log.Printf("Transparency log key is not persisted; use -data or -tlog-key.")
+		} else if err := ioutil.WriteFile(path, []byte(skey+"\n"), 0600); err != nil {
+			return fmt.Errorf("cannot write transparency log key: %v", err)
+		}
+	} else if err != nil {
+		return fmt.Errorf("cannot read transparency log key: %v", err)
+	} else {
+		skey = strings.TrimSpace(string(data))
+	}
+	tlogSigner, err = note.NewSigner(skey)
+	if err != nil {
+		return fmt.Errorf("invalid transparency log key in %s: %v", path, err)
+	}
+	if tlogSigner.Name() != *hostFlag {
+		return fmt.Errorf("transparency log key in %s is for %s, not -host %s", path, tlogSigner.Name(), *hostFlag)
+	}
+	if vkey == "" {
+		// Signer keys are "PRIVATE+KEY+<name>+<hash>+<key>", with the
+		// key holding the algorithm byte and the ed25519 seed.
+		fields := strings.SplitN(skey, "+", 5)
+		key, _ := base64.StdEncoding.DecodeString(fields[len(fields)-1])
+		if len(fields) != 5 || len(key) != 1+ed25519.SeedSize {
+			return fmt.Errorf("invalid transparency log key in %s", path)
+		}
+		public := ed25519.NewKeyFromSeed(key[1:]).Public().(ed25519.PublicKey)
+		vkey, err = note.NewEd25519VerifierKey(fields[2], public)
+		if err != nil {
+			return fmt.Errorf("invalid transparency log key in %s: %v", path, err)
+		}
+	}
+	tlogVerifierKey = vkey
+	return nil
+}
+
+// appendTlogRecord must be called with tlogLock held.
+func appendTlogRecord(e *tlogEntry) error {
+	text := e.text()
+	n := int64(len(tlogRecords))
+	hashes, err := tlog.StoredHashes(n, text, tlogHashReader)
+	if err != nil {
+		return err
+	}
+	tlogRecords = append(tlogRecords, text)
+	tlogHashes = append(tlogHashes, hashes...)
+	tlogLookup[e.Path+"@"+e.Version] = n
+	tlogSeen[string(text)] = true
+	tlogSize.set(float64(len(tlogRecords)))
+	return nil
+}
+
+var tlogHashReader = tlog.HashReaderFunc(func(indexes []int64) ([]tlog.Hash, error) {
+	hashes := make([]tlog.Hash, len(indexes))
+	for i, index := range indexes {
+		if index >= int64(len(tlogHashes)) {
+			return nil, fmt.Errorf("transparency log hash %d not available", index)
+		}
+		hashes[i] = tlogHashes[index]
+	}
+	return hashes, nil
+})
+
+// tlogObserve appends to the transparency log the resolution of the given
+// package path and version to commit hash, unless it was already recorded.
+func tlogObserve(path string, version resolver.Version, hash string) {
+	e := &tlogEntry{
+		Path:    path,
+		Version: version.String(),
+		Hash:    hash,
+		Time:    time.Now(),
+	}
+	tlogLock.RLock()
+	seen := tlogSeen[string(e.text())]
+	tlogLock.RUnlock()
+	if seen {
+		return
+	}
+
+	tlogLock.Lock()
+	defer tlogLock.Unlock()
+	if tlogSeen[string(e.text())] {
+		return
+	}
+	if id, ok := tlogLookup[e.Path+"@"+e.Version]; ok {
+		log.Printf("Transparency log has %s %s at a different commit in record %d", e.Path, e.Version, id)
+	}
+	if err := appendTlogRecord(e); err != nil {
+		log.Printf("Error appending to transparency log: %v", err)
+		return
+	}
+	if err := appendState(tlogFile, e); err != nil {
+		log.Printf("Error saving transparency log: %v", err)
+	}
+}
+
+// tlogTreeHead returns the signed tree head for the current log. It must be
+// called with tlogLock held.
+func tlogTreeHead() ([]byte, error) {
+	n := int64(len(tlogRecords))
+	hash, err := tlog.TreeHash(n, tlogHashReader)
+	if err != nil {
+		return nil, err
+	}
+	text := tlog.FormatTree(tlog.Tree{N: n, Hash: hash})
+	return note.Sign(&note.Note{Text: string(text)}, tlogSigner)
+}
+
+func tlogHandler(resp http.ResponseWriter, req *http.Request) {
+	path := strings.TrimPrefix(req.URL.Path, "/tlog/")
+
+	tlogLock.RLock()
+	defer tlogLock.RUnlock()
+
+	switch {
+	case path == "key":
+		resp.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		resp.Write([]byte(tlogVerifierKey + "\n"))
+
+	case path == "latest":
+		head, err := tlogTreeHead()
+		if err != nil {
+			sendTlogError(resp, err)
+			return
+		}
+		resp.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		resp.Write(head)
+
+	case strings.HasPrefix(path, "lookup/"):
+		id, ok := tlogLookup[strings.TrimPrefix(path, "lookup/")]
+		if !ok {
+			sendNotFound(resp, "No transparency log record for %s", strings.TrimPrefix(path, "lookup/"))
+			return
+		}
+		msg, err := tlog.FormatRecord(id, tlogRecords[id])
+		if err == nil {
+			var head []byte
+			head, err = tlogTreeHead()
+			msg = append(msg, head...)
+		}
+		if err != nil {
+			sendTlogError(resp, err)
+			return
+		}
+		resp.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		resp.Write(msg)
+
+	case strings.HasPrefix(path, "tile/"):
+		t, err := tlog.ParseTilePath(path)
+		if err != nil || t.H != tlogTileHeight {
+			sendNotFound(resp, "Invalid transparency log tile path")
+			return
+		}
+		if !tlogHasTile(t) {
+			sendNotFound(resp, "Transparency log tile not available yet")
+			return
+		}
+		var data []byte
+		if t.L == -1 {
+			start := t.N << uint(t.H)
+			for i := start; i < start+int64(t.W); i++ {
+				msg, ferr := tlog.FormatRecord(i, tlogRecords[i])
+				if ferr != nil {
+					err = ferr
+					break
+				}
+				data = append(data, msg...)
+			}
+		} else {
+			data, err = tlog.ReadTileData(t, tlogHashReader)
+		}
+		if err != nil {
+			sendTlogError(resp, err)
+			return
+		}
+		if t.W == 1<<uint(t.H) {
+			// Full tiles never change.
+			resp.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		}
+		resp.Header().Set("Content-Type", "application/octet-stream")
+		resp.Write(data)
+
+	default:
+		sendNotFound(resp, "Unknown transparency log resource")
+	}
+}
+
+// tlogHasTile reports whether all hashes or records in tile t are
+// available in the current log. It must be called with tlogLock held.
+func tlogHasTile(t tlog.Tile) bool {
+	level := t.L
+	if level < 0 {
+		level = 0
+	}
+	// Each hash at level L covers 2^(H*L) records.
+	end := ((t.N << uint(t.H)) + int64(t.W)) << uint(t.H*level)
+	return end <= int64(len(tlogRecords))
+}
+
+func sendTlogError(resp http.ResponseWriter, err error) {
+	log.Printf("Error serving transparency log: %v", err)
+	resp.WriteHeader(http.StatusInternalServerError)
+	resp.Write([]byte(fmt.Sprintf("Cannot serve transparency log: %v", err)))
+}
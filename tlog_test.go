@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+
+	"golang.org/x/mod/sumdb/note"
+	"golang.org/x/mod/sumdb/tlog"
+	. "gopkg.in/check.v1"
+
+	"github.com/niemeyer/gopkg/resolver"
+)
+
+var _ = Suite(&TlogSuite{})
+
+type TlogSuite struct{}
+
+func (s *TlogSuite) SetUpTest(c *C) {
+	c.Assert(loadTlogKey(), IsNil)
+}
+
+func (s *TlogSuite) TearDownTest(c *C) {
+	tlogLock.Lock()
+	tlogRecords = nil
+	tlogHashes = nil
+	tlogLookup = make(map[string]int64)
+	tlogSeen = make(map[string]bool)
+	tlogLock.Unlock()
+}
+
+func (s *TlogSuite) TestLoadKey(c *C) {
+	path := filepath.Join(c.MkDir(), "tlog.key")
+	*tlogKeyFlag = path
+	defer func() { *tlogKeyFlag = "" }()
+
+	// A key with "+" in its base64 encoding.
+	skey := "PRIVATE+KEY+gopkg.in+95bb2f47+AfhI+lO7hQt+a00BE99gX6SdQmE4gQJUvXxRensSMHvO"
+	c.Assert(ioutil.WriteFile(path, []byte(skey+"\n"), 0600), IsNil)
+	c.Assert(loadTlogKey(), IsNil)
+	c.Assert(tlogSigner.Name(), Equals, "gopkg.in")
+	_, err := note.NewVerifier(tlogVerifierKey)
+	c.Assert(err, IsNil)
+
+	*hostFlag = "example.com"
+	defer func() { *hostFlag = gopkgIn }()
+	c.Assert(loadTlogKey(), ErrorMatches, "transparency log key in .* is for gopkg.in, not -host example.com")
+}
+
+func (s *TlogSuite) TestGenerateKey(c *C) {
+	*hostFlag = "example.com"
+	defer func() { *hostFlag = gopkgIn }()
+	c.Assert(loadTlogKey(), IsNil)
+	c.Assert(tlogSigner.Name(), Equals, "example.com")
+}
+
+func tlogGet(path string) *httptest.ResponseRecorder {
+	resp := httptest.NewRecorder()
+	tlogHandler(resp, httptest.NewRequest("GET", path, nil))
+	return resp
+}
+
+func (s *TlogSuite) TestObserve(c *C) {
+	tlogObserve("gopkg.in/foo.v1", resolver.Version{Major: 1, Minor: 0, Patch: 0}, "00000000000000000000000000000000000hash1")
+	tlogObserve("gopkg.in/foo.v1", resolver.Version{Major: 1, Minor: 0, Patch: 0}, "00000000000000000000000000000000000hash1")
+	tlogObserve("gopkg.in/foo.v1", resolver.Version{Major: 1, Minor: 0, Patch: 1}, "00000000000000000000000000000000000hash2")
+	tlogObserve("gopkg.in/foo.v1", resolver.Version{Major: 1, Minor: 0, Patch: 0}, "00000000000000000000000000000000000hash3")
+
+	resp := tlogGet("/tlog/key")
+	verifier, err := note.NewVerifier(resp.Body.String()[:resp.Body.Len()-1])
+	c.Assert(err, IsNil)
+
+	resp = tlogGet("/tlog/latest")
+	c.Assert(resp.Code, Equals, http.StatusOK)
+	n, err := note.Open(resp.Body.Bytes(), note.VerifierList(verifier))
+	c.Assert(err, IsNil)
+	tree, err := tlog.ParseTree([]byte(n.Text))
+	c.Assert(err, IsNil)
+	c.Assert(tree.N, Equals, int64(3))
+
+	resp = tlogGet("/tlog/lookup/gopkg.in/foo.v1@v1.0.0")
+	c.Assert(resp.Code, Equals, http.StatusOK)
+	id, text, rest, err := tlog.ParseRecord(resp.Body.Bytes())
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, int64(2))
+	c.Assert(string(text), Equals, "gopkg.in/foo.v1 v1.0.0 00000000000000000000000000000000000hash3\n")
+	_, err = note.Open(rest, note.VerifierList(verifier))
+	c.Assert(err, IsNil)
+
+	resp = tlogGet("/tlog/tile/8/data/000.p/3")
+	c.Assert(resp.Code, Equals, http.StatusOK)
+	data := resp.Body.Bytes()
+	for i := int64(0); i < 3; i++ {
+		id, text, data, err = tlog.ParseRecord(data)
+		c.Assert(err, IsNil)
+		c.Assert(id, Equals, i)
+		c.Assert(tlog.RecordHash(text), Equals, tlogHashes[tlog.StoredHashIndex(0, i)])
+	}
+
+	resp = tlogGet("/tlog/tile/8/0/000.p/3")
+	c.Assert(resp.Code, Equals, http.StatusOK)
+	c.Assert(resp.Body.Len(), Equals, 3*tlog.HashSize)
+
+	resp = tlogGet("/tlog/tile/8/0/000.p/4")
+	c.Assert(resp.Code, Equals, http.StatusNotFound)
+	resp = tlogGet("/tlog/tile/8/1/000.p/1")
+	c.Assert(resp.Code, Equals, http.StatusNotFound)
+}
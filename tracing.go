@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	mathrand "math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Requests are traced with spans for each step in handling them and for
+// every request made to GitHub on their behalf. The trace context is taken
+// from W3C traceparent headers, and only passed on to the -trace-propagate
+// hosts, so trace IDs don't leak to GitHub and others. Whether a request is
+// traced is always decided with -trace-sample, whatever the caller asks for.
+// Spans are exported in batches to the OTLP/HTTP collector at -otlp-endpoint.
+
+const (
+	traceQueueSize = 4096
+	traceBatchSize = 512
+	traceInterval  = 5 * time.Second
+)
+
+var (
+	traceQueue     chan *span // Nil when tracing is disabled.
+	traceFlush     chan chan bool
+	traceEndpoint  string
+	tracePropagate map[string]bool // Hosts the trace context is passed on to.
+)
+
+var traceClient = &http.Client{Timeout: 10 * time.Second}
+
+var (
+	traceDropped      = newCounter("gopkg_trace_spans_dropped_total", "Number of spans dropped for a full export queue.")
+	traceExportErrors = newCounter("gopkg_trace_export_errors_total", "Number of failed attempts to export spans.")
+)
+
+// Span kinds as defined by OTLP.
+const (
+	spanInternal = 1
+	spanServer   = 2
+	spanClient   = 3
+)
+
+type span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	sampled  bool
+
+	name  string
+	kind  int
+	start time.Time
+
+	mu      sync.Mutex
+	attrs   []string
+	err     string
+	endTime time.Time // Zero until ended, and then left alone.
+}
+
+type spanKey struct{}
+
+func setupTracing() error {
+	if *otlpEndpointFlag == "" {
+		return nil
+	}
+	u, err := url.Parse(*otlpEndpointFlag)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid -otlp-endpoint: %q", *otlpEndpointFlag)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	traceEndpoint = u.String()
+	tracePropagate = make(map[string]bool)
+	for _, host := range strings.Split(*tracePropagateFlag, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			tracePropagate[strings.ToLower(host)] = true
+		}
+	}
+	traceQueue = make(chan *span, traceQueueSize)
+	traceFlush = make(chan chan bool)
+	go traceLoop(traceQueue, traceFlush)
+	return nil
+}
+
+// startSpan starts a span as a child of the one in ctx, if any, with
+// attributes as key and value pairs. It returns a nil span, which is fine
+// to use, if tracing is disabled.
+func startSpan(ctx context.Context, name string, kind int, attrs ...string) (context.Context, *span) {
+	if traceQueue == nil {
+		return ctx, nil
+	}
+	s := &span{name: name, kind: kind, start: time.Now(), attrs: attrs}
+	if parent, ok := ctx.Value(spanKey{}).(*span); ok {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+		s.sampled = parent.sampled
+	} else {
+		rand.Read(s.traceID[:])
+		s.sampled = mathrand.Float64() < *traceSampleFlag
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// contextWithTraceparent returns ctx holding the remote span in the W3C
+// traceparent header value, if valid, as the parent for new spans. The
+// sampled flag in the header is disregarded in favor of -trace-sample,
+// so callers can't have more requests traced than configured.
+func contextWithTraceparent(ctx context.Context, header string) context.Context {
+	if traceQueue == nil {
+		return ctx
+	}
+	parent, ok := parseTraceparent(header)
+	if !ok {
+		return ctx
+	}
+	parent.sampled = mathrand.Float64() < *traceSampleFlag
+	return context.WithValue(ctx, spanKey{}, parent)
+}
+
+func parseTraceparent(header string) (*span, bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || parts[0] == "00" && len(parts) != 4 {
+		return nil, false
+	}
+	s := &span{}
+	traceID, err1 := hex.DecodeString(parts[1])
+	spanID, err2 := hex.DecodeString(parts[2])
+	flags, err3 := hex.DecodeString(parts[3])
+	if err1 != nil || err2 != nil || err3 != nil || len(traceID) != 16 || len(spanID) != 8 || len(flags) != 1 {
+		return nil, false
+	}
+	copy(s.traceID[:], traceID)
+	copy(s.spanID[:], spanID)
+	if s.traceID == [16]byte{} || s.spanID == [8]byte{} {
+		return nil, false
+	}
+	s.sampled = flags[0]&1 == 1
+	return s, true
+}
+
+// traceparent returns the W3C traceparent header value for s.
+func (s *span) traceparent() string {
+	flags := 0
+	if s.sampled {
+		flags = 1
+	}
+	return fmt.Sprintf("00-%x-%x-%02x", s.traceID, s.spanID, flags)
+}
+
+// traceID returns the trace ID of the span in ctx, or an empty string.
+func traceID(ctx context.Context) string {
+	if s, ok := ctx.Value(spanKey{}).(*span); ok {
+		return hex.EncodeToString(s.traceID[:])
+	}
+	return ""
+}
+
+// set adds attributes as key and value pairs.
+func (s *span) set(attrs ...string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.endTime.IsZero() {
+		s.attrs = append(s.attrs, attrs...)
+	}
+	s.mu.Unlock()
+}
+
+// end ends the span with err, if not nil, and further attributes, and
+// queues it for export if sampled.
+func (s *span) end(err error, attrs ...string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if !s.endTime.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.endTime = time.Now()
+	s.attrs = append(s.attrs, attrs...)
+	if err != nil {
+		s.err = err.Error()
+	}
+	s.mu.Unlock()
+	if !s.sampled {
+		return
+	}
+	select {
+	case traceQueue <- s:
+	default:
+		traceDropped.inc()
+	}
+}
+
+// traceStep starts a span for a step in resolving a request, for the
+// resolver Trace option.
+func traceStep(ctx context.Context, name string, attrs ...string) (context.Context, func(err error, attrs ...string)) {
+	ctx, s := startSpan(ctx, name, spanInternal, attrs...)
+	return ctx, s.end
+}
+
+// tracingTransport traces requests made with the base transport, or with
+// http.DefaultTransport if nil, passing on the trace context to the
+// -trace-propagate hosts.
+type tracingTransport struct {
+	base http.RoundTripper
+}
+
+func (t tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	ctx, s := startSpan(req.Context(), "HTTP "+req.Method, spanClient,
+		"http.request.method", req.Method,
+		"server.address", req.URL.Host,
+		"url.full", req.URL.Scheme+"://"+req.URL.Host+req.URL.Path,
+	)
+	if s == nil {
+		return base.RoundTrip(req)
+	}
+	if tracePropagate[strings.ToLower(req.URL.Hostname())] {
+		req = req.Clone(ctx)
+		req.Header.Set("traceparent", s.traceparent())
+	}
+	resp, err := base.RoundTrip(req)
+	if err != nil {
+		s.end(err)
+		return nil, err
+	}
+	var status error
+	if resp.StatusCode >= 500 {
+		status = fmt.Errorf("%s", resp.Status)
+	}
+	s.end(status, "http.response.status_code", strconv.Itoa(resp.StatusCode))
+	return resp, nil
+}
+
+// traceHandler wraps h so that every request is traced as a child of the
+// span in its traceparent header, if any.
+func traceHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if traceQueue == nil {
+			h.ServeHTTP(resp, req)
+			return
+		}
+		ctx := contextWithTraceparent(req.Context(), req.Header.Get("traceparent"))
+		ctx, s := startSpan(ctx, req.Method, spanServer,
+			"http.request.method", req.Method,
+			"url.path", req.URL.Path,
+			"client.address", clientIP(req),
+			"user_agent.original", req.UserAgent(),
+		)
+		rec := &statusRecorder{ResponseWriter: resp, status: http.StatusOK}
+		defer func() {
+			if v := recover(); v != nil {
+				s.end(fmt.Errorf("aborted: %v", v), "http.response.status_code", strconv.Itoa(rec.status))
+				panic(v)
+			}
+			var err error
+			if rec.status >= 500 {
+				err = fmt.Errorf("%s", http.StatusText(rec.status))
+			}
+			s.end(err, "http.response.status_code", strconv.Itoa(rec.status))
+		}()
+		h.ServeHTTP(rec, req.WithContext(ctx))
+	})
+}
+
+// statusRecorder records the status code of the response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// traceLoop exports the spans in queue in batches, and everything queued
+// so far when asked to flush.
+func traceLoop(queue chan *span, flush chan chan bool) {
+	ticker := time.NewTicker(traceInterval)
+	defer ticker.Stop()
+	var batch []*span
+	for {
+		select {
+		case s := <-queue:
+			batch = append(batch, s)
+			if len(batch) < traceBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		case done := <-flush:
+			for len(queue) > 0 {
+				batch = append(batch, <-queue)
+			}
+			exportSpans(batch)
+			batch = nil
+			close(done)
+			continue
+		}
+		exportSpans(batch)
+		batch = nil
+	}
+}
+
+// flushTraces exports the queued spans, waiting for up to timeout.
+func flushTraces(timeout time.Duration) {
+	if traceQueue == nil {
+		return
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	done := make(chan bool)
+	select {
+	case traceFlush <- done:
+	case <-timer.C:
+		return
+	}
+	select {
+	case <-done:
+	case <-timer.C:
+	}
+}
+
+func exportSpans(batch []*span) {
+	if len(batch) == 0 {
+		return
+	}
+	data, err := json.Marshal(otlpRequest(batch))
+	if err == nil {
+		var resp *http.Response
+		resp, err = traceClient.Post(traceEndpoint, "application/json", bytes.NewReader(data))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				err = fmt.Errorf("collector returned %s", resp.Status)
+			}
+		}
+	}
+	if err != nil {
+		traceExportErrors.inc()
+		log.Printf("Error exporting %d spans: %v", len(batch), err)
+	}
+}
+
+// OTLP/HTTP JSON encoding of spans.
+
+type otlpAttr struct {
+	Key   string            `json:"key"`
+	Value map[string]string `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID      string     `json:"traceId"`
+	SpanID       string     `json:"spanId"`
+	ParentSpanID string     `json:"parentSpanId,omitempty"`
+	Name         string     `json:"name"`
+	Kind         int        `json:"kind"`
+	Start        string     `json:"startTimeUnixNano"`
+	End          string     `json:"endTimeUnixNano"`
+	Attributes   []otlpAttr `json:"attributes,omitempty"`
+	Status       otlpStatus `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+const otlpStatusError = 2
+
+func otlpAttrs(pairs ...string) []otlpAttr {
+	var attrs []otlpAttr
+	for i := 0; i+1 < len(pairs); i += 2 {
+		attrs = append(attrs, otlpAttr{pairs[i], map[string]string{"stringValue": pairs[i+1]}})
+	}
+	return attrs
+}
+
+func otlpRequest(batch []*span) interface{} {
+	spans := make([]otlpSpan, len(batch))
+	for i, s := range batch {
+		spans[i] = otlpSpan{
+			TraceID:    hex.EncodeToString(s.traceID[:]),
+			SpanID:     hex.EncodeToString(s.spanID[:]),
+			Name:       s.name,
+			Kind:       s.kind,
+			Start:      strconv.FormatInt(s.start.UnixNano(), 10),
+			End:        strconv.FormatInt(s.endTime.UnixNano(), 10),
+			Attributes: otlpAttrs(s.attrs...),
+		}
+		if s.parentID != [8]byte{} {
+			spans[i].ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		if s.err != "" {
+			spans[i].Status = otlpStatus{otlpStatusError, s.err}
+		}
+	}
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttrs("service.name", "gopkg"),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "gopkg"},
+				"spans": spans,
+			}},
+		}},
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&TracingSuite{})
+
+type TracingSuite struct {
+	mu        sync.Mutex
+	collector *httptest.Server
+	exported  []otlpSpan
+}
+
+func (s *TracingSuite) SetUpTest(c *C) {
+	s.exported = nil
+	s.collector = httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		c.Check(req.URL.Path, Equals, "/v1/traces")
+		c.Check(req.Header.Get("Content-Type"), Equals, "application/json")
+		var body struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []otlpSpan
+				}
+			}
+		}
+		c.Check(json.NewDecoder(req.Body).Decode(&body), IsNil)
+		s.mu.Lock()
+		for _, rs := range body.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				s.exported = append(s.exported, ss.Spans...)
+			}
+		}
+		s.mu.Unlock()
+	}))
+	*otlpEndpointFlag = s.collector.URL
+	c.Assert(setupTracing(), IsNil)
+}
+
+func (s *TracingSuite) TearDownTest(c *C) {
+	traceQueue = nil
+	traceFlush = nil
+	*otlpEndpointFlag = ""
+	*traceSampleFlag = 1
+	*tracePropagateFlag = ""
+	s.collector.Close()
+}
+
+func (s *TracingSuite) flush(c *C) map[string]otlpSpan {
+	flushTraces(5 * time.Second)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	spans := make(map[string]otlpSpan)
+	for _, span := range s.exported {
+		spans[span.Name] = span
+	}
+	return spans
+}
+
+var traceparentTests = []struct {
+	header  string
+	ok      bool
+	sampled bool
+}{
+	{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+	{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+	{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true, true},
+	{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false, false},
+	{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+	{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+	{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, false},
+	{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902-01", false, false},
+	{"00-4bf92f3577b34da6a3ce929d0e0e47zz-00f067aa0ba902b7-01", false, false},
+	{"", false, false},
+}
+
+func (s *TracingSuite) TestParseTraceparent(c *C) {
+	for _, test := range traceparentTests {
+		parent, ok := parseTraceparent(test.header)
+		c.Assert(ok, Equals, test.ok, Commentf("%s", test.header))
+		if ok {
+			c.Assert(parent.sampled, Equals, test.sampled)
+			c.Assert(parent.traceparent()[3:52], Equals, test.header[3:52])
+		}
+	}
+}
+
+func (s *TracingSuite) TestTraceRequest(c *C) {
+	*tracePropagateFlag = "internal.example.com, GitHub.com"
+	c.Assert(setupTracing(), IsNil)
+	var sentTraceparent string
+	client := &http.Client{Transport: tracingTransport{roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		sentTraceparent = req.Header.Get("traceparent")
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader("")), Request: req}, nil
+	})}}
+
+	h := traceHandler(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		c.Check(traceID(req.Context()), Equals, "4bf92f3577b34da6a3ce929d0e0e4736")
+		ctx, end := traceStep(req.Context(), "step", "key", "value")
+		upreq, _ := http.NewRequestWithContext(ctx, "GET", "https://github.com/foo/bar.git/info/refs?service=git-upload-pack", nil)
+		_, err := client.Do(upreq)
+		c.Check(err, IsNil)
+		end(errors.New("failed"), "more", "attrs")
+		resp.WriteHeader(http.StatusNotFound)
+	}))
+	req := httptest.NewRequest("GET", "/foo/bar.v1", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := s.flush(c)
+	c.Assert(spans, HasLen, 3)
+	server, step, client_ := spans["GET"], spans["step"], spans["HTTP GET"]
+	for _, span := range spans {
+		c.Assert(span.TraceID, Equals, "4bf92f3577b34da6a3ce929d0e0e4736")
+	}
+	c.Assert(server.ParentSpanID, Equals, "00f067aa0ba902b7")
+	c.Assert(server.Kind, Equals, spanServer)
+	c.Assert(server.Attributes, DeepEquals, otlpAttrs(
+		"http.request.method", "GET",
+		"url.path", "/foo/bar.v1",
+		"client.address", "192.0.2.1",
+		"user_agent.original", "",
+		"http.response.status_code", "404",
+	))
+	c.Assert(step.ParentSpanID, Equals, server.SpanID)
+	c.Assert(step.Attributes, DeepEquals, otlpAttrs("key", "value", "more", "attrs"))
+	c.Assert(step.Status, Equals, otlpStatus{otlpStatusError, "failed"})
+	c.Assert(client_.ParentSpanID, Equals, step.SpanID)
+	c.Assert(client_.Kind, Equals, spanClient)
+	c.Assert(client_.Attributes[2], DeepEquals, otlpAttrs("url.full", "https://github.com/foo/bar.git/info/refs")[0])
+	c.Assert(sentTraceparent, Equals, "00-4bf92f3577b34da6a3ce929d0e0e4736-"+client_.SpanID+"-01")
+	c.Assert(server.Start <= step.Start && step.End <= server.End, Equals, true)
+}
+
+func (s *TracingSuite) TestUnsampled(c *C) {
+	*traceSampleFlag = 0
+	*tracePropagateFlag = "github.com"
+	c.Assert(setupTracing(), IsNil)
+	var sentTraceparent string
+	client := &http.Client{Transport: tracingTransport{roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		sentTraceparent = req.Header.Get("traceparent")
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader("")), Request: req}, nil
+	})}}
+	h := traceHandler(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		client.Get("https://github.com/")
+		upreq, _ := http.NewRequestWithContext(req.Context(), "GET", "https://github.com/", nil)
+		client.Do(upreq)
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	c.Assert(sentTraceparent, Matches, "00-[0-9a-f]{32}-[0-9a-f]{16}-00")
+	c.Assert(s.flush(c), HasLen, 0)
+
+	// Callers can't have requests sampled.
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	c.Assert(sentTraceparent, Matches, "00-4bf92f3577b34da6a3ce929d0e0e4736-[0-9a-f]{16}-00")
+	c.Assert(s.flush(c), HasLen, 0)
+}
+
+func (s *TracingSuite) TestPropagate(c *C) {
+	sent := make(map[string]string)
+	client := &http.Client{Transport: tracingTransport{roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		sent[req.URL.Host] = req.Header.Get("traceparent")
+		return &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader("")), Request: req}, nil
+	})}}
+	h := traceHandler(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		for _, url := range []string{"https://github.com/", "https://internal.example.com:8080/"} {
+			upreq, _ := http.NewRequestWithContext(req.Context(), "GET", url, nil)
+			client.Do(upreq)
+		}
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	c.Assert(sent, DeepEquals, map[string]string{"github.com": "", "internal.example.com:8080": ""})
+
+	*tracePropagateFlag = "internal.example.com"
+	c.Assert(setupTracing(), IsNil)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	c.Assert(sent["github.com"], Equals, "")
+	c.Assert(sent["internal.example.com:8080"], Matches, "00-[0-9a-f]{32}-[0-9a-f]{16}-01")
+
+	// Client spans are recorded either way.
+	c.Assert(s.flush(c)["HTTP GET"].Kind, Equals, spanClient)
+}
+
+func (s *TracingSuite) TestDisabled(c *C) {
+	traceQueue = nil
+	ctx, span := startSpan(context.Background(), "name", spanInternal)
+	c.Assert(span, IsNil)
+	c.Assert(ctx, Equals, context.Background())
+	span.set("key", "value")
+	span.end(nil)
+	flushTraces(time.Second)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/niemeyer/gopkg/pktline"
+)
+
+// uploadPackRequest holds the details of the client side of an upload-pack
+// negotiation, in either the original protocol or protocol v2.
+type uploadPackRequest struct {
+	Command  string   // Protocol v2 command, such as "fetch".
+	Wants    []string // Object hashes wanted.
+	WantRefs []string // References wanted by name, in protocol v2.
+	Haves    int      // Number of object hashes the client has.
+	Done     bool     // Whether the client is done negotiating.
+
+	// Options holds the capabilities and arguments other than the above,
+	// such as "ofs-delta", "deepen 1" or "filter blob:none". Capabilities
+	// identifying the client, such as its agent, are left out.
+	Options []string
+}
+
+// parseUploadPack parses the upload-pack request body read from r.
+func parseUploadPack(r io.Reader) (*uploadPackRequest, error) {
+	upr := &uploadPackRequest{}
+	pr := pktline.NewReader(r)
+	for pr.Next() {
+		if pr.Type() != pktline.Data {
+			continue
+		}
+		line := strings.TrimSuffix(string(pr.Payload()), "\n")
+		switch {
+		case strings.HasPrefix(line, "command="):
+			upr.Command = strings.TrimPrefix(line, "command=")
+		case strings.HasPrefix(line, "want "):
+			fields := strings.Fields(line)
+			if len(fields) < 2 || len(fields[1]) != 40 {
+				return nil, fmt.Errorf("invalid upload-pack want line: %q", line)
+			}
+			upr.Wants = append(upr.Wants, fields[1])
+			// In the original protocol capabilities follow the first want.
+			for _, capability := range fields[2:] {
+				upr.addOption(capability)
+			}
+		case strings.HasPrefix(line, "want-ref "):
+			ref := strings.TrimPrefix(line, "want-ref ")
+			if ref == "" || strings.ContainsAny(ref, " \x00") {
+				return nil, fmt.Errorf("invalid upload-pack want-ref line: %q", line)
+			}
+			upr.WantRefs = append(upr.WantRefs, ref)
+		case strings.HasPrefix(line, "have "):
+			upr.Haves++
+		case line == "done":
+			upr.Done = true
+		default:
+			upr.addOption(line)
+		}
+	}
+	if err := pr.Err(); err != nil {
+		return nil, fmt.Errorf("cannot parse upload-pack request: %v", err)
+	}
+	return upr, nil
+}
+
+func (upr *uploadPackRequest) addOption(option string) {
+	if !strings.HasPrefix(option, "agent=") && !strings.HasPrefix(option, "session-id=") {
+		upr.Options = append(upr.Options, option)
+	}
+}
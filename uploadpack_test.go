@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/niemeyer/gopkg/resolver"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+var _ = Suite(&UploadPackSuite{})
+
+type UploadPackSuite struct{}
+
+const (
+	wantHash1 = "00000000000000000000000000000000000hash1"
+	wantHash2 = "00000000000000000000000000000000000hash2"
+	wantHash3 = "00000000000000000000000000000000000hash3"
+)
+
+var uploadPackRefs = reflines(
+	wantHash3+" HEAD",
+	wantHash1+" refs/tags/v1.0.0",
+	wantHash3+" refs/tags/v1.1.0",
+	wantHash2+" refs/tags/v2.0.0",
+)
+
+var uploadPackV0 = pktlines(
+	"want "+wantHash1+" multi_ack_detailed no-done side-band-64k thin-pack ofs-delta agent=git/2.40\n",
+	"want "+wantHash2+"\n",
+	"0000",
+	"have "+wantHash2+"\n",
+	"done\n",
+)
+
+var uploadPackV2 = pktlines(
+	"command=fetch\n",
+	"agent=git/2.40\n",
+	"0001",
+	"thin-pack\n",
+	"want "+wantHash1+"\n",
+	"done\n",
+	"0000",
+)
+
+var uploadPackWantRef = pktlines(
+	"command=fetch\n",
+	"0001",
+	"want-ref refs/heads/master\n",
+	"done\n",
+	"0000",
+)
+
+// pktlines encodes each line as a data packet, except for the special
+// packets "0000", "0001" and "0002" which are included as-is.
+func pktlines(lines ...string) string {
+	var buf bytes.Buffer
+	for _, l := range lines {
+		if l == "0000" || l == "0001" || l == "0002" {
+			buf.WriteString(l)
+		} else {
+			fmt.Fprintf(&buf, "%04x%s", len(l)+4, l)
+		}
+	}
+	return buf.String()
+}
+
+func (s *UploadPackSuite) TestParse(c *C) {
+	upr, err := parseUploadPack(bytes.NewReader([]byte(uploadPackV0)))
+	c.Assert(err, IsNil)
+	c.Assert(upr, DeepEquals, &uploadPackRequest{
+		Wants:   []string{wantHash1, wantHash2},
+		Haves:   1,
+		Done:    true,
+		Options: []string{"multi_ack_detailed", "no-done", "side-band-64k", "thin-pack", "ofs-delta"},
+	})
+
+	upr, err = parseUploadPack(bytes.NewReader([]byte(uploadPackV2)))
+	c.Assert(err, IsNil)
+	c.Assert(upr, DeepEquals, &uploadPackRequest{
+		Command: "fetch",
+		Wants:   []string{wantHash1},
+		Done:    true,
+		Options: []string{"thin-pack"},
+	})
+
+	upr, err = parseUploadPack(bytes.NewReader([]byte(uploadPackWantRef)))
+	c.Assert(err, IsNil)
+	c.Assert(upr, DeepEquals, &uploadPackRequest{
+		Command:  "fetch",
+		WantRefs: []string{"refs/heads/master"},
+		Done:     true,
+	})
+
+	_, err = parseUploadPack(bytes.NewReader([]byte("000awant x\n")))
+	c.Assert(err, ErrorMatches, `invalid upload-pack want line: "want x"`)
+	_, err = parseUploadPack(bytes.NewReader([]byte("0032want")))
+	c.Assert(err, ErrorMatches, "cannot parse upload-pack request: .*")
+}
+
+func (s *UploadPackSuite) TestProxyRejectsWants(c *C) {
+	repo := &resolver.Repo{User: "user", Name: "repo", MajorVersion: resolver.Version{Major: 1, Minor: -1, Patch: -1}}
+	req := httptest.NewRequest("POST", "/user/repo.v1/git-upload-pack", strings.NewReader(uploadPackV0))
+	resp := httptest.NewRecorder()
+	body, upr, ok := readUploadPack(resp, req)
+	c.Assert(ok, Equals, true)
+	*restrictWantsFlag = true
+	defer func() { *restrictWantsFlag = false }()
+	proxyUploadPack(resp, req, resolution(repo, nil), body, upr)
+	c.Assert(resp.Code, Equals, http.StatusOK)
+	c.Assert(resp.Header().Get("Content-Type"), Equals, "application/x-git-upload-pack-result")
+	c.Assert(resp.Body.String(), Equals, pktlines("ERR want "+wantHash2+" is not available from gopkg.in/user/repo.v1\n"))
+
+	// Objects only referenced by blocked versions are never available.
+	*restrictWantsFlag = false
+	resp = httptest.NewRecorder()
+	blocked := func(v resolver.Version) bool { return v == resolver.Version{Major: 1, Minor: 0, Patch: 0} }
+	proxyUploadPack(resp, req, resolution(repo, blocked), body, upr)
+	c.Assert(resp.Body.String(), Equals, pktlines("ERR want "+wantHash1+" is not available from gopkg.in/user/repo.v1\n"))
+
+	// References may not be wanted by name, as GitHub would resolve
+	// them to its own refs, such as the original master.
+	req = httptest.NewRequest("POST", "/user/repo.v1/git-upload-pack", strings.NewReader(uploadPackWantRef))
+	resp = httptest.NewRecorder()
+	body, upr, ok = readUploadPack(resp, req)
+	c.Assert(ok, Equals, true)
+	proxyUploadPack(resp, req, resolution(repo, nil), body, upr)
+	c.Assert(resp.Body.String(), Equals, pktlines("ERR want-ref refs/heads/master is not available from gopkg.in/user/repo.v1\n"))
+}
+
+func (s *UploadPackSuite) TestProxyRequestTooLarge(c *C) {
+	defer func(max int64) { *maxRequestFlag = max }(*maxRequestFlag)
+	*maxRequestFlag = 64
+
+	req := httptest.NewRequest("POST", "/user/repo.v1/git-upload-pack", strings.NewReader(uploadPackV0))
+	resp := httptest.NewRecorder()
+	_, _, ok := readUploadPack(resp, req)
+	c.Assert(ok, Equals, false)
+	c.Assert(resp.Code, Equals, http.StatusRequestEntityTooLarge)
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write([]byte(uploadPackV0))
+	w.Close()
+	*maxRequestFlag = int64(buf.Len())
+	req = httptest.NewRequest("POST", "/user/repo.v1/git-upload-pack", &buf)
+	req.Header.Set("Content-Encoding", "gzip")
+	resp = httptest.NewRecorder()
+	_, _, ok = readUploadPack(resp, req)
+	c.Assert(ok, Equals, false)
+	c.Assert(resp.Code, Equals, http.StatusRequestEntityTooLarge)
+	c.Assert(resp.Body.String(), Matches, ".*uncompressed request body too large")
+}
+
+// resolution returns the outcome of resolving repo against uploadPackRefs,
+// with a resolver configured by the flags. The blocked function may be nil.
+func resolution(repo *resolver.Repo, blocked func(v resolver.Version) bool) *resolver.Resolution {
+	sel, err := resolver.SelectRefs(strings.NewReader(uploadPackRefs), repo.MajorVersion, blocked)
+	if err != nil {
+		panic(err)
+	}
+	return &resolver.Resolution{Repo: repo, Refs: []byte(uploadPackRefs), Selection: sel, Handler: resolver.New(resolverOptions())}
+}
+
+// proxyTo proxies the upload-pack request to GitHub, as replaced by f.
+func proxyTo(c *C, req *http.Request, f roundTripFunc) *httptest.ResponseRecorder {
+	defer func(transport http.RoundTripper) { bulkClient.Transport = transport }(bulkClient.Transport)
+	bulkClient.Transport = f
+	repo := &resolver.Repo{User: "user", Name: "repo", MajorVersion: resolver.Version{Major: 1, Minor: -1, Patch: -1}}
+	resp := httptest.NewRecorder()
+	body, upr, ok := readUploadPack(resp, req)
+	c.Assert(ok, Equals, true)
+	proxyUploadPack(resp, req, resolution(repo, nil), body, upr)
+	return resp
+}
+
+type truncatedReader struct{ io.Reader }
+
+func (r truncatedReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (s *UploadPackSuite) TestProxyHeaders(c *C) {
+	req := httptest.NewRequest("POST", "/user/repo.v1/git-upload-pack", strings.NewReader(uploadPackV0))
+	req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+	req.Header.Set("Git-Protocol", "version=2")
+	req.Header.Set("Cookie", "secret=1")
+	req.Header.Set("Authorization", "Basic c2VjcmV0")
+	req.Header.Set("Connection", "keep-alive, X-Private")
+	req.Header.Set("X-Private", "1")
+	req.Header.Set("User-Agent", "git/2.40")
+
+	var sent http.Header
+	resp := proxyTo(c, req, func(req *http.Request) (*http.Response, error) {
+		sent = req.Header
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header: http.Header{
+				"Content-Type": {"application/x-git-upload-pack-result"},
+				"Set-Cookie":   {"logged_in=no"},
+				"Connection":   {"close"},
+				"Server":       {"GitHub Babel 2.0"},
+			},
+			Body:    ioutil.NopCloser(strings.NewReader("0008NAK\n")),
+			Request: req,
+		}, nil
+	})
+
+	c.Assert(sent, DeepEquals, http.Header{
+		"Content-Type": {"application/x-git-upload-pack-request"},
+		"Git-Protocol": {"version=2"},
+		"User-Agent":   {"gopkg.in (+https://gopkg.in)"},
+		"Via":          {"1.1 gopkg.in"},
+	})
+	c.Assert(resp.Header(), DeepEquals, http.Header{
+		"Content-Type": {"application/x-git-upload-pack-result"},
+		"Via":          {"1.1 gopkg.in"},
+	})
+	c.Assert(resp.Body.String(), Equals, "0008NAK\n")
+}
+
+func (s *UploadPackSuite) TestProxyTruncated(c *C) {
+	defer func(max int64) { *maxResponseFlag = max }(*maxResponseFlag)
+
+	github := func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(truncatedReader{strings.NewReader("0008NAK\nPACK")}),
+			Request:    req,
+		}, nil
+	}
+	req := httptest.NewRequest("POST", "/user/repo.v1/git-upload-pack", strings.NewReader(uploadPackV0))
+	c.Assert(func() { proxyTo(c, req, github) }, PanicMatches, "net/http: abort Handler")
+
+	github = func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(strings.NewReader("0008NAK\nPACK")),
+			Request:    req,
+		}, nil
+	}
+	*maxResponseFlag = 8
+	req = httptest.NewRequest("POST", "/user/repo.v1/git-upload-pack", strings.NewReader(uploadPackV0))
+	c.Assert(func() { proxyTo(c, req, github) }, PanicMatches, "net/http: abort Handler")
+
+	*maxResponseFlag = 12
+	req = httptest.NewRequest("POST", "/user/repo.v1/git-upload-pack", strings.NewReader(uploadPackV0))
+	c.Assert(proxyTo(c, req, github).Body.String(), Equals, "0008NAK\nPACK")
+}